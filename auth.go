@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrTokenMalformed is returned for a token that isn't a well formed HS256 JWT
+	ErrTokenMalformed = errors.New("malformed token")
+	// ErrTokenSignature is returned for a token not signed with the server's secret
+	ErrTokenSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned for a token past its expiry
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims are the JWT claims identifying an authenticated player
+type Claims struct {
+	// Subject is the player's stable identity, used in place of a client token
+	Subject string `json:"sub"`
+	// Name is the player's username
+	Name string `json:"name"`
+	// Flag is optional, the flag query parameter is used if it's unset
+	Flag string `json:"flag,omitempty"`
+	// ExpiresAt is the unix time in seconds after which the token is rejected
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Authenticator verifies the HS256 signed JWTs presented by players when
+// connecting, for deployments that require authenticated play
+type Authenticator struct {
+	secret []byte
+	clock  Clock
+}
+
+// NewAuthenticator creates an authenticator accepting tokens signed with secret
+func NewAuthenticator(secret string) *Authenticator {
+	return &Authenticator{
+		secret: []byte(secret),
+		clock:  realClock{},
+	}
+}
+
+// Verify checks a token's signature and expiry, returning its claims
+func (a *Authenticator) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Claims{}, ErrTokenMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrTokenMalformed
+	}
+	if !hmac.Equal(signature, a.sign(parts[0]+"."+parts[1])) {
+		return Claims{}, ErrTokenSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrTokenMalformed
+	}
+	if claims.Subject == "" || claims.Name == "" || claims.ExpiresAt == 0 {
+		return Claims{}, ErrTokenMalformed
+	}
+	if a.clock.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// sign returns the HS256 signature of a token's header and payload
+func (a *Authenticator) sign(signingInput string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// decodeSegment decodes a base64url encoded JSON token segment
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
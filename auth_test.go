@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAuthSecret = "test-secret"
+
+// signToken creates an HS256 JWT for the claims
+func signToken(t *testing.T, secret string, claims any) string {
+	t.Helper()
+	segment := func(v any) string {
+		raw, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signingInput := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	auth := NewAuthenticator(testAuthSecret)
+	clock := newFakeClock()
+	auth.clock = clock
+	exp := clock.Now().Add(time.Hour).Unix()
+
+	t.Run("valid", func(t *testing.T) {
+		token := signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", Flag: "GB", ExpiresAt: exp})
+		claims, err := auth.Verify(token)
+		require.NoError(t, err)
+		assert.Equal(t, Claims{Subject: "user-1", Name: "alice", Flag: "GB", ExpiresAt: exp}, claims)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		token := signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", ExpiresAt: clock.Now().Unix()})
+		_, err := auth.Verify(token)
+		assert.ErrorIs(t, err, ErrTokenExpired)
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		token := signToken(t, "other-secret", Claims{Subject: "user-1", Name: "alice", ExpiresAt: exp})
+		_, err := auth.Verify(token)
+		assert.ErrorIs(t, err, ErrTokenSignature)
+	})
+
+	t.Run("tampered claims", func(t *testing.T) {
+		token := signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", ExpiresAt: exp})
+		forged := strings.Split(signToken(t, testAuthSecret, Claims{Subject: "user-2", Name: "mallory", ExpiresAt: exp}), ".")
+		parts := strings.Split(token, ".")
+		_, err := auth.Verify(parts[0] + "." + forged[1] + "." + parts[2])
+		assert.ErrorIs(t, err, ErrTokenSignature)
+	})
+
+	malformed := map[string]string{
+		"empty":           "",
+		"too few parts":   "abc.def",
+		"bad base64":      "!!!.???.***",
+		"unsigned":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + strings.Split(signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", ExpiresAt: exp}), ".")[1] + ".",
+		"missing subject": signToken(t, testAuthSecret, Claims{Name: "alice", ExpiresAt: exp}),
+		"missing expiry":  signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice"}),
+		"claims not json": signToken(t, testAuthSecret, "alice"),
+	}
+	for name, token := range malformed {
+		t.Run(name, func(t *testing.T) {
+			_, err := auth.Verify(token)
+			assert.ErrorIs(t, err, ErrTokenMalformed)
+		})
+	}
+}
+
+func TestWebsocketHandlerAuthentication(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.auth = NewAuthenticator(testAuthSecret)
+	server := httptest.NewServer(http.HandlerFunc(NewWebsocketHandler(mm)))
+	t.Cleanup(server.Close)
+
+	dial := func(token string) (*websocket.Conn, *http.Response, error) {
+		query := url.Values{"name": {"spoofed"}, "flag": {"US"}, "client_token": {"spoofed"}}
+		if token != "" {
+			query.Set("token", token)
+		}
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query.Encode(), nil)
+	}
+
+	for name, token := range map[string]string{
+		"missing token": "",
+		"expired token": signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()}),
+		"bad token":     "not-a-token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, resp, err := dial(token)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		token := signToken(t, testAuthSecret, Claims{Subject: "user-1", Name: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		conn, _, err := dial(token)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), RespConnectionConfirmation)
+
+		// The player is identified by the claims rather than the query
+		client, ok := mm.connections.Get("user-1")
+		require.True(t, ok, "connection should be registered under the token subject")
+		assert.Equal(t, "alice", client.player.Username)
+		assert.Equal(t, "user-1", client.player.Identity)
+		_, spoofed := mm.connections.Get("spoofed")
+		assert.False(t, spoofed)
+	})
+}
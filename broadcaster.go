@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log/slog"
 	"time"
 )
 
@@ -9,21 +8,97 @@ import (
 type Broadcaster interface {
 	Start(game *BaseGame)
 	Stop()
+	Pause()
+	Resume()
 }
 
 // BaseBroadcaster provides common broadcasting functionality
 type BaseBroadcaster struct {
-	game     *BaseGame
-	ticker   *time.Ticker
-	stopChan chan struct{}
+	game       *BaseGame
+	ticker     Ticker
+	stopChan   chan struct{}
+	pauseChan  chan struct{}
+	resumeChan chan struct{}
 }
 
 func NewBaseBroadcaster() *BaseBroadcaster {
 	return &BaseBroadcaster{
-		stopChan: make(chan struct{}),
+		stopChan:   make(chan struct{}),
+		pauseChan:  make(chan struct{}, 1),
+		resumeChan: make(chan struct{}, 1),
 	}
 }
 
+// Pause signals the broadcaster to stop ticking until resumed
+func (b *BaseBroadcaster) Pause() {
+	select {
+	case b.pauseChan <- struct{}{}:
+	default:
+	}
+}
+
+// Resume signals a paused broadcaster to continue ticking
+func (b *BaseBroadcaster) Resume() {
+	select {
+	case b.resumeChan <- struct{}{}:
+	default:
+	}
+}
+
+// awaitResume stops the ticker until the broadcaster is resumed, shifting the
+// game's start time by the paused duration. It returns the paused duration,
+// or false if the broadcaster should stop instead.
+func (b *BaseBroadcaster) awaitResume(game *BaseGame) (time.Duration, bool) {
+	b.ticker.Stop()
+	pausedAt := game.clock.Now()
+
+	select {
+	case <-b.resumeChan:
+	case <-b.stopChan:
+		return 0, false
+	case <-game.ctx.Done():
+		return 0, false
+	}
+
+	paused := game.clock.Now().Sub(pausedAt)
+	game.State.DelayStart(paused)
+	b.ticker.Reset(game.tickrate)
+	return paused, true
+}
+
+// awaitLoaded waits for every connected player to acknowledge they have
+// loaded the game, for at most the game's loading grace, shifting the game's
+// start time by the wait. Player updates are dropped until it returns. It
+// returns the time waited, or false if the broadcaster should stop instead.
+func (b *BaseBroadcaster) awaitLoaded(game *BaseGame) (time.Duration, bool) {
+	if game.loadingGrace <= 0 {
+		return 0, true
+	}
+	game.loading.Store(true)
+	defer game.loading.Store(false)
+	timeout := game.clock.NewTimer(game.loadingGrace)
+	defer timeout.Stop()
+	waitingFrom := game.clock.Now()
+
+loading:
+	for !game.allLoaded() {
+		select {
+		case <-game.loadedSignal:
+		case <-timeout.C():
+			game.logger.Warn("loading grace expired, starting round", "loaded", game.loaded.Len())
+			break loading
+		case <-b.stopChan:
+			return 0, false
+		case <-game.ctx.Done():
+			return 0, false
+		}
+	}
+
+	waited := game.clock.Now().Sub(waitingFrom)
+	game.State.DelayStart(waited)
+	return waited, true
+}
+
 func (b *BaseBroadcaster) Stop() {
 	if b.ticker != nil {
 		b.ticker.Stop()
@@ -35,6 +110,8 @@ func (b *BaseBroadcaster) Stop() {
 type SprintBroadcaster struct {
 	*BaseBroadcaster
 	roundLength time.Duration
+	// A player exceeding this level wins before the timer expires, 0 for no cap
+	levelCap int
 }
 
 func NewSprintBroadcaster(roundLength time.Duration) *SprintBroadcaster {
@@ -46,31 +123,56 @@ func NewSprintBroadcaster(roundLength time.Duration) *SprintBroadcaster {
 
 func (sb *SprintBroadcaster) Start(game *BaseGame) {
 	sb.game = game
-	sb.ticker = time.NewTicker(game.tickrate)
-	roundTimer := time.NewTimer(sb.roundLength)
-	startTime := time.Now()
-	game.State.StartTime = startTime.UnixMilli()
+	sb.ticker = game.clock.NewTicker(game.tickrate)
+
+	startTime := game.startRound()
 
 	// Send initial state
 	if err := game.broadcastInitialState(); err != nil {
-		slog.Error("failed to broadcast initial state", "error", err)
+		game.logger.Error("failed to broadcast initial state", "error", err)
 		return
 	}
 
+	// The round doesn't start until players have had a chance to load the maze
+	loading, ok := sb.awaitLoaded(game)
+	if !ok {
+		return
+	}
+	// The round ends a round length after the start time players are sent
+	deadline := startTime.Add(loading + sb.roundLength)
+	roundTimer := game.clock.NewTimer(deadline.Sub(game.clock.Now()))
+
 	for {
 		select {
 		case <-sb.stopChan:
 			return
 		case <-game.ctx.Done():
 			return
-		case <-roundTimer.C:
-			if err := game.broadcastResult(); err != nil {
-				slog.Error("failed to broadcast result", "error", err)
+		case <-roundTimer.C():
+			if err := game.broadcastResult(game.State.GetRoundResult()); err != nil {
+				game.logger.Error("failed to broadcast result", "error", err)
 			}
 			return
-		case <-sb.ticker.C:
+		case <-sb.pauseChan:
+			roundTimer.Stop()
+			paused, ok := sb.awaitResume(game)
+			if !ok {
+				return
+			}
+			deadline = deadline.Add(paused)
+			roundTimer.Reset(deadline.Sub(game.clock.Now()))
+		case <-sb.ticker.C():
+			if sb.levelCap > 0 && game.minRoundElapsed() {
+				if result, ok := game.State.TargetReachedResult(sb.levelCap); ok {
+					roundTimer.Stop()
+					if err := game.broadcastResult(result); err != nil {
+						game.logger.Error("failed to broadcast result", "error", err)
+					}
+					return
+				}
+			}
 			if err := game.broadcastUpdate(); err != nil {
-				slog.Error("failed to broadcast update", "error", err)
+				game.logger.Error("failed to broadcast update", "error", err)
 			}
 		}
 	}
@@ -91,12 +193,11 @@ func NewRaceBroadcaster(levelTarget int) *RaceBroadcaster {
 
 func (rb *RaceBroadcaster) Start(game *BaseGame) {
 	rb.game = game
-	rb.ticker = time.NewTicker(game.tickrate)
-	startTime := time.Now()
-	game.State.StartTime = startTime.UnixMilli()
+	rb.ticker = game.clock.NewTicker(game.tickrate)
+	game.startRound()
 
 	if err := game.broadcastInitialState(); err != nil {
-		slog.Error("failed to broadcast initial state", "error", err)
+		game.logger.Error("failed to broadcast initial state", "error", err)
 		return
 	}
 
@@ -106,15 +207,95 @@ func (rb *RaceBroadcaster) Start(game *BaseGame) {
 			return
 		case <-game.ctx.Done():
 			return
-		case <-rb.ticker.C:
-			if game.State.MaxLevel > rb.levelTarget {
-				if err := game.broadcastResult(); err != nil {
-					slog.Error("failed to broadcast result", "error", err)
+		case <-rb.pauseChan:
+			if _, ok := rb.awaitResume(game); !ok {
+				return
+			}
+		case <-rb.ticker.C():
+			// Snapshot the result at the moment the target is detected. A win
+			// before the minimum round length is held until it has passed,
+			// when the first player over the target still wins.
+			if game.minRoundElapsed() {
+				if result, ok := game.State.TargetReachedResult(rb.levelTarget); ok {
+					if err := game.broadcastResult(result); err != nil {
+						game.logger.Error("failed to broadcast result", "error", err)
+					}
+					return
 				}
+			}
+			if err := game.broadcastUpdate(); err != nil {
+				game.logger.Error("failed to broadcast update", "error", err)
+			}
+		}
+	}
+}
+
+// HybridBroadcaster implements hybrid game broadcasting, ending the round as
+// soon as a player exceeds the level target or when the round timer expires
+type HybridBroadcaster struct {
+	*BaseBroadcaster
+	levelTarget int
+	roundLength time.Duration
+}
+
+func NewHybridBroadcaster(levelTarget int, roundLength time.Duration) *HybridBroadcaster {
+	return &HybridBroadcaster{
+		BaseBroadcaster: NewBaseBroadcaster(),
+		levelTarget:     levelTarget,
+		roundLength:     roundLength,
+	}
+}
+
+func (hb *HybridBroadcaster) Start(game *BaseGame) {
+	hb.game = game
+	hb.ticker = game.clock.NewTicker(game.tickrate)
+
+	startTime := game.startRound()
+
+	if err := game.broadcastInitialState(); err != nil {
+		game.logger.Error("failed to broadcast initial state", "error", err)
+		return
+	}
+
+	loading, ok := hb.awaitLoaded(game)
+	if !ok {
+		return
+	}
+	deadline := startTime.Add(loading + hb.roundLength)
+	roundTimer := game.clock.NewTimer(deadline.Sub(game.clock.Now()))
+
+	for {
+		select {
+		case <-hb.stopChan:
+			return
+		case <-game.ctx.Done():
+			return
+		case <-roundTimer.C():
+			// Nobody reached the target, the highest level wins
+			if err := game.broadcastResult(game.State.GetRoundResult()); err != nil {
+				game.logger.Error("failed to broadcast result", "error", err)
+			}
+			return
+		case <-hb.pauseChan:
+			roundTimer.Stop()
+			paused, ok := hb.awaitResume(game)
+			if !ok {
 				return
 			}
+			deadline = deadline.Add(paused)
+			roundTimer.Reset(deadline.Sub(game.clock.Now()))
+		case <-hb.ticker.C():
+			if game.minRoundElapsed() {
+				if result, ok := game.State.TargetReachedResult(hb.levelTarget); ok {
+					roundTimer.Stop()
+					if err := game.broadcastResult(result); err != nil {
+						game.logger.Error("failed to broadcast result", "error", err)
+					}
+					return
+				}
+			}
 			if err := game.broadcastUpdate(); err != nil {
-				slog.Error("failed to broadcast update", "error", err)
+				game.logger.Error("failed to broadcast update", "error", err)
 			}
 		}
 	}
@@ -133,10 +314,11 @@ func NewDefaultBroadcaster() *DefaultBroadcaster {
 
 func (db *DefaultBroadcaster) Start(game *BaseGame) {
 	db.game = game
-	db.ticker = time.NewTicker(game.tickrate)
-	
+	db.ticker = game.clock.NewTicker(game.tickrate)
+	game.startRound()
+
 	if err := game.broadcastInitialState(); err != nil {
-		slog.Error("failed to broadcast initial state", "error", err)
+		game.logger.Error("failed to broadcast initial state", "error", err)
 		return
 	}
 
@@ -146,9 +328,13 @@ func (db *DefaultBroadcaster) Start(game *BaseGame) {
 			return
 		case <-game.ctx.Done():
 			return
-		case <-db.ticker.C:
+		case <-db.pauseChan:
+			if _, ok := db.awaitResume(game); !ok {
+				return
+			}
+		case <-db.ticker.C():
 			if err := game.broadcastUpdate(); err != nil {
-				slog.Error("failed to broadcast update", "error", err)
+				game.logger.Error("failed to broadcast update", "error", err)
 			}
 		}
 	}
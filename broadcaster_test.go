@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lastRoundResult returns the most recent round result delivered to a client
+func lastRoundResult(t *testing.T, c *Client) (RoundResult, bool) {
+	t.Helper()
+	var result RoundResult
+	found := false
+	for len(c.send) > 0 {
+		var msg struct {
+			Type    MessageType     `json:"messageType"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(<-c.send, &msg))
+		if msg.Type == RespRoundResult {
+			require.NoError(t, json.Unmarshal(msg.Payload, &result))
+			found = true
+		}
+	}
+	return result, found
+}
+
+func TestRaceResultSnapshotDuringConcurrentUpdates(t *testing.T) {
+	const target = 3
+
+	game := NewRaceGame(2*time.Millisecond, target).(*RaceGame)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	c1.send = make(chan []byte, 4096)
+	for _, c := range []*Client{c1, c2} {
+		game.Clients.Set(c.player.Id, NewClientSink(c))
+		game.State.Players.Set(c.player.Id, c.player)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	// Hammer the losing player with updates throughout the race
+	var wg sync.WaitGroup
+	finished := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-finished:
+				return
+			default:
+				game.UpdatePlayer(c2.player, PlayerUpdateRequest{
+					Level:    1 + i%target,
+					Position: Position{X: float64(i), Y: float64(i)},
+				})
+			}
+		}
+	}()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: target + 1})
+	}()
+
+	game.BroadcastState()
+	close(finished)
+	wg.Wait()
+
+	// Allow the final frame to be fanned out
+	require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 0 }))
+	time.Sleep(5 * time.Millisecond)
+
+	result, ok := lastRoundResult(t, c1)
+	require.True(t, ok, "should receive a round result")
+	require.Len(t, result.PlayerScores, 2)
+
+	winner := result.PlayerScores[0]
+	assert.Equal(t, "player1", winner.Username)
+	assert.True(t, winner.IsWinner)
+	assert.Equal(t, target+1, winner.Level)
+
+	loser := result.PlayerScores[1]
+	assert.Equal(t, "player2", loser.Username)
+	assert.False(t, loser.IsWinner)
+	assert.LessOrEqual(t, loser.Level, target)
+}
+
+func TestCustomRaceTargetEndsGame(t *testing.T) {
+	mm := NewMatchmaker(2 * time.Millisecond)
+	g, err := mm.newGame(ModeRace, GameParams{LevelTarget: 4})
+	require.NoError(t, err)
+	game := g.(*RaceGame)
+	assert.Equal(t, 4, game.levelTarget)
+
+	c := newTestClient("player1")
+	game.Clients.Set(c.player.Id, NewClientSink(c))
+	game.State.Players.Set(c.player.Id, c.player)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	done := make(chan struct{})
+	go func() {
+		game.BroadcastState()
+		close(done)
+	}()
+
+	// Matching the custom target isn't enough, it must be exceeded
+	game.UpdatePlayer(c.player, PlayerUpdateRequest{Level: 4})
+	select {
+	case <-done:
+		t.Fatal("game ended before the custom target was exceeded")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	game.UpdatePlayer(c.player, PlayerUpdateRequest{Level: 5})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("game did not end after the custom target was exceeded")
+	}
+}
+
+func TestMinRoundLengthDelaysInstantWin(t *testing.T) {
+	const target = 3
+
+	mm := NewMatchmaker(time.Second)
+	mm.minRoundLength = 5 * time.Second
+	g, err := mm.newGame(ModeRace, GameParams{LevelTarget: target})
+	require.NoError(t, err)
+	game := g.(*RaceGame)
+	clock := newFakeClock()
+	game.clock = clock
+	defer game.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		c.send = make(chan []byte, 4096)
+		game.Clients.Set(c.player.Id, NewClientSink(c))
+		game.State.Players.Set(c.player.Id, c.player)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	done := make(chan struct{})
+	go func() {
+		game.BroadcastState()
+		close(done)
+	}()
+	clock.BlockUntil(t, 1)
+
+	// Winning at the start of the round is held until the minimum has passed
+	game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: target + 1})
+	for range 4 {
+		clock.Advance(time.Second)
+		select {
+		case <-done:
+			t.Fatalf("round ended %v in, before the minimum round length", clock.Now().Sub(time.UnixMilli(game.startedAt.Load())))
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	game.UpdatePlayer(c2.player, PlayerUpdateRequest{Level: target + 1})
+
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("round did not end once the minimum round length passed")
+	}
+	var result RoundResult
+	require.True(t, waitFor(time.Second, func() bool {
+		var ok bool
+		result, ok = lastRoundResult(t, c2)
+		return ok
+	}), "round result should be sent")
+	require.NotEmpty(t, result.PlayerScores)
+	assert.Equal(t, "player1", result.PlayerScores[0].Username, "the first player over the target should still win")
+	assert.True(t, result.PlayerScores[0].IsWinner)
+}
+
+func TestBroadcastToCancelledGameDoesNotLeak(t *testing.T) {
+	game := NewRaceGame(time.Millisecond, 3).(*RaceGame)
+	c := newTestClient("player1")
+	game.Clients.Set(c.player.Id, NewClientSink(c))
+	game.State.Players.Set(c.player.Id, c.player)
+
+	// The listener never runs, so nothing drains the broadcast channel
+	game.Cleanup()
+	before := runtime.NumGoroutine()
+
+	broadcasts := []func() error{
+		game.broadcastInitialState,
+		game.broadcastUpdate,
+		func() error { return game.broadcastResult(game.State.GetRoundResult()) },
+	}
+	for _, broadcast := range broadcasts {
+		errs := make(chan error, 1)
+		go func() { errs <- broadcast() }()
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrGameClosed)
+		case <-time.After(time.Second):
+			t.Fatal("broadcast to a cancelled game blocked")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		game.BroadcastState()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcaster for a cancelled game didn't exit")
+	}
+
+	assert.True(t, waitFor(time.Second, func() bool {
+		return runtime.NumGoroutine() <= before
+	}), "broadcast goroutines should exit")
+}
+
+func TestSprintLoadingGrace(t *testing.T) {
+	const roundLength = 20 * time.Millisecond
+
+	newLoadingGame := func(grace time.Duration) (*SprintGame, []*Client) {
+		game := NewSprintGame(time.Millisecond, roundLength).(*SprintGame)
+		game.SetLoadingGrace(grace)
+		clients := []*Client{newTestClient("player1"), newTestClient("player2")}
+		for _, c := range clients {
+			c.send = make(chan []byte, 4096)
+			game.Clients.Set(c.player.Id, NewClientSink(c))
+			game.State.Players.Set(c.player.Id, c.player)
+		}
+		return game, clients
+	}
+
+	runRound := func(game *SprintGame) <-chan struct{} {
+		stop := make(chan struct{})
+		t.Cleanup(func() { close(stop) })
+		go drainBroadcasts(game.BaseGame, stop)
+
+		done := make(chan struct{})
+		go func() {
+			game.BroadcastState()
+			close(done)
+		}()
+		return done
+	}
+
+	t.Run("all loaded", func(t *testing.T) {
+		game, clients := newLoadingGame(10 * time.Second)
+		defer game.Cleanup()
+		done := runRound(game)
+
+		game.MarkLoaded(clients[0].player.Id)
+		select {
+		case <-done:
+			t.Fatal("round ended before every player loaded")
+		case <-time.After(5 * roundLength):
+		}
+
+		game.MarkLoaded(clients[1].player.Id)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("round did not run once every player loaded")
+		}
+		assert.True(t, waitFor(time.Second, func() bool {
+			_, ok := lastRoundResult(t, clients[0])
+			return ok
+		}), "round result should be sent")
+	})
+
+	t.Run("updates while loading", func(t *testing.T) {
+		game, clients := newLoadingGame(10 * time.Second)
+		defer game.Cleanup()
+		runRound(game)
+		require.True(t, waitFor(time.Second, game.loading.Load))
+
+		game.UpdatePlayer(clients[0].player, PlayerUpdateRequest{Level: 3})
+		assert.Equal(t, StartingLevel, clients[0].player.Level, "players shouldn't move before everyone has loaded")
+
+		game.MarkLoaded(clients[0].player.Id)
+		game.MarkLoaded(clients[1].player.Id)
+		require.True(t, waitFor(time.Second, func() bool { return !game.loading.Load() }))
+		game.UpdatePlayer(clients[0].player, PlayerUpdateRequest{Level: 2})
+		assert.Equal(t, 2, clients[0].player.Level)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		const grace = 50 * time.Millisecond
+		game, clients := newLoadingGame(grace)
+		defer game.Cleanup()
+
+		start := time.Now()
+		done := runRound(game)
+		game.MarkLoaded(clients[0].player.Id)
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("round did not start after the loading grace expired")
+		}
+		assert.GreaterOrEqual(t, time.Since(start), grace+roundLength)
+		assert.GreaterOrEqual(t, game.State.StartTime, start.Add(grace).UnixMilli(),
+			"start time should be set once the grace expires")
+	})
+}
+
+func TestSprintLevelCapEndsRoundEarly(t *testing.T) {
+	const levelCap = 5
+
+	mm := NewMatchmaker(time.Second)
+	mm.sprintLevelCap = levelCap
+	g, err := mm.newGame(ModeSprint, GameParams{RoundLength: 60 * time.Second})
+	require.NoError(t, err)
+	game := g.(*SprintGame)
+	clock := newFakeClock()
+	game.clock = clock
+	defer game.Cleanup()
+	assert.Equal(t, levelCap, game.GetParams().LevelTarget, "players should be told the cap")
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		c.send = make(chan []byte, 4096)
+		game.Clients.Set(c.player.Id, NewClientSink(c))
+		game.State.Players.Set(c.player.Id, c.player)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	done := make(chan struct{})
+	go func() {
+		game.BroadcastState()
+		close(done)
+	}()
+	clock.BlockUntil(t, 2)
+
+	// Reaching the cap isn't enough, it has to be exceeded
+	game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: levelCap})
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+		t.Fatal("round ended before the cap was exceeded")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	game.UpdatePlayer(c2.player, PlayerUpdateRequest{Level: 2})
+	game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: levelCap + 1})
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("round did not end when the cap was exceeded")
+	}
+	var result RoundResult
+	require.True(t, waitFor(time.Second, func() bool {
+		var ok bool
+		result, ok = lastRoundResult(t, c2)
+		return ok
+	}), "round result should be sent")
+	require.NotEmpty(t, result.PlayerScores)
+	assert.Equal(t, "player1", result.PlayerScores[0].Username)
+	assert.True(t, result.PlayerScores[0].IsWinner)
+}
+
+func TestHybridGameOutcomes(t *testing.T) {
+	const (
+		target      = 4
+		roundLength = 60 * time.Second
+	)
+
+	// start runs a hybrid game on a fake clock, returning a channel closed
+	// when the round ends
+	start := func(t *testing.T) (*HybridGame, *fakeClock, *Client, *Client, chan struct{}) {
+		mm := NewMatchmaker(time.Second)
+		g, err := mm.newGame(ModeHybrid, GameParams{LevelTarget: target, RoundLength: roundLength})
+		require.NoError(t, err)
+		game := g.(*HybridGame)
+		clock := newFakeClock()
+		game.clock = clock
+		t.Cleanup(game.Cleanup)
+
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		for _, c := range []*Client{c1, c2} {
+			c.send = make(chan []byte, 4096)
+			game.Clients.Set(c.player.Id, NewClientSink(c))
+			game.State.Players.Set(c.player.Id, c.player)
+		}
+		stop := make(chan struct{})
+		t.Cleanup(func() { close(stop) })
+		go drainBroadcasts(game.BaseGame, stop)
+
+		done := make(chan struct{})
+		go func() {
+			game.BroadcastState()
+			close(done)
+		}()
+		// The update ticker and the round timer
+		clock.BlockUntil(t, 2)
+		return game, clock, c1, c2, done
+	}
+	winner := func(t *testing.T, c *Client) PlayerScore {
+		var result RoundResult
+		require.True(t, waitFor(time.Second, func() bool {
+			var ok bool
+			result, ok = lastRoundResult(t, c)
+			return ok
+		}), "round result should be sent")
+		require.NotEmpty(t, result.PlayerScores)
+		assert.True(t, result.PlayerScores[0].IsWinner)
+		return result.PlayerScores[0]
+	}
+
+	t.Run("target reached", func(t *testing.T) {
+		game, clock, c1, c2, done := start(t)
+
+		game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: 2})
+		game.UpdatePlayer(c2.player, PlayerUpdateRequest{Level: target + 1})
+		clock.Advance(time.Second)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("round did not end when the target was exceeded")
+		}
+		assert.Equal(t, "player2", winner(t, c1).Username)
+	})
+
+	t.Run("time cap", func(t *testing.T) {
+		game, clock, c1, c2, done := start(t)
+
+		game.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: target})
+		game.UpdatePlayer(c2.player, PlayerUpdateRequest{Level: 2})
+		clock.Advance(roundLength - time.Second)
+		select {
+		case <-done:
+			t.Fatal("round ended before the time cap")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		clock.Advance(time.Second)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("round did not end at the time cap")
+		}
+		score := winner(t, c1)
+		assert.Equal(t, "player1", score.Username, "the highest level should win at the time cap")
+		assert.Equal(t, target, score.Level)
+	})
+}
+
+func TestEventsBatchedPerTick(t *testing.T) {
+	clock := newFakeClock()
+	g := NewPracticeGame(time.Second).(*PracticeGame)
+	g.clock = clock
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	g.Add() <- c1
+	require.True(t, receiveType(c1, RespGameState, time.Second))
+	clock.BlockUntil(t, 1)
+
+	// Several events within a single tick
+	c2 := newTestClient("player2")
+	c3 := newTestClient("player3")
+	g.Add() <- c2
+	g.Add() <- c3
+	g.Remove() <- c2
+	require.True(t, waitFor(time.Second, func() bool { return g.clientCount() == 2 }))
+	assert.Empty(t, c1.send, "events shouldn't be sent before the tick")
+
+	clock.Advance(time.Second)
+	require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 0 }))
+	var batch struct {
+		Type    MessageType   `json:"messageType"`
+		Payload BatchResponse `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(<-c1.send, &batch))
+	require.Equal(t, RespBatch, batch.Type)
+
+	var types []MessageType
+	var players []string
+	for _, raw := range batch.Payload.Messages {
+		var msg struct {
+			Type    MessageType `json:"messageType"`
+			Payload struct {
+				PlayerID string `json:"player_id"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(raw, &msg))
+		types = append(types, msg.Type)
+		players = append(players, msg.Payload.PlayerID)
+	}
+	assert.Equal(t, []MessageType{RespPlayerEntered, RespPlayerEntered, RespPlayerLeft, RespGameState}, types,
+		"events should be delivered in order, followed by the state")
+	assert.Equal(t, []string{c2.player.Id, c3.player.Id, c2.player.Id, ""}, players)
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, c1.send, "the batch should be the tick's only frame")
+
+	// A quiet tick is just the state
+	clock.Advance(time.Second)
+	require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 0 }))
+	var base BaseMessage
+	require.NoError(t, json.Unmarshal(<-c1.send, &base))
+	assert.Equal(t, RespGameState, base.Type)
+}
+
+func TestBroadcastOnChange(t *testing.T) {
+	const keepalive = 5 * time.Second
+
+	clock := newFakeClock()
+	game := NewGame(ModePractice, time.Second)
+	game.clock = clock
+	game.SetBroadcastOnChange(keepalive)
+	defer game.Cleanup()
+
+	c := newTestClient("player1")
+	game.Clients.Set(c.player.Id, NewClientSink(c))
+	game.State.Players.Set(c.player.Id, c.player)
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game, stop)
+
+	go game.BroadcastState()
+	clock.BlockUntil(t, 1)
+	require.True(t, receiveType(c, RespGameState, time.Second), "the initial state should always be sent")
+
+	// An idle game only sends keepalives
+	for range 4 {
+		clock.Advance(time.Second)
+		assert.False(t, receiveType(c, RespGameState, 20*time.Millisecond), "unchanged state shouldn't be sent")
+	}
+	clock.Advance(time.Second)
+	assert.True(t, receiveType(c, RespGameState, time.Second), "a keepalive should be sent")
+
+	// An active game sends an update for each change
+	for i := range 3 {
+		game.UpdatePlayer(c.player, PlayerUpdateRequest{Level: 1, Position: Position{X: float64(i)}})
+		clock.Advance(time.Second)
+		assert.True(t, receiveType(c, RespGameState, time.Second), "changed state should be sent")
+	}
+	clock.Advance(time.Second)
+	assert.False(t, receiveType(c, RespGameState, 20*time.Millisecond))
+
+	// Players joining and leaving change the state
+	other := newTestClient("player2")
+	game.State.AddPlayer(other.player)
+	clock.Advance(time.Second)
+	assert.True(t, receiveType(c, RespGameState, time.Second), "a player joining should be sent")
+	game.State.RemovePlayer(other.player.Id)
+	clock.Advance(time.Second)
+	assert.True(t, receiveType(c, RespGameState, time.Second), "a player leaving should be sent")
+}
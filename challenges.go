@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// ChallengeState is a stage in a challenge's lifecycle. A challenge is
+// created with its game, active while its game accepts players, and then
+// accepted, expired or cancelled.
+type ChallengeState string
+
+const (
+	ChallengeCreated   ChallengeState = "created"
+	ChallengeActive    ChallengeState = "active"
+	ChallengeAccepted  ChallengeState = "accepted"
+	ChallengeExpired   ChallengeState = "expired"
+	ChallengeCancelled ChallengeState = "cancelled"
+)
+
+// challengeTransitions lists the states each state may move to. Accepted,
+// expired and cancelled challenges are final.
+var challengeTransitions = map[ChallengeState][]ChallengeState{
+	ChallengeCreated: {ChallengeActive, ChallengeCancelled},
+	ChallengeActive:  {ChallengeAccepted, ChallengeExpired, ChallengeCancelled},
+}
+
+// ErrInvalidTransition is returned when moving a challenge to a state it
+// can't reach from its current one
+var ErrInvalidTransition = errors.New("invalid challenge state transition")
+
+// CanTransition reports whether a challenge in this state may move to next
+func (s ChallengeState) CanTransition(next ChallengeState) bool {
+	return slices.Contains(challengeTransitions[s], next)
+}
+
+// transitionChallenge moves a challenge to the next state, logging the change.
+// The caller must hold challengeMu.
+func (m *Matchmaker) transitionChallenge(challengeID string, next ChallengeState) error {
+	challenge, ok := m.challenges.Get(challengeID)
+	if !ok {
+		return fmt.Errorf("challenge id not found: %v", challengeID)
+	}
+	if !challenge.State.CanTransition(next) {
+		slog.Warn("rejected challenge state transition",
+			"game_id", challengeID,
+			"from", challenge.State,
+			"to", next)
+		return fmt.Errorf("%w: %v to %v", ErrInvalidTransition, challenge.State, next)
+	}
+	prev := challenge.State
+	challenge.State = next
+	m.challenges.Set(challengeID, challenge)
+	slog.Info("challenge state changed",
+		"game_id", challengeID,
+		"from", prev,
+		"to", next)
+	return nil
+}
+
+// ChallengeStates returns the state of every challenge whose game hasn't
+// been torn down
+func (m *Matchmaker) ChallengeStates() map[string]ChallengeState {
+	states := make(map[string]ChallengeState)
+	for id, challenge := range m.challenges.Snapshot() {
+		states[id] = challenge.State
+	}
+	return states
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChallengeTransitions(t *testing.T) {
+	states := []ChallengeState{ChallengeCreated, ChallengeActive, ChallengeAccepted, ChallengeExpired, ChallengeCancelled}
+	valid := map[ChallengeState][]ChallengeState{
+		ChallengeCreated: {ChallengeActive, ChallengeCancelled},
+		ChallengeActive:  {ChallengeAccepted, ChallengeExpired, ChallengeCancelled},
+	}
+
+	for _, from := range states {
+		for _, to := range states {
+			allowed := false
+			for _, next := range valid[from] {
+				allowed = allowed || next == to
+			}
+			t.Run(string(from)+" to "+string(to), func(t *testing.T) {
+				mm := NewMatchmaker(ServerTickrate)
+				mm.challenges.Set("challenge", Challenge{State: from, Mode: ModeSprint})
+
+				assert.Equal(t, allowed, from.CanTransition(to))
+				err := mm.transitionChallenge("challenge", to)
+				challenge, _ := mm.challenges.Get("challenge")
+				if allowed {
+					assert.NoError(t, err)
+					assert.Equal(t, to, challenge.State)
+				} else {
+					assert.ErrorIs(t, err, ErrInvalidTransition)
+					assert.Equal(t, from, challenge.State, "a rejected transition shouldn't change the state")
+				}
+			})
+		}
+	}
+
+	t.Run("unknown challenge", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		assert.Error(t, mm.transitionChallenge("missing", ChallengeActive))
+	})
+}
+
+func TestChallengeLifecycle(t *testing.T) {
+	stateOf := func(mm *Matchmaker, challengeID string) ChallengeState {
+		challenge, _ := mm.challenges.Get(challengeID)
+		return challenge.State
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		challengeID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+		require.NoError(t, err)
+		game, _ := mm.headToHeadGames.Get(challengeID)
+		defer game.Cleanup()
+		assert.Equal(t, ChallengeActive, stateOf(mm, challengeID))
+
+		require.NoError(t, mm.AcceptChallenge(newTestClient("player1"), challengeID, ""))
+		assert.Equal(t, ChallengeActive, stateOf(mm, challengeID), "the challenge has a slot left")
+		require.NoError(t, mm.AcceptChallenge(newTestClient("player2"), challengeID, ""))
+		assert.Equal(t, ChallengeAccepted, stateOf(mm, challengeID))
+		assert.Equal(t, map[string]ChallengeState{challengeID: ChallengeAccepted}, mm.ChallengeStates(),
+			"accepted challenges are tracked until their game ends")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		mm.challengeExpiry = 10 * time.Millisecond
+		challengeID, err := mm.CreateOpenChallenge(ModeRace, GameParams{})
+		require.NoError(t, err)
+
+		assert.True(t, waitFor(time.Second, func() bool {
+			return stateOf(mm, challengeID) != ChallengeActive
+		}))
+		assert.True(t, waitFor(time.Second, func() bool {
+			return len(mm.ChallengeStates()) == 0
+		}), "the challenge should be forgotten once its game ends")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		creator := newTestClient("creator")
+		creator.mm = mm
+		require.NoError(t, mm.CreateChallengeGame(creator, ModeRace, GameParams{}))
+		challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+
+		require.NoError(t, mm.CancelChallenge(creator.player.Id, challengeID))
+		assert.Contains(t, []ChallengeState{ChallengeCancelled, ""}, stateOf(mm, challengeID))
+		assert.Error(t, mm.CancelChallenge(creator.player.Id, challengeID), "a cancelled challenge can't be cancelled again")
+	})
+
+	t.Run("game ended while open", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		challengeID, err := mm.CreateOpenChallenge(ModeHybrid, GameParams{})
+		require.NoError(t, err)
+		game, _ := mm.headToHeadGames.Get(challengeID)
+
+		game.Cleanup()
+		assert.True(t, waitFor(time.Second, func() bool {
+			_, ok := mm.challenges.Get(challengeID)
+			return !ok
+		}))
+		assert.Error(t, mm.AcceptChallenge(newTestClient("late"), challengeID, ""))
+	})
+}
+
+func TestChallengeStatesHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	challengeID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	game, _ := mm.headToHeadGames.Get(challengeID)
+	defer game.Cleanup()
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/debug/challenges", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		NewChallengeStatesHandler(mm, "secret")(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		w := get(token)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotContains(t, w.Body.String(), challengeID)
+	}
+
+	w := get("secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp ChallengeStatesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]ChallengeState{challengeID: ChallengeActive}, resp.Challenges)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock is the source of time for games and their broadcasters, so tests can
+// drive timing deterministically
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is the subset of time.Ticker used by games
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Timer is the subset of time.Timer used by games
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{t: time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
+
+func (r realTicker) Reset(d time.Duration) {
+	r.t.Reset(d)
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+func (r realTimer) Reset(d time.Duration) bool {
+	return r.t.Reset(d)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock which only moves when advanced by the test.
+// Like the time package, each ticker and timer buffers a single tick and
+// drops ticks that aren't received in time.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.UnixMilli(1_700_000_000_000)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) newTimer(d time.Duration, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		period: period,
+		active: true,
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing due timers in order
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		select {
+		case next.c <- c.now:
+		default:
+		}
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			next.active = false
+		}
+	}
+	c.now = end
+}
+
+// BlockUntil waits until at least n timers are active
+func (c *fakeClock) BlockUntil(t *testing.T, n int) {
+	t.Helper()
+	require.True(t, waitFor(time.Second, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		active := 0
+		for _, timer := range c.timers {
+			if timer.active {
+				active++
+			}
+		}
+		return active >= n
+	}), "timed out waiting for %d active timers", n)
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.when = t.clock.now.Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.active = true
+	return wasActive
+}
+
+// fakeTicker is a repeating fakeTimer
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func (t fakeTicker) Reset(d time.Duration) {
+	t.fakeTimer.Reset(d)
+}
+
+func TestFakeClockCountdownCompletes(t *testing.T) {
+	clock := newFakeClock()
+	game := NewGame(ModeSprint, ServerTickrate)
+	game.clock = clock
+	defer game.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		game.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game, stop)
+
+	game.StartCountdown()
+	clock.BlockUntil(t, 1)
+
+	// Step one tick at a time, waiting for each to be broadcast
+	tick := func() {
+		clock.Advance(time.Second)
+		require.True(t, receiveType(c1, RespSecondsToNextRoundStart, time.Second))
+	}
+	for range 9 {
+		tick()
+	}
+	select {
+	case <-game.countdownDone:
+		t.Fatal("countdown finished early")
+	default:
+	}
+
+	// Readying up shortens the remaining countdown
+	c1.SetStatus(StatusReady)
+	c2.SetStatus(StatusReady)
+	for range ReadyCountdown/time.Second + 1 {
+		tick()
+	}
+	select {
+	case <-game.countdownDone:
+	case <-time.After(time.Second):
+		t.Fatal("countdown did not finish")
+	}
+}
+
+// countdownGoroutines counts the countdown goroutines alive in the process
+func countdownGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, "StartCountdown.func") {
+			count++
+		}
+	}
+	return count
+}
+
+// checkCountdownLeaks fails the test if countdown goroutines started after
+// it's called are still running once the test ends
+func checkCountdownLeaks(t *testing.T) {
+	t.Helper()
+	before := countdownGoroutines()
+	t.Cleanup(func() {
+		assert.True(t, waitFor(time.Second, func() bool { return countdownGoroutines() <= before }),
+			"leaked %d countdown goroutines", countdownGoroutines()-before)
+	})
+}
+
+func TestCountdownStopsAtGamePhase(t *testing.T) {
+	before := countdownGoroutines()
+	// countdownRunning reports whether the game's countdown goroutine is alive
+	countdownRunning := func() bool {
+		return countdownGoroutines() > before
+	}
+
+	clock := newFakeClock()
+	game := NewGame(ModeSprint, ServerTickrate)
+	game.clock = clock
+	go game.RunListeners()
+	defer game.Cleanup()
+
+	c1 := newTestClient("player1")
+	game.Add() <- c1
+	game.Add() <- newTestClient("player2")
+	clock.BlockUntil(t, 1)
+	clock.Advance(time.Second)
+	require.True(t, receiveType(c1, RespSecondsToNextRoundStart, time.Second))
+
+	// The game phase begins while the countdown still has time left
+	game.finishCountdown()
+	require.True(t, receiveType(c1, RespGameStarted, time.Second))
+	require.True(t, waitFor(time.Second, func() bool { return !countdownRunning() }),
+		"the countdown should stop once the game is running")
+
+	clock.Advance(5 * time.Second)
+	assert.False(t, receiveType(c1, RespSecondsToNextRoundStart, 20*time.Millisecond),
+		"no countdown should be sent once the game is running")
+}
+
+func TestCountdownGoroutineExits(t *testing.T) {
+	// start runs the countdown of a game with two players. Broadcasts are
+	// only delivered if drain is set.
+	start := func(t *testing.T, drain bool) (*BaseGame, *fakeClock, *Client, *Client) {
+		checkCountdownLeaks(t)
+		clock := newFakeClock()
+		game := NewGame(ModeSprint, ServerTickrate)
+		game.clock = clock
+		t.Cleanup(game.Cleanup)
+
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		for _, c := range []*Client{c1, c2} {
+			game.Clients.Set(c.player.Id, NewClientSink(c))
+		}
+		if drain {
+			stop := make(chan struct{})
+			t.Cleanup(func() { close(stop) })
+			go drainBroadcasts(game, stop)
+		}
+
+		game.StartCountdown()
+		clock.BlockUntil(t, 1)
+		return game, clock, c1, c2
+	}
+	tick := func(t *testing.T, clock *fakeClock, c *Client) {
+		t.Helper()
+		clock.Advance(time.Second)
+		require.True(t, receiveType(c, RespSecondsToNextRoundStart, time.Second))
+	}
+	// finished waits for the countdown to signal the game phase
+	finished := func(t *testing.T, game *BaseGame) {
+		t.Helper()
+		select {
+		case <-game.countdownDone:
+		case <-time.After(time.Second):
+			t.Fatal("countdown did not finish")
+		}
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		game, clock, c1, _ := start(t, true)
+		for range DefaultCountdown / time.Second {
+			tick(t, clock, c1)
+		}
+		finished(t, game)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		game, clock, c1, _ := start(t, true)
+		tick(t, clock, c1)
+		game.Cleanup()
+	})
+
+	t.Run("cancelled while broadcasting", func(t *testing.T) {
+		game, clock, _, _ := start(t, false)
+		// Nothing receives the broadcasts, so the countdown backs up
+		for range cap(game.Broadcast) + 1 {
+			clock.Advance(time.Second)
+		}
+		game.Cleanup()
+	})
+
+	t.Run("all ready completed", func(t *testing.T) {
+		game, clock, c1, c2 := start(t, true)
+		c1.SetStatus(StatusReady)
+		c2.SetStatus(StatusReady)
+		for range ReadyCountdown/time.Second + 1 {
+			tick(t, clock, c1)
+		}
+		finished(t, game)
+	})
+
+	t.Run("all ready cancelled", func(t *testing.T) {
+		game, clock, c1, c2 := start(t, true)
+		c1.SetStatus(StatusReady)
+		c2.SetStatus(StatusReady)
+		// The countdown is shortened on the first tick
+		tick(t, clock, c1)
+		tick(t, clock, c1)
+		game.Cleanup()
+	})
+}
+
+func TestFakeClockSprintRoundEnds(t *testing.T) {
+	const roundLength = 60 * time.Second
+
+	clock := newFakeClock()
+	game := NewSprintGame(time.Second, roundLength).(*SprintGame)
+	game.clock = clock
+	defer game.Cleanup()
+
+	c := newTestClient("player1")
+	c.send = make(chan []byte, 4096)
+	game.Clients.Set(c.player.Id, NewClientSink(c))
+	game.State.Players.Set(c.player.Id, c.player)
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	done := make(chan struct{})
+	go func() {
+		game.BroadcastState()
+		close(done)
+	}()
+	// The update ticker and the round timer
+	clock.BlockUntil(t, 2)
+
+	clock.Advance(roundLength - time.Second)
+	select {
+	case <-done:
+		t.Fatal("round ended early")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("round did not end")
+	}
+	assert.True(t, waitFor(time.Second, func() bool {
+		_, ok := lastRoundResult(t, c)
+		return ok
+	}), "round result should be sent")
+}
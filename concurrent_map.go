@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"maps"
 	"sync"
 )
 
@@ -12,10 +15,22 @@ type CMap[K comparable, V any] interface {
 	Set(key K, value V)
 	Del(key K)
 	Get(key K) (V, bool)
+	// CompareAndDelete deletes the entry for key if its value equals old,
+	// reporting whether it was deleted. It panics if V isn't comparable.
+	CompareAndDelete(key K, old V) bool
+	// CompareAndSwap stores new for key if its current value equals old,
+	// reporting whether it was swapped. It panics if V isn't comparable.
+	CompareAndSwap(key K, old V, new V) bool
+	// SetIfAbsent stores value for key unless the key is already present,
+	// reporting whether it was stored
+	SetIfAbsent(key K, value V) bool
 	Values() []V
 	Keys() []K
+	Len() int
 	Reset()
 	Iterate(func(K, V) bool)
+	// Snapshot returns a newly allocated copy of the map's contents
+	Snapshot() map[K]V
 	MarshalJSON() ([]byte, error)
 }
 
@@ -54,6 +69,39 @@ func (m *mutexMap[K, V]) Get(key K) (V, bool) {
 	return val, exists
 }
 
+// CompareAndDelete removes a key-value pair if the value matches old
+func (m *mutexMap[K, V]) CompareAndDelete(key K, old V) bool {
+	m.Lock()
+	defer m.Unlock()
+	if val, exists := m.data[key]; !exists || any(val) != any(old) {
+		return false
+	}
+	delete(m.data, key)
+	return true
+}
+
+// CompareAndSwap updates a key-value pair if the value matches old
+func (m *mutexMap[K, V]) CompareAndSwap(key K, old V, new V) bool {
+	m.Lock()
+	defer m.Unlock()
+	if val, exists := m.data[key]; !exists || any(val) != any(old) {
+		return false
+	}
+	m.data[key] = new
+	return true
+}
+
+// SetIfAbsent adds a key-value pair if the key isn't already present
+func (m *mutexMap[K, V]) SetIfAbsent(key K, value V) bool {
+	m.Lock()
+	defer m.Unlock()
+	if _, exists := m.data[key]; exists {
+		return false
+	}
+	m.data[key] = value
+	return true
+}
+
 // Values returns a slice of all values
 func (m *mutexMap[K, V]) Values() []V {
 	m.RLock()
@@ -76,6 +124,13 @@ func (m *mutexMap[K, V]) Keys() []K {
 	return keys
 }
 
+// Len returns the number of key value pairs
+func (m *mutexMap[K, V]) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.data)
+}
+
 // Clear deletes all key value pairs in the cmap
 func (m *mutexMap[K, V]) Reset() {
 	for _, k := range m.Keys() {
@@ -95,6 +150,13 @@ func (m *mutexMap[K, V]) Iterate(fn func(K, V) bool) {
 	}
 }
 
+// Snapshot returns a point-in-time copy of the map taken under the read lock
+func (m *mutexMap[K, V]) Snapshot() map[K]V {
+	m.RLock()
+	defer m.RUnlock()
+	return maps.Clone(m.data)
+}
+
 func (m *mutexMap[K, V]) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m.Values())
 }
@@ -121,6 +183,19 @@ func (sm *syncMap[K, V]) Get(key K) (V, bool) {
 	return v, (ok && exists)
 }
 
+func (sm *syncMap[K, V]) CompareAndDelete(key K, old V) bool {
+	return sm.Map.CompareAndDelete(key, old)
+}
+
+func (sm *syncMap[K, V]) CompareAndSwap(key K, old V, new V) bool {
+	return sm.Map.CompareAndSwap(key, old, new)
+}
+
+func (sm *syncMap[K, V]) SetIfAbsent(key K, value V) bool {
+	_, loaded := sm.LoadOrStore(key, value)
+	return !loaded
+}
+
 func (sm *syncMap[K, V]) Values() []V {
 	var values []V
 	sm.Range(func(_, value any) bool {
@@ -141,6 +216,15 @@ func (sm *syncMap[K, V]) Keys() []K {
 	return keys
 }
 
+func (sm *syncMap[K, V]) Len() int {
+	n := 0
+	sm.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
 func (sm *syncMap[K, V]) Reset() {
 	sm.Clear()
 }
@@ -149,6 +233,21 @@ func (sm *syncMap[K, V]) MarshalJSON() ([]byte, error) {
 	return json.Marshal(sm.Values())
 }
 
+// Snapshot returns a copy of the map. As with Range, entries written while
+// the copy is taken may or may not be included.
+func (sm *syncMap[K, V]) Snapshot() map[K]V {
+	snapshot := make(map[K]V)
+	sm.Range(func(key, value any) bool {
+		k, okK := key.(K)
+		v, okV := value.(V)
+		if okK && okV {
+			snapshot[k] = v
+		}
+		return true
+	})
+	return snapshot
+}
+
 func (sm *syncMap[K, V]) Iterate(fn func(K, V) bool) {
 	sm.Range(func(key, value any) bool {
 		k, okK := key.(K)
@@ -156,3 +255,132 @@ func (sm *syncMap[K, V]) Iterate(fn func(K, V) bool) {
 		return fn(k, v) && okK && okV
 	})
 }
+
+// shardedMap spreads keys across independently locked mutexMaps to reduce contention
+type shardedMap[K comparable, V any] struct {
+	seed   maphash.Seed
+	shards []*mutexMap[K, V]
+}
+
+// NewShardedMap creates a concurrent map split across the given number of shards
+func NewShardedMap[K comparable, V any](shards int) CMap[K, V] {
+	sm := &shardedMap[K, V]{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*mutexMap[K, V], max(shards, 1)),
+	}
+	for i := range sm.shards {
+		sm.shards[i] = &mutexMap[K, V]{
+			data: make(map[K]V),
+		}
+	}
+	return sm
+}
+
+// shard returns the shard responsible for a key
+func (sm *shardedMap[K, V]) shard(key K) *mutexMap[K, V] {
+	var h uint64
+	switch k := any(key).(type) {
+	case string:
+		h = maphash.String(sm.seed, k)
+	case int:
+		h = uint64(k)
+	case int64:
+		h = uint64(k)
+	default:
+		h = maphash.String(sm.seed, fmt.Sprint(k))
+	}
+	return sm.shards[h%uint64(len(sm.shards))]
+}
+
+func (sm *shardedMap[K, V]) Set(key K, value V) {
+	sm.shard(key).Set(key, value)
+}
+
+func (sm *shardedMap[K, V]) Del(key K) {
+	sm.shard(key).Del(key)
+}
+
+func (sm *shardedMap[K, V]) Get(key K) (V, bool) {
+	return sm.shard(key).Get(key)
+}
+
+func (sm *shardedMap[K, V]) CompareAndDelete(key K, old V) bool {
+	return sm.shard(key).CompareAndDelete(key, old)
+}
+
+func (sm *shardedMap[K, V]) CompareAndSwap(key K, old V, new V) bool {
+	return sm.shard(key).CompareAndSwap(key, old, new)
+}
+
+func (sm *shardedMap[K, V]) SetIfAbsent(key K, value V) bool {
+	return sm.shard(key).SetIfAbsent(key, value)
+}
+
+func (sm *shardedMap[K, V]) Values() []V {
+	values := make([]V, 0, sm.Len())
+	for _, shard := range sm.shards {
+		values = append(values, shard.Values()...)
+	}
+	return values
+}
+
+func (sm *shardedMap[K, V]) Keys() []K {
+	keys := make([]K, 0, sm.Len())
+	for _, shard := range sm.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	return keys
+}
+
+func (sm *shardedMap[K, V]) Len() int {
+	n := 0
+	for _, shard := range sm.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (sm *shardedMap[K, V]) Reset() {
+	for _, shard := range sm.shards {
+		shard.Reset()
+	}
+}
+
+// Iterate blocks each shard in turn while iterating over its key value pairs
+func (sm *shardedMap[K, V]) Iterate(fn func(K, V) bool) {
+	for _, shard := range sm.shards {
+		stopped := false
+		shard.Iterate(func(k K, v V) bool {
+			if !fn(k, v) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Snapshot returns a point-in-time copy of the map, holding every shard's
+// read lock while the copy is taken
+func (sm *shardedMap[K, V]) Snapshot() map[K]V {
+	for _, shard := range sm.shards {
+		shard.RLock()
+		defer shard.RUnlock()
+	}
+
+	n := 0
+	for _, shard := range sm.shards {
+		n += len(shard.data)
+	}
+	snapshot := make(map[K]V, n)
+	for _, shard := range sm.shards {
+		maps.Copy(snapshot, shard.data)
+	}
+	return snapshot
+}
+
+func (sm *shardedMap[K, V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sm.Values())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"sync"
@@ -30,6 +31,62 @@ func testCMap(t *testing.T, m CMap[string, int]) {
 		assert.False(t, exists, "key should not exist after deletion")
 	})
 
+	t.Run("CompareAndDelete", func(t *testing.T) {
+		m.Reset()
+		m.Set("a", 1)
+		assert.False(t, m.CompareAndDelete("a", 2), "a different value shouldn't be deleted")
+		assert.False(t, m.CompareAndDelete("missing", 0), "a missing key shouldn't match the zero value")
+		val, exists := m.Get("a")
+		assert.True(t, exists)
+		assert.Equal(t, 1, val)
+
+		assert.True(t, m.CompareAndDelete("a", 1))
+		_, exists = m.Get("a")
+		assert.False(t, exists, "key should not exist after a matching delete")
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		m.Reset()
+		m.Set("a", 1)
+		assert.False(t, m.CompareAndSwap("a", 2, 3), "a different value shouldn't be swapped")
+		assert.False(t, m.CompareAndSwap("missing", 0, 3), "a missing key shouldn't match the zero value")
+		_, exists := m.Get("missing")
+		assert.False(t, exists)
+
+		assert.True(t, m.CompareAndSwap("a", 1, 3))
+		val, _ := m.Get("a")
+		assert.Equal(t, 3, val)
+	})
+
+	t.Run("SetIfAbsent", func(t *testing.T) {
+		m.Reset()
+		assert.True(t, m.SetIfAbsent("a", 1))
+		assert.False(t, m.SetIfAbsent("a", 2), "a present key shouldn't be overwritten")
+		val, _ := m.Get("a")
+		assert.Equal(t, 1, val)
+	})
+
+	t.Run("Concurrent CompareAndDelete", func(t *testing.T) {
+		m.Reset()
+		m.Set("a", 1)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		deleted := 0
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if m.CompareAndDelete("a", 1) {
+					mu.Lock()
+					deleted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, deleted, "exactly one delete should succeed")
+	})
+
 	// Test Values
 	t.Run("Values", func(t *testing.T) {
 		m.Reset()
@@ -42,6 +99,18 @@ func testCMap(t *testing.T, m CMap[string, int]) {
 
 	})
 
+	// Test Len
+	t.Run("Len", func(t *testing.T) {
+		m.Reset()
+		assert.Equal(t, 0, m.Len())
+		m.Set("a", 1)
+		m.Set("b", 2)
+		m.Set("a", 3)
+		assert.Equal(t, 2, m.Len(), "overwriting a key should not change the length")
+		m.Del("a")
+		assert.Equal(t, 1, m.Len())
+	})
+
 	t.Run("Sequential access", func(t *testing.T) {
 		m.Reset()
 		var wg sync.WaitGroup
@@ -289,4 +358,138 @@ func TestConcurrentMap(t *testing.T) {
 		m := NewSyncMap[string, int]()
 		testCMap(t, m)
 	})
+
+	t.Run("shardedMap", func(t *testing.T) {
+		m := NewShardedMap[string, int](16)
+		testCMap(t, m)
+	})
+}
+
+func TestShardedMapIterateStops(t *testing.T) {
+	m := NewShardedMap[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+	}
+
+	visited := 0
+	m.Iterate(func(_, _ int) bool {
+		visited++
+		return visited < 10
+	})
+	assert.Equal(t, 10, visited, "iteration should stop across shards")
+
+	bytes, err := m.MarshalJSON()
+	assert.NoError(t, err)
+	var values []int
+	assert.NoError(t, json.Unmarshal(bytes, &values))
+	assert.Len(t, values, 100, "marshalling should aggregate every shard")
+}
+
+func TestCMapSnapshot(t *testing.T) {
+	testCases := []struct {
+		name string
+		new  func() CMap[int, int]
+		// Whether the snapshot is taken at a single point in time
+		pointInTime bool
+	}{
+		{"mutexMap", NewMutexMap[int, int], true},
+		{"syncMap", NewSyncMap[int, int], false},
+		{"shardedMap", func() CMap[int, int] { return NewShardedMap[int, int](8) }, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("Independent copy", func(t *testing.T) {
+				m := tc.new()
+				m.Set(1, 1)
+				m.Set(2, 2)
+
+				snapshot := m.Snapshot()
+				assert.Equal(t, map[int]int{1: 1, 2: 2}, snapshot)
+
+				snapshot[1] = 100
+				snapshot[3] = 3
+				delete(snapshot, 2)
+
+				v, _ := m.Get(1)
+				assert.Equal(t, 1, v, "mutating the snapshot shouldn't affect the map")
+				_, ok := m.Get(2)
+				assert.True(t, ok)
+				_, ok = m.Get(3)
+				assert.False(t, ok)
+
+				m.Set(4, 4)
+				assert.NotContains(t, snapshot, 4, "later writes shouldn't affect the snapshot")
+			})
+
+			t.Run("Concurrent writes", func(t *testing.T) {
+				const total = 2000
+				m := tc.new()
+
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					// Keys are only ever added in order
+					for i := 0; i < total; i++ {
+						m.Set(i, i*2)
+					}
+				}()
+
+				for {
+					snapshot := m.Snapshot()
+					for k, v := range snapshot {
+						assert.Equal(t, k*2, v)
+					}
+					if tc.pointInTime {
+						// A consistent snapshot holds exactly the first n keys
+						for i := 0; i < len(snapshot); i++ {
+							if _, ok := snapshot[i]; !ok {
+								t.Fatalf("snapshot of %d keys is missing key %d", len(snapshot), i)
+							}
+						}
+					}
+
+					select {
+					case <-done:
+						assert.Len(t, m.Snapshot(), total)
+						return
+					default:
+					}
+				}
+			})
+		})
+	}
+}
+
+// benchmarkContention measures mixed read/write access from parallel goroutines
+func benchmarkContention(b *testing.B, m CMap[string, int]) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		m.Set(keys[i], i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 == 0 {
+				m.Set(key, i)
+			} else {
+				m.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCMapContention(b *testing.B) {
+	b.Run("mutexMap", func(b *testing.B) {
+		benchmarkContention(b, NewMutexMap[string, int]())
+	})
+
+	b.Run("shardedMap", func(b *testing.B) {
+		benchmarkContention(b, NewShardedMap[string, int](32))
+	})
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultCORSMethods are the methods cross-origin requests may use unless configured
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+	// DefaultCORSHeaders are the request headers cross-origin requests may send unless configured
+	DefaultCORSHeaders = []string{"Content-Type", "Authorization"}
+)
+
+// CORSMaxAge is how long browsers may cache a preflight response
+const CORSMaxAge time.Duration = 10 * time.Minute
+
+// CORS lets browser frontends on other origins call the HTTP API. The
+// websocket endpoint isn't subject to CORS and checks origins itself.
+type CORS struct {
+	// Allowed origins, "*" allows any origin
+	origins []string
+	methods []string
+	headers []string
+}
+
+// NewCORS creates a CORS policy allowing requests from the given origins,
+// using the default methods and headers if none are given
+func NewCORS(origins, methods, headers []string) *CORS {
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	upper := make([]string, len(methods))
+	for i, method := range methods {
+		upper[i] = strings.ToUpper(method)
+	}
+	return &CORS{
+		origins: origins,
+		methods: upper,
+		headers: headers,
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// origin, or false if the origin isn't allowed
+func (c *CORS) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	if slices.Contains(c.origins, "*") {
+		return "*", true
+	}
+	if slices.Contains(c.origins, origin) {
+		return origin, true
+	}
+	return "", false
+}
+
+// allowHeaders reports whether every header named in an
+// Access-Control-Request-Headers value is allowed
+func (c *CORS) allowHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !slices.ContainsFunc(c.headers, func(allowed string) bool {
+			return strings.EqualFold(allowed, header)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin adds the headers allowing the request's origin to read the
+// response, reporting false if the origin isn't allowed
+func (c *CORS) setOrigin(w http.ResponseWriter, r *http.Request) bool {
+	allowed, ok := c.allowOrigin(r.Header.Get("Origin"))
+	if allowed != "*" {
+		// Responses differ by origin, so caches mustn't share them
+		w.Header().Add("Vary", "Origin")
+	}
+	if !ok {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	return true
+}
+
+// Preflight answers a browser's preflight OPTIONS request, refusing with 403
+// if the origin, method or headers it asks about aren't allowed
+func (c *CORS) Preflight(w http.ResponseWriter, r *http.Request) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		// Not a preflight, just an OPTIONS request
+		w.Header().Set("Allow", strings.Join(append(slices.Clone(c.methods), http.MethodOptions), ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	if !c.setOrigin(w, r) ||
+		!slices.Contains(c.methods, method) ||
+		!c.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		w.Header().Del("Access-Control-Allow-Origin")
+		http.Error(w, "cross-origin request not allowed", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORSMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Wrap wraps a handler, letting allowed origins read its responses.
+// Requests from other origins are still served, the browser keeps the
+// response from the page.
+func (c *CORS) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			c.Preflight(w, r)
+			return
+		}
+		if c.setOrigin(w, r) {
+			// Busy responses tell clients when to retry
+			w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+		}
+		next(w, r)
+	}
+}
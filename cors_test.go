@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	cors := NewCORS([]string{"https://maze.example.com"}, nil, nil)
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/challenge", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		cors.Preflight(w, req)
+		return w
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		w := preflight("https://maze.example.com", http.MethodPost, "content-type")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "https://maze.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Content-Type, Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+		assert.Contains(t, w.Header().Values("Vary"), "Origin")
+	})
+
+	refused := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+	}{
+		{"other origin", "https://evil.example.com", http.MethodGet, ""},
+		{"method", "https://maze.example.com", http.MethodDelete, ""},
+		{"headers", "https://maze.example.com", http.MethodPost, "Content-Type, X-Secret"},
+	}
+	for _, tc := range refused {
+		t.Run("refused "+tc.name, func(t *testing.T) {
+			w := preflight(tc.origin, tc.method, tc.headers)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+		})
+	}
+
+	t.Run("plain options", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		cors.Preflight(w, httptest.NewRequest(http.MethodOptions, "/api/queues", nil))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "GET, POST, OPTIONS", w.Header().Get("Allow"))
+	})
+}
+
+func TestCORSWrap(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	request := func(handler http.HandlerFunc, method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/healthz", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	t.Run("listed origins", func(t *testing.T) {
+		handler := NewCORS([]string{"https://maze.example.com"}, nil, nil).Wrap(ok)
+
+		w := request(handler, http.MethodGet, "https://maze.example.com")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "https://maze.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "Retry-After", w.Header().Get("Access-Control-Expose-Headers"))
+		assert.Contains(t, w.Header().Values("Vary"), "Origin")
+
+		w = request(handler, http.MethodGet, "https://evil.example.com")
+		assert.Equal(t, http.StatusOK, w.Code, "other origins are still served")
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+		w = request(handler, http.MethodGet, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "same origin requests need no headers")
+
+		w = request(handler, http.MethodOptions, "https://maze.example.com")
+		assert.Equal(t, http.StatusNoContent, w.Code, "preflights to wrapped handlers are answered")
+	})
+
+	t.Run("any origin", func(t *testing.T) {
+		handler := NewCORS([]string{"*"}, []string{"get"}, nil).Wrap(ok)
+
+		w := request(handler, http.MethodGet, "https://anywhere.example.com")
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, w.Header().Values("Vary"))
+
+		w = request(handler, http.MethodOptions, "https://anywhere.example.com")
+		assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"), "methods should be upper cased")
+	})
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	gonanoid "github.com/matoous/go-nanoid/v2"
@@ -14,18 +20,63 @@ type Game interface {
 	BroadcastState()
 	RunListeners()
 	Cleanup()
+	Cancel()
 	CheckAllPlayersReady() bool
 	StartCountdown()
 	GetID() string
+	SetID(string)
 	GetMode() GameMode
+	GetParams() GameParams
 	GetMaxLevel() int
+	GetPlayerCount() int
 	SetMaxLevel(int)
+	UpdatePlayer(*Player, PlayerUpdateRequest)
+	SetConnection(*Player, ConnectionQuality)
 	Add() chan<- *Client
+	TryAdd(*Client) error
 	Remove() chan<- *Client
 	Context() context.Context
+	SwapClient(*Client) (*Client, bool)
+	Reconnect(*Client) error
+	OnOrphaned(func(*Client))
+	OnRematch(func(players []*Client, sameMaze bool))
+	DisconnectedPlayer(string) (*Player, bool)
+	PlayerConnected(string) bool
+	Recorder() *Recorder
+	SetRecorder(*Recorder)
+	SetBackfill(BackfillConfig)
+	SetLobby(LobbyConfig)
+	SetExpectedPlayers(int)
+	SetLayout(MazeLayout)
+	SetSeed(int64)
+	SetMazeAlgo(MazeAlgo)
+	SetCountdown(countdown time.Duration, readyCountdown time.Duration)
+	SetLoadingGrace(time.Duration)
+	SetAFKTimeout(time.Duration)
+	SetResultStore(*ResultStore)
+	SetDropCounter(*atomic.Int64)
+	SetMaxResultPlayers(int)
+	SetBroadcastOnChange(keepalive time.Duration)
+	SetResultPolicy(ResultPolicy)
+	SetResultTimeout(time.Duration)
+	SetMinRoundLength(time.Duration)
+	VoteSurrender(*Client)
+	VoteRematch(c *Client, sameMaze bool)
+	MarkLoaded(playerID string)
+	SetReady(*Client, bool)
+	EnterGame(*Client)
+	SetRequireEnter(bool)
+	Resync(*Client) bool
+	CanBackfill() bool
+	CanJoinLobby() bool
 	broadcastMessage([]byte)
 }
 
+// PracticeGame represents a persistent warmup lobby
+type PracticeGame struct {
+	*BaseGame
+}
+
 // SprintGame represents a sixty second sprint maze racer game
 type SprintGame struct {
 	*BaseGame
@@ -38,39 +89,200 @@ type RaceGame struct {
 	levelTarget int
 }
 
+// HybridGame represents a race to the level target with a time cap, won on
+// levels if nobody reaches the target in time
+type HybridGame struct {
+	*BaseGame
+	levelTarget int
+	roundLength time.Duration
+}
+
+// TimeTrialGame represents a single player game against the clock
+type TimeTrialGame struct {
+	*BaseGame
+	roundLength time.Duration
+	results     *ResultStore
+}
+
+// BackfillConfig controls whether players can join a game that is already
+// running. Backfill is disabled unless a window is set.
+type BackfillConfig struct {
+	// Upper bound on players, including any backfilled mid-game
+	MaxPlayers int
+	// How long after the start players may still be slotted in
+	Window time.Duration
+	// Spawn backfilled players at the leader's level rather than level one
+	SpawnAtLeader bool
+}
+
+// LobbyConfig lets a game wait for more than the minimum number of players
+// before the countdown begins. Once the minimum is present the lobby waits up
+// to FillTimeout for MaxPlayers, then starts with whoever has joined. The
+// countdown starts as soon as the minimum is present unless both are set.
+type LobbyConfig struct {
+	MaxPlayers  int
+	FillTimeout time.Duration
+}
+
 // BaseGame represents a maze racer game
 type BaseGame struct {
 	id            string
 	tickrate      time.Duration
 	Mode          GameMode
 	State         *GameState
-	Clients       map[*Client]bool
+	Clients       CMap[string, *ClientSink]
 	add           chan *Client
 	remove        chan *Client
 	Broadcast     chan []byte
+	resultMsgs    chan []byte
 	ctx           context.Context
 	cancel        context.CancelFunc
 	countdownDone chan struct{}
 	broadcaster   Broadcaster
+	recorder      *Recorder
+	logger        *slog.Logger
+	params        GameParams
+	// Number of players needed for the countdown to start
+	minPlayersToStart int
+	// Number of players being placed into the game together, who the
+	// countdown waits for even once the minimum has joined
+	expectedPlayers int
+	// Number of connected players needed for a running game to continue.
+	// Below this the game is cancelled, unless a single player remains of a
+	// head-to-head game, who is declared the winner instead.
+	minPlayersToContinue int
+	// Start the game as soon as enough players join, without a countdown
+	skipCountdown bool
+	// The game runs until cleaned up, with players free to join and leave
+	persistent bool
+	// Countdown length, shortened to readyCountdown once all players are ready
+	countdown      time.Duration
+	readyCountdown time.Duration
+	// Called with the round result after it has been broadcast
+	onResult func(RoundResult)
+	// Called with each remaining client when the game is orphaned during countdown
+	onOrphaned func(*Client)
+	// Called with the players once they have all voted for a rematch, nil if
+	// the game can't be rematched
+	onRematch func(players []*Client, sameMaze bool)
+	// Records games aborted without a result, nil to not record them
+	results *ResultStore
+	// Counts clients dropped from broadcasts for a full send buffer, nil to
+	// only log them
+	drops *atomic.Int64
+	// Which results are recorded once the round has been broadcast
+	resultPolicy ResultPolicy
+	// How long the round result waits for room in a client's send buffer
+	resultTimeout time.Duration
+	// How long the round must run before reaching the level target ends it,
+	// 0 to end it as soon as the target is reached
+	minRoundLength time.Duration
+	// Round result frame once sent, kept for resyncing clients
+	latestResult atomic.Pointer[[]byte]
+	// Number of scores sent in round results, 0 to send every player's
+	maxResultPlayers int
+	// How long a player may go without sending an update before they're
+	// kicked from the running game, 0 to never kick players
+	afkTimeout time.Duration
+	// When each player last sent an update, or joined the running game
+	lastActive CMap[string, time.Time]
+	// How long a running game waits for a dropped player to reconnect
+	reconnectGrace time.Duration
+	reconnect      chan *Client
+	disconnected   CMap[string, bool]
+	// Votes to end the running game early by player id, only accessed by
+	// the listener
+	surrender      chan *Client
+	surrenderVotes map[string]bool
+	// Votes for a rematch once the round has ended, by player id and whether
+	// the player asked for the same maze. Only accessed by the listener.
+	rematch      chan rematchVote
+	rematchVotes map[string]bool
+	backfill     BackfillConfig
+	lobby        LobbyConfig
+	// Players must enter the game before readying up, and those who haven't
+	// readied by the end of the countdown are dropped
+	requireEnter bool
+	// Set once the countdown begins, after which the lobby takes no more players
+	lobbyClosed atomic.Bool
+	// Unix milliseconds at which the game phase began, zero until then
+	startedAt atomic.Int64
+	// Most recently broadcast state frame, kept for resyncing clients
+	latestState atomic.Pointer[[]byte]
+	// How long a sprint round waits for players to load before starting,
+	// 0 to start immediately
+	loadingGrace time.Duration
+	loaded       CMap[string, bool]
+	loadedSignal chan struct{}
+	// Source of time for the game's timers and broadcasters
+	clock Clock
+	// Events since the last state update, sent with the next one
+	eventsMu sync.Mutex
+	events   [][]byte
+	// Send state updates only when the state has changed, or once the
+	// keepalive has passed since the last one. 0 sends every tick.
+	keepalive time.Duration
+	// When state was last broadcast, only accessed by the broadcaster
+	lastBroadcast time.Time
+	// Set while the countdown is held awaiting a reconnection
+	countdownPaused atomic.Bool
+	// Set while the broadcaster waits for players to load, when their
+	// updates are dropped so nobody starts ahead
+	loading atomic.Bool
+	// Closed when the game phase begins, stopping any countdown still running
+	countdownStop chan struct{}
+	// Guard closing the countdown channels, which may be triggered more than once
+	countdownDoneOnce sync.Once
+	countdownStopOnce sync.Once
 }
 
-// NewGame instantiates a new base game
+// SeedSource generates the seeds game mazes are generated from
+type SeedSource func() int64
+
+// NewGame instantiates a new base game with a seed from the global generator.
+// A tickrate that isn't positive, which can't be ticked with, falls back to
+// ServerTickrate.
 func NewGame(mode GameMode, tickrate time.Duration) *BaseGame {
 	seed := rand.Int64()
 	ctx, cancel := context.WithCancel(context.Background())
 	id := gonanoid.Must(5)
+	clock := realClock{}
 	bg := &BaseGame{
-		id:            id,
-		tickrate:      tickrate,
-		Mode:          mode,
-		State:         NewGameState(seed), // temporary seed
-		Clients:       make(map[*Client]bool),
-		add:           make(chan *Client),
-		remove:        make(chan *Client),
-		Broadcast:     make(chan []byte),
-		ctx:           ctx,
-		cancel:        cancel,
-		countdownDone: make(chan struct{}),
+		id:                   id,
+		tickrate:             tickrate,
+		Mode:                 mode,
+		State:                NewGameState(seed, clock), // temporary seed
+		Clients:              NewMutexMap[string, *ClientSink](),
+		add:                  make(chan *Client),
+		remove:               make(chan *Client),
+		Broadcast:            make(chan []byte),
+		resultMsgs:           make(chan []byte),
+		ctx:                  ctx,
+		cancel:               cancel,
+		countdownDone:        make(chan struct{}),
+		countdownStop:        make(chan struct{}),
+		logger:               slog.Default().With("game_id", id, "mode", mode),
+		minPlayersToStart:    2,
+		minPlayersToContinue: 2,
+		countdown:            DefaultCountdown,
+		readyCountdown:       ReadyCountdown,
+		resultTimeout:        ResultDeliveryTimeout,
+
+		reconnectGrace: ReconnectGracePeriod,
+		reconnect:      make(chan *Client),
+		disconnected:   NewMutexMap[string, bool](),
+		surrender:      make(chan *Client),
+		surrenderVotes: make(map[string]bool),
+		rematch:        make(chan rematchVote),
+		rematchVotes:   make(map[string]bool),
+		loaded:         NewMutexMap[string, bool](),
+		lastActive:     NewMutexMap[string, time.Time](),
+		loadedSignal:   make(chan struct{}, 1),
+		clock:          clock,
+	}
+	if err := checkDuration("tickrate", tickrate); err != nil {
+		bg.logger.Warn("using default tickrate", "default", ServerTickrate, "error", err)
+		bg.tickrate = ServerTickrate
 	}
 	bg.broadcaster = NewDefaultBroadcaster() // default broadcaster
 	return bg
@@ -78,6 +290,7 @@ func NewGame(mode GameMode, tickrate time.Duration) *BaseGame {
 
 func NewSprintGame(tickrate time.Duration, roundLength time.Duration) Game {
 	baseGame := NewGame(ModeSprint, tickrate)
+	baseGame.params = GameParams{RoundLength: roundLength}
 	sprintGame := &SprintGame{
 		BaseGame:    baseGame,
 		roundLength: roundLength,
@@ -86,8 +299,22 @@ func NewSprintGame(tickrate time.Duration, roundLength time.Duration) Game {
 	return sprintGame
 }
 
+// SetLevelCap ends the round early once a player exceeds the given level,
+// for very short rounds. 0 leaves the round to run until the timer. It must
+// be called before RunListeners.
+func (g *SprintGame) SetLevelCap(levelCap int) {
+	if levelCap <= 0 {
+		return
+	}
+	g.State.LevelTarget = levelCap
+	g.params.LevelTarget = levelCap
+	g.broadcaster.(*SprintBroadcaster).levelCap = levelCap
+}
+
 func NewRaceGame(tickrate time.Duration, levelTarget int) Game {
 	baseGame := NewGame(ModeRace, tickrate)
+	baseGame.State.LevelTarget = levelTarget
+	baseGame.params = GameParams{LevelTarget: levelTarget}
 	raceGame := &RaceGame{
 		BaseGame:    baseGame,
 		levelTarget: levelTarget,
@@ -96,65 +323,708 @@ func NewRaceGame(tickrate time.Duration, levelTarget int) Game {
 	return raceGame
 }
 
+func NewHybridGame(tickrate time.Duration, levelTarget int, roundLength time.Duration) Game {
+	baseGame := NewGame(ModeHybrid, tickrate)
+	baseGame.State.LevelTarget = levelTarget
+	baseGame.params = GameParams{LevelTarget: levelTarget, RoundLength: roundLength}
+	hybridGame := &HybridGame{
+		BaseGame:    baseGame,
+		levelTarget: levelTarget,
+		roundLength: roundLength,
+	}
+	baseGame.broadcaster = NewHybridBroadcaster(levelTarget, roundLength)
+	return hybridGame
+}
+
+// NewPracticeGame creates a warmup lobby which never ends and has no results
+func NewPracticeGame(tickrate time.Duration) Game {
+	baseGame := NewGame(ModePractice, tickrate)
+	baseGame.minPlayersToStart = 1
+	baseGame.minPlayersToContinue = 0
+	baseGame.skipCountdown = true
+	baseGame.persistent = true
+	baseGame.reconnectGrace = 0
+	// The default broadcaster only sends updates, so a round never ends
+	return &PracticeGame{
+		BaseGame: baseGame,
+	}
+}
+
+// NewTimeTrialGame creates a single player game that starts immediately and
+// records the result against the player's personal best
+func NewTimeTrialGame(tickrate time.Duration, roundLength time.Duration, results *ResultStore) Game {
+	baseGame := NewGame(ModeTimeTrial, tickrate)
+	baseGame.params = GameParams{RoundLength: roundLength}
+	baseGame.minPlayersToStart = 1
+	baseGame.minPlayersToContinue = 1
+	baseGame.skipCountdown = true
+	timeTrialGame := &TimeTrialGame{
+		BaseGame:    baseGame,
+		roundLength: roundLength,
+		results:     results,
+	}
+	baseGame.broadcaster = NewSprintBroadcaster(roundLength)
+	baseGame.onResult = timeTrialGame.recordPersonalBests
+	return timeTrialGame
+}
+
+// ErrInvalidDuration is returned when a game is given a timer duration that
+// isn't positive, which it can't tick or time a round with
+var ErrInvalidDuration = errors.New("duration must be positive")
+
+// checkDuration returns an error naming the setting if d isn't positive
+func checkDuration(name string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%w: %v is %v", ErrInvalidDuration, name, d)
+	}
+	return nil
+}
+
+// NewModeGame creates a game of the given mode with the tickrate and params
+// given, returning ErrInvalidDuration if the tickrate, or the round length
+// of a timed mode, isn't positive
+func NewModeGame(mode GameMode, tickrate time.Duration, params GameParams, results *ResultStore) (Game, error) {
+	if err := checkDuration("tickrate", tickrate); err != nil {
+		return nil, err
+	}
+	switch mode {
+	case ModeSprint, ModeHybrid, ModeTimeTrial:
+		if err := checkDuration("round length", params.RoundLength); err != nil {
+			return nil, err
+		}
+	}
+
+	switch mode {
+	case ModeSprint:
+		return NewSprintGame(tickrate, params.RoundLength), nil
+	case ModeRace:
+		return NewRaceGame(tickrate, params.LevelTarget), nil
+	case ModeHybrid:
+		return NewHybridGame(tickrate, params.LevelTarget, params.RoundLength), nil
+	case ModeTimeTrial:
+		return NewTimeTrialGame(tickrate, params.RoundLength, results), nil
+	case ModePractice:
+		return NewPracticeGame(tickrate), nil
+	default:
+		return nil, fmt.Errorf("invalid game mode")
+	}
+}
+
+// recordPersonalBests stores each player's result and notifies them of their best
+func (g *TimeTrialGame) recordPersonalBests(result RoundResult) {
+	for _, sink := range g.Clients.Values() {
+		player := sink.Client().player
+		best, isNew := g.results.RecordPersonalBest(player, player.Level, g.clock.Now())
+		msg := MustCreateResponseBytes(RespPersonalBest, PersonalBestResponse{
+			Level:   player.Level,
+			Best:    best.Level,
+			NewBest: isNew,
+		})
+		sink.Send(msg)
+	}
+}
+
 func (g *BaseGame) broadcastMessage(message []byte) {
-	for client := range g.Clients {
-		select {
-		case <-client.ctx.Done():
-			g.remove <- client
-		default:
-			select {
-			case client.send <- message:
-			default:
-				g.remove <- client
+	for _, sink := range g.Clients.Values() {
+		if !sink.Send(message) {
+			g.dropClient(sink.Client())
+		}
+	}
+}
+
+// broadcastReliably sends a message every player must receive, waiting up to
+// the result timeout for room in each send buffer rather than dropping
+// clients that are momentarily behind
+func (g *BaseGame) broadcastReliably(message []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.resultTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, sink := range g.Clients.Values() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sink.SendWait(ctx, message) {
+				g.dropClient(sink.Client())
 			}
+		}()
+	}
+	wg.Wait()
+}
+
+// dropClient removes a client that couldn't be sent a message. Removal is
+// handled by the listener, which may be the caller.
+func (g *BaseGame) dropClient(client *Client) {
+	if client.ctx.Err() == nil {
+		g.recordDrop(client)
+	}
+	go func() {
+		select {
+		case g.remove <- client:
+		case <-g.ctx.Done():
 		}
+	}()
+}
+
+// recordDrop notes a connected client is being dropped for falling behind
+// on broadcasts, so clients that consistently can't keep up can be diagnosed
+func (g *BaseGame) recordDrop(client *Client) {
+	if g.drops != nil {
+		g.drops.Add(1)
 	}
+	g.logger.Debug("dropping client with full send buffer",
+		"player_id", client.player.Id,
+		"buffered", len(client.send))
 }
 
-func (g *BaseGame) broadcastInitialState() error {
-	// Set initial start time
-	g.State.StartTime = time.Now().UnixMilli()
+// clientCount returns the number of players in the game, including any awaiting reconnection
+func (g *BaseGame) clientCount() int {
+	return g.Clients.Len()
+}
+
+// connectedCount returns the number of players currently connected to the game
+func (g *BaseGame) connectedCount() int {
+	return g.clientCount() - g.disconnected.Len()
+}
+
+// sendAll sends a message directly to every player in the game
+func (g *BaseGame) sendAll(message []byte) {
+	for _, sink := range g.Clients.Values() {
+		sink.Send(message)
+	}
+}
+
+// isCurrent reports whether a client is the current connection for its
+// player in the game
+func (g *BaseGame) isCurrent(client *Client) bool {
+	sink, ok := g.Clients.Get(client.player.Id)
+	return ok && sink.Client() == client
+}
+
+// removeClient removes a client from the game if it's the current connection
+// for its player. It returns false for unknown or already replaced clients.
+func (g *BaseGame) removeClient(client *Client) bool {
+	if !g.isCurrent(client) {
+		return false
+	}
+	g.Clients.Del(client.player.Id)
+	g.State.RemovePlayer(client.player.Id)
+	return true
+}
+
+// gameStartedMessage describes the game to players as it starts
+func (g *BaseGame) gameStartedMessage() []byte {
+	return MustCreateResponseBytes(RespGameStarted, GameStartedResponse{
+		GameID:    g.id,
+		StartTime: g.startedAt.Load(),
+		Mode:      g.Mode,
+		Params:    g.params,
+	})
+}
+
+// CanBackfill returns true if a new player can currently join the running game.
+// It is safe to call from outside the listener, although the listener has the
+// final say when the player arrives.
+func (g *BaseGame) CanBackfill() bool {
+	started := g.startedAt.Load()
+	if g.backfill.Window <= 0 || started == 0 {
+		return false
+	}
+	if g.clock.Now().Sub(time.UnixMilli(started)) > g.backfill.Window {
+		return false
+	}
+	return g.connectedCount() >= g.minPlayersToContinue && g.clientCount() < g.backfill.MaxPlayers
+}
+
+// Resync immediately resends the latest state frame to a player in the game,
+// outside of the normal tick cadence. Tick frames omit the seed, which the
+// player already has. It returns false if there's no state to send yet.
+func (g *BaseGame) Resync(client *Client) bool {
+	frame := g.latestState.Load()
+	if frame == nil {
+		return false
+	}
+	sink, ok := g.Clients.Get(client.player.Id)
+	if !ok || sink.Client() != client {
+		return false
+	}
+	if !sink.Send(*frame) {
+		return false
+	}
+	// Players who missed the result can recover it once the round is over
+	if result := g.latestResult.Load(); result != nil {
+		return sink.Send(*result)
+	}
+	return true
+}
+
+// SetLayout sets a custom maze layout for the game, which is sent to players
+// with the initial state. It must be called before RunListeners.
+func (g *BaseGame) SetLayout(layout MazeLayout) {
+	g.params.Layout = layout.String()
+	g.State.Layout = g.params.Layout
+}
+
+// mazeLayout returns the game's custom maze layout, nil if its maze is
+// generated from the seed
+func (g *BaseGame) mazeLayout() *MazeLayout {
+	if g.params.Layout == "" {
+		return nil
+	}
+	layout, err := ParseMazeLayout(g.params.Layout)
+	if err != nil {
+		g.logger.Error("invalid maze layout", "error", err)
+		return nil
+	}
+	return &layout
+}
+
+// SetSeed sets the seed the maze is generated from. It must be called before
+// RunListeners.
+func (g *BaseGame) SetSeed(seed int64) {
+	g.State.Seed = seed
+}
+
+// SetMazeAlgo sets the algorithm clients generate the maze with, which is
+// sent to players with the seed. It must be called before RunListeners.
+func (g *BaseGame) SetMazeAlgo(algo MazeAlgo) {
+	g.params.MazeAlgo = algo
+	g.State.MazeAlgo = algo
+}
+
+// SetCountdown sets the countdown durations for the game. The countdown ticks
+// every second, or every readyCountdown if shorter. Durations that aren't
+// positive are refused, keeping the current ones. It must be called before
+// StartCountdown.
+func (g *BaseGame) SetCountdown(countdown time.Duration, readyCountdown time.Duration) {
+	if err := cmp.Or(checkDuration("countdown", countdown), checkDuration("ready countdown", readyCountdown)); err != nil {
+		g.logger.Warn("refused countdown, keeping the current one",
+			"countdown", g.countdown,
+			"ready_countdown", g.readyCountdown,
+			"error", err)
+		return
+	}
+	g.countdown = countdown
+	g.readyCountdown = readyCountdown
+}
 
+// SetLoadingGrace sets how long the round waits for players to acknowledge
+// they have loaded. It must be called before RunListeners.
+func (g *BaseGame) SetLoadingGrace(grace time.Duration) {
+	g.loadingGrace = grace
+}
+
+// SetRequireEnter has players confirm they accept the game before they can
+// ready up, dropping those who haven't readied by the end of the countdown.
+// It must be called before RunListeners.
+func (g *BaseGame) SetRequireEnter(require bool) {
+	g.requireEnter = require
+}
+
+// SetAFKTimeout sets how long players may go without sending an update before
+// they're kicked. It must be called before RunListeners.
+func (g *BaseGame) SetAFKTimeout(timeout time.Duration) {
+	g.afkTimeout = timeout
+}
+
+// SetResultStore sets where aborted games are recorded
+func (g *BaseGame) SetResultStore(results *ResultStore) {
+	g.results = results
+}
+
+// SetDropCounter sets the counter incremented for each client dropped from a
+// broadcast because its send buffer is full
+func (g *BaseGame) SetDropCounter(drops *atomic.Int64) {
+	g.drops = drops
+}
+
+// SetBroadcastOnChange skips state updates on ticks where nothing has
+// changed, for low activity games, still sending one at least every
+// keepalive. A keepalive of 0 sends an update every tick.
+func (g *BaseGame) SetBroadcastOnChange(keepalive time.Duration) {
+	g.keepalive = keepalive
+}
+
+// SetResultTimeout sets how long the round result waits for room in a
+// client's send buffer before the client is dropped
+func (g *BaseGame) SetResultTimeout(timeout time.Duration) {
+	g.resultTimeout = timeout
+}
+
+// SetMinRoundLength sets how long the round must run before a player
+// exceeding the level target ends it, so a bugged or cheating client can't
+// end the round the moment it starts. The round timer is unaffected.
+func (g *BaseGame) SetMinRoundLength(length time.Duration) {
+	g.minRoundLength = length
+}
+
+// SetResultPolicy sets which round results are recorded. Results are still
+// sent to the players of games that don't qualify.
+func (g *BaseGame) SetResultPolicy(policy ResultPolicy) {
+	g.resultPolicy = policy
+}
+
+// SetMaxResultPlayers caps the scores sent in round results to the leading
+// players, 0 to send them all. Players left out still receive their placement.
+func (g *BaseGame) SetMaxResultPlayers(n int) {
+	g.maxResultPlayers = n
+}
+
+// saveAbort records the game as aborted along with its players and any who
+// have already been removed
+func (g *BaseGame) saveAbort(reason AbortReason, removed ...*Player) {
+	if g.results == nil {
+		return
+	}
+	g.results.SaveAbort(g.id, reason, append(removed, g.State.Players.Values()...), g.clock.Now())
+}
+
+// afkClients returns the connected players who haven't sent an update within
+// the AFK timeout
+func (g *BaseGame) afkClients() []*Client {
+	cutoff := g.clock.Now().Add(-g.afkTimeout)
+	var afk []*Client
+	for _, sink := range g.Clients.Values() {
+		client := sink.Client()
+		if _, gone := g.disconnected.Get(client.player.Id); gone {
+			continue
+		}
+		if lastActive, ok := g.lastActive.Get(client.player.Id); ok && lastActive.Before(cutoff) {
+			afk = append(afk, client)
+		}
+	}
+	return afk
+}
+
+// kickAFK removes an inactive player from the running game. It returns true
+// if the game ended as a result. Must only be called by the listener.
+func (g *BaseGame) kickAFK(client *Client) bool {
+	g.logger.Info("kicking AFK player", "player_id", client.player.Id)
+	client.SetActiveGame(nil)
+	g.State.SetActive(client.player, false)
+	client.SetStatus(StatusIdle)
+	client.trySend(MustCreateResponseBytes(RespKickedAFK, KickedAFKResponse{
+		GameID: g.id,
+	}))
+	return g.dropPlayer(client)
+}
+
+// dropPlayer removes a player who has left the running game, ending it if
+// too few players remain. It returns true if the game ended. Must only be
+// called by the listener.
+func (g *BaseGame) dropPlayer(client *Client) bool {
+	g.removeClient(client)
+	g.lastActive.Del(client.player.Id)
+	if g.connectedCount() == 1 && g.minPlayersToStart > 1 {
+		g.logger.Info("last player standing, awarding win by forfeit")
+		g.awardForfeit([]*Player{client.player})
+		return true
+	}
+	if g.connectedCount() < g.minPlayersToContinue {
+		g.logger.Info("game ended due to insufficient players")
+		g.saveAbort(AbortInsufficientPlayers, client.player)
+
+		g.sendAll(MustCreateResponseBytes(RespGameCancelled, struct{}{}))
+		g.Cleanup()
+		return true
+	}
+	g.queueEvent(MustCreateResponseBytes(RespPlayerLeft, PlayerLeftResponse{
+		PlayerID: client.player.Id,
+	}))
+	return false
+}
+
+// MarkLoaded records that a player has loaded the game
+func (g *BaseGame) MarkLoaded(playerID string) {
+	if g.loadingGrace <= 0 {
+		return
+	}
+	g.loaded.Set(playerID, true)
+	select {
+	case g.loadedSignal <- struct{}{}:
+	default:
+	}
+}
+
+// allLoaded reports whether every connected player has loaded the game
+func (g *BaseGame) allLoaded() bool {
+	for _, id := range g.Clients.Keys() {
+		if _, gone := g.disconnected.Get(id); gone {
+			continue
+		}
+		if _, ok := g.loaded.Get(id); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SetBackfill configures backfill for the game. It must be called before
+// RunListeners.
+func (g *BaseGame) SetBackfill(cfg BackfillConfig) {
+	g.backfill = cfg
+}
+
+// SetLobby configures the lobby fill timeout for the game. It must be called
+// before RunListeners.
+func (g *BaseGame) SetLobby(cfg LobbyConfig) {
+	g.lobby = cfg
+}
+
+// SetExpectedPlayers holds the countdown until the given number of players
+// have joined, so a group placed together is confirmed together. It must be
+// called before RunListeners.
+func (g *BaseGame) SetExpectedPlayers(n int) {
+	g.expectedPlayers = n
+}
+
+// lobbyEnabled reports whether the game waits to fill up before the countdown
+func (g *BaseGame) lobbyEnabled() bool {
+	return g.lobby.MaxPlayers > g.minPlayersToStart && g.lobby.FillTimeout > 0
+}
+
+// CanJoinLobby returns true if a new player can currently join the game
+// before its countdown. Like CanBackfill the listener has the final say.
+func (g *BaseGame) CanJoinLobby() bool {
+	if !g.lobbyEnabled() || g.lobbyClosed.Load() || g.ctx.Err() != nil {
+		return false
+	}
+	return g.clientCount() < g.lobby.MaxPlayers
+}
+
+// refuseJoin turns away a player arriving at a game that can't take them.
+// Queued players who lost the race for a slot go back to the queue.
+func (g *BaseGame) refuseJoin(client *Client) {
+	g.logger.Warn("client attempted to join running game", "player_id", client.player.Id)
+	if (g.backfill.Window > 0 || g.lobbyEnabled()) && client.Status() == StatusQueued && g.onOrphaned != nil {
+		go g.onOrphaned(client)
+		return
+	}
+	client.trySend(MustCreateResponseBytes(RespJoinRunningGame, struct{}{}))
+}
+
+// backfillClient slots a new player into the running game
+func (g *BaseGame) backfillClient(client *Client) {
+	level := 1
+	if g.backfill.SpawnAtLeader {
+		level = max(g.State.GetMaxLevel(), 1)
+	}
+	client.player.SetLevel(level, g.clock.Now())
+
+	client.SetActiveGame(g)
+	client.player.Active = true
+	g.Clients.Set(client.player.Id, NewClientSink(client))
+	g.State.AddPlayer(client.player)
+	g.State.AssignSpawn(client.player, g.mazeLayout())
+	client.SetStatus(StatusInGame)
+	g.lastActive.Set(client.player.Id, g.clock.Now())
+
+	g.logger.Info("player backfilled into running game",
+		"player_id", client.player.Id,
+		"level", level)
+	client.trySend(g.gameStartedMessage())
+	g.sendInitialState(client)
+	g.queueEvent(MustCreateResponseBytes(RespPlayerEntered, PlayerEnteredResponse{
+		PlayerID: client.player.Id,
+		Username: client.player.Username,
+	}))
+}
+
+// sendInitialState sends the full game state to a player joining mid-game, as
+// tick updates don't carry the maze seed
+func (g *BaseGame) sendInitialState(client *Client) {
+	msg, err := g.State.AsInitialMessage()
+	if err != nil {
+		g.logger.Error("failed to create initial state message", "error", err)
+		return
+	}
+	client.trySend(msg)
+}
+
+// startRound sets the state's start time to the moment the game phase began,
+// so the game started message, initial state and updates all carry the same
+// start time. It returns the start time.
+func (g *BaseGame) startRound() time.Time {
+	start := g.clock.Now()
+	// Broadcasters driven without the listener start the round themselves
+	if !g.startedAt.CompareAndSwap(0, start.UnixMilli()) {
+		start = time.UnixMilli(g.startedAt.Load())
+	}
+	g.State.SetStartTime(start.UnixMilli())
+	g.State.SetPhase(PhaseRunning)
+	return start
+}
+
+func (g *BaseGame) broadcastInitialState() error {
+	g.State.AssignSpawns(g.mazeLayout())
 	// Create and send initial state message
-	initialMsg, err := g.State.AsUpdateMessage()
+	initialMsg, err := g.State.AsInitialMessage()
 	if err != nil {
 		return fmt.Errorf("error creating initial state message: %v", err)
 	}
-	g.Broadcast <- initialMsg
+	g.record(initialMsg)
+	g.latestState.Store(&initialMsg)
+	g.State.TakeChanged()
+	g.lastBroadcast = g.clock.Now()
+	return g.publish(initialMsg)
+}
 
-	// Clear start time for subsequent updates
-	// g.State.StartTime = 0
+// ErrGameClosed is returned when broadcasting to a game that is shutting down
+var ErrGameClosed = errors.New("game is shutting down")
 
-	return nil
+// publish hands a message to the listener for broadcast. The listener may
+// already have exited, so the send gives up once the game is cancelled.
+func (g *BaseGame) publish(message []byte) error {
+	select {
+	case g.Broadcast <- message:
+		return nil
+	case <-g.ctx.Done():
+		return ErrGameClosed
+	}
+}
+
+// broadcastResult hands the round result to the listener, which delivers it
+// after any state already broadcast
+func (g *BaseGame) broadcastResult(result RoundResult) error {
+	return g.deliverResult(result, func(msg []byte) error {
+		select {
+		case g.resultMsgs <- msg:
+			return nil
+		case <-g.ctx.Done():
+			return ErrGameClosed
+		}
+	})
+}
+
+// sendResult delivers the round result directly to every player, for use by
+// the listener which can't send to its own result channel
+func (g *BaseGame) sendResult(result RoundResult) error {
+	return g.deliverResult(result, func(msg []byte) error {
+		g.broadcastReliably(msg)
+		return nil
+	})
 }
 
-func (g *BaseGame) broadcastResult() error {
-	result := g.State.GetRoundResult()
-	msg, err := CreateResponseBytes(RespRoundResult, result)
+func (g *BaseGame) deliverResult(result RoundResult, send func([]byte) error) error {
+	msg, err := CreateResponseBytes(RespRoundResult, result.Top(g.maxResultPlayers))
 	if err != nil {
 		return fmt.Errorf("error creating round result message: %v", err)
 	}
 
-	g.Broadcast <- msg
-	slog.Info("round completed",
-		"game_id", g.id,
+	// The final state, sent ahead of the result, tells players the game has ended
+	g.State.SetPhase(PhaseEnded)
+	state, err := g.State.AsUpdateMessage()
+	if err != nil {
+		return fmt.Errorf("error creating final state message: %v", err)
+	}
+	g.record(state)
+	g.latestState.Store(&state)
+	if err := send(state); err != nil {
+		return err
+	}
+
+	g.record(msg)
+	g.latestResult.Store(&msg)
+	if err := send(msg); err != nil {
+		return err
+	}
+	for _, sink := range g.Clients.Values() {
+		sink.Client().SetStatus(StatusEndGame)
+	}
+	g.logger.Info("round completed",
 		"result", result)
 
+	if g.onResult != nil {
+		if g.resultQualifies() {
+			g.onResult(result)
+		} else {
+			g.logger.Info("not recording result of game without play",
+				"min_duration", g.resultPolicy.MinDuration,
+				"max_level", g.State.GetMaxLevel())
+		}
+	}
+
 	return nil
 }
 
+// minRoundElapsed reports whether the round has run for the minimum round
+// length, before which reaching the level target doesn't end it
+func (g *BaseGame) minRoundElapsed() bool {
+	if g.minRoundLength <= 0 {
+		return true
+	}
+	started := g.startedAt.Load()
+	return started != 0 && g.clock.Now().Sub(time.UnixMilli(started)) >= g.minRoundLength
+}
+
+// resultQualifies reports whether the round's result meets the result policy
+func (g *BaseGame) resultQualifies() bool {
+	var duration time.Duration
+	if started := g.startedAt.Load(); started != 0 {
+		duration = g.clock.Now().Sub(time.UnixMilli(started))
+	}
+	return g.resultPolicy.Qualifies(duration, g.State.GetMaxLevel())
+}
+
 func (g *BaseGame) broadcastUpdate() error {
+	changed := g.State.TakeChanged()
+	events := g.takeEvents()
+	now := g.clock.Now()
+	if g.keepalive > 0 && !changed && len(events) == 0 && now.Sub(g.lastBroadcast) < g.keepalive {
+		return nil
+	}
+	g.lastBroadcast = now
+
 	msg, err := g.State.AsUpdateMessage()
 	if err != nil {
 		return fmt.Errorf("error creating state update message: %v", err)
 	}
-	g.Broadcast <- msg
-	return nil
+	g.latestState.Store(&msg)
+
+	frame := msg
+	if len(events) > 0 {
+		messages := make([]json.RawMessage, 0, len(events)+1)
+		for _, event := range events {
+			messages = append(messages, event)
+		}
+		frame, err = CreateResponseBytes(RespBatch, BatchResponse{
+			Messages: append(messages, msg),
+		})
+		if err != nil {
+			return fmt.Errorf("error creating batch message: %v", err)
+		}
+	}
+	g.record(frame)
+	return g.publish(frame)
+}
+
+// queueEvent holds an event message for the next state update, so everything
+// that happened within a tick reaches players in a single frame
+func (g *BaseGame) queueEvent(message []byte) {
+	g.eventsMu.Lock()
+	defer g.eventsMu.Unlock()
+	g.events = append(g.events, message)
+}
+
+// takeEvents returns and clears the queued events
+func (g *BaseGame) takeEvents() [][]byte {
+	g.eventsMu.Lock()
+	defer g.eventsMu.Unlock()
+	events := g.events
+	g.events = nil
+	return events
+}
+
+// record captures a broadcast frame if recording is enabled for the game
+func (g *BaseGame) record(message []byte) {
+	if g.recorder != nil {
+		g.recorder.Record(message, g.clock.Now())
+	}
 }
 
 // BroadcastState starts the broadcasting - this is the public interface
 func (g *BaseGame) BroadcastState() {
-	slog.Info("starting game broadcast", "game_id", g.id)
+	g.logger.Info("starting game broadcast")
 	g.broadcaster.Start(g)
 }
 
@@ -162,49 +1032,221 @@ func (g *BaseGame) RunListeners() {
 	defer g.cancel()
 
 	countdownStarted := false
+	startCountdown := func() {
+		countdownStarted = true
+		g.lobbyClosed.Store(true)
+		// Players carried over from a finished game, e.g. for a rematch,
+		// start the round from the starting level
+		g.State.Reset(g.State.GetSeed())
+		if g.skipCountdown {
+			g.finishCountdown()
+		} else {
+			go g.StartCountdown()
+		}
+	}
+
+	// Set while the lobby waits to fill up
+	var lobbyTimer Timer
+	var lobbyExpired <-chan time.Time
+	defer func() {
+		if lobbyTimer != nil {
+			lobbyTimer.Stop()
+		}
+	}()
+	// Set while the game is paused awaiting a reconnection
+	var graceTimer Timer
+	var graceExpired <-chan time.Time
+	// awaitReconnect holds a dropped player's slot open, pausing the game
+	// with pause until they reconnect or the grace period expires
+	awaitReconnect := func(client *Client, pause func()) {
+		g.disconnected.Set(client.player.Id, true)
+		g.State.SetActive(client.player, false)
+		if graceExpired != nil {
+			return
+		}
+		g.logger.Info("game paused awaiting reconnection",
+			"player_id", client.player.Id,
+			"grace", g.reconnectGrace)
+		pause()
+		graceTimer = g.clock.NewTimer(g.reconnectGrace)
+		graceExpired = graceTimer.C()
+		g.sendAll(MustCreateResponseBytes(RespGamePaused, GamePausedResponse{
+			GracePeriodMs: g.reconnectGrace.Milliseconds(),
+		}))
+	}
+	// reconnected reports whether a reconnection is for a player awaiting
+	// one, swapping in their new connection
+	reconnected := func(client *Client) bool {
+		sink, ok := g.Clients.Get(client.player.Id)
+		if _, gone := g.disconnected.Get(client.player.Id); !gone || !ok {
+			g.logger.Warn("unexpected reconnection", "player_id", client.player.Id)
+			return false
+		}
+		sink.Swap(client)
+		g.State.ResetSeq(client.player)
+		g.disconnected.Del(client.player.Id)
+		client.SetActiveGame(g)
+		g.State.SetActive(client.player, true)
+		g.State.SetDisconnectReason(client.player, "")
+		g.logger.Info("player reconnected", "player_id", client.player.Id)
+		return true
+	}
+	// resumed reports whether every player is connected again, stopping
+	// the grace timer if so
+	resumed := func() bool {
+		if graceExpired == nil || g.connectedCount() != g.clientCount() {
+			return false
+		}
+		graceTimer.Stop()
+		graceExpired = nil
+		g.sendAll(MustCreateResponseBytes(RespGameResumed, struct{}{}))
+		return true
+	}
+	defer func() {
+		if graceTimer != nil {
+			graceTimer.Stop()
+		}
+	}()
+	// Ticks while the game is running if AFK players are kicked
+	var afkCheck <-chan time.Time
 
 	// Phase 1: Countdown
 	for {
 		select {
 		case <-g.ctx.Done():
+			// Cancelled from outside the listener, which cleans up itself.
+			// Players yet to play are requeued if an orphan handler is set.
+			if g.onOrphaned != nil {
+				g.orphan()
+			} else {
+				g.Cleanup()
+			}
 			return
 		case client := <-g.add:
-			client.activeGame = g
-			g.Clients[client] = true
+			if g.lobbyEnabled() && g.clientCount() >= g.lobby.MaxPlayers {
+				g.refuseJoin(client)
+				continue
+			}
+			client.SetActiveGame(g)
+			g.Clients.Set(client.player.Id, NewClientSink(client))
 			client.player.Active = true
-			g.State.Players.Set(client.player.Id, client.player)
+			g.State.AddPlayer(client.player)
 
-			if len(g.Clients) >= 2 && !countdownStarted {
-				countdownStarted = true
-				go g.StartCountdown()
+			if g.clientCount() < max(g.minPlayersToStart, g.expectedPlayers) || countdownStarted {
+				continue
 			}
+			if !g.lobbyEnabled() || g.clientCount() >= g.lobby.MaxPlayers {
+				if lobbyTimer != nil {
+					lobbyTimer.Stop()
+				}
+				lobbyExpired = nil
+				startCountdown()
+			} else if lobbyExpired == nil {
+				g.logger.Info("lobby waiting for more players",
+					"players", g.clientCount(),
+					"max_players", g.lobby.MaxPlayers,
+					"timeout", g.lobby.FillTimeout)
+				lobbyTimer = g.clock.NewTimer(g.lobby.FillTimeout)
+				lobbyExpired = lobbyTimer.C()
+			}
+
+		case <-lobbyExpired:
+			lobbyExpired = nil
+			g.logger.Info("lobby fill timeout reached, starting with present players",
+				"players", g.clientCount())
+			startCountdown()
 
 		case client := <-g.remove:
-			if g.Clients[client] {
-				delete(g.Clients, client)
-				g.State.Players.Del(client.player.Id)
+			if _, gone := g.disconnected.Get(client.player.Id); gone {
+				continue
+			}
+			if g.isCurrent(client) {
+				g.State.SetDisconnectReason(client.player, client.disconnectReason)
+			}
+			// Hold the countdown if a dropped connection leaves too few
+			// players to start. Players who leave deliberately aren't waited for.
+			remaining := g.connectedCount() - 1
+			if countdownStarted && !g.persistent && g.reconnectGrace > 0 && g.isCurrent(client) &&
+				client.ctx.Err() != nil && remaining > 0 && remaining < g.minPlayersToStart {
+				awaitReconnect(client, func() { g.countdownPaused.Store(true) })
+				continue
 			}
 
-			if len(g.Clients) < 2 && countdownStarted {
-				slog.Info("game orphaned during countdown, sending cancel message to remaining client")
+			removed := g.removeClient(client)
+			if removed && !countdownStarted && g.expectedPlayers > 0 {
+				// Don't wait for an expected player who has already left
+				g.expectedPlayers--
+			}
 
-				msg := MustCreateResponseBytes(RespGameCancelled, struct{}{})
+			if lobbyExpired != nil && g.clientCount() < g.minPlayersToStart {
+				// Wait for the minimum again before restarting the timeout
+				lobbyTimer.Stop()
+				lobbyExpired = nil
+			}
 
-				for remainingClient := range g.Clients {
-					remainingClient.send <- msg
+			if g.clientCount() < g.minPlayersToStart && countdownStarted && !g.persistent {
+				if removed {
+					g.saveAbort(AbortOrphaned, client.player)
+				} else {
+					g.saveAbort(AbortOrphaned)
 				}
-
-				g.Cleanup()
+				g.logger.Info("game orphaned during countdown")
+				g.orphan()
 				return
 			}
 
 		case <-g.countdownDone:
-			for client := range g.Clients {
-				client.SetStatus(StatusInGame)
+			// Nothing reads the countdown's messages once the game is running
+			g.stopCountdown()
+			if g.dropUnready() {
+				return
+			}
+			for _, sink := range g.Clients.Values() {
+				sink.Client().SetStatus(StatusInGame)
+			}
+			// Sent directly, so it always precedes the first state broadcast
+			g.State.SetPhase(PhaseRunning)
+			g.startedAt.Store(g.clock.Now().UnixMilli())
+			for _, id := range g.Clients.Keys() {
+				g.lastActive.Set(id, g.clock.Now())
+			}
+			g.sendAll(g.gameStartedMessage())
+			if graceExpired != nil {
+				// A player dropped as the countdown finished, the game waits
+				// for them from the start
+				g.broadcaster.Pause()
 			}
 			go g.BroadcastState()
 			goto GamePhase
 
+		case <-graceExpired:
+			g.logger.Info("reconnect grace expired during countdown")
+			var dropped []*Player
+			for _, id := range g.disconnected.Keys() {
+				if p, ok := g.State.Players.Get(id); ok {
+					dropped = append(dropped, p)
+				}
+				g.disconnected.Del(id)
+				g.Clients.Del(id)
+				g.State.RemovePlayer(id)
+			}
+			g.saveAbort(AbortGraceExpired, dropped...)
+			g.orphan()
+			return
+
+		case client := <-g.reconnect:
+			if !reconnected(client) {
+				continue
+			}
+			// The player confirms the game afresh
+			client.SetStatus(StatusConfirming)
+			if sink, ok := g.Clients.Get(client.player.Id); ok {
+				sink.Send(g.gameConfirmedMessage(client, g.confirmedPlayers()))
+			}
+			if resumed() {
+				g.countdownPaused.Store(false)
+			}
+
 		case message := <-g.Broadcast:
 			g.broadcastMessage(message)
 		}
@@ -212,46 +1254,345 @@ func (g *BaseGame) RunListeners() {
 
 	// Phase 2: Game Running
 GamePhase:
+	if g.afkTimeout > 0 {
+		afkTicker := g.clock.NewTicker(min(time.Second, g.afkTimeout))
+		defer afkTicker.Stop()
+		afkCheck = afkTicker.C()
+	}
 	for {
 		select {
 		case <-g.ctx.Done():
+			// Cancelled from outside the listener, which cleans up itself
+			g.Cleanup()
 			return
 		case client := <-g.add:
-			slog.Warn("client attempted to join running game", "client", client)
-			msg := MustCreateResponseBytes(RespJoinRunningGame, struct{}{})
-			client.send <- msg
+			if g.persistent || g.CanBackfill() {
+				g.backfillClient(client)
+				continue
+			}
+			g.refuseJoin(client)
 		case client := <-g.remove:
-			if g.Clients[client] {
-				delete(g.Clients, client)
-				g.State.Players.Del(client.player.Id)
+			if _, gone := g.disconnected.Get(client.player.Id); gone {
+				continue
+			}
+			if !g.isCurrent(client) {
+				continue
+			}
+			g.State.SetDisconnectReason(client.player, client.disconnectReason)
 
-				if len(g.Clients) < 2 {
-					// TODO: some kind of game aborted handler?
-					// TODO: what do we do with the final player?
-					slog.Info("game ended due to insufficient players")
+			g.logger.Info("player left running game",
+				"player_id", client.player.Id,
+				"reason", client.player.DisconnectReason)
 
-					msg := MustCreateResponseBytes(RespGameCancelled, struct{}{})
+			// Hold the slot open if the remaining players can't continue alone
+			remaining := g.connectedCount() - 1
+			if g.reconnectGrace > 0 && remaining > 0 && remaining < g.minPlayersToContinue {
+				awaitReconnect(client, g.broadcaster.Pause)
+				if g.recountSurrender() || g.recountRematch() {
+					return
+				}
+				continue
+			}
 
-					for client := range g.Clients {
-						client.send <- msg
-					}
-					g.Cleanup()
+			if g.dropPlayer(client) || g.recountSurrender() || g.recountRematch() {
+				return
+			}
+		case <-afkCheck:
+			if graceExpired != nil {
+				// Nobody can play while the game is paused
+				continue
+			}
+			for _, client := range g.afkClients() {
+				if g.kickAFK(client) || g.recountSurrender() {
 					return
 				}
 			}
+		case client := <-g.surrender:
+			if g.voteSurrender(client) {
+				return
+			}
+		case vote := <-g.rematch:
+			if g.voteRematch(vote.client, vote.sameMaze) {
+				return
+			}
+		case <-graceExpired:
+			if g.connectedCount() == 1 && g.minPlayersToStart > 1 {
+				g.logger.Info("reconnect grace expired, awarding win by forfeit")
+				var forfeited []*Player
+				for _, id := range g.disconnected.Keys() {
+					if p, ok := g.State.Players.Get(id); ok {
+						forfeited = append(forfeited, p)
+					}
+				}
+				g.awardForfeit(forfeited)
+				return
+			}
+			g.logger.Info("reconnect grace expired, ending game")
+			g.saveAbort(AbortGraceExpired)
+
+			g.sendAll(MustCreateResponseBytes(RespGameCancelled, struct{}{}))
+			g.Cleanup()
+			return
+		case client := <-g.reconnect:
+			if !reconnected(client) {
+				continue
+			}
+			client.SetStatus(StatusInGame)
+			g.sendInitialState(client)
+
+			if resumed() {
+				for _, id := range g.Clients.Keys() {
+					g.lastActive.Set(id, g.clock.Now())
+				}
+				g.broadcaster.Resume()
+			}
 		case message := <-g.Broadcast:
 			g.broadcastMessage(message)
+		case message := <-g.resultMsgs:
+			g.broadcastReliably(message)
+		}
+	}
+}
+
+// voteSurrender records a player's vote to end the running game early,
+// ending it with the current standings once a majority of the connected
+// players have voted. It returns true if the game ended. Must only be called
+// by the listener.
+func (g *BaseGame) voteSurrender(client *Client) bool {
+	sink, ok := g.Clients.Get(client.player.Id)
+	if !ok || sink.Client() != client {
+		return false
+	}
+	if g.persistent || g.clientCount() < SurrenderMinPlayers {
+		g.logger.Warn("refused surrender vote", "player_id", client.player.Id)
+		sink.Send(MustCreateResponseBytes(RespError, ErrorResponse{
+			Message: fmt.Sprintf("surrender votes need at least %v players", SurrenderMinPlayers),
+		}))
+		return false
+	}
+	if g.surrenderVotes[client.player.Id] {
+		return false
+	}
+	g.surrenderVotes[client.player.Id] = true
+	g.logger.Info("player voted to surrender", "player_id", client.player.Id)
+	return g.tallySurrender()
+}
+
+// recountSurrender retallies a surrender vote in progress once a player has
+// left, as fewer votes may now be a majority. It returns true if the game
+// ended. Must only be called by the listener.
+func (g *BaseGame) recountSurrender() bool {
+	if len(g.surrenderVotes) == 0 {
+		return false
+	}
+	return g.tallySurrender()
+}
+
+// tallySurrender sends every player the surrender vote tally, ending the game
+// with the current standings if a majority of the connected players voted.
+// Votes of players who have left are discarded, and those of players
+// awaiting reconnection aren't counted. It returns true if the game ended.
+func (g *BaseGame) tallySurrender() bool {
+	tally := SurrenderVoteResponse{Players: g.connectedCount()}
+	tally.Needed = tally.Players/2 + 1
+	for id := range g.surrenderVotes {
+		if _, ok := g.Clients.Get(id); !ok {
+			delete(g.surrenderVotes, id)
+			continue
+		}
+		if _, gone := g.disconnected.Get(id); !gone {
+			tally.Votes++
+		}
+	}
+	g.sendAll(MustCreateResponseBytes(RespSurrenderVote, tally))
+	if tally.Votes < tally.Needed {
+		return false
+	}
+
+	g.logger.Info("players voted to surrender, ending game",
+		"votes", tally.Votes,
+		"players", tally.Players)
+	if err := g.sendResult(g.State.GetRoundResult()); err != nil {
+		g.logger.Error("failed to send result", "error", err)
+	}
+	g.Cleanup()
+	return true
+}
+
+// rematchVote is a player's vote for a rematch, handed to the listener
+type rematchVote struct {
+	client   *Client
+	sameMaze bool
+}
+
+// voteRematch records a player's vote to play the finished game again,
+// starting the rematch once every player still in the game has voted. It
+// returns true if the game ended. Must only be called by the listener.
+func (g *BaseGame) voteRematch(client *Client, sameMaze bool) bool {
+	sink, ok := g.Clients.Get(client.player.Id)
+	if !ok || sink.Client() != client {
+		return false
+	}
+	if g.onRematch == nil || g.latestResult.Load() == nil {
+		g.logger.Warn("refused rematch vote", "player_id", client.player.Id)
+		sink.Send(MustCreateResponseBytes(RespError, ErrorResponse{
+			Message: "rematches are only available once a head-to-head round has ended",
+		}))
+		return false
+	}
+	g.rematchVotes[client.player.Id] = sameMaze
+	g.logger.Info("player voted for a rematch",
+		"player_id", client.player.Id,
+		"same_maze", sameMaze)
+	return g.tallyRematch()
+}
+
+// recountRematch retallies a rematch vote in progress once a player has
+// left, as the remaining players may all have voted. It returns true if the
+// game ended. Must only be called by the listener.
+func (g *BaseGame) recountRematch() bool {
+	if len(g.rematchVotes) == 0 {
+		return false
+	}
+	return g.tallyRematch()
+}
+
+// tallyRematch sends the rematch vote tally to the players still in the
+// game, starting the rematch once all of them voted. The maze is kept only
+// if every voter asked for the same maze. Votes of players who have left are
+// discarded, and players awaiting reconnection or who have moved on to a
+// queue or another game aren't counted. It returns true if the game ended.
+func (g *BaseGame) tallyRematch() bool {
+	var players []*Client
+	for _, sink := range g.Clients.Values() {
+		client := sink.Client()
+		if _, gone := g.disconnected.Get(client.player.Id); gone || client.ActiveGame() != Game(g) {
+			continue
+		}
+		players = append(players, client)
+	}
+
+	tally := RematchVoteResponse{Needed: len(players)}
+	sameMaze := true
+	for id, same := range g.rematchVotes {
+		if _, ok := g.Clients.Get(id); !ok {
+			delete(g.rematchVotes, id)
+			continue
+		}
+		if slices.ContainsFunc(players, func(c *Client) bool { return c.player.Id == id }) {
+			tally.Votes++
+			sameMaze = sameMaze && same
+		}
+	}
+	msg := MustCreateResponseBytes(RespRematchVote, tally)
+	for _, client := range players {
+		client.trySend(msg)
+	}
+	if tally.Votes < tally.Needed || tally.Needed < g.minPlayersToStart {
+		return false
+	}
+
+	g.logger.Info("players voted for a rematch",
+		"players", len(players),
+		"same_maze", sameMaze)
+	g.Cleanup()
+	g.onRematch(players, sameMaze)
+	return true
+}
+
+// orphan ends a game left with too few players to start, requeueing the
+// remaining players if an orphan handler is set and otherwise telling them
+// the game is cancelled. Must only be called by the listener.
+func (g *BaseGame) orphan() {
+	if g.onOrphaned == nil {
+		g.logger.Info("sending cancel message to remaining client")
+		g.sendAll(MustCreateResponseBytes(RespGameCancelled, struct{}{}))
+		g.Cleanup()
+		return
+	}
+
+	g.logger.Info("requeueing remaining client")
+	remaining := make([]*Client, 0, g.clientCount())
+	for _, sink := range g.Clients.Values() {
+		remaining = append(remaining, sink.Client())
+	}
+	g.Cleanup()
+	for _, c := range remaining {
+		g.onOrphaned(c)
+	}
+}
+
+// dropUnready removes the players who didn't both enter and ready up before
+// the countdown ran out, when entering is required. If too few players remain
+// to start, the game is abandoned. It returns true if the game ended. Must
+// only be called by the listener.
+func (g *BaseGame) dropUnready() bool {
+	if !g.requireEnter || g.skipCountdown {
+		return false
+	}
+	var dropped []*Player
+	for _, sink := range g.Clients.Values() {
+		client := sink.Client()
+		if client.Status() == StatusReady {
+			continue
+		}
+		g.logger.Info("dropping player who didn't ready up",
+			"player_id", client.player.Id,
+			"status", client.Status())
+		g.removeClient(client)
+		client.SetActiveGame(nil)
+		client.player.Active = false
+		client.SetStatus(StatusIdle)
+		sink.Send(MustCreateResponseBytes(RespNotReady, NotReadyResponse{
+			GameID: g.id,
+		}))
+		dropped = append(dropped, client.player)
+	}
+	if len(dropped) == 0 || g.clientCount() >= g.minPlayersToStart {
+		return false
+	}
+	g.saveAbort(AbortInsufficientPlayers, dropped...)
+	g.logger.Info("too few players ready to start")
+	g.orphan()
+	return true
+}
+
+// awardForfeit ends a head-to-head game left with a single connected player,
+// crediting them with the win over the players who left. Must only be called
+// by the listener.
+func (g *BaseGame) awardForfeit(forfeited []*Player) {
+	for _, sink := range g.Clients.Values() {
+		winner := sink.Client().player
+		if _, gone := g.disconnected.Get(winner.Id); gone {
+			continue
+		}
+		if err := g.sendResult(g.State.ForfeitResult(winner, forfeited)); err != nil {
+			g.logger.Error("failed to send result", "error", err)
 		}
+		break
 	}
+	g.Cleanup()
 }
 
+// Cleanup cancels the game and returns its players to the lobby, telling
+// each of them the game has ended
 func (g *BaseGame) Cleanup() {
 	g.cancel()
+	g.markEnded()
 
-	for client := range g.Clients {
-		g.State.Players.Del(client.player.Id)
-		client.activeGame = nil
-		delete(g.Clients, client)
+	ended := MustCreateResponseBytes(RespGameEnded, GameEndedResponse{
+		GameID: g.id,
+		Status: StatusIdle,
+	})
+	for _, id := range g.Clients.Keys() {
+		// Players who have moved on to a queue or another game keep their
+		// new session, as cleanup can run long after the game ended
+		if sink, ok := g.Clients.Get(id); ok && sink.Client().leaveGame(g) {
+			sink.Client().SetStatus(StatusIdle)
+			sink.Send(ended)
+		}
+		g.State.RemovePlayer(id)
+		g.Clients.Del(id)
 	}
 
 	// close(g.Add)
@@ -259,55 +1600,179 @@ func (g *BaseGame) Cleanup() {
 	// close(g.Broadcast)
 }
 
+// markEnded records the game as ended in its latest state, for games that
+// end without a round result, e.g. when cancelled, so a resync can't report
+// the game as still running
+func (g *BaseGame) markEnded() {
+	if g.latestState.Load() == nil || g.State.GetPhase() == PhaseEnded {
+		return
+	}
+	g.State.SetPhase(PhaseEnded)
+	state, err := g.State.AsUpdateMessage()
+	if err != nil {
+		g.logger.Error("failed to create final state message", "error", err)
+		return
+	}
+	g.record(state)
+	g.latestState.Store(&state)
+}
+
+// Cancel ends the game from outside its listener, which cleans up as it exits
+func (g *BaseGame) Cancel() {
+	g.cancel()
+}
+
 func (g *BaseGame) CheckAllPlayersReady() bool {
-	for client := range g.Clients {
-		if client.Status() != StatusReady {
+	for _, sink := range g.Clients.Values() {
+		if sink.Client().Status() != StatusReady {
 			return false
 		}
 	}
-	slog.Info("all players ready, adjusting countdown")
+	g.logger.Info("all players ready, adjusting countdown")
 	return true
 }
 
-func (g *BaseGame) StartCountdown() {
-	const (
-		defaultCountdown = 30 * time.Second
-		readyCountdown   = 5 * time.Second
-	)
+// SetReady readies or unreadies a player during the countdown and sends every
+// player the updated ready roster. Players must have entered the game before
+// readying up if entering is required.
+func (g *BaseGame) SetReady(client *Client, ready bool) {
+	if !client.setReady(ready, g.requireEnter) {
+		return
+	}
+	g.sendRoster()
+}
 
-	confirmMsg := MustCreateResponseBytes(RespGameConfirmed, GameConfirmedResponse{
-		GameID: g.id,
+// EnterGame confirms a player accepts the game they've been matched into,
+// when entering is required, and sends every player the updated roster
+func (g *BaseGame) EnterGame(client *Client) {
+	if !g.requireEnter {
+		client.logger.Warn("game doesn't require entering")
+		return
+	}
+	if !client.enterGame() {
+		return
+	}
+	g.sendRoster()
+}
+
+// sendRoster sends every player which players have entered and readied up
+func (g *BaseGame) sendRoster() {
+	ready := make(map[string]bool)
+	var entered map[string]bool
+	if g.requireEnter {
+		entered = make(map[string]bool)
+	}
+	for id, sink := range g.Clients.Snapshot() {
+		status := sink.Client().Status()
+		ready[id] = status == StatusReady
+		if entered != nil {
+			entered[id] = status == StatusEntered || status == StatusReady
+		}
+	}
+	g.sendAll(MustCreateResponseBytes(RespReadyRoster, ReadyRosterResponse{
+		Players: ready,
+		Entered: entered,
+	}))
+}
+
+// confirmedPlayers describes the players in the game, ordered by username
+func (g *BaseGame) confirmedPlayers() []ConfirmedPlayer {
+	sinks := g.Clients.Values()
+	players := make([]ConfirmedPlayer, 0, len(sinks))
+	for _, sink := range sinks {
+		p := sink.Client().player
+		players = append(players, ConfirmedPlayer{
+			ID:       p.Id,
+			Username: p.Username,
+			Flag:     p.Flag,
+			Color:    p.Color,
+		})
+	}
+	slices.SortFunc(players, func(a, b ConfirmedPlayer) int {
+		return cmp.Or(cmp.Compare(a.Username, b.Username), cmp.Compare(a.ID, b.ID))
+	})
+	return players
+}
+
+// gameConfirmedMessage describes the game to a player, with the other
+// players as their opponents
+func (g *BaseGame) gameConfirmedMessage(client *Client, players []ConfirmedPlayer) []byte {
+	params := g.GetParams()
+	opponents := slices.DeleteFunc(slices.Clone(players), func(p ConfirmedPlayer) bool {
+		return p.ID == client.player.Id
 	})
+	return MustCreateResponseBytes(RespGameConfirmed, GameConfirmedResponse{
+		GameID:    g.id,
+		Mode:      g.Mode,
+		Params:    params,
+		Seed:      params.Seed,
+		MazeAlgo:  params.MazeAlgo,
+		Opponents: opponents,
+
+		RequireEnter: g.requireEnter,
+	})
+}
 
-	for client := range g.Clients {
-		client.send <- confirmMsg
+func (g *BaseGame) StartCountdown() {
+	players := g.confirmedPlayers()
+	for _, sink := range g.Clients.Values() {
+		client := sink.Client()
+		sink.Send(g.gameConfirmedMessage(client, players))
 		client.SetStatus(StatusConfirming)
 	}
 
-	countdown := defaultCountdown
-	ticker := time.NewTicker(time.Second)
-	slog.Info("starting countdown", "duration", defaultCountdown)
+	interval := time.Second
+	if g.readyCountdown > 0 {
+		interval = min(interval, g.readyCountdown)
+	}
+	ticker := g.clock.NewTicker(interval)
+	g.logger.Info("starting countdown", "duration", g.countdown)
 
 	go func() {
 		defer ticker.Stop()
-		timeLeft := countdown
+		// The full countdown keeps running while shortened, so it can be
+		// restored if a player unreadies
+		fullLeft := g.countdown
+		var readyLeft time.Duration
+		shortened := false
 		for {
 			select {
 			case <-g.ctx.Done():
 				return
-			case <-ticker.C:
-				timeLeft -= time.Second
+			case <-g.countdownStop:
+				return
+			case <-ticker.C():
+				if g.countdownPaused.Load() {
+					continue
+				}
+				fullLeft -= interval
+				readyLeft -= interval
+
+				allReady := g.CheckAllPlayersReady()
+				if allReady && !shortened && fullLeft > g.readyCountdown {
+					shortened = true
+					readyLeft = g.readyCountdown
+				} else if !allReady && shortened {
+					g.logger.Info("player unreadied, restoring countdown")
+					shortened = false
+				}
+				timeLeft := fullLeft
+				if shortened {
+					timeLeft = readyLeft
+				}
 
 				// Broadcast remaining time to clients
 				msg, _ := CreateResponseBytes(RespSecondsToNextRoundStart, timeLeft.Seconds())
-				g.Broadcast <- msg
-
-				if timeLeft > readyCountdown && g.CheckAllPlayersReady() {
-					timeLeft = readyCountdown
+				select {
+				case g.Broadcast <- msg:
+				case <-g.countdownStop:
+					return
+				case <-g.ctx.Done():
+					return
 				}
 
 				if timeLeft <= 0 {
-					close(g.countdownDone)
+					g.finishCountdown()
 					return
 				}
 			}
@@ -315,28 +1780,87 @@ func (g *BaseGame) StartCountdown() {
 	}()
 }
 
+// finishCountdown signals the listener to begin the game phase
+func (g *BaseGame) finishCountdown() {
+	g.countdownDoneOnce.Do(func() {
+		close(g.countdownDone)
+	})
+}
+
+// stopCountdown stops the countdown goroutine, if one is running, so it
+// can't block broadcasting to a listener which is no longer counting down
+func (g *BaseGame) stopCountdown() {
+	g.countdownStopOnce.Do(func() {
+		close(g.countdownStop)
+	})
+}
+
 // GetID returns the given game id
 func (g *BaseGame) GetID() string {
 	return g.id
 }
 
+// SetID replaces the game's generated id. It must be called before the game
+// is registered or started.
+func (g *BaseGame) SetID(id string) {
+	g.id = id
+	g.logger = slog.Default().With("game_id", id, "mode", g.Mode)
+}
+
 // GetMode returns the current GameMode for the game
 func (g *BaseGame) GetMode() GameMode {
 	return g.Mode
 }
 
+// GetParams returns the params the game was created with, including its seed
+func (g *BaseGame) GetParams() GameParams {
+	params := g.params
+	params.Seed = g.State.GetSeed()
+	return params
+}
+
+// GetPlayerCount returns the number of players in the game, including any
+// awaiting reconnection
+func (g *BaseGame) GetPlayerCount() int {
+	return g.clientCount()
+}
+
 func (g *BaseGame) GetMaxLevel() int {
-	return g.State.MaxLevel
+	return g.State.GetMaxLevel()
 }
 
 func (g *BaseGame) SetMaxLevel(level int) {
-	g.State.MaxLevel = level
+	g.State.SetMaxLevel(level)
+}
+
+// UpdatePlayer applies a player's update to the game state
+func (g *BaseGame) UpdatePlayer(p *Player, update PlayerUpdateRequest) {
+	if g.loading.Load() {
+		return
+	}
+	g.lastActive.Set(p.Id, g.clock.Now())
+	g.State.UpdatePlayer(p, update)
+}
+
+func (g *BaseGame) SetConnection(p *Player, quality ConnectionQuality) {
+	g.State.SetConnection(p, quality)
 }
 
 func (g *BaseGame) Add() chan<- *Client {
 	return g.add
 }
 
+// TryAdd hands a player to the game's listener, returning ErrGameClosed
+// instead of blocking if the listener has exited
+func (g *BaseGame) TryAdd(c *Client) error {
+	select {
+	case g.add <- c:
+		return nil
+	case <-g.ctx.Done():
+		return fmt.Errorf("%w: %v", ErrGameClosed, g.id)
+	}
+}
+
 func (g *BaseGame) Remove() chan<- *Client {
 	return g.remove
 }
@@ -344,3 +1868,97 @@ func (g *BaseGame) Remove() chan<- *Client {
 func (g *BaseGame) Context() context.Context {
 	return g.ctx
 }
+
+// OnOrphaned sets a handler for clients left behind when the game is
+// orphaned during countdown, replacing the default cancellation
+func (g *BaseGame) OnOrphaned(fn func(*Client)) {
+	g.onOrphaned = fn
+}
+
+// Reconnect hands a new connection for a disconnected player to the game
+func (g *BaseGame) Reconnect(c *Client) error {
+	if _, ok := g.disconnected.Get(c.player.Id); !ok {
+		return fmt.Errorf("player not awaiting reconnection: %v", c.player.Id)
+	}
+	select {
+	case g.reconnect <- c:
+		return nil
+	case <-g.ctx.Done():
+		return fmt.Errorf("game has ended: %v", g.id)
+	}
+}
+
+// OnRematch sets a handler starting a rematch once the players of the
+// finished game have all voted for one
+func (g *BaseGame) OnRematch(fn func(players []*Client, sameMaze bool)) {
+	g.onRematch = fn
+}
+
+// VoteRematch hands a player's vote for a rematch to the listener
+func (g *BaseGame) VoteRematch(c *Client, sameMaze bool) {
+	select {
+	case g.rematch <- rematchVote{client: c, sameMaze: sameMaze}:
+	case <-g.ctx.Done():
+	}
+}
+
+// VoteSurrender hands a player's vote to end the running game early to the
+// listener
+func (g *BaseGame) VoteSurrender(c *Client) {
+	select {
+	case g.surrender <- c:
+	case <-g.ctx.Done():
+	}
+}
+
+// DisconnectedPlayer returns the player with the given id if they are awaiting reconnection
+func (g *BaseGame) DisconnectedPlayer(id string) (*Player, bool) {
+	if _, ok := g.disconnected.Get(id); !ok {
+		return nil, false
+	}
+	return g.State.Players.Get(id)
+}
+
+// PlayerConnected reports whether the player with the given id is in the
+// game with a live connection. A player whose connection has dropped may not
+// have been removed by the listener yet.
+func (g *BaseGame) PlayerConnected(id string) bool {
+	sink, ok := g.Clients.Get(id)
+	if !ok {
+		return false
+	}
+	if _, gone := g.disconnected.Get(id); gone {
+		return false
+	}
+	return sink.Client().ctx.Err() == nil
+}
+
+// SwapClient replaces the connection backing a player already in the game,
+// carrying over the previous connection's status. It returns the replaced
+// client, or false if the player isn't part of the game.
+func (g *BaseGame) SwapClient(c *Client) (*Client, bool) {
+	sink, ok := g.Clients.Get(c.player.Id)
+	if !ok {
+		return nil, false
+	}
+
+	c.SetActiveGame(g)
+	c.SetStatus(sink.Client().Status())
+	old := sink.Swap(c)
+	g.State.ResetSeq(c.player)
+	old.SetActiveGame(nil)
+
+	g.logger.Info("swapped client connection", "player_id", c.player.Id)
+	return old, true
+}
+
+// Recorder returns the replay recorder for the game, or nil if recording is disabled
+func (g *BaseGame) Recorder() *Recorder {
+	return g.recorder
+}
+
+// SetRecorder enables replay recording for the game.
+// It must be called before the game starts broadcasting.
+func (g *BaseGame) SetRecorder(r *Recorder) {
+	g.recorder = r
+}
@@ -0,0 +1,1508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient creates a client without a websocket connection for driving games in tests
+func newTestClient(username string) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	player := NewPlayer(username, "🏴")
+	return &Client{
+		player: player,
+		status: StatusIdle,
+		send:   make(chan []byte, 256),
+		ctx:    ctx,
+		cancel: cancel,
+		logger: slog.Default().With("player_id", player.Id),
+	}
+}
+
+// drainBroadcasts consumes a game's broadcast and result channels until the
+// game is cancelled or stop is closed
+func drainBroadcasts(g *BaseGame, stop <-chan struct{}) {
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-stop:
+			return
+		case msg := <-g.Broadcast:
+			g.broadcastMessage(msg)
+		case msg := <-g.resultMsgs:
+			g.broadcastReliably(msg)
+		}
+	}
+}
+
+// waitFor polls cond until it is true or the timeout elapses
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+// receiveType waits for a message of the given type on a client's send channel
+func receiveType(c *Client, msgType MessageType, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg := <-c.send:
+			var base BaseMessage
+			if err := json.Unmarshal(msg, &base); err == nil && base.Type == msgType {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func TestSwapClientMidGame(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.reconnectGrace = 0
+	g.skipCountdown = true
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+
+	require.True(t, receiveType(c1, RespGameState, time.Second), "original client should receive state")
+
+	replacement := newTestClient("player1")
+	replacement.player = c1.player
+	old, ok := g.SwapClient(replacement)
+	require.True(t, ok)
+	assert.Same(t, c1, old)
+	assert.Equal(t, StatusInGame, replacement.Status())
+
+	require.True(t, receiveType(replacement, RespGameState, time.Second), "replacement should receive state")
+
+	// Nothing further should be delivered to the replaced connection
+	for len(c1.send) > 0 {
+		<-c1.send
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, c1.send)
+
+	// A stale remove from the old connection must not drop the player
+	c1.cancel()
+	g.Remove() <- c1
+	assert.Equal(t, 2, g.clientCount())
+	assert.NoError(t, g.ctx.Err())
+
+	g.Remove() <- replacement
+	assert.True(t, receiveType(c2, RespRoundResult, time.Second))
+}
+
+func TestTimeTrialSinglePlayer(t *testing.T) {
+	results := NewResultStore()
+	g := NewTimeTrialGame(5*time.Millisecond, 50*time.Millisecond, results)
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c := newTestClient("player1")
+	g.Add() <- c
+
+	require.True(t, receiveType(c, RespGameState, time.Second), "time trial should start with one player")
+	g.UpdatePlayer(c.player, PlayerUpdateRequest{Level: 4})
+
+	// The best is sent by the broadcaster as the listener fans out the
+	// result, so the two may arrive in either order
+	seen := make(map[MessageType]bool)
+	require.True(t, waitFor(time.Second, func() bool {
+		for len(c.send) > 0 {
+			var base BaseMessage
+			require.NoError(t, json.Unmarshal(<-c.send, &base))
+			seen[base.Type] = true
+		}
+		return seen[RespRoundResult] && seen[RespPersonalBest]
+	}), "time trial should complete and the player should be told their best")
+
+	best, ok := results.GetPersonalBest("player1")
+	require.True(t, ok)
+	assert.Equal(t, 4, best.Level)
+}
+
+func TestResultPolicySkipsGamesWithoutPlay(t *testing.T) {
+	policy := ResultPolicy{MinDuration: 20 * time.Millisecond, RequireProgress: true}
+	assert.True(t, policy.Qualifies(30*time.Millisecond, 2))
+	assert.False(t, policy.Qualifies(10*time.Millisecond, 2), "games shorter than the minimum shouldn't qualify")
+	assert.False(t, policy.Qualifies(30*time.Millisecond, StartingLevel), "games without progress shouldn't qualify")
+	assert.True(t, ResultPolicy{}.Qualifies(0, 0), "the zero policy should record every result")
+
+	play := func(t *testing.T, level int) *ResultStore {
+		results := NewResultStore()
+		g := NewTimeTrialGame(5*time.Millisecond, 50*time.Millisecond, results)
+		g.SetResultPolicy(policy)
+		go g.RunListeners()
+		t.Cleanup(g.Cleanup)
+
+		c := newTestClient("player1")
+		g.Add() <- c
+		require.True(t, receiveType(c, RespGameState, time.Second))
+		if level > StartingLevel {
+			g.UpdatePlayer(c.player, PlayerUpdateRequest{Level: level})
+		}
+		require.True(t, receiveType(c, RespRoundResult, time.Second), "players should get the result either way")
+		return results
+	}
+
+	t.Run("qualifying game", func(t *testing.T) {
+		results := play(t, 3)
+		assert.True(t, waitFor(time.Second, func() bool { return results.Len() == 1 }))
+	})
+
+	t.Run("no progress", func(t *testing.T) {
+		results := play(t, StartingLevel)
+		assert.False(t, waitFor(50*time.Millisecond, func() bool { return results.Len() > 0 }),
+			"a game without progress shouldn't be recorded")
+	})
+}
+
+func TestResultStorePersonalBest(t *testing.T) {
+	results := NewResultStore()
+	player := NewPlayer("player1", "🏴")
+
+	best, isNew := results.RecordPersonalBest(player, 5, time.Now())
+	assert.True(t, isNew)
+	assert.Equal(t, 5, best.Level)
+
+	best, isNew = results.RecordPersonalBest(player, 3, time.Now())
+	assert.False(t, isNew)
+	assert.Equal(t, 5, best.Level)
+
+	best, isNew = results.RecordPersonalBest(player, 7, time.Now())
+	assert.True(t, isNew)
+	assert.Equal(t, 7, best.Level)
+
+	// Authenticated players' bests follow their subject, not their username
+	impostor := NewPlayer("player1", "🏴")
+	impostor.Identity = "subject2"
+	best, isNew = results.RecordPersonalBest(impostor, 2, time.Now())
+	assert.True(t, isNew, "a username shouldn't carry another player's best")
+	assert.Equal(t, 2, best.Level)
+	renamed := NewPlayer("renamed", "🏴")
+	renamed.Identity = "subject2"
+	best, isNew = results.RecordPersonalBest(renamed, 1, time.Now())
+	assert.False(t, isNew)
+	assert.Equal(t, 2, best.Level)
+	best, ok := results.GetPersonalBest("player1")
+	require.True(t, ok)
+	assert.Equal(t, 7, best.Level)
+}
+
+// startRunningGame creates a game with two clients that skips the countdown
+func startRunningGame(t *testing.T, grace time.Duration) (*BaseGame, *Client, *Client) {
+	t.Helper()
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.reconnectGrace = grace
+	g.skipCountdown = true
+	go g.RunListeners()
+	t.Cleanup(g.Cleanup)
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+
+	require.True(t, receiveType(c2, RespGameState, time.Second))
+	return g, c1, c2
+}
+
+func TestReconnectWithinGrace(t *testing.T) {
+	g, c1, c2 := startRunningGame(t, time.Second)
+
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, receiveType(c2, RespGamePaused, time.Second), "remaining player should be told the game is paused")
+
+	player, ok := g.DisconnectedPlayer(c1.player.Id)
+	require.True(t, ok)
+	assert.False(t, player.Active)
+
+	// The broadcaster should be frozen while paused
+	time.Sleep(10 * time.Millisecond)
+	for len(c2.send) > 0 {
+		<-c2.send
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, c2.send, "no state should be broadcast while paused")
+
+	replacement := newTestClient("player1")
+	replacement.player = player
+	require.NoError(t, g.Reconnect(replacement))
+
+	assert.True(t, receiveType(c2, RespGameResumed, time.Second), "remaining player should be told the game resumed")
+	assert.True(t, receiveType(replacement, RespGameState, time.Second), "reconnected player should receive state")
+	assert.NoError(t, g.ctx.Err())
+	assert.True(t, player.Active)
+}
+
+func TestFindDisconnectedRequiresToken(t *testing.T) {
+	g, c1, c2 := startRunningGame(t, time.Second)
+	mm := NewMatchmaker(ServerTickrate)
+	mm.headToHeadGames.Set(g.GetID(), g)
+
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, receiveType(c2, RespGamePaused, time.Second))
+
+	// Opponents see the player's id, but not their reconnect token
+	for _, token := range []string{"", c2.player.ReconnectToken, c1.player.ReconnectToken[1:]} {
+		_, _, ok := mm.FindDisconnected(c1.player.Id, token)
+		assert.False(t, ok, "token %q shouldn't reclaim the player", token)
+	}
+	game, player, ok := mm.FindDisconnected(c1.player.Id, c1.player.ReconnectToken)
+	require.True(t, ok)
+	assert.Equal(t, Game(g), game)
+	assert.Equal(t, c1.player, player)
+}
+
+func TestReconnectGraceExpires(t *testing.T) {
+	g, c1, c2 := startRunningGame(t, 20*time.Millisecond)
+
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, receiveType(c2, RespGamePaused, time.Second))
+	<-g.ctx.Done()
+	result, ok := lastRoundResult(t, c2)
+	require.True(t, ok, "the remaining player should win once the grace period expires")
+	require.Len(t, result.PlayerScores, 2)
+	assert.Equal(t, "player2", result.PlayerScores[0].Username)
+	assert.True(t, result.PlayerScores[0].IsWinner)
+	assert.Equal(t, "player1", result.PlayerScores[1].Username)
+	assert.True(t, result.PlayerScores[1].Forfeited)
+
+	replacement := newTestClient("player1")
+	replacement.player = c1.player
+	assert.Error(t, g.Reconnect(replacement))
+}
+
+func TestTryAdd(t *testing.T) {
+	t.Run("running game", func(t *testing.T) {
+		g := NewGame(ModeSprint, ServerTickrate)
+		go g.RunListeners()
+		defer g.Cleanup()
+
+		c := newTestClient("player1")
+		require.NoError(t, g.TryAdd(c))
+		assert.True(t, waitFor(time.Second, func() bool { return g.PlayerConnected(c.player.Id) }))
+	})
+
+	t.Run("closed game", func(t *testing.T) {
+		g := NewGame(ModeSprint, ServerTickrate)
+		exited := make(chan struct{})
+		go func() {
+			g.RunListeners()
+			close(exited)
+		}()
+		g.Cleanup()
+		<-exited
+
+		errs := make(chan error, 1)
+		go func() { errs <- g.TryAdd(newTestClient("player1")) }()
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrGameClosed)
+		case <-time.After(time.Second):
+			t.Fatal("adding to a closed game blocked")
+		}
+	})
+}
+
+func TestGamePhase(t *testing.T) {
+	// phaseOf returns the phase carried by a state message
+	phaseOf := func(t *testing.T, data []byte) GamePhase {
+		t.Helper()
+		var msg struct {
+			Type    MessageType `json:"messageType"`
+			Payload struct {
+				Phase GamePhase `json:"phase"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(data, &msg))
+		require.Equal(t, RespGameState, msg.Type)
+		return msg.Payload.Phase
+	}
+
+	const target = 2
+	g := NewRaceGame(5*time.Millisecond, target).(*RaceGame)
+	g.skipCountdown = true
+	assert.Equal(t, PhaseCountdown, g.State.GetPhase(), "games start counting down")
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c1.send = make(chan []byte, 4096)
+	g.Add() <- c1
+	g.Add() <- newTestClient("player2")
+
+	// Collect the phase of every state until the round result
+	var phases []GamePhase
+	deadline := time.After(time.Second)
+	for ended := false; !ended; {
+		select {
+		case data := <-c1.send:
+			var base BaseMessage
+			require.NoError(t, json.Unmarshal(data, &base))
+			switch base.Type {
+			case RespGameState:
+				phases = append(phases, phaseOf(t, data))
+				if len(phases) == 3 {
+					g.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: target + 1})
+				}
+			case RespBatch:
+				var batch BatchResponse
+				require.NoError(t, json.Unmarshal(base.Payload, &batch))
+				phases = append(phases, phaseOf(t, batch.Messages[len(batch.Messages)-1]))
+			case RespRoundResult:
+				ended = true
+			}
+		case <-deadline:
+			t.Fatal("round did not end")
+		}
+	}
+
+	require.GreaterOrEqual(t, len(phases), 4)
+	for _, phase := range phases[:len(phases)-1] {
+		assert.Equal(t, PhaseRunning, phase, "states broadcast during the round should be running")
+	}
+	assert.Equal(t, PhaseEnded, phases[len(phases)-1], "the final state should be sent as ended")
+
+	require.True(t, g.Resync(c1))
+	assert.Equal(t, PhaseEnded, phaseOf(t, <-c1.send), "resyncing after the round should report it ended")
+}
+
+func TestGamePhaseEndedWithoutResult(t *testing.T) {
+	// latestPhase returns the phase of the game's latest state
+	latestPhase := func(t *testing.T, g *BaseGame) GamePhase {
+		t.Helper()
+		var msg struct {
+			Payload struct {
+				Phase GamePhase `json:"phase"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(*g.latestState.Load(), &msg))
+		return msg.Payload.Phase
+	}
+
+	t.Run("grace expired", func(t *testing.T) {
+		g, c1, _ := startRunningGame(t, 20*time.Millisecond)
+		c1.cancel()
+		g.Remove() <- c1
+		require.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+		require.True(t, waitFor(time.Second, func() bool { return latestPhase(t, g) == PhaseEnded }))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		g, _, _ := startRunningGame(t, time.Second)
+		assert.Equal(t, PhaseRunning, latestPhase(t, g))
+		g.Cancel()
+		require.True(t, waitFor(time.Second, func() bool { return latestPhase(t, g) == PhaseEnded }))
+	})
+}
+
+func TestGameStartedSentOnce(t *testing.T) {
+	g := NewRaceGame(5*time.Millisecond, 4).(*RaceGame)
+	g.skipCountdown = true
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 0 }))
+
+	// Players arriving after the transition mustn't re-trigger it
+	late := newTestClient("player3")
+	g.Add() <- late
+	require.True(t, receiveType(late, RespJoinRunningGame, time.Second))
+
+	require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 5 }))
+
+	var types []MessageType
+	var started struct {
+		GameID    string   `json:"game_id"`
+		StartTime int64    `json:"start_time_ms"`
+		Mode      GameMode `json:"game_mode"`
+		Params    struct {
+			LevelTarget int `json:"level_target"`
+		} `json:"params"`
+	}
+	for len(c1.send) > 0 {
+		var msg struct {
+			Type    MessageType     `json:"messageType"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(<-c1.send, &msg))
+		types = append(types, msg.Type)
+		if msg.Type == RespGameStarted {
+			require.NoError(t, json.Unmarshal(msg.Payload, &started))
+		}
+	}
+
+	count := 0
+	for _, msgType := range types {
+		if msgType == RespGameStarted {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count, "game started should be sent exactly once")
+	assert.Equal(t, RespGameStarted, types[0], "game started should precede state updates")
+	assert.Equal(t, g.GetID(), started.GameID)
+	assert.Equal(t, ModeRace, started.Mode)
+	assert.Equal(t, 4, started.Params.LevelTarget)
+	assert.NotZero(t, started.StartTime)
+}
+
+func TestStartTimeConsistent(t *testing.T) {
+	games := map[string]func() Game{
+		"race":   func() Game { return NewRaceGame(5*time.Millisecond, 4) },
+		"sprint": func() Game { return NewSprintGame(5*time.Millisecond, time.Minute) },
+		"hybrid": func() Game { return NewHybridGame(5*time.Millisecond, 4, time.Minute) },
+	}
+	for name, newGame := range games {
+		t.Run(name, func(t *testing.T) {
+			g := newGame()
+			g.SetCountdown(10*time.Millisecond, 10*time.Millisecond)
+			go g.RunListeners()
+			defer g.Cleanup()
+
+			c1 := newTestClient("player1")
+			c2 := newTestClient("player2")
+			g.Add() <- c1
+			g.Add() <- c2
+			require.True(t, waitFor(time.Second, func() bool { return len(c1.send) > 10 }))
+
+			startTimes := make(map[int64]bool)
+			states := 0
+			for len(c1.send) > 0 {
+				var msg BaseMessage
+				require.NoError(t, json.Unmarshal(<-c1.send, &msg))
+				if msg.Type != RespGameState && msg.Type != RespGameStarted {
+					continue
+				}
+				if msg.Type == RespGameState {
+					states++
+				}
+				var payload struct {
+					StartTime int64 `json:"start_time_ms"`
+				}
+				require.NoError(t, json.Unmarshal(msg.Payload, &payload))
+				startTimes[payload.StartTime] = true
+			}
+			require.NotZero(t, states)
+			assert.Len(t, startTimes, 1, "every message should carry the same start time")
+			assert.NotContains(t, startTimes, int64(0))
+		})
+	}
+}
+
+func TestPlayersSpawnOnFirstUpdate(t *testing.T) {
+	g, c1, _ := startRunningGame(t, 0)
+
+	// spawned reports whether each player is marked spawned in a state update, by username
+	spawned := func(state *GameState) map[string]bool {
+		msg, err := state.AsUpdateMessage()
+		require.NoError(t, err)
+		var update struct {
+			Payload struct {
+				Players []*Player `json:"players"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(msg, &update))
+		spawned := make(map[string]bool)
+		for _, p := range update.Payload.Players {
+			spawned[p.Username] = p.Spawned
+		}
+		return spawned
+	}
+
+	assert.Equal(t, map[string]bool{"player1": false, "player2": false}, spawned(g.State),
+		"players shouldn't be spawned before their first update")
+	g.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: 1, Position: Position{X: 1, Y: 2}})
+	assert.Equal(t, map[string]bool{"player1": true, "player2": false}, spawned(g.State))
+
+	// Entering another game leaves the player unspawned until they update again
+	next := NewRaceGame(5*time.Millisecond, 4).(*RaceGame)
+	go next.RunListeners()
+	defer next.Cleanup()
+	next.Add() <- c1
+	require.True(t, waitFor(time.Second, func() bool { return next.State.Players.Len() == 1 }))
+	assert.Equal(t, map[string]bool{"player1": false}, spawned(next.State))
+}
+
+func TestSpawnPositionsAssignedAtStart(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	layout, err := ParseMazeLayout("5x5:gAAAAA")
+	require.NoError(t, err)
+	g.SetLayout(layout)
+	g.skipCountdown = true
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+
+	var initial struct {
+		Payload struct {
+			Spawns  map[string]Position `json:"spawns"`
+			Players []*Player           `json:"players"`
+		} `json:"payload"`
+	}
+	for initial.Payload.Spawns == nil {
+		select {
+		case raw := <-c1.send:
+			var msg BaseMessage
+			require.NoError(t, json.Unmarshal(raw, &msg))
+			if msg.Type == RespGameState {
+				require.NoError(t, json.Unmarshal(raw, &initial))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("didn't receive the initial state")
+		}
+	}
+
+	spawns := initial.Payload.Spawns
+	require.Len(t, spawns, 2, "every player should be given a spawn")
+	for _, p := range initial.Payload.Players {
+		assert.Equal(t, spawns[p.Id], p.Position, "players should start at their spawn")
+	}
+	first, second := spawns[c1.player.Id], spawns[c2.player.Id]
+	assert.NotEqual(t, first, second, "players should have distinct spawns")
+	assert.Equal(t, first.Y, second.Y)
+	assert.Equal(t, 3.0, first.X+second.X, "spawns should be symmetric about the start cell")
+
+	update, err := g.State.AsUpdateMessage()
+	require.NoError(t, err)
+	assert.NotContains(t, string(update), "spawns", "spawns are only sent with the initial state")
+}
+
+func TestBackfillIntoRunningGame(t *testing.T) {
+	g := NewRaceGame(5*time.Millisecond, 3).(*RaceGame)
+	g.skipCountdown = true
+	g.SetBackfill(BackfillConfig{MaxPlayers: 3, Window: time.Second, SpawnAtLeader: true})
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	require.True(t, receiveType(c1, RespGameState, time.Second))
+	g.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: 2})
+
+	c3 := newTestClient("player3")
+	assert.True(t, g.CanBackfill())
+	g.Add() <- c3
+	require.True(t, receiveType(c3, RespGameStarted, time.Second), "backfilled player should be told the game started")
+	require.True(t, receiveType(c3, RespGameState, time.Second), "backfilled player should receive state")
+	assert.Equal(t, 2, c3.player.Level, "backfilled player should spawn at the leader's level")
+	assert.Equal(t, StatusInGame, c3.Status())
+
+	// The game is now full
+	assert.False(t, g.CanBackfill())
+	c4 := newTestClient("player4")
+	g.Add() <- c4
+	assert.True(t, receiveType(c4, RespJoinRunningGame, time.Second))
+
+	g.UpdatePlayer(c3.player, PlayerUpdateRequest{Level: 4})
+	var result RoundResult
+	require.True(t, waitFor(time.Second, func() bool {
+		var ok bool
+		result, ok = lastRoundResult(t, c3)
+		return ok
+	}), "backfilled player should receive the round result")
+	require.Len(t, result.PlayerScores, 3)
+	assert.Equal(t, "player3", result.PlayerScores[0].Username)
+	assert.True(t, result.PlayerScores[0].IsWinner)
+}
+
+func TestBackfillWindowCloses(t *testing.T) {
+	g, _, _ := startRunningGame(t, 0)
+	g.SetBackfill(BackfillConfig{MaxPlayers: 3, Window: 20 * time.Millisecond})
+	assert.True(t, g.CanBackfill())
+
+	require.True(t, waitFor(time.Second, func() bool { return !g.CanBackfill() }))
+	late := newTestClient("player3")
+	g.Add() <- late
+	assert.True(t, receiveType(late, RespJoinRunningGame, time.Second))
+}
+
+func TestMinPlayersToStart(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.skipCountdown = true
+	g.minPlayersToStart = 3
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	assert.False(t, receiveType(c1, RespGameStarted, 20*time.Millisecond), "game shouldn't start below the start threshold")
+
+	g.Add() <- newTestClient("player3")
+	assert.True(t, receiveType(c1, RespGameStarted, time.Second))
+}
+
+func TestLobbyFillTimeout(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGame(ModeSprint, time.Second)
+	g.clock = clock
+	g.skipCountdown = true
+	g.SetLobby(LobbyConfig{MaxPlayers: 4, FillTimeout: 10 * time.Second})
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	clock.BlockUntil(t, 1)
+	assert.True(t, g.CanJoinLobby())
+	assert.False(t, receiveType(c1, RespGameStarted, 20*time.Millisecond), "the lobby should wait for more players")
+
+	// A third player arriving in time joins the lobby
+	clock.Advance(5 * time.Second)
+	c3 := newTestClient("player3")
+	g.Add() <- c3
+	assert.False(t, receiveType(c1, RespGameStarted, 20*time.Millisecond))
+
+	clock.Advance(5 * time.Second)
+	require.True(t, receiveType(c1, RespGameStarted, time.Second), "the game should start once the lobby times out")
+	assert.True(t, receiveType(c3, RespGameStarted, time.Second))
+	assert.False(t, g.CanJoinLobby())
+
+	// but a fourth after the start is refused
+	c4 := newTestClient("player4")
+	g.Add() <- c4
+	assert.True(t, receiveType(c4, RespJoinRunningGame, time.Second))
+	assert.Equal(t, 3, g.clientCount())
+}
+
+func TestLastPlayerStandingWins(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.skipCountdown = true
+	g.reconnectGrace = 0
+	g.minPlayersToContinue = 1
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	require.True(t, receiveType(c2, RespGameState, time.Second))
+
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+
+	result, ok := lastRoundResult(t, c2)
+	require.True(t, ok, "remaining player should receive a result rather than a cancellation")
+	require.Len(t, result.PlayerScores, 2)
+	assert.Equal(t, "player2", result.PlayerScores[0].Username)
+	assert.True(t, result.PlayerScores[0].IsWinner)
+	assert.True(t, result.PlayerScores[1].Forfeited)
+}
+
+func TestOpponentLeavingAwardsWin(t *testing.T) {
+	g, c1, c2 := startRunningGame(t, 0)
+
+	// The leaver was ahead, but forfeits by leaving
+	g.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: 5})
+	g.UpdatePlayer(c2.player, PlayerUpdateRequest{Level: 2})
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+
+	result, ok := lastRoundResult(t, c2)
+	require.True(t, ok, "remaining player should receive a win rather than a cancellation")
+	require.Len(t, result.PlayerScores, 2)
+	winner, leaver := result.PlayerScores[0], result.PlayerScores[1]
+	assert.Equal(t, "player2", winner.Username)
+	assert.True(t, winner.IsWinner)
+	assert.False(t, winner.Forfeited)
+	assert.Equal(t, "player1", leaver.Username)
+	assert.False(t, leaver.IsWinner)
+	assert.True(t, leaver.Forfeited)
+	assert.Equal(t, 5, leaver.Level)
+}
+
+func TestGameEndedReturnsPlayersToLobby(t *testing.T) {
+	g, c1, c2 := startRunningGame(t, 0)
+
+	c1.cancel()
+	g.Remove() <- c1
+	require.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+
+	var types []MessageType
+	var ended GameEndedResponse
+	for len(c2.send) > 0 {
+		var msg struct {
+			Type    MessageType     `json:"messageType"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(<-c2.send, &msg))
+		types = append(types, msg.Type)
+		if msg.Type == RespGameEnded {
+			require.NoError(t, json.Unmarshal(msg.Payload, &ended))
+		}
+	}
+	require.NotEmpty(t, types)
+	assert.Equal(t, RespGameEnded, types[len(types)-1], "game ended should be the last message from the game")
+	assert.Contains(t, types, RespRoundResult, "game ended is sent as well as the result")
+	assert.Equal(t, g.GetID(), ended.GameID)
+	assert.Equal(t, StatusIdle, ended.Status)
+	assert.Equal(t, StatusIdle, c2.Status())
+	assert.Nil(t, c2.activeGame)
+}
+
+func TestMaxResultPlayers(t *testing.T) {
+	g := NewGame(ModeSprint, ServerTickrate)
+	defer g.Cleanup()
+	g.SetMaxResultPlayers(1)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	c1.player.Level = 3
+	for _, c := range []*Client{c1, c2} {
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+		g.State.Players.Set(c.player.Id, c.player)
+	}
+
+	require.NoError(t, g.sendResult(g.State.GetRoundResult()))
+	result, ok := lastRoundResult(t, c2)
+	require.True(t, ok)
+	require.Len(t, result.PlayerScores, 1)
+	assert.Equal(t, "player1", result.PlayerScores[0].Username)
+	assert.Equal(t, 2, result.TotalPlayers)
+	assert.Equal(t, 2, result.Placements[c2.player.Id], "players outside the top should still get their placement")
+}
+
+func TestAFKPlayerKicked(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.skipCountdown = true
+	g.SetAFKTimeout(50 * time.Millisecond)
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	active := newTestClient("player1")
+	idle := newTestClient("player2")
+	g.Add() <- active
+	g.Add() <- idle
+	require.True(t, receiveType(idle, RespGameState, time.Second))
+
+	// Only one player keeps playing
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for level := 1; ; level++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				g.UpdatePlayer(active.player, PlayerUpdateRequest{Level: min(level, 3)})
+			}
+		}
+	}()
+
+	require.True(t, receiveType(idle, RespKickedAFK, time.Second), "idle player should be kicked")
+	assert.Equal(t, StatusIdle, idle.Status())
+	assert.Nil(t, idle.activeGame)
+
+	// Being kicked is a forfeit
+	require.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+	result, ok := lastRoundResult(t, active)
+	require.True(t, ok, "active player should be awarded the win")
+	require.Len(t, result.PlayerScores, 2)
+	assert.Equal(t, "player1", result.PlayerScores[0].Username)
+	assert.True(t, result.PlayerScores[0].IsWinner)
+	assert.Equal(t, "player2", result.PlayerScores[1].Username)
+	assert.True(t, result.PlayerScores[1].Forfeited)
+}
+
+func TestAFKPlayerWithFullBufferKicked(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	defer g.Cleanup()
+	clients := []*Client{newTestClient("player1"), newTestClient("player2"), newTestClient("player3")}
+	for _, c := range clients {
+		c.activeGame = g
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+		g.State.Players.Set(c.player.Id, c.player)
+	}
+	// An idle player's client has often stopped reading
+	idle := clients[0]
+	for len(idle.send) < cap(idle.send) {
+		idle.send <- []byte("{}")
+	}
+
+	done := make(chan bool)
+	go func() { done <- g.kickAFK(idle) }()
+	select {
+	case ended := <-done:
+		assert.False(t, ended, "two players remain")
+	case <-time.After(time.Second):
+		t.Fatal("kicking a player who isn't reading shouldn't stall the game")
+	}
+	assert.False(t, g.PlayerConnected(idle.player.Id))
+	assert.Equal(t, StatusIdle, idle.Status())
+}
+
+func TestBelowContinueThresholdCancels(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.skipCountdown = true
+	g.reconnectGrace = 0
+	g.minPlayersToStart = 3
+	g.minPlayersToContinue = 3
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	clients := []*Client{newTestClient("player1"), newTestClient("player2"), newTestClient("player3")}
+	for _, c := range clients {
+		g.Add() <- c
+	}
+	require.True(t, receiveType(clients[2], RespGameState, time.Second))
+
+	clients[0].cancel()
+	g.Remove() <- clients[0]
+	assert.True(t, receiveType(clients[1], RespGameCancelled, time.Second))
+}
+
+func TestCountdownResetsCarriedOverPlayers(t *testing.T) {
+	g := NewGame(ModeSprint, 5*time.Millisecond)
+	g.skipCountdown = true
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	// As if carried over from a finished game
+	c1 := newTestClient("player1")
+	c1.player.Level = 4
+	c1.player.Splits = []LevelSplit{{Level: 2, ReachedAt: 100}}
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+
+	require.True(t, receiveType(c1, RespGameState, time.Second))
+	assert.Equal(t, StartingLevel, c1.player.Level)
+	assert.Empty(t, c1.player.Splits)
+}
+
+func TestSurrenderVote(t *testing.T) {
+	start := func(t *testing.T, players int) (*BaseGame, []*Client) {
+		g := NewGame(ModeSprint, 5*time.Millisecond)
+		g.skipCountdown = true
+		g.reconnectGrace = 0
+		g.minPlayersToStart = players
+		go g.RunListeners()
+		t.Cleanup(g.Cleanup)
+
+		clients := make([]*Client, players)
+		for i := range clients {
+			clients[i] = newTestClient("player" + strconv.Itoa(i+1))
+			g.Add() <- clients[i]
+		}
+		require.True(t, receiveType(clients[players-1], RespGameState, time.Second))
+		return g, clients
+	}
+	// tally waits for the next surrender vote tally sent to a client
+	tally := func(t *testing.T, c *Client) SurrenderVoteResponse {
+		t.Helper()
+		deadline := time.After(time.Second)
+		for {
+			select {
+			case msg := <-c.send:
+				var base BaseMessage
+				require.NoError(t, json.Unmarshal(msg, &base))
+				if base.Type == RespSurrenderVote {
+					var resp SurrenderVoteResponse
+					require.NoError(t, json.Unmarshal(base.Payload, &resp))
+					return resp
+				}
+			case <-deadline:
+				t.Fatal("no surrender vote tally received")
+			}
+		}
+	}
+	leave := func(g *BaseGame, c *Client) {
+		c.cancel()
+		g.Remove() <- c
+	}
+
+	t.Run("majority ends the game", func(t *testing.T) {
+		g, clients := start(t, 4)
+		g.UpdatePlayer(clients[3].player, PlayerUpdateRequest{Level: 3})
+
+		g.VoteSurrender(clients[0])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 1, Needed: 3, Players: 4}, tally(t, clients[3]))
+		g.VoteSurrender(clients[0])
+		g.VoteSurrender(clients[1])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 2, Needed: 3, Players: 4}, tally(t, clients[3]), "repeat votes shouldn't be counted")
+		g.VoteSurrender(clients[2])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 3, Needed: 3, Players: 4}, tally(t, clients[3]))
+
+		var result RoundResult
+		require.True(t, waitFor(time.Second, func() bool {
+			var ok bool
+			result, ok = lastRoundResult(t, clients[0])
+			return ok
+		}), "the game should end with the current standings")
+		assert.Equal(t, "player4", result.PlayerScores[0].Username)
+		assert.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+	})
+
+	t.Run("without a majority the game continues", func(t *testing.T) {
+		g, clients := start(t, 4)
+		g.VoteSurrender(clients[0])
+		g.VoteSurrender(clients[1])
+		tally(t, clients[2])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 2, Needed: 3, Players: 4}, tally(t, clients[2]))
+		assert.True(t, receiveType(clients[2], RespGameState, time.Second))
+		assert.NoError(t, g.Context().Err())
+	})
+
+	t.Run("voter leaving", func(t *testing.T) {
+		g, clients := start(t, 4)
+		g.VoteSurrender(clients[0])
+		g.VoteSurrender(clients[1])
+		tally(t, clients[3])
+		tally(t, clients[3])
+		leave(g, clients[0])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 1, Needed: 2, Players: 3}, tally(t, clients[3]), "the leaver's vote should be discarded")
+		assert.NoError(t, g.Context().Err())
+	})
+
+	t.Run("non-voter leaving", func(t *testing.T) {
+		g, clients := start(t, 4)
+		g.VoteSurrender(clients[0])
+		g.VoteSurrender(clients[1])
+		tally(t, clients[2])
+		tally(t, clients[2])
+		leave(g, clients[3])
+		assert.Equal(t, SurrenderVoteResponse{Votes: 2, Needed: 2, Players: 3}, tally(t, clients[2]), "fewer votes are needed once a player leaves")
+		assert.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+	})
+
+	t.Run("head-to-head games", func(t *testing.T) {
+		g, clients := start(t, 2)
+		g.VoteSurrender(clients[0])
+		assert.True(t, receiveType(clients[0], RespError, time.Second))
+		assert.NoError(t, g.Context().Err())
+	})
+}
+
+func TestResyncSendsLatestState(t *testing.T) {
+	// Slow enough that only the initial state is broadcast during the test
+	g := NewGame(ModeSprint, time.Hour)
+	g.skipCountdown = true
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	assert.False(t, g.Resync(c1), "there's no state to resync before the game starts")
+	g.Add() <- c1
+	g.Add() <- c2
+	require.True(t, receiveType(c1, RespGameState, time.Second))
+	for len(c1.send) > 0 {
+		<-c1.send
+	}
+	require.True(t, waitFor(time.Second, func() bool { return len(c2.send) == 2 }))
+
+	c1.HandleResync()
+	select {
+	case frame := <-c1.send:
+		var msg struct {
+			Type    MessageType `json:"messageType"`
+			Payload struct {
+				Id      string   `json:"id"`
+				Players []Player `json:"players"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(frame, &msg))
+		assert.Equal(t, RespGameState, msg.Type)
+		assert.Equal(t, g.State.Id, msg.Payload.Id)
+		assert.Len(t, msg.Payload.Players, 2)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("resync should send a state frame immediately")
+	}
+	assert.Len(t, c2.send, 2, "only the requesting client should be resynced")
+
+	// Clients outside the game can't resync from it
+	assert.False(t, g.Resync(newTestClient("stranger")))
+}
+
+func TestSetReadyTransitions(t *testing.T) {
+	g := NewGame(ModeSprint, ServerTickrate)
+	defer g.Cleanup()
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		c.SetStatus(StatusConfirming)
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+
+	roster := func(c *Client) map[string]bool {
+		t.Helper()
+		var msg struct {
+			Type    MessageType         `json:"messageType"`
+			Payload ReadyRosterResponse `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(<-c.send, &msg))
+		require.Equal(t, RespReadyRoster, msg.Type)
+		return msg.Payload.Players
+	}
+
+	g.SetReady(c1, true)
+	assert.Equal(t, StatusReady, c1.Status())
+	want := map[string]bool{c1.player.Id: true, c2.player.Id: false}
+	assert.Equal(t, want, roster(c1))
+	assert.Equal(t, want, roster(c2))
+
+	g.SetReady(c1, false)
+	assert.Equal(t, StatusConfirming, c1.Status())
+	want = map[string]bool{c1.player.Id: false, c2.player.Id: false}
+	assert.Equal(t, want, roster(c1))
+	assert.Equal(t, want, roster(c2))
+
+	// Readiness can't be changed once the game is underway
+	c2.SetStatus(StatusInGame)
+	g.SetReady(c2, false)
+	assert.Equal(t, StatusInGame, c2.Status())
+	assert.Len(t, c1.send, 0, "no roster should be sent")
+}
+
+func TestEnterGameBeforeReady(t *testing.T) {
+	// start runs the countdown of a game requiring players to enter it
+	start := func(t *testing.T, players int) (*BaseGame, *fakeClock, []*Client) {
+		clock := newFakeClock()
+		g := NewGame(ModeSprint, ServerTickrate)
+		g.clock = clock
+		g.SetCountdown(30*time.Second, 5*time.Second)
+		g.SetRequireEnter(true)
+		// Every player is in the game when the countdown starts, after which
+		// two are enough to play
+		g.minPlayersToStart = players
+		go g.RunListeners()
+		t.Cleanup(g.Cleanup)
+
+		clients := make([]*Client, players)
+		for i := range clients {
+			clients[i] = newTestClient("player" + strconv.Itoa(i+1))
+			clients[i].send = make(chan []byte, 4096)
+			g.Add() <- clients[i]
+		}
+		clock.BlockUntil(t, 1)
+		g.minPlayersToStart = 2
+		for _, c := range clients {
+			var msg struct {
+				Type    MessageType           `json:"messageType"`
+				Payload GameConfirmedResponse `json:"payload"`
+			}
+			require.NoError(t, json.Unmarshal(<-c.send, &msg))
+			require.Equal(t, RespGameConfirmed, msg.Type)
+			assert.True(t, msg.Payload.RequireEnter, "players should be told to enter the game")
+		}
+		return g, clock, clients
+	}
+	// tick advances the countdown a second
+	tick := func(t *testing.T, clock *fakeClock, c *Client) {
+		t.Helper()
+		clock.Advance(time.Second)
+		require.True(t, receiveType(c, RespSecondsToNextRoundStart, time.Second))
+	}
+
+	t.Run("enter, ready and start", func(t *testing.T) {
+		g, clock, clients := start(t, 2)
+		c1, c2 := clients[0], clients[1]
+
+		g.SetReady(c1, true)
+		assert.Equal(t, StatusConfirming, c1.Status(), "players must enter before readying up")
+
+		g.EnterGame(c1)
+		assert.Equal(t, StatusEntered, c1.Status())
+		var msg struct {
+			Type    MessageType         `json:"messageType"`
+			Payload ReadyRosterResponse `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(<-c2.send, &msg))
+		require.Equal(t, RespReadyRoster, msg.Type)
+		assert.Equal(t, map[string]bool{c1.player.Id: true, c2.player.Id: false}, msg.Payload.Entered)
+		g.EnterGame(c2)
+
+		g.SetReady(c1, true)
+		g.SetReady(c2, true)
+		assert.Equal(t, StatusReady, c2.Status())
+		g.SetReady(c2, false)
+		assert.Equal(t, StatusEntered, c2.Status(), "unreadying should leave the player entered")
+		g.SetReady(c2, true)
+
+		// The countdown shortens to 5 seconds once everyone is ready
+		for range 6 {
+			tick(t, clock, c1)
+		}
+		assert.True(t, receiveType(c1, RespGameStarted, time.Second))
+		assert.Equal(t, StatusInGame, c2.Status())
+		assert.Equal(t, 2, g.GetPlayerCount())
+	})
+
+	t.Run("entered but never ready", func(t *testing.T) {
+		g, clock, clients := start(t, 2)
+		c1, c2 := clients[0], clients[1]
+		g.EnterGame(c1)
+		g.SetReady(c1, true)
+		g.EnterGame(c2)
+
+		for range 30 {
+			tick(t, clock, c1)
+		}
+		assert.True(t, receiveType(c2, RespNotReady, time.Second), "the unready player should be dropped")
+		assert.Equal(t, StatusIdle, c2.Status())
+		assert.Nil(t, c2.activeGame)
+		assert.True(t, receiveType(c1, RespGameCancelled, time.Second), "too few players are left to start")
+		assert.True(t, waitFor(time.Second, func() bool { return g.Context().Err() != nil }))
+	})
+
+	t.Run("enough players ready", func(t *testing.T) {
+		g, clock, clients := start(t, 3)
+		for _, c := range clients[:2] {
+			g.EnterGame(c)
+			g.SetReady(c, true)
+		}
+
+		for range 30 {
+			tick(t, clock, clients[0])
+		}
+		assert.True(t, receiveType(clients[2], RespNotReady, time.Second))
+		assert.True(t, receiveType(clients[0], RespGameStarted, time.Second), "the ready players should still play")
+		assert.Equal(t, 2, g.GetPlayerCount())
+	})
+}
+
+func TestReconnectDuringCountdown(t *testing.T) {
+	// start runs the countdown of a game holding slots open for a while
+	start := func(t *testing.T) (*BaseGame, *fakeClock, *Client, *Client) {
+		clock := newFakeClock()
+		g := NewGame(ModeSprint, ServerTickrate)
+		g.clock = clock
+		g.reconnectGrace = 10 * time.Second
+		g.SetCountdown(5*time.Second, 3*time.Second)
+		go g.RunListeners()
+		t.Cleanup(g.Cleanup)
+
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		g.Add() <- c1
+		g.Add() <- c2
+		clock.BlockUntil(t, 1)
+		require.True(t, receiveType(c1, RespGameConfirmed, time.Second))
+		require.True(t, receiveType(c2, RespGameConfirmed, time.Second))
+
+		c1.cancel()
+		g.Remove() <- c1
+		require.True(t, receiveType(c2, RespGamePaused, time.Second), "the remaining player should be told the countdown is paused")
+		clock.BlockUntil(t, 2)
+		return g, clock, c1, c2
+	}
+	// secondsLeft returns the next countdown value sent to a player
+	secondsLeft := func(t *testing.T, c *Client) float64 {
+		t.Helper()
+		for {
+			select {
+			case data := <-c.send:
+				var msg struct {
+					Type    MessageType `json:"messageType"`
+					Payload float64     `json:"payload"`
+				}
+				require.NoError(t, json.Unmarshal(data, &msg))
+				if msg.Type == RespSecondsToNextRoundStart {
+					return msg.Payload
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no countdown update received")
+			}
+		}
+	}
+
+	t.Run("reconnect resumes", func(t *testing.T) {
+		g, clock, c1, c2 := start(t)
+
+		clock.Advance(time.Second)
+		clock.Advance(time.Second)
+		assert.False(t, receiveType(c2, RespSecondsToNextRoundStart, 20*time.Millisecond),
+			"the countdown shouldn't progress while paused")
+
+		player, ok := g.DisconnectedPlayer(c1.player.Id)
+		require.True(t, ok, "the dropped player's slot should be held")
+		replacement := newTestClient("player1")
+		replacement.player = player
+		require.NoError(t, g.Reconnect(replacement))
+		require.True(t, receiveType(replacement, RespGameConfirmed, time.Second), "the reconnected player should be sent the game again")
+		require.True(t, receiveType(c2, RespGameResumed, time.Second))
+		assert.Equal(t, StatusConfirming, replacement.Status())
+
+		clock.Advance(time.Second)
+		assert.Equal(t, 4.0, secondsLeft(t, c2), "the countdown should resume where it paused")
+		for range 4 {
+			clock.Advance(time.Second)
+			secondsLeft(t, c2)
+		}
+		assert.True(t, receiveType(replacement, RespGameStarted, time.Second))
+		assert.NoError(t, g.ctx.Err())
+	})
+
+	t.Run("grace expires", func(t *testing.T) {
+		g, clock, c1, c2 := start(t)
+
+		clock.Advance(10 * time.Second)
+		assert.True(t, receiveType(c2, RespGameCancelled, time.Second), "the pairing is abandoned once the grace period expires")
+		<-g.ctx.Done()
+
+		replacement := newTestClient("player1")
+		replacement.player = c1.player
+		assert.Error(t, g.Reconnect(replacement))
+	})
+}
+
+func TestNewModeGameRejectsInvalidTimers(t *testing.T) {
+	valid := GameParams{LevelTarget: RaceLevelTarget, RoundLength: SprintRoundLength}
+	for _, d := range []time.Duration{0, -time.Second} {
+		for _, mode := range gameModes {
+			_, err := NewModeGame(mode, d, valid, nil)
+			assert.ErrorIs(t, err, ErrInvalidDuration, "%v with a tickrate of %v", mode, d)
+		}
+		// The mode constructors can't return an error, so fall back instead
+		for _, base := range []*BaseGame{
+			NewSprintGame(d, SprintRoundLength).(*SprintGame).BaseGame,
+			NewRaceGame(d, RaceLevelTarget).(*RaceGame).BaseGame,
+			NewHybridGame(d, RaceLevelTarget, SprintRoundLength).(*HybridGame).BaseGame,
+		} {
+			assert.Equal(t, ServerTickrate, base.tickrate, "%v with a tickrate of %v", base.GetMode(), d)
+		}
+
+		for _, mode := range []GameMode{ModeSprint, ModeHybrid, ModeTimeTrial} {
+			_, err := NewModeGame(mode, ServerTickrate, GameParams{LevelTarget: RaceLevelTarget, RoundLength: d}, nil)
+			assert.ErrorIs(t, err, ErrInvalidDuration, "%v with a round length of %v", mode, d)
+		}
+		game, err := NewModeGame(ModeRace, ServerTickrate, GameParams{LevelTarget: RaceLevelTarget, RoundLength: d}, nil)
+		require.NoError(t, err, "races aren't timed")
+		game.Cleanup()
+
+		g := NewGame(ModeSprint, ServerTickrate)
+		g.SetCountdown(d, time.Second)
+		g.SetCountdown(time.Minute, d)
+		assert.Equal(t, DefaultCountdown, g.countdown, "a countdown of %v should be refused", d)
+		assert.Equal(t, ReadyCountdown, g.readyCountdown)
+	}
+
+	game, err := NewModeGame(ModeSprint, ServerTickrate, valid, nil)
+	require.NoError(t, err)
+	defer game.Cleanup()
+	assert.Equal(t, SprintRoundLength, game.GetParams().RoundLength)
+	_, err = NewModeGame("unknown", ServerTickrate, valid, nil)
+	assert.Error(t, err)
+}
+
+func TestUnreadyRestoresCountdown(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGame(ModeSprint, ServerTickrate)
+	g.clock = clock
+	g.SetCountdown(30*time.Second, 5*time.Second)
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(g, stop)
+
+	g.StartCountdown()
+	clock.BlockUntil(t, 1)
+
+	// tick advances the countdown a second, returning the seconds remaining
+	tick := func() float64 {
+		t.Helper()
+		clock.Advance(time.Second)
+		for {
+			select {
+			case raw := <-c1.send:
+				var msg BaseMessage
+				require.NoError(t, json.Unmarshal(raw, &msg))
+				if msg.Type == RespSecondsToNextRoundStart {
+					var secs float64
+					require.NoError(t, json.Unmarshal(msg.Payload, &secs))
+					return secs
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no countdown tick")
+			}
+		}
+	}
+
+	assert.Equal(t, 29.0, tick())
+	g.SetReady(c1, true)
+	g.SetReady(c2, true)
+	assert.Equal(t, 5.0, tick(), "countdown should shorten once everyone is ready")
+	assert.Equal(t, 4.0, tick())
+
+	g.SetReady(c2, false)
+	assert.Equal(t, 26.0, tick(), "countdown should be restored when a player unreadies")
+
+	g.SetReady(c2, true)
+	assert.Equal(t, 5.0, tick(), "readying again should shorten the countdown afresh")
+	for range 4 {
+		tick()
+	}
+	assert.Equal(t, 0.0, tick())
+	select {
+	case <-g.countdownDone:
+	case <-time.After(time.Second):
+		t.Fatal("countdown did not finish")
+	}
+}
+
+func TestPracticeLobby(t *testing.T) {
+	mm := NewMatchmaker(5 * time.Millisecond)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	for _, c := range []*Client{c1, c2} {
+		c.mm = mm
+		require.NoError(t, mm.AddToQueue(c, ModePractice))
+		require.True(t, receiveType(c, RespGameStarted, time.Second))
+	}
+	lobby := mm.practice
+	defer lobby.Cleanup()
+	// The initial state assigns spawn points, moving players to them
+	require.True(t, receiveType(c1, RespGameState, time.Second))
+
+	// Players see each other move
+	lobby.UpdatePlayer(c1.player, PlayerUpdateRequest{Level: 2, Position: Position{X: 3, Y: 4}})
+	assert.True(t, waitFor(time.Second, func() bool {
+		var msg struct {
+			Payload struct {
+				Players []Player `json:"players"`
+			} `json:"payload"`
+		}
+		select {
+		case raw := <-c2.send:
+			if json.Unmarshal(raw, &msg) != nil {
+				return false
+			}
+			for _, p := range msg.Payload.Players {
+				if p.Id == c1.player.Id && p.Position == (Position{X: 3, Y: 4}) {
+					return true
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}), "other players should see the update")
+
+	// Leaving, even as the last player, doesn't end the lobby
+	c1.HandleExitGame()
+	assert.True(t, receiveType(c1, RespPlayerExited, time.Second))
+	assert.Equal(t, StatusIdle, c1.Status())
+	lobby.Remove() <- c2
+	assert.True(t, waitFor(time.Second, func() bool { return lobby.(*PracticeGame).clientCount() == 0 }))
+	assert.NoError(t, lobby.Context().Err(), "practice lobby should keep running")
+
+	// and players can hop back in
+	require.NoError(t, mm.AddToQueue(c1, ModePractice))
+	assert.True(t, receiveType(c1, RespGameStarted, time.Second))
+	assert.Same(t, lobby, mm.practice)
+	_, found := lastRoundResult(t, c1)
+	assert.False(t, found, "practice should never send a result")
+}
+
+func TestBroadcastCountsBackpressureDrops(t *testing.T) {
+	g := NewRaceGame(time.Second, RaceLevelTarget).(*RaceGame)
+	defer g.cancel()
+	var drops atomic.Int64
+	g.SetDropCounter(&drops)
+
+	fast := newTestClient("fast")
+	slow := newTestClient("slow")
+	slow.send = make(chan []byte, 1)
+	slow.send <- []byte("backlog")
+	gone := newTestClient("gone")
+	gone.send = make(chan []byte)
+	gone.cancel()
+	for _, c := range []*Client{fast, slow, gone} {
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+
+	g.broadcastMessage([]byte("state"))
+	assert.Equal(t, int64(1), drops.Load(), "only the client with a full buffer should count as a drop")
+	assert.Len(t, fast.send, 1)
+
+	g.broadcastMessage([]byte("state"))
+	assert.Equal(t, int64(2), drops.Load())
+}
+
+func TestResultDeliveredToBackedUpClient(t *testing.T) {
+	g := NewRaceGame(time.Second, RaceLevelTarget).(*RaceGame)
+	defer g.Cleanup()
+	var drops atomic.Int64
+	g.SetDropCounter(&drops)
+
+	fast := newTestClient("fast")
+	slow := newTestClient("slow")
+	slow.send = make(chan []byte, 1)
+	slow.send <- []byte("backlog")
+	for _, c := range []*Client{fast, slow} {
+		g.Clients.Set(c.player.Id, NewClientSink(c))
+		g.State.Players.Set(c.player.Id, c.player)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(g.BaseGame, stop)
+
+	// The slow client catches up shortly after the round ends
+	errs := make(chan error, 1)
+	go func() { errs <- g.broadcastResult(g.State.GetRoundResult()) }()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []byte("backlog"), <-slow.send)
+
+	assert.True(t, receiveType(slow, RespRoundResult, time.Second), "a briefly backed up client should still get the result")
+	assert.True(t, receiveType(fast, RespRoundResult, time.Second))
+	require.NoError(t, <-errs)
+	assert.Zero(t, drops.Load(), "waiting for the slow client shouldn't drop them")
+
+	// The result is resent to players resyncing after the round
+	state := []byte("state")
+	g.latestState.Store(&state)
+	require.True(t, g.Resync(fast))
+	assert.Equal(t, state, <-fast.send)
+	assert.True(t, receiveType(fast, RespRoundResult, time.Second))
+
+	// Clients that don't catch up in time are dropped
+	g.SetResultTimeout(10 * time.Millisecond)
+	slow.send <- []byte("backlog")
+	require.NoError(t, g.broadcastResult(g.State.GetRoundResult()))
+	assert.True(t, waitFor(time.Second, func() bool { return drops.Load() == 1 }))
+}
@@ -3,7 +3,6 @@ module github.com/chowieuk/simple-maze-multiplayer
 go 1.23.4
 
 require (
-	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/matoous/go-nanoid/v2 v2.1.0
 	github.com/rs/zerolog v1.33.0
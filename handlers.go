@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownMessage is returned when dispatching a message type with no handler
+var ErrUnknownMessage = errors.New("unknown message type")
+
+// MessageHandler handles a message from a client. It returns an error if the
+// message couldn't be parsed.
+type MessageHandler func(*Client, BaseMessage) error
+
+// HandlerRegistry maps each message type clients may send to its handler
+type HandlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[MessageType]MessageHandler
+}
+
+// NewHandlerRegistry creates a registry with no handlers
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{
+		handlers: make(map[MessageType]MessageHandler),
+	}
+}
+
+// Register sets the handler for a message type, replacing any existing one
+func (r *HandlerRegistry) Register(msgType MessageType, handler MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = handler
+}
+
+// Dispatch passes a message to the handler registered for its type
+func (r *HandlerRegistry) Dispatch(cl *Client, msg BaseMessage) error {
+	r.mu.RLock()
+	handler, ok := r.handlers[msg.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrUnknownMessage
+	}
+	return handler(cl, msg)
+}
+
+// handle adapts a handler of a concrete request type, parsing the payload
+// before it's called
+func handle[T Message](fn func(*Client, *T)) MessageHandler {
+	return func(cl *Client, base BaseMessage) error {
+		msg, err := ParseMessage[T](base)
+		if err != nil {
+			return err
+		}
+		fn(cl, msg)
+		return nil
+	}
+}
+
+// DefaultHandlers creates a registry with the handlers for every request
+func DefaultHandlers() *HandlerRegistry {
+	r := NewHandlerRegistry()
+	r.Register(ReqJoinQueue, handle((*Client).HandleJoinQueue))
+	r.Register(ReqLeaveQueue, handle((*Client).HandleLeaveQueue))
+	r.Register(ReqPlayerUpdate, handle((*Client).HandlePlayerUpdate))
+	r.Register(ReqPlayerReady, handle(func(cl *Client, _ *PlayerReadyRequest) {
+		cl.logger.Info("received ready request")
+		cl.HandleSetReady(true)
+	}))
+	r.Register(ReqSetReady, handle(func(cl *Client, req *SetReadyRequest) {
+		cl.logger.Info("received set ready request", "ready", req.Ready)
+		cl.HandleSetReady(req.Ready)
+	}))
+	r.Register(ReqCreateChallenge, handle((*Client).HandleCreateChallenge))
+	r.Register(ReqAcceptChallenge, handle((*Client).HandleAcceptChallenge))
+	r.Register(ReqResync, handle(func(cl *Client, _ *ResyncRequest) {
+		cl.HandleResync()
+	}))
+	r.Register(ReqClientLoaded, handle(func(cl *Client, _ *ClientLoadedRequest) {
+		cl.HandleClientLoaded()
+	}))
+	r.Register(ReqPong, handle((*Client).HandlePong))
+	r.Register(ReqListMyChallenges, func(cl *Client, _ BaseMessage) error {
+		cl.HandleListMyChallenges()
+		return nil
+	})
+	r.Register(ReqExitGame, func(cl *Client, _ BaseMessage) error {
+		cl.HandleExitGame()
+		return nil
+	})
+	r.Register(ReqEnterGame, func(cl *Client, _ BaseMessage) error {
+		cl.HandleEnterGame()
+		return nil
+	})
+	r.Register(ReqVoteSurrender, func(cl *Client, _ BaseMessage) error {
+		cl.HandleVoteSurrender()
+		return nil
+	})
+	r.Register(ReqCreateParty, func(cl *Client, _ BaseMessage) error {
+		cl.HandleCreateParty()
+		return nil
+	})
+	r.Register(ReqJoinParty, handle((*Client).HandleJoinParty))
+	r.Register(ReqLeaveParty, func(cl *Client, _ BaseMessage) error {
+		cl.HandleLeaveParty()
+		return nil
+	})
+	r.Register(ReqRematch, handle((*Client).HandleRematch))
+	r.Register(ReqCancelChallenge, handle((*Client).HandleCancelChallenge))
+	r.Register(ReqGetGameInfo, handle((*Client).HandleGetGameInfo))
+	return r
+}
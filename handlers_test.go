@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerRegistryDispatch(t *testing.T) {
+	mm := NewMatchmaker(time.Second)
+	received := make(chan *JoinQueueRequest, 1)
+	mm.handlers.Register(ReqJoinQueue, handle(func(cl *Client, req *JoinQueueRequest) {
+		received <- req
+	}))
+
+	conn := connectMemClient(t, mm, "alice")
+	conn.sendRequest(t, ReqJoinQueue, JoinQueueRequest{GameMode: ModeSprint})
+
+	select {
+	case req := <-received:
+		assert.Equal(t, ModeSprint, req.GameMode)
+	case <-time.After(time.Second):
+		t.Fatal("registered handler wasn't called")
+	}
+}
+
+func TestHandlerRegistryUnknownType(t *testing.T) {
+	registry := DefaultHandlers()
+	client := newTestClient("alice")
+
+	err := registry.Dispatch(client, BaseMessage{Type: "no_such_type", Payload: json.RawMessage(`{}`)})
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+
+	err = registry.Dispatch(client, BaseMessage{Type: ReqJoinQueue, Payload: json.RawMessage(`not json`)})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnknownMessage, "parse failures should be reported separately")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionQuality is a coarse indicator of a player's latency, shown to
+// opponents so they can tell when someone is lagging
+type ConnectionQuality string
+
+const (
+	ConnectionGood ConnectionQuality = "good"
+	ConnectionFair ConnectionQuality = "fair"
+	ConnectionPoor ConnectionQuality = "poor"
+)
+
+const (
+	// PingInterval is how often the server pings each client to measure latency
+	PingInterval time.Duration = 2 * time.Second
+	// RTTSamples is the number of recent round trips averaged for a client
+	RTTSamples int = 5
+	// Average round trips from these thresholds are fair and poor respectively
+	FairRTT time.Duration = 100 * time.Millisecond
+	PoorRTT time.Duration = 250 * time.Millisecond
+	// Round trips longer than this are discarded as bogus
+	MaxRTT time.Duration = time.Minute
+)
+
+// rttWindow holds a client's most recent round trip times
+type rttWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// Record adds a round trip, replacing the oldest once the window is full,
+// and returns the resulting connection quality
+func (w *rttWindow) Record(rtt time.Duration) ConnectionQuality {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < RTTSamples {
+		w.samples = append(w.samples, rtt)
+	} else {
+		w.samples[w.next] = rtt
+		w.next = (w.next + 1) % RTTSamples
+	}
+	return qualityFor(w.average())
+}
+
+// average returns the mean of the recorded round trips, 0 if there are none.
+// The caller must hold the lock.
+func (w *rttWindow) average() time.Duration {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, rtt := range w.samples {
+		total += rtt
+	}
+	return total / time.Duration(len(w.samples))
+}
+
+// qualityFor classifies an average round trip time
+func qualityFor(rtt time.Duration) ConnectionQuality {
+	switch {
+	case rtt >= PoorRTT:
+		return ConnectionPoor
+	case rtt >= FairRTT:
+		return ConnectionFair
+	default:
+		return ConnectionGood
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTTWindowQuality(t *testing.T) {
+	var w rttWindow
+	assert.Equal(t, ConnectionGood, w.Record(20*time.Millisecond))
+	assert.Equal(t, ConnectionFair, w.Record(200*time.Millisecond), "the average should cross the fair threshold")
+
+	// Sustained lag makes the connection poor
+	var quality ConnectionQuality
+	for range RTTSamples {
+		quality = w.Record(400 * time.Millisecond)
+	}
+	assert.Equal(t, ConnectionPoor, quality)
+
+	// Old samples roll out of the window once the lag clears
+	for range RTTSamples {
+		quality = w.Record(30 * time.Millisecond)
+	}
+	assert.Equal(t, ConnectionGood, quality)
+}
+
+func TestHighRTTShownInGameState(t *testing.T) {
+	game := NewRaceGame(ServerTickrate, RaceLevelTarget).(*RaceGame)
+	defer game.Cleanup()
+	c := newTestClient("player1")
+	c.activeGame = game
+	game.State.Players.Set(c.player.Id, c.player)
+
+	connection := func() ConnectionQuality {
+		msg, err := game.State.AsUpdateMessage()
+		require.NoError(t, err)
+		var state struct {
+			Payload struct {
+				Players []Player `json:"players"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(msg, &state))
+		require.Len(t, state.Payload.Players, 1)
+		return state.Payload.Players[0].Connection
+	}
+	assert.Empty(t, connection(), "quality shouldn't be reported before it's measured")
+
+	// Pongs echo the ping's timestamp, so an old timestamp is a long round trip
+	c.HandlePong(&PongRequest{SentAtMs: time.Now().Add(-10 * time.Millisecond).UnixMilli()})
+	assert.Equal(t, ConnectionGood, connection())
+	for range RTTSamples {
+		c.HandlePong(&PongRequest{SentAtMs: time.Now().Add(-time.Second).UnixMilli()})
+	}
+	assert.Equal(t, ConnectionPoor, connection())
+
+	// Timestamps from the future aren't counted
+	c.HandlePong(&PongRequest{SentAtMs: time.Now().Add(time.Hour).UnixMilli()})
+	assert.Equal(t, ConnectionPoor, connection())
+}
+
+func TestClientIsPinged(t *testing.T) {
+	conn := newMemConn()
+	client := NewClient(conn, NewPlayer("player1", "US"), nil, 1)
+	client.pingInterval = 5 * time.Millisecond
+	go client.StartWriting()
+	defer client.cancel()
+
+	var ping PingResponse
+	require.NoError(t, json.Unmarshal(conn.expect(t, RespPing, time.Second), &ping))
+	assert.InDelta(t, time.Now().UnixMilli(), ping.SentAtMs, float64(time.Second.Milliseconds()))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	slogzerolog "github.com/samber/slog-zerolog"
+)
+
+// Release is attached to every log line
+const Release = "v1.0.0"
+
+// LogFormat selects how log lines are written
+type LogFormat string
+
+const (
+	LogFormatConsole LogFormat = "console"
+	LogFormatJSON    LogFormat = "json"
+)
+
+// LogConfig configures the logger created by newLogger
+type LogConfig struct {
+	Level  slog.Level
+	Format LogFormat
+	Output io.Writer
+}
+
+// logConfigFromEnv reads LOG_LEVEL and LOG_FORMAT, defaulting to debug console logs.
+// An unrecognized level falls back to info, returning the error for the
+// caller to log once the logger is set up.
+func logConfigFromEnv() (LogConfig, error) {
+	cfg := LogConfig{
+		Level:  slog.LevelDebug,
+		Format: LogFormatConsole,
+		Output: os.Stderr,
+	}
+
+	var err error
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err = cfg.Level.UnmarshalText([]byte(level)); err != nil {
+			cfg.Level = slog.LevelInfo
+		}
+	}
+
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), string(LogFormatJSON)) {
+		cfg.Format = LogFormatJSON
+	}
+
+	return cfg, err
+}
+
+// newLogger creates a structured logger backed by zerolog
+func newLogger(cfg LogConfig) *slog.Logger {
+	var zerologLogger zerolog.Logger
+	switch cfg.Format {
+	case LogFormatJSON:
+		zerologLogger = zerolog.New(cfg.Output).With().Timestamp().Logger()
+	default:
+		zerologLogger = zerolog.New(zerolog.ConsoleWriter{Out: cfg.Output})
+	}
+
+	logger := slog.New(slogzerolog.Option{Level: cfg.Level, Logger: &zerologLogger}.NewZerologHandler())
+	return logger.
+		With("release", Release)
+}
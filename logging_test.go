@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogConfigFromEnv(t *testing.T) {
+	testCases := []struct {
+		name           string
+		level          string
+		format         string
+		expectedLevel  slog.Level
+		expectedFormat LogFormat
+		expectErr      bool
+	}{
+		{"defaults", "", "", slog.LevelDebug, LogFormatConsole, false},
+		{"json warn", "warn", "json", slog.LevelWarn, LogFormatJSON, false},
+		{"case insensitive", "ERROR", "JSON", slog.LevelError, LogFormatJSON, false},
+		{"invalid values", "loud", "xml", slog.LevelInfo, LogFormatConsole, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", tc.level)
+			t.Setenv("LOG_FORMAT", tc.format)
+
+			cfg, err := logConfigFromEnv()
+			if tc.expectErr {
+				assert.Error(t, err, "an invalid level should be reported")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedLevel, cfg.Level)
+			assert.Equal(t, tc.expectedFormat, cfg.Format)
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	t.Run("json output respects level", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := newLogger(LogConfig{Level: slog.LevelWarn, Format: LogFormatJSON, Output: &buf})
+
+		logger.Info("hidden")
+		assert.Empty(t, buf.String(), "info should be below the configured level")
+
+		logger.Warn("shown", "game_id", "abcde")
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "shown", line["message"])
+		assert.Equal(t, "abcde", line["game_id"])
+		assert.Equal(t, Release, line["release"])
+	})
+
+	t.Run("console output", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := newLogger(LogConfig{Level: slog.LevelDebug, Format: LogFormatConsole, Output: &buf})
+
+		logger.Debug("shown")
+		assert.Contains(t, buf.String(), "shown")
+		assert.False(t, json.Valid(buf.Bytes()), "console output should not be json")
+	})
+}
+
+// captureLogs replaces the default logger with a JSON logger writing to the returned buffer
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(LogConfig{Level: slog.LevelDebug, Format: LogFormatJSON, Output: &buf}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logLines decodes each JSON log line in the buffer
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(raw, &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestScopedLoggers(t *testing.T) {
+	t.Run("game logs carry game id and mode", func(t *testing.T) {
+		buf := captureLogs(t)
+		g := NewGame(ModeRace, ServerTickrate)
+		g.CheckAllPlayersReady()
+
+		lines := logLines(t, buf)
+		require.NotEmpty(t, lines)
+		for _, line := range lines {
+			assert.Equal(t, g.GetID(), line["game_id"])
+			assert.Equal(t, string(ModeRace), line["mode"])
+		}
+	})
+
+	t.Run("client logs carry player id", func(t *testing.T) {
+		buf := captureLogs(t)
+		mm := NewMatchmaker(ServerTickrate)
+		c := NewClient(nil, NewPlayer("player1", "🏴"), mm, mm.sendBufferSize)
+		c.HandleLeaveQueue(&LeaveQueueRequest{})
+
+		lines := logLines(t, buf)
+		require.NotEmpty(t, lines)
+		assert.Equal(t, c.player.Id, lines[0]["player_id"])
+	})
+}
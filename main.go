@@ -1,268 +1,1567 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/rs/zerolog"
-	slogzerolog "github.com/samber/slog-zerolog"
+	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
 // GameMode represents the available game modes
 type GameMode string
 
 const (
-	ModeSprint        GameMode      = "sprint"
-	ModeRace          GameMode      = "race"
+	ModeSprint    GameMode = "sprint"
+	ModeRace      GameMode = "race"
+	ModeTimeTrial GameMode = "time_trial"
+	ModePractice  GameMode = "practice"
+	// ModeHybrid is a race to the level target with a sprint's time cap
+	ModeHybrid        GameMode      = "hybrid"
 	ServerTickrate    time.Duration = time.Second / 30
 	SprintRoundLength time.Duration = 60 * time.Second
 	RaceLevelTarget   int           = 10
+	// DefaultCountdown is how long players have to ready up before a game
+	// starts, shortened to ReadyCountdown once every player is ready
+	DefaultCountdown time.Duration = 30 * time.Second
+	ReadyCountdown   time.Duration = 5 * time.Second
+	// Bounds for challenge creators customising their game
+	MinRaceLevelTarget   int           = 3
+	MaxRaceLevelTarget   int           = 50
+	MinSprintRoundLength time.Duration = 15 * time.Second
+	MaxSprintRoundLength time.Duration = 300 * time.Second
+	// DefaultMaxMessageBytes bounds the size of a message read from a client.
+	// Larger messages close the connection.
+	DefaultMaxMessageBytes int = 4096
+	// CloseWriteTimeout bounds how long sending a close frame may block
+	CloseWriteTimeout time.Duration = time.Second
+	// DefaultSendBufferSize is the number of outgoing messages buffered per client.
+	// A larger buffer gives slow clients more headroom before they are dropped
+	// by the broadcaster, at the cost of memory per connection and of stale
+	// frames queued for clients that have fallen behind.
+	DefaultSendBufferSize int = 256
+	// ReconnectGracePeriod is how long a head-to-head game stays paused
+	// waiting for a dropped player to reconnect before it is cancelled
+	ReconnectGracePeriod time.Duration = 15 * time.Second
+	// ResultDeliveryTimeout is how long a round result waits for room in a
+	// client's send buffer before the client is dropped
+	ResultDeliveryTimeout time.Duration = 2 * time.Second
+	// SurrenderMinPlayers is the fewest players a game needs for them to
+	// vote to end it early, head-to-head games are left to be played out
+	SurrenderMinPlayers int = 3
+	// ChallengeExpiry is how long a challenge stays open waiting for players
+	ChallengeExpiry time.Duration = 10 * time.Minute
+	// DefaultChallengeIDLength is the length of challenge ids, which appear in
+	// share links
+	DefaultChallengeIDLength int = 8
+	// GameRegistryShards is how many independently locked shards the active
+	// games are spread across, as every player's lookups go through them
+	GameRegistryShards int = 16
+	// ChallengeIDAttempts bounds the ids tried for a challenge before giving up
+	ChallengeIDAttempts int = 10
+	// DefaultMaxActiveGames bounds the number of games running at once
+	DefaultMaxActiveGames int = 1000
+	// DefaultMaxChallengesPerPlayer bounds the active challenge games each
+	// player may have created
+	DefaultMaxChallengesPerPlayer int = 3
+	// MaxRegionLength bounds the region a client may report on connect
+	MaxRegionLength int = 16
+	// RetryAfterBase is the reconnect hint given to the first client refused
+	// at capacity, doubling for each further refusal up to RetryAfterMax
+	RetryAfterBase time.Duration = time.Second
+	RetryAfterMax  time.Duration = 30 * time.Second
+	// RegionFallback is how long a player waits for an opponent in their
+	// region before being matched with anyone
+	RegionFallback time.Duration = 10 * time.Second
+	// MaxTickrateHz bounds the broadcast tickrate ops may configure at runtime
+	MaxTickrateHz int = 120
 )
 
+// gameModes are every mode a game can be played in
+var gameModes = []GameMode{ModeSprint, ModeRace, ModeHybrid, ModeTimeTrial, ModePractice}
+
 // Matchmaker handles player queuing and game creation
 type Matchmaker struct {
-	tickrate time.Duration
-	// Queues for head-to-head games
+	// Default tickrate, overridden per mode by modeTickrates. Tickrates and
+	// default params may be changed at runtime under configMu.
+	tickrate      time.Duration
+	modeTickrates map[GameMode]time.Duration
+	configMu      sync.RWMutex
+	// Keepalives of modes which only broadcast state when it changes
+	modeKeepalives map[GameMode]time.Duration
+	// Params applied to new games where unset
+	defaultParams GameParams
+	// Countdown durations for new games, the game defaults are used when 0
+	countdown      time.Duration
+	readyCountdown time.Duration
+	// How long sprint rounds wait for players to load, 0 to start immediately
+	loadingGrace time.Duration
+	// Level beyond which a sprint round is won early, 0 for no cap
+	sprintLevelCap int
+	// How long players may be inactive in a running game, 0 to never kick them
+	afkTimeout time.Duration
+	// Queues for head-to-head games, guarded by queueMu
+	queueMu     sync.Mutex
 	sprintQueue []*Client
 	raceQueue   []*Client
+	hybridQueue []*Client
+	// Maximum number of active games, 0 for no limit
+	maxGames int
+	// Requests refused at capacity since a game last ended, scales retry hints
+	busyRefusals atomic.Int32
+	// Clients dropped from game broadcasts for a full send buffer
+	backpressureDrops atomic.Int64
 	// Track active head-to-head games
 	headToHeadGames CMap[string, Game]
-	// Track active challenges
-	activeChallenges CMap[string, GameMode]
+	// Every challenge by game id until its game ends, challengeMu serialises
+	// transitions between their states
+	challenges      CMap[string, Challenge]
+	challengeMu     sync.Mutex
+	challengeExpiry time.Duration
+	// Format of the ids given to challenge games
+	challengeIDs ChallengeIDFormat
+	// Active challenge games created by each player id, createdMu serialises
+	// checking the limit. 0 for no limit.
+	createdGames           CMap[string, int]
+	createdMu              sync.Mutex
+	maxChallengesPerPlayer int
+	// Replays of completed games, recording is disabled when replayFrames is 0
+	replayFrames int
+	replays      CMap[string, *Recorder]
+	// Ids of the kept replays, oldest first, replayMu serialises eviction.
+	// 0 to keep every replay.
+	replayOrder []string
+	replayMu    sync.Mutex
+	maxReplays  int
+	// Gzip replays once their game ends
+	compressReplays bool
+	// Size of the send buffer given to each new client
+	sendBufferSize int
+	// Largest message accepted from a client
+	maxMessageBytes int
+	// Store for completed game results
+	results *ResultStore
+	// Number of scores sent in round results, 0 to send every player's
+	maxResultPlayers int
+	// Which round results are recorded, every result by default
+	resultPolicy ResultPolicy
+	// How long round results wait for a client with a full send buffer
+	resultTimeout time.Duration
+	// Whether players must enter matched games before readying up
+	requireEnter bool
+	// How long rounds run before a player reaching the level target ends
+	// them, 0 to end them straight away
+	minRoundLength time.Duration
+	// Backfill settings for matchmade games, disabled by default
+	backfill BackfillConfig
+	// Lobby settings for matchmade games, disabled by default
+	lobby LobbyConfig
+	// Selects which queued players are paired, FIFO by default
+	strategy MatchStrategy
+	// Seeds for games that aren't given one, the global generator by default
+	seeds SeedSource
+	// Persistent practice lobby, created when first joined
+	practice   Game
+	practiceMu sync.Mutex
+	// Verifies players' tokens when connecting, nil to allow anyone to play
+	auth *Authenticator
+	// Active connections by client token, connMu serialises takeovers
+	connections CMap[string, *Client]
+	connMu      sync.Mutex
+	// Every connected client by player id, whether or not it has a token
+	online CMap[string, *Client]
+	// Parties by code, partyMu guards their membership
+	parties      CMap[string, *Party]
+	partyMu      sync.Mutex
+	maxPartySize int
+	// Handlers for the messages clients send
+	handlers *HandlerRegistry
 }
 
 // NewMatchmaker creates a new matchmaker instance
-// All spawned games will use the provided tickrate
+// All spawned games will use the provided tickrate unless overridden for their mode
 func NewMatchmaker(tickrate time.Duration) *Matchmaker {
 	return &Matchmaker{
-		tickrate:         tickrate,
-		sprintQueue:      make([]*Client, 0),
-		raceQueue:        make([]*Client, 0),
-		headToHeadGames:  NewMutexMap[string, Game](),
-		activeChallenges: NewMutexMap[string, GameMode](),
+		tickrate:        tickrate,
+		modeTickrates:   make(map[GameMode]time.Duration),
+		modeKeepalives:  make(map[GameMode]time.Duration),
+		defaultParams:   GameParams{LevelTarget: RaceLevelTarget, RoundLength: SprintRoundLength, MazeAlgo: DefaultMazeAlgo},
+		sprintQueue:     make([]*Client, 0),
+		raceQueue:       make([]*Client, 0),
+		hybridQueue:     make([]*Client, 0),
+		headToHeadGames: NewShardedMap[string, Game](GameRegistryShards),
+		challenges:      NewMutexMap[string, Challenge](),
+		challengeIDs:    ChallengeIDFormat{Length: DefaultChallengeIDLength},
+		createdGames:    NewMutexMap[string, int](),
+		challengeExpiry: ChallengeExpiry,
+		replayFrames:    ReplayMaxFrames,
+		maxReplays:      DefaultMaxReplays,
+		replays:         NewMutexMap[string, *Recorder](),
+		sendBufferSize:  DefaultSendBufferSize,
+		maxMessageBytes: DefaultMaxMessageBytes,
+		results:         NewResultStore(),
+		resultTimeout:   ResultDeliveryTimeout,
+		strategy:        FIFOStrategy{},
+		seeds:           rand.Int64,
+		connections:     NewMutexMap[string, *Client](),
+		online:          NewMutexMap[string, *Client](),
+		parties:         NewMutexMap[string, *Party](),
+		maxPartySize:    DefaultMaxPartySize,
+		handlers:        DefaultHandlers(),
 	}
 }
 
+// ErrServerBusy is returned when the matchmaker has reached its game limit
+var ErrServerBusy = errors.New("server busy: active game limit reached")
+
 // AddToQueue adds a player to the queue for head-to-head games
 func (m *Matchmaker) AddToQueue(c *Client, mode GameMode) error {
 
+	if mode == ModeTimeTrial || mode == ModePractice {
+		// Solo games start straight away, so leave any head-to-head queues
+		m.queueMu.Lock()
+		m.dequeue(c, "")
+		m.queueMu.Unlock()
+		if mode == ModeTimeTrial {
+			return m.startTimeTrial(c)
+		}
+		return m.joinPractice(c)
+	}
+
+	if party := c.party.Load(); party != nil {
+		return m.addPartyToQueue(c, party, mode)
+	}
+
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+
+	queue := m.queue(mode)
+	if queue == nil {
+		return fmt.Errorf("unrecognized queue: %v", mode)
+	}
+	if slices.Contains(*queue, c) {
+		return fmt.Errorf("client already in queue: %v", mode)
+	}
+	if err := m.enqueue(c, mode); err != nil {
+		return err
+	}
+
+	m.matchQueue(mode)
+	return nil
+}
+
+// enqueue adds a client to the back of a head-to-head queue.
+// The caller must hold queueMu.
+func (m *Matchmaker) enqueue(c *Client, mode GameMode) error {
+	queue := m.queue(mode)
+	// Players may wait in several queues at once, their wait is counted from
+	// the first they joined
+	*queue = append(*queue, c)
+	if c.Status() != StatusQueued {
+		c.queuedAt = time.Now()
+	}
+	// Queueing again leaves the game the player just finished
+	c.SetActiveGame(nil)
+	c.SetStatus(StatusQueued)
+	slog.Info("added player to queue",
+		"player", c.player.Username,
+		"region", c.player.Region,
+		"queue", mode)
+
+	queueJoined, err := CreateResponseBytes(RespQueueJoined, QueueJoinedResponse{
+		Queue: mode,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Sent without blocking, as queueMu is held
+	c.trySend(queueJoined)
+	return nil
+}
+
+// queue returns the queue for a head-to-head game mode, or nil if there isn't one
+func (m *Matchmaker) queue(mode GameMode) *[]*Client {
 	switch mode {
 	case ModeSprint:
+		return &m.sprintQueue
+	case ModeRace:
+		return &m.raceQueue
+	case ModeHybrid:
+		return &m.hybridQueue
+	default:
+		return nil
+	}
+}
 
-		m.sprintQueue = append(m.sprintQueue, c)
-		slog.Info("added player to queue",
-			"player", c.player.Username,
-			"queue", mode)
+// matchQueue creates games from the front of a queue while there is capacity.
+// Players left in the queue wait until a running game ends.
+// The caller must hold queueMu.
+func (m *Matchmaker) matchQueue(mode GameMode) {
+	queue := m.queue(mode)
+	m.pruneQueue(mode)
+	m.backfillQueue(mode)
+	m.fillLobbies(mode)
+
+	for len(*queue) >= 2 {
+		if m.atCapacity() {
+			slog.Info("game limit reached, players waiting in queue",
+				"queue", mode,
+				"waiting", len(*queue))
+			return
+		}
 
-		queueJoined, err := CreateResponseBytes(RespQueueJoined, QueueJoinedResponse{
-			Queue: mode,
-		})
+		i, j, ok := m.strategy.SelectPair(*queue)
+		if !ok {
+			return
+		}
 
-		if err != nil {
-			return err
+		client1 := (*queue)[i]
+		client2 := (*queue)[j]
+		// Parties are placed into the game together
+		players := partyOf(*queue, client1)
+		if !slices.Contains(players, client2) {
+			other := partyOf(*queue, client2)
+			if capacity := m.lobbyCapacity(); capacity > 0 && len(players)+len(other) > capacity {
+				// The parties don't fit one lobby together. Neither outgrows
+				// it, so whichever can play on its own goes first.
+				if len(players) < 2 {
+					players = other
+				}
+			} else {
+				players = append(players, other...)
+			}
 		}
 
-		c.send <- queueJoined
+		slog.Info("creating new game",
+			"queue", mode,
+			"players", len(players))
 
-		if len(m.sprintQueue) >= 2 {
-			slog.Info("creating new game",
+		game, err := m.newGame(mode, GameParams{})
+		if err != nil {
+			// The players keep their place in the queue, retried when
+			// someone else joins
+			slog.Error("error creating game",
 				"queue", mode,
-				"players", 2)
-
-			client1 := m.sprintQueue[0]
-			client2 := m.sprintQueue[1]
-
-			game := NewSprintGame(m.tickrate, SprintRoundLength)
-			m.registerGame(game)
+				"error", err)
+			failed := MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()})
+			for _, c := range players {
+				c.trySend(failed)
+			}
+			return
+		}
+		game.OnOrphaned(func(c *Client) {
+			m.Requeue(c, mode)
+		})
+		game.OnRematch(func(players []*Client, sameMaze bool) {
+			m.startRematch(game, players, sameMaze)
+		})
+		game.SetBackfill(m.backfill)
+		game.SetLobby(m.lobby)
+		// Confirm the game once every player has joined, not just the first two
+		game.SetExpectedPlayers(len(players))
+		m.registerGame(game)
+
+		go game.RunListeners()
+
+		var added []*Client
+		for _, c := range players {
+			if err := game.TryAdd(c); err != nil {
+				slog.Warn("new game ended before its players were added",
+					"game_id", game.GetID(),
+					"error", err)
+				break
+			}
+			added = append(added, c)
+		}
 
-			go game.RunListeners()
+		*queue = slices.DeleteFunc(*queue, func(c *Client) bool {
+			return slices.Contains(added, c)
+		})
+		for _, c := range added {
+			m.dequeue(c, mode)
+		}
+		if len(added) < len(players) {
+			// Anyone not added waits for the next attempt, and the ended
+			// game requeues the players it already took
+			return
+		}
+	}
+}
 
-			game.Add() <- client1
-			game.Add() <- client2
+// dequeue removes a client from every queue except the given mode, telling
+// them which queues they've left. It reports whether they were in any.
+// The caller must hold queueMu.
+func (m *Matchmaker) dequeue(c *Client, except GameMode) bool {
+	removed := false
+	for _, mode := range []GameMode{ModeSprint, ModeRace, ModeHybrid} {
+		queue := m.queue(mode)
+		if mode == except || !slices.Contains(*queue, c) {
+			continue
+		}
+		*queue = slices.DeleteFunc(*queue, func(queued *Client) bool {
+			return queued == c
+		})
+		c.trySend(MustCreateResponseBytes(RespQueueLeft, QueueLeftResponse{
+			Queue: mode,
+		}))
+		removed = true
+	}
+	return removed
+}
 
-			m.sprintQueue = m.sprintQueue[2:]
+// pruneQueue discards clients that disconnected while queued but haven't yet
+// been removed by their cleanup, so they aren't placed into a game.
+// The caller must hold queueMu.
+func (m *Matchmaker) pruneQueue(mode GameMode) {
+	queue := m.queue(mode)
+	*queue = slices.DeleteFunc(*queue, func(c *Client) bool {
+		if c.ctx.Err() == nil {
+			return false
 		}
+		slog.Info("discarding disconnected player from queue",
+			"queue", mode,
+			"player_id", c.player.Id)
+		return true
+	})
+}
 
-	case ModeRace:
+// backfillQueue moves queued players into running games with an open slot.
+// The caller must hold queueMu.
+func (m *Matchmaker) backfillQueue(mode GameMode) {
+	if m.backfill.Window <= 0 {
+		return
+	}
+	queue := m.queue(mode)
+
+	for len(*queue) > 0 {
+		var target Game
+		for _, game := range m.headToHeadGames.Values() {
+			if game.GetMode() == mode && game.CanBackfill() {
+				target = game
+				break
+			}
+		}
+		if target == nil {
+			return
+		}
 
-		m.raceQueue = append(m.raceQueue, c)
-		slog.Info("added player to queue",
-			"player", c.player.Username,
-			"queue", mode)
+		// Parties only fit a game with room for them all, so they wait for a new one
+		i := firstSolo(*queue)
+		if i < 0 {
+			return
+		}
+		client := (*queue)[i]
+		slog.Info("backfilling player into running game",
+			"queue", mode,
+			"game_id", target.GetID(),
+			"player_id", client.player.Id)
+		if err := target.TryAdd(client); err != nil {
+			slog.Warn("unable to backfill player", "game_id", target.GetID(), "error", err)
+			return
+		}
+		*queue = slices.Delete(*queue, i, i+1)
+		m.dequeue(client, mode)
+	}
+}
 
-		queueJoined, err := CreateResponseBytes(RespQueueJoined, QueueJoinedResponse{
-			Queue: mode,
-		})
+// fillLobbies moves queued players into games still waiting for players
+// before their countdown. The caller must hold queueMu.
+func (m *Matchmaker) fillLobbies(mode GameMode) {
+	queue := m.queue(mode)
+
+	for len(*queue) > 0 {
+		var target Game
+		for _, game := range m.headToHeadGames.Values() {
+			if game.GetMode() == mode && game.CanJoinLobby() {
+				target = game
+				break
+			}
+		}
+		if target == nil {
+			return
+		}
 
-		if err != nil {
-			return err
+		i := firstSolo(*queue)
+		if i < 0 {
+			return
+		}
+		client := (*queue)[i]
+		slog.Info("adding player to waiting lobby",
+			"queue", mode,
+			"game_id", target.GetID(),
+			"player_id", client.player.Id)
+		if err := target.TryAdd(client); err != nil {
+			slog.Warn("unable to add player to lobby", "game_id", target.GetID(), "error", err)
+			return
 		}
+		*queue = slices.Delete(*queue, i, i+1)
+		m.dequeue(client, mode)
+	}
+}
+
+// Requeue places a client back at the front of a queue, e.g. after their
+// opponent dropped out during the countdown
+func (m *Matchmaker) Requeue(c *Client, mode GameMode) {
+	if c.ctx.Err() != nil {
+		return
+	}
 
-		c.send <- queueJoined
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
 
-		if len(m.raceQueue) >= 2 {
-			slog.Info("creating new game",
-				"queue", mode,
-				"players", 2)
+	queue := m.queue(mode)
+	if queue == nil {
+		return
+	}
 
-			client1 := m.raceQueue[0]
-			client2 := m.raceQueue[1]
+	*queue = append([]*Client{c}, *queue...)
+	c.SetStatus(StatusQueued)
+	slog.Info("requeued player",
+		"player", c.player.Username,
+		"queue", mode)
 
-			game := NewRaceGame(m.tickrate, RaceLevelTarget)
-			m.registerGame(game)
+	c.trySend(MustCreateResponseBytes(RespRequeued, QueueJoinedResponse{
+		Queue: mode,
+	}))
 
-			go game.RunListeners()
+	m.matchQueue(mode)
+}
 
-			game.Add() <- client1
-			game.Add() <- client2
+// matchAllQueues attempts to form games from every queue
+func (m *Matchmaker) matchAllQueues() {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	m.matchQueue(ModeSprint)
+	m.matchQueue(ModeRace)
+	m.matchQueue(ModeHybrid)
+}
 
-			m.raceQueue = m.raceQueue[2:]
+// RematchEvery periodically retries matching the queues until stop is closed,
+// for strategies that relax their criteria the longer players wait
+func (m *Matchmaker) RematchEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.matchAllQueues()
 		}
-	default:
-		return fmt.Errorf("unrecognized queue: %v", mode)
 	}
-
-	return nil
 }
 
-// RemoveFromQueue removes a player from any queue they're in
-func (m *Matchmaker) RemoveFromQueue(c *Client) error {
+// RegisterConnection records the client as online and as the active
+// connection for its token, returning any connection it replaces
+func (m *Matchmaker) RegisterConnection(c *Client) (*Client, bool) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	m.online.Set(c.player.Id, c)
+	if c.token == "" {
+		return nil, false
+	}
+	old, ok := m.connections.Get(c.token)
+	m.connections.Set(c.token, c)
+	return old, ok && old != c
+}
 
-	inSprint := slices.Contains(m.sprintQueue, c)
+// UnregisterConnection forgets the client if it's still the active connection
+// for its player and token
+func (m *Matchmaker) UnregisterConnection(c *Client) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	// A reconnecting player's new connection may already have taken over
+	if current, ok := m.online.Get(c.player.Id); ok && current == c {
+		m.online.Del(c.player.Id)
+	}
+	if c.token == "" {
+		return
+	}
+	if current, ok := m.connections.Get(c.token); ok && current == c {
+		m.connections.Del(c.token)
+	}
+}
 
-	if inSprint {
-		queueLeft, err := CreateResponseBytes(RespQueueLeft, QueueLeftResponse{
-			Queue: ModeSprint,
+// OnlinePlayers lists every connected player, in username order
+func (m *Matchmaker) OnlinePlayers() []OnlinePlayer {
+	clients := m.online.Values()
+	players := make([]OnlinePlayer, 0, len(clients))
+	for _, c := range clients {
+		players = append(players, OnlinePlayer{
+			Username: c.player.Username,
+			Flag:     c.player.Flag,
+			Status:   c.Status(),
 		})
-		if err != nil {
-			return fmt.Errorf("error creating response: %v", err)
-		}
-		c.send <- queueLeft
-		m.sprintQueue = m.sprintQueue[:1]
-		return nil
 	}
+	slices.SortFunc(players, func(a, b OnlinePlayer) int {
+		return cmp.Or(
+			cmp.Compare(a.Username, b.Username),
+			cmp.Compare(a.Flag, b.Flag),
+			cmp.Compare(a.Status, b.Status),
+		)
+	})
+	return players
+}
 
-	inRace := slices.Contains(m.raceQueue, c)
+// atCapacity reports whether the active game limit has been reached
+func (m *Matchmaker) atCapacity() bool {
+	return m.maxGames > 0 && m.headToHeadGames.Len() >= m.maxGames
+}
 
-	if inRace {
-		queueLeft, err := CreateResponseBytes(RespQueueLeft, QueueLeftResponse{
-			Queue: ModeRace,
-		})
+// QueueDepths returns the number of players waiting in each head-to-head queue
+func (m *Matchmaker) QueueDepths() map[GameMode]int {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	return map[GameMode]int{
+		ModeSprint: len(m.sprintQueue),
+		ModeRace:   len(m.raceQueue),
+		ModeHybrid: len(m.hybridQueue),
+	}
+}
+
+// ActiveGamesByMode returns the number of active games of each mode
+func (m *Matchmaker) ActiveGamesByMode() map[GameMode]int {
+	counts := map[GameMode]int{
+		ModeSprint:    0,
+		ModeRace:      0,
+		ModeHybrid:    0,
+		ModeTimeTrial: 0,
+	}
+	for _, game := range m.headToHeadGames.Values() {
+		counts[game.GetMode()]++
+	}
+	return counts
+}
+
+// retryAfter counts a request refused at capacity and returns how long the
+// client should wait before retrying. The hint backs off exponentially with
+// the number of refusals since capacity was last freed.
+func (m *Matchmaker) retryAfter() time.Duration {
+	refusals := m.busyRefusals.Add(1)
+	return min(RetryAfterBase<<min(refusals-1, 8), RetryAfterMax)
+}
+
+// busyResponse creates a server busy response with a retry hint
+func (m *Matchmaker) busyResponse() []byte {
+	return MustCreateResponseBytes(RespServerBusy, ServerBusyResponse{
+		RetryAfterMs: m.retryAfter().Milliseconds(),
+	})
+}
+
+// startTimeTrial creates a solo game for the client, which starts immediately
+func (m *Matchmaker) startTimeTrial(c *Client) error {
+	if m.atCapacity() {
+		c.trySend(m.busyResponse())
+		return ErrServerBusy
+	}
+
+	slog.Info("creating new game",
+		"queue", ModeTimeTrial,
+		"players", 1)
+
+	game, err := m.newGame(ModeTimeTrial, GameParams{})
+	if err != nil {
+		slog.Error("error creating game",
+			"queue", ModeTimeTrial,
+			"error", err)
+		c.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+		return err
+	}
+	m.registerGame(game)
+
+	go game.RunListeners()
+
+	return game.TryAdd(c)
+}
+
+// joinPractice adds the client to the practice lobby, creating it if needed
+func (m *Matchmaker) joinPractice(c *Client) error {
+	m.practiceMu.Lock()
+	defer m.practiceMu.Unlock()
+
+	if m.practice == nil || m.practice.Context().Err() != nil {
+		game, err := m.newGame(ModePractice, GameParams{})
 		if err != nil {
-			return fmt.Errorf("error creating response: %v", err)
+			return err
 		}
-		c.send <- queueLeft
-		m.raceQueue = m.raceQueue[:1]
-		return nil
+		slog.Info("creating practice lobby", "game_id", game.GetID())
+		m.practice = game
+		go game.RunListeners()
 	}
 
-	return fmt.Errorf("client not found in queue")
+	slog.Info("adding player to practice lobby",
+		"game_id", m.practice.GetID(),
+		"player_id", c.player.Id)
+	if err := m.practice.TryAdd(c); err != nil {
+		return fmt.Errorf("practice lobby closed: %w", err)
+	}
+	return nil
+}
+
+// RemoveFromQueue removes a player from every queue they're in
+func (m *Matchmaker) RemoveFromQueue(c *Client) error {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+
+	if !m.dequeue(c, "") {
+		return fmt.Errorf("client not found in queue")
+	}
+	c.SetStatus(StatusIdle)
+	return nil
 }
 
 // registerGame adds a game to the matchmaker and sets up context-based cleanup
 func (m *Matchmaker) registerGame(game Game) {
+	if m.replayFrames > 0 {
+		game.SetRecorder(NewRecorder(m.replayFrames))
+	}
 	m.headToHeadGames.Set(game.GetID(), game)
 	slog.Info("added game to matchmaker", "game_id", game.GetID())
 
 	// Start a goroutine that waits for the game's context to be cancelled
 	go func() {
 		<-game.Context().Done()
-		m.headToHeadGames.Del(game.GetID())
-		m.activeChallenges.Del(game.GetID())
+		// Teardown order: the game's context is cancelled by Cleanup before
+		// anything is unregistered, so a lookup finding the game can tell it
+		// has ended. Its challenge is then closed under challengeMu, so an
+		// acceptance in progress sees either an open challenge or none, and
+		// finally the game is unregistered, leaving any newer game registered
+		// under the same id in place.
+		m.challengeMu.Lock()
+		if challenge, ok := m.challenges.Get(game.GetID()); ok {
+			// A game ending while still open, e.g. once its creator leaves,
+			// takes its challenge with it
+			if challenge.State == ChallengeCreated || challenge.State == ChallengeActive {
+				m.transitionChallenge(game.GetID(), ChallengeCancelled)
+			}
+			m.challenges.Del(game.GetID())
+		}
+		m.challengeMu.Unlock()
+		m.headToHeadGames.CompareAndDelete(game.GetID(), game)
+		m.busyRefusals.Store(0)
+		if rec := game.Recorder(); rec != nil && rec.Len() > 0 {
+			if m.compressReplays {
+				if err := rec.Compress(); err != nil {
+					slog.Error("error compressing replay", "game_id", game.GetID(), "error", err)
+				}
+			}
+			m.storeReplay(game.GetID(), rec)
+		}
 		slog.Info("removed game from matchmaker", "game_id", game.GetID())
+
+		// Capacity has been freed for any waiting players
+		m.matchAllQueues()
 	}()
 }
 
-// CreateChallengeGame creates a challenge game and adds a player to it
-func (m *Matchmaker) CreateChallengeGame(c *Client, mode GameMode) error {
-	var game Game
-	switch mode {
-	case ModeSprint:
-		game = NewSprintGame(m.tickrate, SprintRoundLength)
-	case ModeRace:
-		game = NewRaceGame(m.tickrate, RaceLevelTarget)
-	default:
-		return fmt.Errorf("invalid game mode")
+// storeReplay keeps the replay of a finished game, discarding the oldest
+// replays beyond maxReplays
+func (m *Matchmaker) storeReplay(gameID string, rec *Recorder) {
+	m.replayMu.Lock()
+	defer m.replayMu.Unlock()
+
+	m.replays.Set(gameID, rec)
+	m.replayOrder = append(m.replayOrder, gameID)
+	for m.maxReplays > 0 && len(m.replayOrder) > m.maxReplays {
+		m.replays.Del(m.replayOrder[0])
+		m.replayOrder = m.replayOrder[1:]
+	}
+}
+
+// GameParams holds the mode specific settings for a game.
+// Zero values fall back to the defaults for the mode.
+type GameParams struct {
+	LevelTarget int
+	RoundLength time.Duration
+	// Encoded custom maze layout, empty to generate the maze from the seed
+	Layout string
+	// Seed the maze is generated from, 0 for a random seed
+	Seed int64
+	// Algorithm the maze is generated with, empty for the default
+	MazeAlgo MazeAlgo
+}
+
+// MarshalJSON encodes the params with the round length in milliseconds
+func (p GameParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		LevelTarget   int   `json:"level_target,omitempty"`
+		RoundLengthMs int64 `json:"round_length_ms,omitempty"`
+	}{
+		LevelTarget:   p.LevelTarget,
+		RoundLengthMs: p.RoundLength.Milliseconds(),
+	})
+}
+
+// SetModeTickrate overrides the broadcast tickrate for games of the given
+// mode created from now on
+func (m *Matchmaker) SetModeTickrate(mode GameMode, tickrate time.Duration) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.modeTickrates[mode] = tickrate
+}
+
+// SetModeKeepalive makes games of the given mode broadcast state only when it
+// changes, or at least every keepalive. It must be called before the
+// matchmaker starts creating games.
+func (m *Matchmaker) SetModeKeepalive(mode GameMode, keepalive time.Duration) {
+	m.modeKeepalives[mode] = keepalive
+}
+
+// tickrateFor returns the broadcast tickrate for games of the given mode
+func (m *Matchmaker) tickrateFor(mode GameMode) time.Duration {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	if tickrate, ok := m.modeTickrates[mode]; ok && tickrate > 0 {
+		return tickrate
+	}
+	return m.tickrate
+}
+
+// SetDefaultParams overrides the params applied to games created from now on
+// where unset
+func (m *Matchmaker) SetDefaultParams(params GameParams) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.defaultParams = params
+}
+
+// ApplyConfig changes the defaults of games created from now on. Games
+// already created keep their params.
+func (m *Matchmaker) ApplyConfig(req ConfigRequest) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	if req.LevelTarget != 0 {
+		m.defaultParams.LevelTarget = req.LevelTarget
+	}
+	if req.RoundLengthSecs != 0 {
+		m.defaultParams.RoundLength = time.Duration(req.RoundLengthSecs) * time.Second
+	}
+	for mode, hz := range req.TickratesHz {
+		m.modeTickrates[mode] = time.Second / time.Duration(hz)
+	}
+	slog.Info("updated game config",
+		"level_target", m.defaultParams.LevelTarget,
+		"round_length", m.defaultParams.RoundLength,
+		"tickrates_hz", req.TickratesHz)
+}
+
+// Config returns the defaults new games are created with
+func (m *Matchmaker) Config() ConfigResponse {
+	m.configMu.RLock()
+	params := m.defaultParams
+	m.configMu.RUnlock()
+
+	tickrates := make(map[GameMode]int, len(gameModes))
+	for _, mode := range gameModes {
+		// Games fall back to the server tickrate when it isn't positive
+		tickrate := m.tickrateFor(mode)
+		if tickrate <= 0 {
+			tickrate = ServerTickrate
+		}
+		tickrates[mode] = int(time.Second / tickrate)
+	}
+	return ConfigResponse{
+		LevelTarget:     params.LevelTarget,
+		RoundLengthSecs: int(params.RoundLength.Seconds()),
+		TickratesHz:     tickrates,
+	}
+}
+
+// SetCountdown overrides the countdown durations of new games, falling back
+// to the defaults for durations that aren't positive. It must be called
+// before the matchmaker starts creating games.
+func (m *Matchmaker) SetCountdown(countdown time.Duration, readyCountdown time.Duration) {
+	if err := checkDuration("countdown", countdown); err != nil {
+		slog.Warn("using default countdown", "default", DefaultCountdown, "error", err)
+		countdown = DefaultCountdown
+	}
+	if err := checkDuration("ready countdown", readyCountdown); err != nil {
+		slog.Warn("using default ready countdown", "default", ReadyCountdown, "error", err)
+		readyCountdown = ReadyCountdown
+	}
+	m.countdown = countdown
+	m.readyCountdown = readyCountdown
+}
+
+// newGame creates a game for the given mode, applying defaults for unset params
+func (m *Matchmaker) newGame(mode GameMode, params GameParams) (Game, error) {
+	m.configMu.RLock()
+	defaults := m.defaultParams
+	m.configMu.RUnlock()
+	if params.LevelTarget == 0 {
+		params.LevelTarget = defaults.LevelTarget
+	}
+	if params.RoundLength == 0 {
+		params.RoundLength = defaults.RoundLength
+	}
+	if params.MazeAlgo == "" {
+		params.MazeAlgo = defaults.MazeAlgo
+	}
+	if params.MazeAlgo != "" {
+		if _, err := ParseMazeAlgo(string(params.MazeAlgo)); err != nil {
+			return nil, err
+		}
+	}
+
+	tickrate := m.tickrateFor(mode)
+	game, err := NewModeGame(mode, tickrate, params, m.results)
+	if errors.Is(err, ErrInvalidDuration) {
+		slog.Warn("game timers misconfigured, falling back to defaults",
+			"mode", mode,
+			"error", err)
+		if tickrate <= 0 {
+			tickrate = ServerTickrate
+		}
+		if params.RoundLength <= 0 {
+			params.RoundLength = SprintRoundLength
+		}
+		game, err = NewModeGame(mode, tickrate, params, m.results)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sprint, ok := game.(*SprintGame); ok {
+		sprint.SetLevelCap(m.sprintLevelCap)
+	}
+
+	if params.Layout != "" {
+		layout, err := ParseMazeLayout(params.Layout)
+		if err != nil {
+			game.Cleanup()
+			return nil, err
+		}
+		game.SetLayout(layout)
+	}
+	if params.Seed == 0 {
+		params.Seed = m.seeds()
+	}
+	game.SetSeed(params.Seed)
+	if params.MazeAlgo != "" {
+		game.SetMazeAlgo(params.MazeAlgo)
+	}
+	if m.countdown > 0 {
+		game.SetCountdown(m.countdown, m.readyCountdown)
+	}
+	game.SetLoadingGrace(m.loadingGrace)
+	game.SetAFKTimeout(m.afkTimeout)
+	game.SetResultStore(m.results)
+	game.SetDropCounter(&m.backpressureDrops)
+	game.SetMaxResultPlayers(m.maxResultPlayers)
+	game.SetBroadcastOnChange(m.modeKeepalives[mode])
+	game.SetResultPolicy(m.resultPolicy)
+	game.SetResultTimeout(m.resultTimeout)
+	game.SetMinRoundLength(m.minRoundLength)
+	game.SetRequireEnter(m.requireEnter)
+	return game, nil
+}
+
+// Rematch creates a new game for the players of a finished one, with the same
+// mode and params, and adds the players to it. The maze is regenerated from a
+// fresh seed unless sameMaze is set.
+func (m *Matchmaker) Rematch(prev Game, players []*Client, sameMaze bool) (Game, error) {
+	if m.atCapacity() {
+		return nil, ErrServerBusy
+	}
+
+	params := prev.GetParams()
+	if !sameMaze {
+		params.Seed = 0
+	}
+	game, err := m.newGame(prev.GetMode(), params)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("creating rematch",
+		"previous_game_id", prev.GetID(),
+		"game_id", game.GetID(),
+		"same_maze", sameMaze)
+
+	game.OnOrphaned(func(c *Client) {
+		m.Requeue(c, prev.GetMode())
+	})
+	game.OnRematch(func(players []*Client, sameMaze bool) {
+		m.startRematch(game, players, sameMaze)
+	})
+	game.SetBackfill(m.backfill)
+	game.SetExpectedPlayers(len(players))
+	m.registerGame(game)
+	go game.RunListeners()
+
+	for _, c := range players {
+		if err := game.TryAdd(c); err != nil {
+			return game, err
+		}
+	}
+	return game, nil
+}
+
+// startRematch starts the rematch the players of a finished game voted for,
+// telling them if the server is too busy to host it
+func (m *Matchmaker) startRematch(prev Game, players []*Client, sameMaze bool) {
+	_, err := m.Rematch(prev, players, sameMaze)
+	if err == nil {
+		return
 	}
+	slog.Warn("failed to start rematch",
+		"previous_game_id", prev.GetID(),
+		"error", err)
+	if errors.Is(err, ErrServerBusy) {
+		busy := m.busyResponse()
+		for _, c := range players {
+			c.trySend(busy)
+		}
+	}
+}
 
+// Challenge represents an open invitation to join a head-to-head game
+type Challenge struct {
+	// Where the challenge is in its lifecycle, changed only by transitionChallenge
+	State ChallengeState
+	Mode  GameMode
+	// Number of players that can still accept the challenge
+	OpenSlots int
+	// Player id of the challenge creator, empty for open challenges
+	CreatorID string
+	// Username of the challenge creator, empty for open challenges
+	CreatorName string
+}
+
+// ChallengeIDFormat controls the ids generated for challenge games, which are
+// shared with the invited players
+type ChallengeIDFormat struct {
+	Length int
+	// Characters ids are drawn from, the nanoid default if empty
+	Alphabet string
+}
+
+// Generate returns a random id in the format
+func (f ChallengeIDFormat) Generate() (string, error) {
+	alphabet := f.Alphabet
+	if alphabet == "" {
+		alphabet = nanoidAlphabet
+	}
+	return gonanoid.Generate(alphabet, f.Length)
+}
+
+// ErrChallengeIDsExhausted is returned when no unused challenge id was found
+var ErrChallengeIDsExhausted = errors.New("unable to generate an unused challenge id")
+
+// ErrChallengeLimitReached is returned when a player already has the maximum
+// number of active challenge games
+var ErrChallengeLimitReached = errors.New("challenge limit reached")
+
+// ErrChallengeModeMismatch is returned when accepting a challenge for a
+// different mode than the player expects
+var ErrChallengeModeMismatch = errors.New("challenge is for a different game mode")
+
+// ErrNotChallengeOwner is returned when a player tries to cancel a challenge
+// they didn't create
+var ErrNotChallengeOwner = errors.New("challenge belongs to another player")
+
+// createChallenge creates a game awaiting the given number of players.
+// The game is cancelled if it hasn't filled up before the challenge expires.
+// The creator is nil for open challenges.
+func (m *Matchmaker) createChallenge(mode GameMode, params GameParams, slots int, creator *Player) (Game, error) {
+	if mode != ModeSprint && mode != ModeRace && mode != ModeHybrid {
+		return nil, fmt.Errorf("invalid game mode")
+	}
+
+	if m.atCapacity() {
+		return nil, ErrServerBusy
+	}
+
+	var creatorID, creatorName string
+	if creator != nil {
+		creatorID, creatorName = creator.Id, creator.Username
+	}
+	if creatorID != "" && !m.reserveCreatedGame(creatorID) {
+		return nil, ErrChallengeLimitReached
+	}
+
+	game, err := m.newGame(mode, params)
+	if err != nil {
+		m.releaseCreatedGame(creatorID)
+		return nil, err
+	}
+	if err := m.claimChallengeID(game); err != nil {
+		game.Cleanup()
+		m.releaseCreatedGame(creatorID)
+		return nil, err
+	}
+	if creatorID != "" {
+		go func() {
+			<-game.Context().Done()
+			m.releaseCreatedGame(creatorID)
+		}()
+	}
+
+	m.challenges.Set(game.GetID(), Challenge{
+		State:       ChallengeCreated,
+		Mode:        mode,
+		OpenSlots:   slots,
+		CreatorID:   creatorID,
+		CreatorName: creatorName,
+	})
+	game.OnRematch(func(players []*Client, sameMaze bool) {
+		m.startRematch(game, players, sameMaze)
+	})
 	m.registerGame(game)
 	go game.RunListeners()
-	game.Add() <- c
-	m.activeChallenges.Set(game.GetID(), mode)
+	m.challengeMu.Lock()
+	// The game may already have been torn down, cancelling the challenge
+	if challenge, ok := m.challenges.Get(game.GetID()); ok && challenge.State == ChallengeCreated {
+		m.transitionChallenge(game.GetID(), ChallengeActive)
+	}
+	m.challengeMu.Unlock()
+
+	time.AfterFunc(m.challengeExpiry, func() {
+		m.challengeMu.Lock()
+		challenge, ok := m.challenges.Get(game.GetID())
+		expired := ok && challenge.State == ChallengeActive && m.transitionChallenge(game.GetID(), ChallengeExpired) == nil
+		m.challengeMu.Unlock()
+		if expired {
+			game.Cancel()
+		}
+	})
+
+	return game, nil
+}
+
+// claimChallengeID gives a challenge game an id in the configured format,
+// retrying on collision. The id is reserved in headToHeadGames so games
+// created concurrently can't be given the same one.
+func (m *Matchmaker) claimChallengeID(game Game) error {
+	for range ChallengeIDAttempts {
+		id, err := m.challengeIDs.Generate()
+		if err != nil {
+			return fmt.Errorf("error generating challenge id: %w", err)
+		}
+		// Replays of ended games are kept under their id
+		if _, ok := m.replays.Get(id); ok {
+			continue
+		}
+		game.SetID(id)
+		if m.headToHeadGames.SetIfAbsent(id, game) {
+			return nil
+		}
+	}
+	return ErrChallengeIDsExhausted
+}
+
+// reserveCreatedGame counts a new challenge game created by the player,
+// returning false if they're already at the limit
+func (m *Matchmaker) reserveCreatedGame(playerID string) bool {
+	m.createdMu.Lock()
+	defer m.createdMu.Unlock()
+	created, _ := m.createdGames.Get(playerID)
+	if m.maxChallengesPerPlayer > 0 && created >= m.maxChallengesPerPlayer {
+		return false
+	}
+	m.createdGames.Set(playerID, created+1)
+	return true
+}
+
+// releaseCreatedGame uncounts a challenge game created by the player once it ends
+func (m *Matchmaker) releaseCreatedGame(playerID string) {
+	if playerID == "" {
+		return
+	}
+	m.createdMu.Lock()
+	defer m.createdMu.Unlock()
+	created, _ := m.createdGames.Get(playerID)
+	if created <= 1 {
+		m.createdGames.Del(playerID)
+		return
+	}
+	m.createdGames.Set(playerID, created-1)
+}
+
+// CreateChallengeGame creates a challenge game and adds a player to it
+func (m *Matchmaker) CreateChallengeGame(c *Client, mode GameMode, params GameParams) error {
+	game, err := m.createChallenge(mode, params, 1, c.player)
+	if err != nil {
+		return err
+	}
+
+	c.SetStatus(StatusQueued)
+	if err := game.TryAdd(c); err != nil {
+		c.SetStatus(StatusIdle)
+		return err
+	}
 	createdMsg := MustCreateResponseBytes(RespChallengeCreated, ChallengeCreatedResponse{
 		ChallengeID: game.GetID(),
 	})
-	c.send <- createdMsg
+	c.trySend(createdMsg)
 	return nil
 }
 
+// CreateOpenChallenge creates a challenge game with no creator attached,
+// leaving both slots open to be accepted over the websocket
+func (m *Matchmaker) CreateOpenChallenge(mode GameMode, params GameParams) (string, error) {
+	game, err := m.createChallenge(mode, params, 2, nil)
+	if err != nil {
+		return "", err
+	}
+	return game.GetID(), nil
+}
+
+// Replay returns the recorded replay for a completed game
+func (m *Matchmaker) Replay(gameID string) (*Recorder, bool) {
+	return m.replays.Get(gameID)
+}
+
+// FindDisconnected returns the game and player for a player awaiting
+// reconnection. The player's reconnect token must match, as their id is
+// known to everyone they played against.
+func (m *Matchmaker) FindDisconnected(playerID, token string) (Game, *Player, bool) {
+	if playerID == "" || token == "" {
+		return nil, nil, false
+	}
+	for _, game := range m.headToHeadGames.Values() {
+		if p, ok := game.DisconnectedPlayer(playerID); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(p.ReconnectToken)) != 1 {
+				return nil, nil, false
+			}
+			return game, p, true
+		}
+	}
+	return nil, nil, false
+}
+
 // ChallengeActive responds true if a challenge is active
 func (m *Matchmaker) ChallengeActive(challengeID string) (GameMode, bool) {
-	return m.activeChallenges.Get(challengeID)
+	challenge, ok := m.challenges.Get(challengeID)
+	if !ok || challenge.State != ChallengeActive {
+		return "", false
+	}
+	if game, ok := m.headToHeadGames.Get(challengeID); !ok || m.challengeStale(challenge, game) != nil {
+		return "", false
+	}
+	return challenge.Mode, true
+}
+
+// challengeStale returns an error if an active challenge's game can't be
+// joined. The challenge is closed as soon as its game starts tearing down,
+// and before then if its creator has disconnected, as the game is about to
+// end without them.
+func (m *Matchmaker) challengeStale(challenge Challenge, game Game) error {
+	if game.Context().Err() != nil {
+		return fmt.Errorf("challenge game ended: %v", game.GetID())
+	}
+	if challenge.CreatorID != "" && !game.PlayerConnected(challenge.CreatorID) {
+		return fmt.Errorf("challenge creator disconnected: %v", game.GetID())
+	}
+	return nil
 }
 
-// AcceptChallenge adds a given client to a waiting challenge game
-func (m *Matchmaker) AcceptChallenge(c *Client, challengeID string) error {
+// ChallengeInfo describes a challenge game without joining it, reporting
+// false if there's no such challenge or its game has ended
+func (m *Matchmaker) ChallengeInfo(challengeID string) (GameInfoResponse, bool) {
+	challenge, ok := m.challenges.Get(challengeID)
+	if !ok {
+		return GameInfoResponse{}, false
+	}
+	game, ok := m.headToHeadGames.Get(challengeID)
+	if !ok || game.Context().Err() != nil {
+		return GameInfoResponse{}, false
+	}
+	_, accepting := m.ChallengeActive(challengeID)
+	return GameInfoResponse{
+		ChallengeID: challengeID,
+		Mode:        challenge.Mode,
+		CreatorName: challenge.CreatorName,
+		PlayerCount: game.GetPlayerCount(),
+		Accepting:   accepting,
+	}, true
+}
 
-	if game, ok := m.headToHeadGames.Get(challengeID); !ok {
+// ChallengesCreatedBy returns the active challenges created by the given player
+func (m *Matchmaker) ChallengesCreatedBy(playerID string) []ChallengeSummary {
+	challenges := make([]ChallengeSummary, 0)
+	for id, challenge := range m.challenges.Snapshot() {
+		if challenge.State == ChallengeActive && challenge.CreatorID == playerID {
+			challenges = append(challenges, ChallengeSummary{
+				ChallengeID: id,
+				GameMode:    challenge.Mode,
+				OpenSlots:   challenge.OpenSlots,
+			})
+		}
+	}
+	return challenges
+}
+
+// CancelChallenge cancels an active challenge on behalf of its creator
+func (m *Matchmaker) CancelChallenge(playerID string, challengeID string) error {
+	m.challengeMu.Lock()
+	challenge, ok := m.challenges.Get(challengeID)
+	game, gameOk := m.headToHeadGames.Get(challengeID)
+	if !ok || !gameOk || challenge.State != ChallengeActive {
+		m.challengeMu.Unlock()
 		return fmt.Errorf("challenge id not found: %v", challengeID)
-	} else {
-		m.activeChallenges.Del(challengeID)
-		game.Add() <- c
-		return nil
+	}
+	if challenge.CreatorID == "" || challenge.CreatorID != playerID {
+		m.challengeMu.Unlock()
+		return ErrNotChallengeOwner
+	}
+	m.transitionChallenge(challengeID, ChallengeCancelled)
+	m.challengeMu.Unlock()
+
+	slog.Info("challenge cancelled by creator",
+		"game_id", challengeID,
+		"player_id", playerID)
+	game.Cancel()
+	return nil
+}
+
+// cancelCreatedChallenges cancels the challenges still waiting for players
+// that the given player created. A player's next connection has a new id, so
+// their challenges end with their connection rather than escape the limit.
+func (m *Matchmaker) cancelCreatedChallenges(playerID string) {
+	m.challengeMu.Lock()
+	var games []Game
+	for id, challenge := range m.challenges.Snapshot() {
+		if challenge.State != ChallengeActive || challenge.CreatorID != playerID {
+			continue
+		}
+		if game, ok := m.headToHeadGames.Get(id); ok && m.transitionChallenge(id, ChallengeCancelled) == nil {
+			games = append(games, game)
+		}
+	}
+	m.challengeMu.Unlock()
+
+	for _, game := range games {
+		slog.Info("challenge cancelled as its creator disconnected",
+			"game_id", game.GetID(),
+			"player_id", playerID)
+		game.Cancel()
 	}
 }
 
+// AcceptChallenge adds a given client to a waiting challenge game.
+// The challenge stops being active once all of its slots are taken. If a
+// mode is given the challenge is refused unless its game is of that mode.
+func (m *Matchmaker) AcceptChallenge(c *Client, challengeID string, mode GameMode) error {
+	m.challengeMu.Lock()
+	challenge, ok := m.challenges.Get(challengeID)
+	game, gameOk := m.headToHeadGames.Get(challengeID)
+	if !ok || !gameOk || challenge.State != ChallengeActive {
+		m.challengeMu.Unlock()
+		return fmt.Errorf("challenge id not found: %v", challengeID)
+	}
+	if mode != "" && (mode != challenge.Mode || mode != game.GetMode()) {
+		m.challengeMu.Unlock()
+		return fmt.Errorf("%w: expected %v, challenge %v is %v", ErrChallengeModeMismatch, mode, challengeID, challenge.Mode)
+	}
+	if err := m.challengeStale(challenge, game); err != nil {
+		m.challengeMu.Unlock()
+		return err
+	}
+
+	challenge.OpenSlots--
+	m.challenges.Set(challengeID, challenge)
+	if challenge.OpenSlots <= 0 {
+		m.transitionChallenge(challengeID, ChallengeAccepted)
+	}
+	m.challengeMu.Unlock()
+
+	// The game may be torn down before its listener takes the player
+	if err := game.TryAdd(c); err != nil {
+		return fmt.Errorf("challenge game ended: %w", err)
+	}
+	return nil
+}
+
+// Conn is the subset of *websocket.Conn used by a Client, allowing clients to
+// be driven by other transports
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
 // Client represents a connected websocket client
 type Client struct {
 	player     *Player
+	statusMu   sync.RWMutex
 	status     ClientStatus
+	gameMu     sync.RWMutex
 	activeGame Game
 	mm         *Matchmaker
-	ws         *websocket.Conn
+	ws         Conn
 	send       chan []byte
 	ctx        context.Context
 	cancel     context.CancelFunc
+	// Why the client's connection ended, set by the read pump
+	disconnectReason DisconnectReason
+	logger           *slog.Logger
+	// When the client last joined a queue, guarded by the matchmaker's queueMu
+	queuedAt time.Time
+	// Stable identity supplied by the client, used to detect duplicate connections
+	token string
+	// Set when a newer connection with the same token takes over
+	replaced atomic.Bool
+	// How often the write pump pings the client, 0 to disable
+	pingInterval time.Duration
+	// Recent round trips measured from pongs
+	rtt rttWindow
+	// The party the client queues with, set under the matchmaker's partyMu
+	party atomic.Pointer[Party]
+}
+
+// DisconnectReason describes how a client's connection ended
+type DisconnectReason string
+
+const (
+	// DisconnectClean is a normal close initiated by the client
+	DisconnectClean DisconnectReason = "clean"
+	// DisconnectUnclean is an abnormal close, e.g. a dropped connection or rage quit
+	DisconnectUnclean DisconnectReason = "unclean"
+	// DisconnectReplaced is a connection closed by the server because the same
+	// client opened a newer one
+	DisconnectReplaced DisconnectReason = "replaced"
+)
+
+// closeReason classifies a websocket read error as a clean or unclean disconnect
+func closeReason(err error) DisconnectReason {
+	if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+		return DisconnectClean
+	}
+	return DisconnectUnclean
 }
 
 type ClientStatus string
 
 const (
+	StatusIdle       ClientStatus = "idle"
 	StatusQueued     ClientStatus = "queued"
 	StatusConfirming ClientStatus = "confirming"
+	StatusEntered    ClientStatus = "entered"
 	StatusReady      ClientStatus = "ready"
 	StatusInGame     ClientStatus = "in_game"
 	StatusEndGame    ClientStatus = "end_game"
 )
 
+// allowedMessages lists the request types a client may send in each status
+var allowedMessages = map[ClientStatus][]MessageType{
+	StatusIdle:       {ReqJoinQueue, ReqCreateChallenge, ReqAcceptChallenge, ReqListMyChallenges, ReqGetGameInfo, ReqCancelChallenge, ReqCreateParty, ReqJoinParty, ReqLeaveParty, ReqPong},
+	StatusQueued:     {ReqJoinQueue, ReqLeaveQueue, ReqListMyChallenges, ReqGetGameInfo, ReqCancelChallenge, ReqLeaveParty, ReqPong},
+	StatusConfirming: {ReqEnterGame, ReqPlayerReady, ReqSetReady, ReqPlayerUpdate, ReqPong},
+	StatusEntered:    {ReqPlayerReady, ReqSetReady, ReqPlayerUpdate, ReqPong},
+	StatusReady:      {ReqPlayerReady, ReqSetReady, ReqPlayerUpdate, ReqPong},
+	StatusInGame:     {ReqPlayerUpdate, ReqResync, ReqClientLoaded, ReqExitGame, ReqVoteSurrender, ReqPong},
+	StatusEndGame:    {ReqJoinQueue, ReqCreateChallenge, ReqAcceptChallenge, ReqListMyChallenges, ReqGetGameInfo, ReqCancelChallenge, ReqCreateParty, ReqJoinParty, ReqLeaveParty, ReqRematch, ReqResync, ReqPong},
+}
+
+// MessageAllowed reports whether a client in the given status may send a message type
+func MessageAllowed(status ClientStatus, msgType MessageType) bool {
+	return slices.Contains(allowedMessages[status], msgType)
+}
+
 // NewClient instantiates a new client for a websocket connection
-func NewClient(ws *websocket.Conn, p *Player, mm *Matchmaker) *Client {
+// with a send channel buffering up to sendBufferSize messages
+func NewClient(ws Conn, p *Player, mm *Matchmaker, sendBufferSize int) *Client {
 	ctx, cancel := context.WithCancel(context.TODO())
 	c := &Client{
 		player:     p,
+		status:     StatusIdle,
 		activeGame: nil,
 		mm:         mm,
 		ws:         ws,
-		send:       make(chan []byte, 256),
+		send:       make(chan []byte, sendBufferSize),
 		ctx:        ctx,
 		cancel:     cancel,
+		logger:     slog.Default().With("player_id", p.Id),
+
+		pingInterval: PingInterval,
+	}
+	return c
+}
+
+func (cl *Client) Status() ClientStatus {
+	cl.statusMu.RLock()
+	defer cl.statusMu.RUnlock()
+	return cl.status
+}
+
+func (cl *Client) SetStatus(cs ClientStatus) {
+	cl.statusMu.Lock()
+	defer cl.statusMu.Unlock()
+	cl.status = cs
+}
+
+// ActiveGame returns the game the client is playing, nil if there isn't one
+func (cl *Client) ActiveGame() Game {
+	cl.gameMu.RLock()
+	defer cl.gameMu.RUnlock()
+	return cl.activeGame
+}
+
+// SetActiveGame points the client at the game it's playing, nil once it has
+// left. Games and the matchmaker set it from their own goroutines.
+func (cl *Client) SetActiveGame(g Game) {
+	cl.gameMu.Lock()
+	defer cl.gameMu.Unlock()
+	cl.activeGame = g
+}
+
+// leaveGame clears the client's game if it's still g, reporting whether it was
+func (cl *Client) leaveGame(g Game) bool {
+	cl.gameMu.Lock()
+	defer cl.gameMu.Unlock()
+	if cl.activeGame != g {
+		return false
 	}
-	return c
+	cl.activeGame = nil
+	return true
 }
 
-func (cl *Client) Status() ClientStatus {
-	return cl.status
+// setReady toggles the client between ready and confirming, or between
+// ready and entered if the game must be entered first. It returns false if
+// the client is no longer confirming a game or hasn't entered it.
+func (cl *Client) setReady(ready bool, requireEnter bool) bool {
+	cl.statusMu.Lock()
+	defer cl.statusMu.Unlock()
+	unready := StatusConfirming
+	if requireEnter {
+		unready = StatusEntered
+	}
+	if cl.status != unready && cl.status != StatusReady {
+		return false
+	}
+	cl.status = unready
+	if ready {
+		cl.status = StatusReady
+	}
+	return true
 }
 
-func (cl *Client) SetStatus(cs ClientStatus) {
-	cl.status = cs
+// enterGame moves the client from confirming to entered. It returns false
+// if the client isn't confirming a game.
+func (cl *Client) enterGame() bool {
+	cl.statusMu.Lock()
+	defer cl.statusMu.Unlock()
+	if cl.status != StatusConfirming {
+		return false
+	}
+	cl.status = StatusEntered
+	return true
 }
 
 // StartReading starts the read pump for the client
@@ -271,10 +1570,17 @@ func (cl *Client) StartReading() {
 	for {
 		_, msg, err := cl.ws.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
-				slog.Error("unexpected read error", "error", err)
+			cl.disconnectReason = closeReason(err)
+			if cl.replaced.Load() {
+				cl.disconnectReason = DisconnectReplaced
+				cl.logger.Info("connection replaced")
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				// The websocket has already sent a message too big close frame
+				cl.logger.Warn("message exceeded read limit, closing connection")
+			} else if cl.disconnectReason == DisconnectUnclean {
+				cl.logger.Error("unexpected read error", "error", err)
 			} else {
-				slog.Info("received close message", "error", err)
+				cl.logger.Info("received close message", "error", err)
 			}
 			break
 		}
@@ -282,165 +1588,333 @@ func (cl *Client) StartReading() {
 		var bMsg BaseMessage
 		err = json.Unmarshal(msg, &bMsg)
 		if err != nil {
-			slog.Error("error unmarshalling message",
+			cl.logger.Error("error unmarshalling message",
 				"message", string(msg),
 				"error", err)
 			continue
 		}
 
-		switch bMsg.Type {
-		case ReqJoinQueue:
-			msg, err := ParseMessage[JoinQueueRequest](bMsg)
-			if err != nil {
-				slog.Error("error parsing message",
-					"type", bMsg.Type,
-					"payload", string(bMsg.Payload),
-					"error", err)
-				continue
-			}
-			cl.HandleJoinQueue(msg)
-
-		case ReqLeaveQueue:
-			msg, err := ParseMessage[LeaveQueueRequest](bMsg)
-			if err != nil {
-				slog.Error("error parsing message",
-					"type", bMsg.Type,
-					"error", err)
-				continue
-			}
-			cl.HandleLeaveQueue(msg)
-
-		case ReqPlayerUpdate:
-			msg, err := ParseMessage[PlayerUpdateRequest](bMsg)
-			if err != nil {
-				slog.Error("error parsing message",
-					"type", bMsg.Type,
-					"error", err)
-				continue
-			}
-			cl.HandlePlayerUpdate(msg)
-
-		case ReqPlayerReady:
-			_, err := ParseMessage[PlayerReadyRequest](bMsg)
-			if err != nil {
-				fmt.Printf("error parsing %s: %v\n", bMsg.Type, err)
-				continue
-			}
-			slog.Info("received ready request")
-			cl.SetStatus(StatusReady)
-
-		case ReqCreateChallenge:
-			msg, err := ParseMessage[CreateChallengeRequest](bMsg)
-			if err != nil {
-				slog.Error("error parsing message",
-					"type", bMsg.Type,
-					"payload", string(bMsg.Payload),
-					"error", err)
-				continue
-			}
-			cl.HandleCreateChallenge(msg)
-
-		case ReqAcceptChallenge:
-			msg, err := ParseMessage[AcceptChallengeRequest](bMsg)
-			if err != nil {
-				slog.Error("error parsing message",
-					"type", bMsg.Type,
-					"payload", string(bMsg.Payload),
-					"error", err)
-				continue
-			}
-			cl.HandleAcceptChallenge(msg)
+		if status := cl.Status(); !MessageAllowed(status, bMsg.Type) {
+			cl.logger.Warn("rejected message not allowed in status",
+				"type", bMsg.Type,
+				"status", status)
+			cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{
+				Message: fmt.Sprintf("%v not allowed while %v", bMsg.Type, status),
+			}))
+			continue
+		}
 
-		default:
-			slog.Warn("received unknown message", "message", bMsg)
+		if err := cl.mm.handlers.Dispatch(cl, bMsg); errors.Is(err, ErrUnknownMessage) {
+			cl.logger.Warn("received unknown message", "message", bMsg)
+		} else if err != nil {
+			cl.logger.Error("error parsing message",
+				"type", bMsg.Type,
+				"payload", string(bMsg.Payload),
+				"error", err)
 		}
 
 	}
 }
 
 func (cl *Client) HandleJoinQueue(req *JoinQueueRequest) {
-	slog.Info("received join request", "gameMode", req.GameMode)
-	cl.mm.AddToQueue(cl, req.GameMode)
+	cl.logger.Info("received join request", "gameMode", req.GameMode)
+	err := cl.mm.AddToQueue(cl, req.GameMode)
+	if errors.Is(err, ErrNotPartyLeader) || errors.Is(err, ErrPartyBusy) {
+		cl.logger.Warn("refused party queue request", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+	}
 }
 
 func (cl *Client) HandleLeaveQueue(req *LeaveQueueRequest) {
-	slog.Info("received leave request")
+	cl.logger.Info("received leave request")
 	cl.mm.RemoveFromQueue(cl)
 }
 
 func (cl *Client) HandlePlayerUpdate(req *PlayerUpdateRequest) {
-	cl.player.Level = req.Level
+	if game := cl.ActiveGame(); game != nil {
+		game.UpdatePlayer(cl.player, *req)
+		return
+	}
+	cl.player.SetLevel(req.Level, time.Now())
 	cl.player.Position = req.Position
 	cl.player.Rotation = req.Rotation
-	if cl.activeGame != nil {
-		if req.Level > cl.activeGame.GetMaxLevel() {
-			cl.activeGame.SetMaxLevel(req.Level)
-		}
+}
+
+func (cl *Client) HandleSetReady(ready bool) {
+	game := cl.ActiveGame()
+	if game == nil {
+		cl.setReady(ready, false)
+		return
 	}
+	game.SetReady(cl, ready)
+}
+
+// HandleEnterGame accepts the game the client has been matched into
+func (cl *Client) HandleEnterGame() {
+	cl.logger.Info("received enter game request")
+	game := cl.ActiveGame()
+	if game == nil {
+		cl.logger.Warn("unable to enter game")
+		return
+	}
+	game.EnterGame(cl)
 }
 
 func (cl *Client) HandleCreateChallenge(req *CreateChallengeRequest) {
-	slog.Info("received create challenge request")
-	cl.mm.CreateChallengeGame(cl, req.GameMode)
+	cl.logger.Info("received create challenge request")
+	err := cl.mm.CreateChallengeGame(cl, req.GameMode, req.Params())
+	if errors.Is(err, ErrServerBusy) {
+		cl.logger.Warn("refused challenge creation", "error", err)
+		cl.trySend(cl.mm.busyResponse())
+	} else if errors.Is(err, ErrChallengeLimitReached) {
+		cl.logger.Warn("refused challenge creation", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespChallengeLimitReached, ChallengeLimitResponse{
+			Limit: cl.mm.maxChallengesPerPlayer,
+		}))
+	} else if err != nil {
+		cl.logger.Warn("error creating challenge", "error", err)
+	}
 }
 
 func (cl *Client) HandleAcceptChallenge(req *AcceptChallengeRequest) {
-	slog.Info("received accept challenge request")
-	err := cl.mm.AcceptChallenge(cl, req.ChallengeID)
-	if err != nil {
-		slog.Warn("error accepting challenge", "error", err)
+	cl.logger.Info("received accept challenge request")
+	err := cl.mm.AcceptChallenge(cl, req.ChallengeID, req.GameMode)
+	if errors.Is(err, ErrChallengeModeMismatch) {
+		cl.logger.Warn("refused challenge acceptance", "error", err)
+		challenge, _ := cl.mm.challenges.Get(req.ChallengeID)
+		cl.trySend(MustCreateResponseBytes(RespChallengeModeMismatch, ChallengeModeMismatchResponse{
+			ChallengeID: req.ChallengeID,
+			GameMode:    challenge.Mode,
+		}))
+	} else if err != nil {
+		cl.logger.Warn("error accepting challenge", "error", err)
 		msg := MustCreateResponseBytes(RespChallengeStale, struct{}{})
-		cl.send <- msg
+		cl.trySend(msg)
+	}
+}
+
+func (cl *Client) HandleResync() {
+	cl.logger.Debug("received resync request")
+	if game := cl.ActiveGame(); game == nil || !game.Resync(cl) {
+		cl.logger.Warn("unable to resync client")
+	}
+}
+
+func (cl *Client) HandleClientLoaded() {
+	cl.logger.Debug("received client loaded acknowledgment")
+	if game := cl.ActiveGame(); game != nil {
+		game.MarkLoaded(cl.player.Id)
+	}
+}
+
+// HandlePong records the round trip to the client, updating their connection
+// quality in any game they're playing
+func (cl *Client) HandlePong(req *PongRequest) {
+	rtt := time.Since(time.UnixMilli(req.SentAtMs))
+	if rtt < 0 || rtt > MaxRTT {
+		cl.logger.Warn("discarding implausible round trip", "rtt", rtt)
+		return
+	}
+	quality := cl.rtt.Record(rtt)
+	if game := cl.ActiveGame(); game != nil {
+		game.SetConnection(cl.player, quality)
+	}
+}
+
+// HandleCreateParty creates a party led by the client
+func (cl *Client) HandleCreateParty() {
+	cl.logger.Info("received create party request")
+	if _, err := cl.mm.CreateParty(cl); err != nil {
+		cl.logger.Warn("error creating party", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+	}
+}
+
+// HandleJoinParty adds the client to the party with the requested code
+func (cl *Client) HandleJoinParty(req *JoinPartyRequest) {
+	cl.logger.Info("received join party request", "party", req.Code)
+	if err := cl.mm.JoinParty(cl, req.Code); err != nil {
+		cl.logger.Warn("error joining party", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+	}
+}
+
+// HandleLeaveParty removes the client from their party
+func (cl *Client) HandleLeaveParty() {
+	cl.logger.Info("received leave party request")
+	if err := cl.mm.LeaveParty(cl); err != nil {
+		cl.logger.Warn("error leaving party", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+	}
+}
+
+// HandleVoteSurrender votes to end the player's running game early
+func (cl *Client) HandleVoteSurrender() {
+	cl.logger.Info("received surrender vote")
+	game := cl.ActiveGame()
+	if game == nil {
+		cl.logger.Warn("unable to vote to surrender")
+		return
+	}
+	game.VoteSurrender(cl)
+}
+
+// HandleRematch votes to play the player's finished game again
+func (cl *Client) HandleRematch(req *RematchRequest) {
+	cl.logger.Info("received rematch vote", "same_maze", req.SameMaze)
+	game := cl.ActiveGame()
+	if game == nil {
+		cl.logger.Warn("unable to vote for a rematch")
+		return
+	}
+	game.VoteRematch(cl, req.SameMaze)
+}
+
+// HandleExitGame leaves the practice lobby. Other games can only be left by
+// disconnecting.
+func (cl *Client) HandleExitGame() {
+	cl.logger.Info("received exit game request")
+	game := cl.ActiveGame()
+	if game == nil || game.GetMode() != ModePractice {
+		cl.logger.Warn("unable to exit game")
+		return
+	}
+
+	select {
+	case game.Remove() <- cl:
+	case <-game.Context().Done():
+	}
+	cl.SetActiveGame(nil)
+	cl.player.Active = false
+	cl.SetStatus(StatusIdle)
+	cl.trySend(MustCreateResponseBytes(RespPlayerExited, PlayerExitedResponse{
+		GameID: game.GetID(),
+	}))
+}
+
+func (cl *Client) HandleListMyChallenges() {
+	cl.logger.Info("received list challenges request")
+	msg := MustCreateResponseBytes(RespMyChallenges, MyChallengesResponse{
+		Challenges: cl.mm.ChallengesCreatedBy(cl.player.Id),
+	})
+	cl.trySend(msg)
+}
+
+// HandleGetGameInfo describes a challenge to a player deciding whether to accept it
+func (cl *Client) HandleGetGameInfo(req *GetGameInfoRequest) {
+	cl.logger.Info("received game info request", "challenge_id", req.ChallengeID)
+	info, ok := cl.mm.ChallengeInfo(req.ChallengeID)
+	if !ok {
+		cl.trySend(MustCreateResponseBytes(RespChallengeStale, struct{}{}))
+		return
+	}
+	cl.trySend(MustCreateResponseBytes(RespGameInfo, info))
+}
+
+func (cl *Client) HandleCancelChallenge(req *CancelChallengeRequest) {
+	cl.logger.Info("received cancel challenge request", "challenge_id", req.ChallengeID)
+	err := cl.mm.CancelChallenge(cl.player.Id, req.ChallengeID)
+	if errors.Is(err, ErrNotChallengeOwner) {
+		cl.logger.Warn("refused challenge cancellation", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespError, ErrorResponse{Message: err.Error()}))
+		return
+	} else if err != nil {
+		cl.logger.Warn("error cancelling challenge", "error", err)
+		cl.trySend(MustCreateResponseBytes(RespChallengeStale, struct{}{}))
+		return
 	}
+	cl.trySend(MustCreateResponseBytes(RespChallengeCancelled, ChallengeCancelledResponse{
+		ChallengeID: req.ChallengeID,
+	}))
 }
 
-// StartWriting starts the write pump for the client
+// StartWriting starts the write pump for the client, pinging it to measure
+// latency
 func (cl *Client) StartWriting() {
-	defer cl.ws.Close()
+	var ping <-chan time.Time
+	if cl.pingInterval > 0 {
+		ticker := time.NewTicker(cl.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
 	for {
 		select {
+		case now := <-ping:
+			msg := MustCreateResponseBytes(RespPing, PingResponse{SentAtMs: now.UnixMilli()})
+			if err := cl.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				cl.ws.Close()
+				return
+			}
 		case <-cl.ctx.Done():
+			// Cleanup closes the connection
 			return
 		case message, ok := <-cl.send:
 			if !ok {
+				cl.Close(websocket.CloseNormalClosure, "")
 				return
 			}
 			err := cl.ws.WriteMessage(websocket.TextMessage, message)
 			if err != nil {
+				// The connection is broken, there's no point sending a close frame
+				cl.ws.Close()
 				return
 			}
 		}
 	}
 }
 
+// Close sends a close frame with the given code and reason, so the client
+// sees why the server ended the connection, then closes the connection.
+// A close frame can't be sent if the client already closed the connection or
+// it has dropped, which is not an error.
+func (cl *Client) Close(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := cl.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(CloseWriteTimeout))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		cl.logger.Debug("unable to send close message", "code", code, "error", err)
+	}
+	cl.ws.Close()
+}
+
+// Replace closes the client's connection in favour of a newer one from the
+// same client. The read pump then cleans up as for any other disconnect.
+func (cl *Client) Replace() {
+	cl.replaced.Store(true)
+	cl.Close(websocket.ClosePolicyViolation, "replaced by a new connection")
+}
+
 func (cl *Client) Cleanup() {
 	cl.cancel()
+	cl.mm.UnregisterConnection(cl)
 
 	err := cl.mm.RemoveFromQueue(cl)
 
 	if err != nil {
-		slog.Error("failed to remove client from queue", "error", err)
+		cl.logger.Error("failed to remove client from queue", "error", err)
+	}
+
+	if cl.party.Load() != nil {
+		cl.mm.LeaveParty(cl)
 	}
+	cl.mm.cancelCreatedChallenges(cl.player.Id)
 
-	if cl.activeGame != nil {
-		// Send remove signal to game if it's still active
+	if game := cl.ActiveGame(); game != nil {
+		// Send remove signal to game unless it has already ended
 		select {
-		case cl.activeGame.Remove() <- cl:
-		default:
-			// Game might already be cleaning up, that's ok
+		case game.Remove() <- cl:
+		case <-game.Context().Done():
 		}
-		cl.activeGame = nil
+		cl.SetActiveGame(nil)
 		cl.player.Active = false
 	}
 
-	// Close send channel only if we haven't already
-	if cl.send != nil {
-		close(cl.send)
-		cl.send = nil
-	}
+	// The send channel is left open as games may still be sending to it,
+	// the write pump exits on the cancelled context instead
 
-	cl.ws.Close()
-	slog.Info("cleaned up client", "player", cl.player.Username)
+	cl.Close(websocket.CloseNormalClosure, "")
+	cl.logger.Info("cleaned up client",
+		"player", cl.player.Username,
+		"reason", cl.disconnectReason)
 }
 
 var upgrader = websocket.Upgrader{
@@ -450,18 +1924,56 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// normaliseRegion cleans up a client supplied region, returning an empty
+// region if it isn't a short alphanumeric code such as "eu-west"
+func normaliseRegion(region string) string {
+	region = strings.ToLower(strings.TrimSpace(region))
+	if len(region) > MaxRegionLength {
+		return ""
+	}
+	for _, r := range region {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return ""
+		}
+	}
+	return region
+}
+
 func NewWebsocketHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract player information from query parameters
 		playerName := r.URL.Query().Get("name")
 		playerFlag := r.URL.Query().Get("flag")
+		clientToken := r.URL.Query().Get("client_token")
+
+		// Authenticated players are identified by their token's claims instead
+		var identity string
+		if mm.auth != nil {
+			claims, err := mm.auth.Verify(r.URL.Query().Get("token"))
+			if err != nil {
+				slog.Warn("rejected unauthenticated connection", "error", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			identity = claims.Subject
+			playerName = claims.Name
+			if claims.Flag != "" {
+				playerFlag = claims.Flag
+			}
+			clientToken = identity
+		}
 
 		// Validate required parameters
 		if playerName == "" || playerFlag == "" {
 			http.Error(w, "missing player_name or player_flag parameters", http.StatusBadRequest)
 			return
 		}
+		playerColor, err := ParsePlayerColor(r.URL.Query().Get("color"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Upgrade HTTP connection to WebSocket
 		ws, err := upgrader.Upgrade(w, r, nil)
@@ -469,21 +1981,44 @@ func NewWebsocketHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Req
 			slog.Error("websocket upgrade error", "error", err)
 			return
 		}
+		ws.SetReadLimit(int64(mm.maxMessageBytes))
 
-		// Create player and client instances
+		// Create player and client instances, restoring the player if they're reconnecting
 		player := NewPlayer(playerName, playerFlag)
-		client := NewClient(ws, player, mm)
+		player.Color = playerColor
+		player.Region = normaliseRegion(r.URL.Query().Get("region"))
+		player.Identity = identity
+		game, existing, reconnecting := mm.FindDisconnected(r.URL.Query().Get("player_id"), r.URL.Query().Get("reconnect_token"))
+		// Authenticated players may only reclaim their own player
+		if reconnecting && existing.Identity == identity {
+			player = existing
+		} else {
+			reconnecting = false
+		}
+		client := NewClient(ws, player, mm, mm.sendBufferSize)
+		client.token = clientToken
 
 		slog.Info("new connection",
 			"player", client.player.Username,
 			"flag", client.player.Flag)
 
-		resp, err := CreateMessageBytes(&ConnectedResponse{
-			PlayerID: player.Id,
+		// A client may only hold one connection, the newest takes over
+		if old, ok := mm.RegisterConnection(client); ok {
+			slog.Info("closing duplicate connection",
+				"player", client.player.Username,
+				"replaced_player_id", old.player.Id)
+			old.Replace()
+		}
+
+		resp, err := CreateResponseBytes(RespConnectionConfirmation, ConnectedResponse{
+			PlayerID:       player.Id,
+			ReconnectToken: player.ReconnectToken,
 		})
 
 		if err != nil {
 			slog.Error("error creating connection confirmation", "error", err)
+			client.Close(websocket.CloseInternalServerErr, "")
+			return
 		}
 
 		err = ws.WriteMessage(1, resp)
@@ -495,6 +2030,11 @@ func NewWebsocketHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Req
 		// Start client routines
 
 		go client.StartWriting()
+		if reconnecting {
+			if err := game.Reconnect(client); err != nil {
+				slog.Warn("error reconnecting player", "player", player.Id, "error", err)
+			}
+		}
 		go client.StartReading()
 	}
 }
@@ -523,40 +2063,357 @@ func NewChallengeHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Req
 	}
 }
 
-func main() {
-	// Initialize structured logging
-	zerologLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr})
+func NewCreateChallengeHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateChallengeRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
 
-	logger := slog.New(slogzerolog.Option{Level: slog.LevelDebug, Logger: &zerologLogger}.NewZerologHandler())
-	logger = logger.
-		With("release", "v1.0.0")
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		challengeID, err := mm.CreateOpenChallenge(req.GameMode, req.Params())
+		if errors.Is(err, ErrServerBusy) {
+			retryAfter := mm.retryAfter()
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			slog.Error("error creating challenge", "error", err)
+			http.Error(w, "error creating challenge", http.StatusInternalServerError)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+
+		slog.Info("created challenge over http", "challengeID", challengeID, "mode", req.GameMode)
+
+		body, _ := json.Marshal(ChallengeCreatedResponse{
+			ChallengeID: challengeID,
+			JoinURL:     fmt.Sprintf("%s://%s/api/challenge?id=%s", scheme, r.Host, challengeID),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}
+}
+
+func NewReplayHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		gameID := r.PathValue("id")
+
+		rec, ok := mm.Replay(gameID)
+		if !ok {
+			slog.Warn("replay not found", "game_id", gameID)
+			http.Error(w, fmt.Sprintf("no replay for game id: %v", gameID), http.StatusNotFound)
+			return
+		}
+
+		// Compressed replays are served as is to clients that accept gzip
+		w.Header().Set("Vary", "Accept-Encoding")
+		if gz, ok := rec.Compressed(); ok && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz)
+			return
+		}
+
+		body, err := json.Marshal(rec)
+		if err != nil {
+			slog.Error("error marshalling replay", "game_id", gameID, "error", err)
+			http.Error(w, "error creating replay", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+func NewQueueStatsHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(QueueStatsResponse{
+			Queues:      mm.QueueDepths(),
+			ActiveGames: mm.ActiveGamesByMode(),
+			Aborts:      mm.results.AbortCounts(),
+
+			BackpressureDrops: mm.backpressureDrops.Load(),
+		})
+		if err != nil {
+			slog.Error("error marshalling queue stats", "error", err)
+			http.Error(w, "error reading queue stats", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// NewOnlinePlayersHandler lists the connected players. Player ids are left
+// out as they let a dropped player's game be reclaimed.
+func NewOnlinePlayersHandler(mm *Matchmaker) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(OnlinePlayersResponse{
+			Players: mm.OnlinePlayers(),
+		})
+		if err != nil {
+			slog.Error("error marshalling online players", "error", err)
+			http.Error(w, "error reading online players", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// NewChallengeStatesHandler lists the state of every challenge. The ids are
+// the secrets players join challenges with, so requests must carry the admin
+// token as a bearer token.
+func NewChallengeStatesHandler(mm *Matchmaker, adminToken string) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r, adminToken) {
+			slog.Warn("refused unauthorised challenge listing")
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := json.Marshal(ChallengeStatesResponse{
+			Challenges: mm.ChallengeStates(),
+		})
+		if err != nil {
+			slog.Error("error marshalling challenge states", "error", err)
+			http.Error(w, "error reading challenge states", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// isAdmin reports whether the request carries the admin token as a bearer token
+func isAdmin(r *http.Request, adminToken string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// NewConfigHandler lets ops change the defaults of new games at runtime.
+// Requests must carry the admin token as a bearer token.
+func NewConfigHandler(mm *Matchmaker, adminToken string) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r, adminToken) {
+			slog.Warn("refused unauthorised config change")
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+
+		var req ConfigRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mm.ApplyConfig(req)
+		body, err := json.Marshal(mm.Config())
+		if err != nil {
+			slog.Error("error marshalling config", "error", err)
+			http.Error(w, "error reading config", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// envInt reads a positive integer from the environment, returning def if unset or invalid
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid environment value, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envList reads a comma separated list from the environment, empty if unset
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
 
-	slog.SetDefault(logger)
+func main() {
+	// Initialize structured logging
+	logConfig, err := logConfigFromEnv()
+	slog.SetDefault(newLogger(logConfig))
+	if err != nil {
+		slog.Warn("using default log level", "default", logConfig.Level, "error", err)
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default port if not specified
 	}
 
 	mm := NewMatchmaker(ServerTickrate)
+	mm.sendBufferSize = envInt("SEND_BUFFER_SIZE", DefaultSendBufferSize)
+	mm.maxMessageBytes = envInt("MAX_MESSAGE_BYTES", DefaultMaxMessageBytes)
+	mm.maxGames = envInt("MAX_ACTIVE_GAMES", DefaultMaxActiveGames)
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		mm.auth = NewAuthenticator(secret)
+	}
+	mm.maxChallengesPerPlayer = envInt("MAX_CHALLENGES_PER_PLAYER", DefaultMaxChallengesPerPlayer)
+	challengeIDs := ChallengeIDFormat{
+		Length:   envInt("CHALLENGE_ID_LENGTH", DefaultChallengeIDLength),
+		Alphabet: os.Getenv("CHALLENGE_ID_ALPHABET"),
+	}
+	if _, err := challengeIDs.Generate(); err != nil {
+		slog.Warn("invalid challenge id format, using default", "alphabet", challengeIDs.Alphabet, "error", err)
+	} else {
+		mm.challengeIDs = challengeIDs
+	}
+	// Per mode tickrates are given in ticks per second
+	if hz := envInt("SPRINT_TICKRATE", 0); hz > 0 {
+		mm.SetModeTickrate(ModeSprint, time.Second/time.Duration(hz))
+	}
+	if hz := envInt("RACE_TICKRATE", 0); hz > 0 {
+		mm.SetModeTickrate(ModeRace, time.Second/time.Duration(hz))
+	}
+	if hz := envInt("HYBRID_TICKRATE", 0); hz > 0 {
+		mm.SetModeTickrate(ModeHybrid, time.Second/time.Duration(hz))
+	}
+	// Modes with a keepalive, e.g. PRACTICE_KEEPALIVE_SECS, only broadcast changes
+	for _, mode := range gameModes {
+		if secs := envInt(strings.ToUpper(string(mode))+"_KEEPALIVE_SECS", 0); secs > 0 {
+			mm.SetModeKeepalive(mode, time.Duration(secs)*time.Second)
+		}
+	}
+	mm.compressReplays = os.Getenv("COMPRESS_REPLAYS") == "true"
+	mm.loadingGrace = time.Duration(envInt("LOADING_GRACE_SECS", 0)) * time.Second
+	mm.afkTimeout = time.Duration(envInt("AFK_TIMEOUT_SECS", 0)) * time.Second
+	mm.sprintLevelCap = envInt("SPRINT_LEVEL_CAP", 0)
+	mm.maxResultPlayers = envInt("MAX_RESULT_PLAYERS", 0)
+	mm.resultPolicy = ResultPolicy{
+		MinDuration:     time.Duration(envInt("RESULT_MIN_DURATION_SECS", 0)) * time.Second,
+		RequireProgress: os.Getenv("RESULT_REQUIRE_PROGRESS") == "true",
+	}
+	mm.resultTimeout = time.Duration(envInt("RESULT_DELIVERY_TIMEOUT_SECS", int(ResultDeliveryTimeout.Seconds()))) * time.Second
+	mm.minRoundLength = time.Duration(envInt("MIN_ROUND_LENGTH_SECS", 0)) * time.Second
+	mm.requireEnter = os.Getenv("REQUIRE_ENTER_GAME") == "true"
+	mm.maxPartySize = envInt("MAX_PARTY_SIZE", DefaultMaxPartySize)
+	mm.maxReplays = envInt("MAX_REPLAYS", DefaultMaxReplays)
+	if ttl := envInt("RESULT_TTL_SECS", 0); ttl > 0 {
+		mm.results = NewTTLResultStore(time.Duration(ttl)*time.Second, time.Minute)
+	}
+	if os.Getenv("MATCH_STRATEGY") == "region" {
+		fallback := time.Duration(envInt("REGION_FALLBACK_SECS", int(RegionFallback.Seconds()))) * time.Second
+		mm.strategy = RegionStrategy{FallbackAfter: fallback}
+		go mm.RematchEvery(time.Second, nil)
+	}
+	mm.backfill = BackfillConfig{
+		MaxPlayers:    envInt("BACKFILL_MAX_PLAYERS", 2),
+		Window:        time.Duration(envInt("BACKFILL_WINDOW_SECS", 0)) * time.Second,
+		SpawnAtLeader: os.Getenv("BACKFILL_SPAWN") == "leader",
+	}
+	if name := os.Getenv("MAZE_ALGO"); name != "" {
+		if algo, err := ParseMazeAlgo(name); err != nil {
+			slog.Warn("invalid environment value, using default", "key", "MAZE_ALGO", "value", name, "default", DefaultMazeAlgo)
+		} else {
+			mm.defaultParams.MazeAlgo = algo
+		}
+	}
+	mm.lobby = LobbyConfig{
+		MaxPlayers:  envInt("LOBBY_MAX_PLAYERS", 0),
+		FillTimeout: time.Duration(envInt("LOBBY_FILL_TIMEOUT_SECS", 0)) * time.Second,
+	}
 
 	wsHandler := NewWebsocketHandler(mm)
+	if limit := envInt("CONN_RATE_LIMIT", 0); limit > 0 {
+		window := time.Duration(envInt("CONN_RATE_WINDOW_SECS", 60)) * time.Second
+		limiter := NewConnRateLimiter(limit, window, os.Getenv("TRUST_PROXY") == "true")
+		go limiter.SweepEvery(window, nil)
+		wsHandler = limiter.Limit(wsHandler)
+	}
 	challengeHandler := NewChallengeHandler(mm)
+	createChallengeHandler := NewCreateChallengeHandler(mm)
+	replayHandler := NewReplayHandler(mm)
+	queueStatsHandler := NewQueueStatsHandler(mm)
+	onlinePlayersHandler := NewOnlinePlayersHandler(mm)
+	healthHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	}
+	readyHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	}
+
+	// Browser frontends on the listed origins, e.g.
+	// CORS_ALLOWED_ORIGINS=https://maze.example.com, may call the HTTP API
+	if origins := envList("CORS_ALLOWED_ORIGINS"); len(origins) > 0 {
+		cors := NewCORS(origins, envList("CORS_ALLOWED_METHODS"), envList("CORS_ALLOWED_HEADERS"))
+		challengeHandler = cors.Wrap(challengeHandler)
+		createChallengeHandler = cors.Wrap(createChallengeHandler)
+		replayHandler = cors.Wrap(replayHandler)
+		queueStatsHandler = cors.Wrap(queueStatsHandler)
+		onlinePlayersHandler = cors.Wrap(onlinePlayersHandler)
+		healthHandler = cors.Wrap(healthHandler)
+		readyHandler = cors.Wrap(readyHandler)
+		// Routes registered by method need their own preflight routes
+		for _, path := range []string{"/api/challenge", "/api/games/{id}/replay", "/api/queues", "/api/players"} {
+			http.HandleFunc("OPTIONS "+path, cors.Preflight)
+		}
+	}
 
 	// API routes
 	http.HandleFunc("/api/ws", wsHandler)
-	http.HandleFunc("/api/challenge", challengeHandler)
+	http.HandleFunc("GET /api/challenge", challengeHandler)
+	http.HandleFunc("POST /api/challenge", createChallengeHandler)
+	http.HandleFunc("GET /api/games/{id}/replay", replayHandler)
+	http.HandleFunc("GET /api/queues", queueStatsHandler)
+	http.HandleFunc("GET /api/players", onlinePlayersHandler)
+	// Admin routes, such as runtime config changes, are only enabled with an admin token
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		http.HandleFunc("GET /api/debug/challenges", NewChallengeStatesHandler(mm, adminToken))
+		http.HandleFunc("PUT /api/config", NewConfigHandler(mm, adminToken))
+	}
 
 	// Health and Readiness
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("ok"))
-	})
+	http.HandleFunc("/healthz", healthHandler)
 
-	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("ok"))
-	})
+	http.HandleFunc("/readyz", readyHandler)
 
 	slog.Info("server starting", "port", port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
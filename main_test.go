@@ -0,0 +1,1495 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClientSendBuffer(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+
+	t.Run("default", func(t *testing.T) {
+		c := NewClient(nil, NewPlayer("player1", "🏴"), mm, mm.sendBufferSize)
+		assert.Equal(t, DefaultSendBufferSize, cap(c.send))
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		c := NewClient(nil, NewPlayer("player1", "🏴"), mm, 8)
+		assert.Equal(t, 8, cap(c.send))
+	})
+}
+
+func TestEnvInt(t *testing.T) {
+	t.Setenv("TEST_ENV_INT", "42")
+	assert.Equal(t, 42, envInt("TEST_ENV_INT", 1))
+
+	t.Setenv("TEST_ENV_INT", "-3")
+	assert.Equal(t, 1, envInt("TEST_ENV_INT", 1))
+
+	t.Setenv("TEST_ENV_INT", "")
+	assert.Equal(t, 1, envInt("TEST_ENV_INT", 1))
+}
+
+func TestMessageAllowed(t *testing.T) {
+	testCases := []struct {
+		status  ClientStatus
+		allowed []MessageType
+		denied  []MessageType
+	}{
+		{
+			status:  StatusIdle,
+			allowed: []MessageType{ReqJoinQueue, ReqCreateChallenge, ReqAcceptChallenge, ReqCreateParty, ReqJoinParty, ReqLeaveParty},
+			denied:  []MessageType{ReqLeaveQueue, ReqPlayerUpdate, ReqPlayerReady},
+		},
+		{
+			status:  StatusQueued,
+			allowed: []MessageType{ReqJoinQueue, ReqLeaveQueue},
+			denied:  []MessageType{ReqPlayerUpdate, ReqPlayerReady, ReqCreateChallenge},
+		},
+		{
+			status:  StatusConfirming,
+			allowed: []MessageType{ReqPlayerReady, ReqPlayerUpdate},
+			denied:  []MessageType{ReqJoinQueue, ReqLeaveQueue, ReqAcceptChallenge},
+		},
+		{
+			status:  StatusConfirming,
+			allowed: []MessageType{ReqEnterGame},
+		},
+		{
+			status:  StatusEntered,
+			allowed: []MessageType{ReqPlayerReady, ReqSetReady, ReqPlayerUpdate},
+			denied:  []MessageType{ReqEnterGame, ReqJoinQueue, ReqLeaveQueue},
+		},
+		{
+			status:  StatusReady,
+			allowed: []MessageType{ReqPlayerReady, ReqPlayerUpdate},
+			denied:  []MessageType{ReqJoinQueue, ReqLeaveQueue, ReqCreateChallenge},
+		},
+		{
+			status:  StatusInGame,
+			allowed: []MessageType{ReqPlayerUpdate, ReqVoteSurrender},
+			denied:  []MessageType{ReqJoinQueue, ReqLeaveQueue, ReqPlayerReady, ReqAcceptChallenge},
+		},
+		{
+			status:  StatusQueued,
+			allowed: []MessageType{ReqLeaveParty},
+			denied:  []MessageType{ReqCreateParty, ReqJoinParty},
+		},
+		{
+			status: StatusInGame,
+			denied: []MessageType{ReqCreateParty, ReqJoinParty, ReqLeaveParty},
+		},
+		{
+			status:  StatusEndGame,
+			allowed: []MessageType{ReqJoinQueue, ReqCreateChallenge, ReqAcceptChallenge, ReqCreateParty, ReqJoinParty, ReqLeaveParty, ReqRematch},
+			denied:  []MessageType{ReqPlayerUpdate, ReqPlayerReady, ReqLeaveQueue},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.status), func(t *testing.T) {
+			for _, msgType := range tc.allowed {
+				assert.True(t, MessageAllowed(tc.status, msgType), "%v should be allowed", msgType)
+			}
+			for _, msgType := range tc.denied {
+				assert.False(t, MessageAllowed(tc.status, msgType), "%v should be denied", msgType)
+			}
+		})
+	}
+
+	assert.False(t, MessageAllowed(StatusIdle, "invalid"), "unknown types should be denied")
+}
+
+func TestCreateChallengeHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	handler := NewCreateChallengeHandler(mm)
+
+	t.Run("valid challenge", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"game_mode":"race","level_target":5}`)
+		req := httptest.NewRequest(http.MethodPost, "/api/challenge", body)
+		handler(w, req)
+
+		require.Equal(t, http.StatusCreated, w.Code)
+		var resp ChallengeCreatedResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.NotEmpty(t, resp.ChallengeID)
+		assert.Equal(t, "http://example.com/api/challenge?id="+resp.ChallengeID, resp.JoinURL)
+
+		mode, ok := mm.ChallengeActive(resp.ChallengeID)
+		assert.True(t, ok)
+		assert.Equal(t, ModeRace, mode)
+
+		game, ok := mm.headToHeadGames.Get(resp.ChallengeID)
+		require.True(t, ok)
+		game.Cleanup()
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"game_mode":"invalid"}`)
+		handler(w, httptest.NewRequest(http.MethodPost, "/api/challenge", body))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`not json`)
+		handler(w, httptest.NewRequest(http.MethodPost, "/api/challenge", body))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestQueueStatsHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.sprintQueue = []*Client{newTestClient("player1"), newTestClient("player2")}
+	mm.raceQueue = []*Client{newTestClient("player3")}
+	race := NewRaceGame(ServerTickrate, RaceLevelTarget)
+	defer race.Cleanup()
+	mm.headToHeadGames.Set(race.GetID(), race)
+
+	w := httptest.NewRecorder()
+	NewQueueStatsHandler(mm)(w, httptest.NewRequest(http.MethodGet, "/api/queues", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp QueueStatsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, map[GameMode]int{ModeSprint: 2, ModeRace: 1, ModeHybrid: 0}, resp.Queues)
+	assert.Equal(t, map[GameMode]int{ModeSprint: 0, ModeRace: 1, ModeHybrid: 0, ModeTimeTrial: 0}, resp.ActiveGames)
+	assert.Equal(t, map[AbortReason]int{AbortOrphaned: 0, AbortInsufficientPlayers: 0, AbortGraceExpired: 0}, resp.Aborts)
+}
+
+func TestConfigHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	handler := NewConfigHandler(mm, "secret")
+	put := func(token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/config", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	before, err := mm.newGame(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	defer before.Cleanup()
+
+	assert.Equal(t, http.StatusUnauthorized, put("", `{"level_target":5}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, put("wrong", `{"level_target":5}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put("secret", `{"level_target":500}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put("secret", `{"tickrates_hz":{"sprint":0}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put("secret", `{"tickrates_hz":{"chess":30}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put("secret", `{"unknown":1}`).Code)
+
+	w := put("secret", `{"level_target":5,"round_length_secs":30,"tickrates_hz":{"sprint":60}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp ConfigResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 5, resp.LevelTarget)
+	assert.Equal(t, 30, resp.RoundLengthSecs)
+	assert.Equal(t, 60, resp.TickratesHz[ModeSprint])
+	assert.Equal(t, 30, resp.TickratesHz[ModeRace], "other modes keep the server tickrate")
+
+	after, err := mm.newGame(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	defer after.Cleanup()
+	assert.Equal(t, 30*time.Second, after.(*SprintGame).roundLength)
+	assert.Equal(t, time.Second/60, after.(*SprintGame).tickrate)
+	race, err := mm.newGame(ModeRace, GameParams{})
+	require.NoError(t, err)
+	defer race.Cleanup()
+	assert.Equal(t, 5, race.GetParams().LevelTarget)
+
+	// Games created before the change keep their params
+	assert.Equal(t, SprintRoundLength, before.(*SprintGame).roundLength)
+	assert.Equal(t, ServerTickrate, before.(*SprintGame).tickrate)
+
+	// Without a positive base tickrate games use the server's, as does the config
+	unset := NewMatchmaker(0).Config()
+	assert.Equal(t, int(time.Second/ServerTickrate), unset.TickratesHz[ModeRace])
+}
+
+func TestOpenChallengeAcceptedByBothPlayers(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	challengeID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+	require.NoError(t, err)
+
+	game, ok := mm.headToHeadGames.Get(challengeID)
+	require.True(t, ok)
+	defer game.Cleanup()
+
+	require.NoError(t, mm.AcceptChallenge(newTestClient("player1"), challengeID, ""))
+	_, ok = mm.ChallengeActive(challengeID)
+	assert.True(t, ok, "challenge should stay open for the second player")
+
+	require.NoError(t, mm.AcceptChallenge(newTestClient("player2"), challengeID, ""))
+	_, ok = mm.ChallengeActive(challengeID)
+	assert.False(t, ok, "challenge should close once full")
+
+	assert.Error(t, mm.AcceptChallenge(newTestClient("player3"), challengeID, ""))
+}
+
+func TestAcceptChallengeDuringTeardown(t *testing.T) {
+	for range 20 {
+		mm := NewMatchmaker(ServerTickrate)
+		challengeID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+		require.NoError(t, err)
+		game, ok := mm.headToHeadGames.Get(challengeID)
+		require.True(t, ok)
+
+		const accepters = 8
+		errs := make(chan error, accepters)
+		start := make(chan struct{})
+		for i := range accepters {
+			go func() {
+				<-start
+				errs <- mm.AcceptChallenge(newTestClient("player"+strconv.Itoa(i)), challengeID, "")
+			}()
+		}
+		close(start)
+		game.Cleanup()
+
+		accepted := 0
+		for range accepters {
+			select {
+			case err := <-errs:
+				if err == nil {
+					accepted++
+				}
+			case <-time.After(time.Second):
+				t.Fatal("acceptance blocked on a game being torn down")
+			}
+		}
+		assert.LessOrEqual(t, accepted, 2, "no more players than slots should be accepted")
+
+		// Once torn down every lookup agrees the challenge is gone
+		_, ok = mm.ChallengeActive(challengeID)
+		assert.False(t, ok)
+		assert.Error(t, mm.AcceptChallenge(newTestClient("late"), challengeID, ""))
+		require.True(t, waitFor(time.Second, func() bool {
+			_, registered := mm.headToHeadGames.Get(challengeID)
+			return !registered
+		}))
+	}
+}
+
+func TestAcceptChallengeAfterCreatorDrops(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	creator := newTestClient("creator")
+	creator.mm = mm
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeSprint, GameParams{}))
+	challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+	game, ok := mm.headToHeadGames.Get(challengeID)
+	require.True(t, ok)
+	defer game.Cleanup()
+	require.True(t, waitFor(time.Second, func() bool {
+		_, ok := mm.ChallengeActive(challengeID)
+		return ok
+	}), "challenge should be open while its creator is connected")
+
+	// The creator's connection has ended but the game hasn't removed them yet
+	creator.cancel()
+	_, ok = mm.ChallengeActive(challengeID)
+	assert.False(t, ok)
+
+	acceptor := newTestClient("acceptor")
+	acceptor.mm = mm
+	acceptor.HandleAcceptChallenge(&AcceptChallengeRequest{ChallengeID: challengeID})
+	assert.True(t, receiveType(acceptor, RespChallengeStale, time.Second))
+	assert.Equal(t, 1, game.GetPlayerCount(), "the acceptor shouldn't join the game")
+}
+
+func TestAcceptChallengeMode(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	challengeID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	game, _ := mm.headToHeadGames.Get(challengeID)
+	defer game.Cleanup()
+
+	// A player expecting a race is refused without taking a slot
+	mismatched := newTestClient("player1")
+	mismatched.mm = mm
+	err = mm.AcceptChallenge(mismatched, challengeID, ModeRace)
+	assert.ErrorIs(t, err, ErrChallengeModeMismatch)
+	mismatched.HandleAcceptChallenge(&AcceptChallengeRequest{ChallengeID: challengeID, GameMode: ModeRace})
+	var msg struct {
+		Type    MessageType                   `json:"messageType"`
+		Payload ChallengeModeMismatchResponse `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(<-mismatched.send, &msg))
+	assert.Equal(t, RespChallengeModeMismatch, msg.Type, "player should be told the challenge's mode")
+	assert.Equal(t, ChallengeModeMismatchResponse{ChallengeID: challengeID, GameMode: ModeSprint}, msg.Payload)
+	challenge, _ := mm.challenges.Get(challengeID)
+	assert.Equal(t, 2, challenge.OpenSlots)
+
+	require.NoError(t, mm.AcceptChallenge(newTestClient("player2"), challengeID, ModeSprint))
+	require.NoError(t, mm.AcceptChallenge(newTestClient("player3"), challengeID, ""), "any mode is accepted when none is expected")
+	assert.True(t, waitFor(time.Second, func() bool { return game.GetPlayerCount() == 2 }))
+}
+
+func TestChallengeIDFormat(t *testing.T) {
+	t.Run("unique under concurrency", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		mm.challengeIDs = ChallengeIDFormat{Length: 8, Alphabet: "abcdefgh"}
+
+		const challenges = 50
+		ids := make(chan string, challenges)
+		var wg sync.WaitGroup
+		for range challenges {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id, err := mm.CreateOpenChallenge(ModeRace, GameParams{})
+				assert.NoError(t, err)
+				ids <- id
+			}()
+		}
+		wg.Wait()
+		close(ids)
+
+		seen := make(map[string]bool)
+		for id := range ids {
+			assert.Len(t, id, 8)
+			assert.Empty(t, strings.Trim(id, "abcdefgh"), "ids should be drawn from the alphabet")
+			assert.False(t, seen[id], "duplicate challenge id %v", id)
+			seen[id] = true
+
+			game, ok := mm.headToHeadGames.Get(id)
+			require.True(t, ok)
+			assert.Equal(t, id, game.GetID())
+			game.Cleanup()
+		}
+	})
+
+	t.Run("collisions refused", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		// Only one id is possible
+		mm.challengeIDs = ChallengeIDFormat{Length: 1, Alphabet: "a"}
+
+		first, err := mm.CreateOpenChallenge(ModeRace, GameParams{})
+		require.NoError(t, err)
+		assert.Equal(t, "a", first)
+		game, _ := mm.headToHeadGames.Get(first)
+
+		_, err = mm.CreateOpenChallenge(ModeRace, GameParams{})
+		assert.ErrorIs(t, err, ErrChallengeIDsExhausted)
+		registered, _ := mm.headToHeadGames.Get(first)
+		assert.Same(t, game, registered, "the refused game shouldn't replace the registered one")
+		assert.Equal(t, 1, mm.headToHeadGames.Len())
+	})
+}
+
+func TestGetGameInfo(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	creator := newTestClient("creator")
+	other := newTestClient("other")
+	creator.mm = mm
+	other.mm = mm
+
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeRace, GameParams{}))
+	require.True(t, receiveType(creator, RespChallengeCreated, time.Second))
+	challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+	game, ok := mm.headToHeadGames.Get(challengeID)
+	require.True(t, ok)
+	defer game.Cleanup()
+
+	// gameInfo requests the info over the client, as a player looking at the challenge would
+	gameInfo := func(challengeID string) (GameInfoResponse, bool) {
+		other.HandleGetGameInfo(&GetGameInfoRequest{ChallengeID: challengeID})
+		var base BaseMessage
+		// Skip any countdown messages for the game the player is in
+		for base.Type != RespGameInfo && base.Type != RespChallengeStale {
+			require.NoError(t, json.Unmarshal(<-other.send, &base))
+		}
+		if base.Type == RespChallengeStale {
+			return GameInfoResponse{}, false
+		}
+		var info GameInfoResponse
+		require.NoError(t, json.Unmarshal(base.Payload, &info))
+		return info, true
+	}
+
+	t.Run("active", func(t *testing.T) {
+		require.True(t, waitFor(time.Second, func() bool { return game.GetPlayerCount() == 1 }))
+		info, ok := gameInfo(challengeID)
+		require.True(t, ok)
+		assert.Equal(t, GameInfoResponse{
+			ChallengeID: challengeID,
+			Mode:        ModeRace,
+			CreatorName: "creator",
+			PlayerCount: 1,
+			Accepting:   true,
+		}, info)
+		assert.Equal(t, StatusIdle, other.Status(), "asking about a challenge shouldn't join it")
+	})
+
+	t.Run("full", func(t *testing.T) {
+		require.NoError(t, mm.AcceptChallenge(other, challengeID, ""))
+		require.True(t, waitFor(time.Second, func() bool { return game.GetPlayerCount() == 2 }))
+		info, ok := gameInfo(challengeID)
+		require.True(t, ok)
+		assert.Equal(t, "creator", info.CreatorName)
+		assert.Equal(t, 2, info.PlayerCount)
+		assert.False(t, info.Accepting)
+	})
+
+	t.Run("non-existent", func(t *testing.T) {
+		_, ok := gameInfo("nope")
+		assert.False(t, ok)
+	})
+}
+
+func TestCancelOwnChallenge(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	creator := newTestClient("creator")
+	other := newTestClient("other")
+	creator.mm = mm
+	other.mm = mm
+
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeRace, GameParams{}))
+	require.True(t, receiveType(creator, RespChallengeCreated, time.Second))
+
+	challenges := mm.ChallengesCreatedBy(creator.player.Id)
+	require.Len(t, challenges, 1)
+	assert.Equal(t, ModeRace, challenges[0].GameMode)
+	assert.Empty(t, mm.ChallengesCreatedBy(other.player.Id))
+	challengeID := challenges[0].ChallengeID
+
+	// Only the creator may cancel the challenge
+	other.HandleCancelChallenge(&CancelChallengeRequest{ChallengeID: challengeID})
+	assert.True(t, receiveType(other, RespError, time.Second))
+	assert.ErrorIs(t, mm.CancelChallenge(other.player.Id, challengeID), ErrNotChallengeOwner)
+	_, ok := mm.ChallengeActive(challengeID)
+	require.True(t, ok, "challenge should survive another player's cancellation")
+
+	creator.HandleCancelChallenge(&CancelChallengeRequest{ChallengeID: challengeID})
+	assert.True(t, receiveType(creator, RespChallengeCancelled, time.Second))
+	_, ok = mm.ChallengeActive(challengeID)
+	assert.False(t, ok)
+	assert.True(t, waitFor(time.Second, func() bool {
+		_, ok := mm.headToHeadGames.Get(challengeID)
+		return !ok
+	}), "cancelled challenge game should be removed")
+	// The game's listener returns the creator to the lobby as it exits
+	assert.True(t, receiveType(creator, RespGameEnded, time.Second))
+	assert.Equal(t, StatusIdle, creator.Status())
+	assert.Empty(t, mm.ChallengesCreatedBy(creator.player.Id))
+
+	// Open challenges have no owner to cancel them
+	openID, err := mm.CreateOpenChallenge(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, mm.CancelChallenge(creator.player.Id, openID), ErrNotChallengeOwner)
+	assert.ErrorIs(t, mm.CancelChallenge("", openID), ErrNotChallengeOwner)
+}
+
+func TestChallengeExpires(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.challengeExpiry = 10 * time.Millisecond
+
+	creator := newTestClient("creator")
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeRace, GameParams{}))
+	challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+
+	assert.True(t, waitFor(time.Second, func() bool {
+		_, ok := mm.ChallengeActive(challengeID)
+		return !ok
+	}), "challenge should expire")
+	assert.True(t, waitFor(time.Second, func() bool {
+		_, ok := mm.headToHeadGames.Get(challengeID)
+		return !ok
+	}), "expired challenge game should be removed")
+	assert.True(t, receiveType(creator, RespGameEnded, time.Second), "the creator should be told the game ended")
+	assert.Equal(t, StatusIdle, creator.Status())
+}
+
+func TestMaxActiveGames(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxGames = 1
+
+	creator := newTestClient("creator")
+	creator.mm = mm
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeSprint, GameParams{}))
+	challenge, ok := mm.headToHeadGames.Get(mm.headToHeadGames.Keys()[0])
+	require.True(t, ok)
+
+	t.Run("challenge creation refused at limit", func(t *testing.T) {
+		err := mm.CreateChallengeGame(newTestClient("other"), ModeRace, GameParams{})
+		assert.ErrorIs(t, err, ErrServerBusy)
+		assert.Equal(t, 1, mm.headToHeadGames.Len())
+	})
+
+	t.Run("busy responses back off", func(t *testing.T) {
+		retryHint := func(c *Client) time.Duration {
+			t.Helper()
+			var msg struct {
+				Type    MessageType        `json:"messageType"`
+				Payload ServerBusyResponse `json:"payload"`
+			}
+			require.NoError(t, json.Unmarshal(<-c.send, &msg))
+			require.Equal(t, RespServerBusy, msg.Type)
+			return time.Duration(msg.Payload.RetryAfterMs) * time.Millisecond
+		}
+
+		mm.busyRefusals.Store(0)
+		c := newTestClient("trialist")
+		var hints []time.Duration
+		for range 8 {
+			require.ErrorIs(t, mm.AddToQueue(c, ModeTimeTrial), ErrServerBusy)
+			hints = append(hints, retryHint(c))
+		}
+		assert.Equal(t, RetryAfterBase, hints[0])
+		assert.Equal(t, 2*RetryAfterBase, hints[1])
+		assert.Equal(t, 4*RetryAfterBase, hints[2])
+		assert.Equal(t, RetryAfterMax, hints[len(hints)-1], "hint should be capped")
+
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"game_mode":"race"}`)
+		NewCreateChallengeHandler(mm)(w, httptest.NewRequest(http.MethodPost, "/api/challenge", body))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+		mm.busyRefusals.Store(0)
+	})
+
+	t.Run("queued players wait for capacity", func(t *testing.T) {
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		require.NoError(t, mm.AddToQueue(c1, ModeRace))
+		require.NoError(t, mm.AddToQueue(c2, ModeRace))
+
+		assert.Len(t, mm.raceQueue, 2, "players should wait in the queue")
+		assert.Equal(t, 1, mm.headToHeadGames.Len())
+
+		challenge.Cleanup()
+
+		assert.True(t, waitFor(time.Second, func() bool {
+			mm.queueMu.Lock()
+			defer mm.queueMu.Unlock()
+			return len(mm.raceQueue) == 0
+		}), "waiting players should be matched once capacity frees up")
+		assert.True(t, receiveType(c1, RespGameConfirmed, time.Second))
+
+		for _, game := range mm.headToHeadGames.Values() {
+			game.Cleanup()
+		}
+	})
+}
+
+func TestChallengeLimitPerPlayer(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxChallengesPerPlayer = 2
+	t.Cleanup(func() {
+		for _, game := range mm.headToHeadGames.Values() {
+			game.Cleanup()
+		}
+	})
+
+	// Each challenge is created from a new connection by the same player
+	const creatorID = "abcde"
+	connect := func() *Client {
+		c := newTestClient("creator")
+		player, err := NewPlayerWithID(creatorID, "creator", "🏴")
+		require.NoError(t, err)
+		c.player = player
+		c.mm = mm
+		return c
+	}
+	for range 2 {
+		require.NoError(t, mm.CreateChallengeGame(connect(), ModeSprint, GameParams{}))
+	}
+	games := mm.headToHeadGames.Values()
+
+	err := mm.CreateChallengeGame(connect(), ModeRace, GameParams{})
+	assert.ErrorIs(t, err, ErrChallengeLimitReached)
+	assert.Equal(t, 2, mm.headToHeadGames.Len())
+
+	refused := connect()
+	refused.HandleCreateChallenge(&CreateChallengeRequest{GameMode: ModeRace})
+	var msg struct {
+		Type    MessageType            `json:"messageType"`
+		Payload ChallengeLimitResponse `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(<-refused.send, &msg))
+	assert.Equal(t, RespChallengeLimitReached, msg.Type, "player should be told they're at the limit")
+	assert.Equal(t, 2, msg.Payload.Limit)
+
+	other := newTestClient("other")
+	assert.NoError(t, mm.CreateChallengeGame(other, ModeRace, GameParams{}), "the limit is per player")
+
+	// Ended games no longer count towards the limit
+	games[0].Cleanup()
+	require.True(t, waitFor(time.Second, func() bool {
+		created, _ := mm.createdGames.Get(creatorID)
+		return created == 1
+	}))
+	assert.NoError(t, mm.CreateChallengeGame(connect(), ModeRace, GameParams{}))
+}
+
+func TestChallengesCancelledOnDisconnect(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxChallengesPerPlayer = 1
+	creator := newTestClient("creator")
+	require.NoError(t, mm.CreateChallengeGame(creator, ModeSprint, GameParams{}))
+	challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+	other := newTestClient("other")
+	require.NoError(t, mm.CreateChallengeGame(other, ModeSprint, GameParams{}))
+
+	creator.cancel()
+	mm.cancelCreatedChallenges(creator.player.Id)
+
+	_, ok := mm.ChallengeActive(challengeID)
+	assert.False(t, ok)
+	require.True(t, waitFor(time.Second, func() bool {
+		_, ok := mm.createdGames.Get(creator.player.Id)
+		return !ok
+	}), "the cancelled game shouldn't count towards the limit")
+	assert.Len(t, mm.ChallengesCreatedBy(other.player.Id), 1, "other players' challenges should stay open")
+	for _, game := range mm.headToHeadGames.Values() {
+		game.Cleanup()
+	}
+}
+
+func TestRemoveFromQueue(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	mm.sprintQueue = []*Client{c1}
+	mm.raceQueue = []*Client{c2}
+
+	require.NoError(t, mm.RemoveFromQueue(c2))
+	assert.Empty(t, mm.raceQueue)
+	assert.Equal(t, []*Client{c1}, mm.sprintQueue, "other queues should be untouched")
+	assert.Equal(t, StatusIdle, c2.Status())
+
+	assert.Error(t, mm.RemoveFromQueue(c2))
+}
+
+func TestMultipleQueues(t *testing.T) {
+	// queuesLeft collects the queues a client is told it left until it's
+	// sent a message of the given type
+	queuesLeft := func(t *testing.T, c *Client, until MessageType) []GameMode {
+		t.Helper()
+		var left []GameMode
+		for {
+			select {
+			case raw := <-c.send:
+				var msg BaseMessage
+				require.NoError(t, json.Unmarshal(raw, &msg))
+				switch msg.Type {
+				case RespQueueLeft:
+					var resp QueueLeftResponse
+					require.NoError(t, json.Unmarshal(msg.Payload, &resp))
+					left = append(left, resp.Queue)
+				case until:
+					return left
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("didn't receive %v", until)
+			}
+		}
+	}
+
+	t.Run("matched in one queue", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		require.NoError(t, mm.AddToQueue(c1, ModeSprint))
+		require.NoError(t, mm.AddToQueue(c1, ModeRace))
+		assert.Error(t, mm.AddToQueue(c1, ModeRace), "a queue can only be joined once")
+
+		require.NoError(t, mm.AddToQueue(c2, ModeRace))
+		require.Equal(t, 1, mm.headToHeadGames.Len())
+		game := mm.headToHeadGames.Values()[0]
+		defer game.Cleanup()
+		assert.Equal(t, ModeRace, game.GetMode())
+
+		assert.Equal(t, []GameMode{ModeSprint}, queuesLeft(t, c1, RespGameConfirmed))
+		mm.queueMu.Lock()
+		assert.Empty(t, mm.sprintQueue, "matched players should leave their other queues")
+		mm.queueMu.Unlock()
+	})
+
+	t.Run("leave every queue", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		c := newTestClient("player1")
+		require.NoError(t, mm.AddToQueue(c, ModeSprint))
+		require.NoError(t, mm.AddToQueue(c, ModeHybrid))
+
+		require.NoError(t, mm.RemoveFromQueue(c))
+		c.send <- MustCreateResponseBytes(RespError, ErrorResponse{})
+		assert.ElementsMatch(t, []GameMode{ModeSprint, ModeHybrid}, queuesLeft(t, c, RespError))
+		assert.Empty(t, mm.sprintQueue)
+		assert.Empty(t, mm.hybridQueue)
+		assert.Equal(t, StatusIdle, c.Status())
+	})
+}
+
+func TestQueueSkipsDisconnectedClients(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	gone := newTestClient("gone")
+	require.NoError(t, mm.AddToQueue(gone, ModeRace))
+	gone.cancel()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	require.NoError(t, mm.AddToQueue(c1, ModeRace))
+	require.NoError(t, mm.AddToQueue(c2, ModeRace))
+
+	mm.queueMu.Lock()
+	assert.Empty(t, mm.raceQueue, "disconnected client should be discarded")
+	mm.queueMu.Unlock()
+
+	require.Equal(t, 1, mm.headToHeadGames.Len())
+	game := mm.headToHeadGames.Values()[0]
+	defer game.Cleanup()
+	assert.True(t, receiveType(c1, RespGameConfirmed, time.Second))
+	assert.True(t, receiveType(c2, RespGameConfirmed, time.Second))
+	assert.False(t, receiveType(gone, RespGameConfirmed, 20*time.Millisecond))
+}
+
+func TestCancelledGameRequeuesPlayers(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	require.NoError(t, mm.AddToQueue(c1, ModeRace))
+	require.NoError(t, mm.AddToQueue(c2, ModeRace))
+	require.Equal(t, 1, mm.headToHeadGames.Len())
+	prev := mm.headToHeadGames.Values()[0]
+	require.True(t, waitFor(time.Second, func() bool {
+		return prev.PlayerConnected(c1.player.Id) && prev.PlayerConnected(c2.player.Id)
+	}))
+
+	prev.Cancel()
+	for _, c := range []*Client{c1, c2} {
+		assert.True(t, receiveType(c, RespRequeued, time.Second), "%v should be requeued", c.player.Username)
+	}
+	assert.True(t, waitFor(time.Second, func() bool {
+		for _, g := range mm.headToHeadGames.Values() {
+			if g != prev && g.PlayerConnected(c1.player.Id) && g.PlayerConnected(c2.player.Id) {
+				return true
+			}
+		}
+		return false
+	}), "the requeued players should be matched again")
+
+	for _, g := range mm.headToHeadGames.Values() {
+		g.Cleanup()
+	}
+}
+
+func TestQueueStalledClient(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	stalled := newTestClient("stalled")
+	require.NoError(t, mm.AddToQueue(stalled, ModeSprint))
+	require.NoError(t, mm.AddToQueue(stalled, ModeRace))
+	for len(stalled.send) < cap(stalled.send) {
+		stalled.send <- []byte("{}")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Matching the stalled client tells them they've left the sprint queue
+		assert.NoError(t, mm.AddToQueue(newTestClient("player1"), ModeRace))
+		assert.NoError(t, mm.AddToQueue(newTestClient("player2"), ModeHybrid))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a client with a full buffer shouldn't stall matchmaking")
+	}
+	require.Equal(t, 1, mm.headToHeadGames.Len())
+	game := mm.headToHeadGames.Values()[0]
+	defer game.Cleanup()
+	assert.Equal(t, map[GameMode]int{ModeSprint: 0, ModeRace: 0, ModeHybrid: 1}, mm.QueueDepths())
+}
+
+func TestGameConfirmedDescribesGame(t *testing.T) {
+	// confirmedParams are the params as decoded by clients
+	type confirmedParams struct {
+		LevelTarget   int   `json:"level_target"`
+		RoundLengthMs int64 `json:"round_length_ms"`
+	}
+	// confirmation reads the next game confirmed message sent to a client
+	confirmation := func(t *testing.T, c *Client) (GameConfirmedResponse, confirmedParams) {
+		t.Helper()
+		var confirmed GameConfirmedResponse
+		var params struct {
+			Params confirmedParams `json:"params"`
+		}
+		require.True(t, waitFor(time.Second, func() bool {
+			select {
+			case raw := <-c.send:
+				var msg struct {
+					Type    MessageType     `json:"messageType"`
+					Payload json.RawMessage `json:"payload"`
+				}
+				require.NoError(t, json.Unmarshal(raw, &msg))
+				if msg.Type != RespGameConfirmed {
+					return false
+				}
+				require.NoError(t, json.Unmarshal(msg.Payload, &confirmed))
+				require.NoError(t, json.Unmarshal(msg.Payload, &params))
+				return true
+			default:
+				return false
+			}
+		}), "game confirmed should be sent")
+		return confirmed, params.Params
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		c2.player.Flag = "gb"
+		c2.player.Color = "#ff0000"
+		require.NoError(t, mm.AddToQueue(c1, ModeRace))
+		require.NoError(t, mm.AddToQueue(c2, ModeRace))
+		game := mm.headToHeadGames.Values()[0]
+		defer game.Cleanup()
+
+		confirmed, params := confirmation(t, c1)
+		assert.Equal(t, game.GetID(), confirmed.GameID)
+		assert.Equal(t, ModeRace, confirmed.Mode)
+		assert.Equal(t, game.GetParams().Seed, confirmed.Seed)
+		assert.Equal(t, RaceLevelTarget, params.LevelTarget)
+		assert.Equal(t, []ConfirmedPlayer{{ID: c2.player.Id, Username: "player2", Flag: "gb", Color: "#ff0000"}},
+			confirmed.Opponents, "players should only be told about their opponents")
+
+		confirmed, _ = confirmation(t, c2)
+		require.Len(t, confirmed.Opponents, 1)
+		assert.Equal(t, c1.player.Id, confirmed.Opponents[0].ID)
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		creator := newTestClient("creator")
+		opponent := newTestClient("opponent")
+		require.NoError(t, mm.CreateChallengeGame(creator, ModeSprint, GameParams{RoundLength: 30 * time.Second, Seed: 42}))
+		require.True(t, receiveType(creator, RespChallengeCreated, time.Second))
+		challengeID := mm.ChallengesCreatedBy(creator.player.Id)[0].ChallengeID
+		game, ok := mm.headToHeadGames.Get(challengeID)
+		require.True(t, ok)
+		defer game.Cleanup()
+		require.NoError(t, mm.AcceptChallenge(opponent, challengeID, ""))
+
+		confirmed, params := confirmation(t, opponent)
+		assert.Equal(t, challengeID, confirmed.GameID)
+		assert.Equal(t, ModeSprint, confirmed.Mode)
+		assert.Equal(t, int64(42), confirmed.Seed)
+		assert.Equal(t, int64(30_000), params.RoundLengthMs)
+		require.Len(t, confirmed.Opponents, 1)
+		assert.Equal(t, "creator", confirmed.Opponents[0].Username)
+	})
+}
+
+func TestGameCleanupKeepsReplacement(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	old := NewRaceGame(ServerTickrate, RaceLevelTarget)
+	mm.registerGame(old)
+
+	replacement := NewRaceGame(ServerTickrate, RaceLevelTarget).(*RaceGame)
+	defer replacement.Cleanup()
+	replacement.id = old.GetID()
+	mm.headToHeadGames.Set(old.GetID(), replacement)
+
+	// The cleanup goroutine resets the refusals once it has run
+	mm.busyRefusals.Store(1)
+	old.Cleanup()
+	require.True(t, waitFor(time.Second, func() bool { return mm.busyRefusals.Load() == 0 }))
+
+	game, ok := mm.headToHeadGames.Get(old.GetID())
+	require.True(t, ok, "the replacement game should stay registered")
+	assert.Same(t, replacement, game)
+}
+
+func TestGameCleanupKeepsNewSession(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	old := NewGame(ModeRace, ServerTickrate)
+	next := NewGame(ModeRace, ServerTickrate)
+	defer next.Cleanup()
+
+	playing := newTestClient("playing")
+	queued := newTestClient("queued")
+	finished := newTestClient("finished")
+	for _, c := range []*Client{playing, queued, finished} {
+		c.activeGame = old
+		c.SetStatus(StatusEndGame)
+		old.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+	// Players move on before the finished game is cleaned up
+	playing.activeGame = next
+	playing.SetStatus(StatusInGame)
+	require.NoError(t, mm.AddToQueue(queued, ModeRace))
+
+	old.Cleanup()
+
+	assert.Equal(t, Game(next), playing.activeGame)
+	assert.Equal(t, StatusInGame, playing.Status())
+	assert.False(t, receiveType(playing, RespGameEnded, 20*time.Millisecond))
+	assert.Equal(t, StatusQueued, queued.Status())
+	assert.False(t, receiveType(queued, RespGameEnded, 20*time.Millisecond))
+
+	assert.Nil(t, finished.activeGame)
+	assert.Equal(t, StatusIdle, finished.Status())
+	assert.True(t, receiveType(finished, RespGameEnded, time.Second))
+}
+
+func TestQueueFillsWaitingLobby(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.lobby = LobbyConfig{MaxPlayers: 3, FillTimeout: time.Minute}
+
+	clients := []*Client{newTestClient("player1"), newTestClient("player2"), newTestClient("player3")}
+	for _, c := range clients {
+		require.NoError(t, mm.AddToQueue(c, ModeRace))
+	}
+
+	require.Equal(t, 1, mm.headToHeadGames.Len(), "the third player should join the waiting lobby")
+	game := mm.headToHeadGames.Values()[0].(*RaceGame)
+	defer game.Cleanup()
+	for _, c := range clients {
+		assert.True(t, receiveType(c, RespGameConfirmed, time.Second))
+	}
+	assert.True(t, waitFor(time.Second, game.lobbyClosed.Load), "a full lobby should start the countdown")
+
+	// Once the countdown starts new players get their own game
+	c4 := newTestClient("player4")
+	require.NoError(t, mm.AddToQueue(c4, ModeRace))
+	mm.queueMu.Lock()
+	assert.Equal(t, []*Client{c4}, mm.raceQueue)
+	mm.queueMu.Unlock()
+}
+
+func TestSeedSource(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	next := int64(100)
+	mm.seeds = func() int64 {
+		next++
+		return next
+	}
+
+	first, err := mm.newGame(ModeRace, GameParams{})
+	require.NoError(t, err)
+	defer first.Cleanup()
+	second, err := mm.newGame(ModeSprint, GameParams{})
+	require.NoError(t, err)
+	defer second.Cleanup()
+	assert.Equal(t, int64(101), first.GetParams().Seed)
+	assert.Equal(t, int64(102), second.GetParams().Seed)
+
+	chosen, err := mm.newGame(ModeRace, GameParams{Seed: 7})
+	require.NoError(t, err)
+	defer chosen.Cleanup()
+	assert.Equal(t, int64(7), chosen.GetParams().Seed, "a requested seed should be kept")
+	assert.Equal(t, int64(102), next, "the source shouldn't be used for games given a seed")
+}
+
+func TestRematchSeed(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	prev, err := mm.newGame(ModeRace, GameParams{LevelTarget: 5})
+	require.NoError(t, err)
+	prev.Cleanup()
+	prevSeed := prev.GetParams().Seed
+
+	initialSeed := func(g Game) int64 {
+		t.Helper()
+		msg, err := g.(*RaceGame).State.AsInitialMessage()
+		require.NoError(t, err)
+		var state struct {
+			Payload struct {
+				Seed int64 `json:"seed"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(msg, &state))
+		return state.Payload.Seed
+	}
+
+	t.Run("fresh maze", func(t *testing.T) {
+		game, err := mm.Rematch(prev, nil, false)
+		require.NoError(t, err)
+		defer game.Cleanup()
+
+		assert.NotEqual(t, prevSeed, initialSeed(game), "a fresh maze rematch should change the seed")
+		assert.Equal(t, 5, game.GetParams().LevelTarget)
+	})
+
+	t.Run("same maze", func(t *testing.T) {
+		game, err := mm.Rematch(prev, nil, true)
+		require.NoError(t, err)
+		defer game.Cleanup()
+
+		assert.Equal(t, prevSeed, initialSeed(game), "a same maze rematch should keep the seed")
+		assert.Equal(t, 5, game.GetParams().LevelTarget)
+	})
+}
+
+func TestRematchVote(t *testing.T) {
+	mm := NewMatchmaker(5 * time.Millisecond)
+	mm.SetDefaultParams(GameParams{RoundLength: 50 * time.Millisecond})
+	mm.SetCountdown(10*time.Millisecond, 10*time.Millisecond)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	require.NoError(t, mm.AddToQueue(c1, ModeSprint))
+	require.NoError(t, mm.AddToQueue(c2, ModeSprint))
+	require.Equal(t, 1, mm.headToHeadGames.Len())
+	prev := mm.headToHeadGames.Values()[0]
+	defer prev.Cleanup()
+
+	c1.HandleRematch(&RematchRequest{})
+	assert.True(t, receiveType(c1, RespError, time.Second), "a rematch can't be voted for before the round ends")
+
+	require.True(t, receiveType(c1, RespRoundResult, 2*time.Second))
+	require.True(t, receiveType(c2, RespRoundResult, 2*time.Second))
+	c1.HandleRematch(&RematchRequest{SameMaze: true})
+	assert.True(t, receiveType(c2, RespRematchVote, time.Second), "the other player should be told of the vote")
+	assert.NoError(t, prev.Context().Err(), "the rematch waits for every player")
+
+	c2.HandleRematch(&RematchRequest{SameMaze: true})
+	for _, c := range []*Client{c1, c2} {
+		confirmed, ok := lastConfirmed(t, c)
+		require.True(t, ok, "%v should be confirmed for the rematch", c.player.Username)
+		assert.NotEqual(t, prev.GetID(), confirmed.GameID)
+		assert.Equal(t, prev.GetParams().Seed, confirmed.Seed, "a same maze rematch should keep the seed")
+	}
+	assert.Error(t, prev.Context().Err(), "the finished game should end")
+
+	for _, g := range mm.headToHeadGames.Values() {
+		g.Cleanup()
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected DisconnectReason
+	}{
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, DisconnectClean},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, DisconnectClean},
+		{"abnormal closure", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, DisconnectUnclean},
+		{"network error", io.ErrUnexpectedEOF, DisconnectUnclean},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, closeReason(tc.err))
+		})
+	}
+}
+
+// serveTestClient starts a websocket server that runs the read pump of a
+// client playing the game, reporting the client once it has been cleaned up.
+// The client joins the game first if join is set.
+func serveTestClient(t *testing.T, mm *Matchmaker, game *BaseGame, join bool) (*websocket.Conn, <-chan *Client) {
+	t.Helper()
+	done := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		client := NewClient(ws, NewPlayer("player1", "🏴"), mm, mm.sendBufferSize)
+		client.activeGame = game
+		if join {
+			game.Add() <- client
+			// The listener points the client at the game as it joins
+			require.True(t, waitFor(time.Second, func() bool { return game.isCurrent(client) }))
+		}
+		client.StartReading()
+		done <- client
+	}))
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	return conn, done
+}
+
+func TestDisconnectReason(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	game := NewGame(ModeSprint, ServerTickrate)
+	go game.RunListeners()
+	defer game.Cleanup()
+
+	t.Run("clean close", func(t *testing.T) {
+		conn, done := serveTestClient(t, mm, game, true)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+		require.NoError(t, conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)))
+
+		client := <-done
+		assert.Equal(t, DisconnectClean, client.disconnectReason)
+		assert.True(t, waitFor(time.Second, func() bool {
+			game.State.mu.Lock()
+			defer game.State.mu.Unlock()
+			return client.player.DisconnectReason == DisconnectClean
+		}), "the game should record how the player left")
+	})
+
+	t.Run("unclean close", func(t *testing.T) {
+		conn, done := serveTestClient(t, mm, game, true)
+		conn.NetConn().Close()
+
+		client := <-done
+		assert.Equal(t, DisconnectUnclean, client.disconnectReason)
+		assert.True(t, waitFor(time.Second, func() bool {
+			game.State.mu.Lock()
+			defer game.State.mu.Unlock()
+			return client.player.DisconnectReason == DisconnectUnclean
+		}), "the game should record how the player left")
+	})
+
+	t.Run("busy game", func(t *testing.T) {
+		// Nothing listens until the test does, as if the listener were busy
+		busy := NewGame(ModeSprint, ServerTickrate)
+		defer busy.Cleanup()
+		conn, done := serveTestClient(t, mm, busy, false)
+		conn.NetConn().Close()
+		time.Sleep(20 * time.Millisecond)
+
+		select {
+		case <-busy.remove:
+		case <-time.After(time.Second):
+			t.Fatal("the game should be told the player left")
+		}
+		<-done
+	})
+}
+
+func TestGameCreationFailure(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.defaultParams.MazeAlgo = "bogus"
+
+	t.Run("head to head", func(t *testing.T) {
+		c1 := newTestClient("player1")
+		c2 := newTestClient("player2")
+		require.NoError(t, mm.AddToQueue(c1, ModeRace))
+		require.NoError(t, mm.AddToQueue(c2, ModeRace))
+
+		assert.Equal(t, 0, mm.headToHeadGames.Len())
+		for _, c := range []*Client{c1, c2} {
+			assert.True(t, receiveType(c, RespError, time.Second), "players should be told the game failed")
+			assert.Equal(t, StatusQueued, c.Status(), "players should keep their place in the queue")
+		}
+		assert.Len(t, mm.raceQueue, 2)
+	})
+
+	t.Run("time trial", func(t *testing.T) {
+		c := newTestClient("player1")
+		assert.Error(t, mm.AddToQueue(c, ModeTimeTrial))
+		assert.True(t, receiveType(c, RespError, time.Second))
+		assert.Equal(t, StatusIdle, c.Status())
+	})
+}
+
+func TestRequeueOnOpponentDropDuringCountdown(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	require.NoError(t, mm.AddToQueue(c1, ModeRace))
+	require.NoError(t, mm.AddToQueue(c2, ModeRace))
+
+	require.Equal(t, 1, mm.headToHeadGames.Len())
+	game := mm.headToHeadGames.Values()[0]
+	require.True(t, receiveType(c2, RespGameConfirmed, time.Second))
+	// The listener only reads the grace once a player drops
+	game.(*RaceGame).reconnectGrace = 20 * time.Millisecond
+
+	c1.cancel()
+	game.Remove() <- c1
+
+	require.True(t, receiveType(c2, RespGamePaused, time.Second), "the pairing should wait for the dropped player")
+	require.True(t, receiveType(c2, RespRequeued, time.Second), "remaining player should be requeued once the grace expires")
+	<-game.Context().Done()
+
+	mm.queueMu.Lock()
+	assert.Equal(t, []*Client{c2}, mm.raceQueue)
+	mm.queueMu.Unlock()
+	assert.Equal(t, StatusQueued, c2.Status())
+
+	// The requeued player is matched with the next arrival
+	c3 := newTestClient("player3")
+	require.NoError(t, mm.AddToQueue(c3, ModeRace))
+	assert.True(t, receiveType(c2, RespGameConfirmed, time.Second))
+	assert.True(t, receiveType(c3, RespGameConfirmed, time.Second))
+
+	for _, g := range mm.headToHeadGames.Values() {
+		g.Cleanup()
+	}
+}
+
+func TestNewGameFallsBackToDefaultTimers(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		mm := NewMatchmaker(d)
+		mm.SetDefaultParams(GameParams{LevelTarget: RaceLevelTarget, RoundLength: d})
+		mm.SetCountdown(d, d)
+		assert.Equal(t, DefaultCountdown, mm.countdown)
+		assert.Equal(t, ReadyCountdown, mm.readyCountdown)
+
+		g, err := mm.newGame(ModeHybrid, GameParams{})
+		require.NoError(t, err, "misconfigured timers should fall back to the defaults")
+		game := g.(*HybridGame)
+		assert.Equal(t, ServerTickrate, game.tickrate)
+		assert.Equal(t, SprintRoundLength, game.roundLength)
+		assert.Equal(t, SprintRoundLength, game.GetParams().RoundLength)
+		game.Cleanup()
+	}
+}
+
+func TestModeTickrateOverride(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.SetModeTickrate(ModeSprint, time.Second/60)
+	mm.SetModeTickrate(ModeRace, time.Second/20)
+
+	tests := []struct {
+		mode     GameMode
+		tickrate time.Duration
+	}{
+		{ModeSprint, time.Second / 60},
+		{ModeRace, time.Second / 20},
+		{ModeTimeTrial, ServerTickrate},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			g, err := mm.newGame(tt.mode, GameParams{})
+			require.NoError(t, err)
+			defer g.Cleanup()
+
+			var base *BaseGame
+			switch game := g.(type) {
+			case *SprintGame:
+				base = game.BaseGame
+			case *RaceGame:
+				base = game.BaseGame
+			case *TimeTrialGame:
+				base = game.BaseGame
+			}
+			require.NotNil(t, base)
+			// The broadcaster ticker is created from the game's tickrate
+			assert.Equal(t, tt.tickrate, base.tickrate)
+		})
+	}
+}
+
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxMessageBytes = 256
+	server := httptest.NewServer(http.HandlerFunc(NewWebsocketHandler(mm)))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?name=player1&flag=US", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	// Messages within the limit are handled as usual
+	require.NoError(t, conn.WriteJSON(map[string]any{
+		"messageType": ReqJoinQueue,
+		"payload":     map[string]any{"game_mode": ModeSprint},
+	}))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(msg), RespQueueJoined)
+
+	require.NoError(t, conn.WriteJSON(map[string]any{
+		"messageType": ReqLeaveQueue,
+		"payload":     strings.Repeat("x", 512),
+	}))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var closeErr *websocket.CloseError
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			require.ErrorAs(t, err, &closeErr)
+			break
+		}
+	}
+	assert.Equal(t, websocket.CloseMessageTooBig, closeErr.Code)
+
+	require.True(t, waitFor(time.Second, func() bool {
+		mm.queueMu.Lock()
+		defer mm.queueMu.Unlock()
+		return len(mm.sprintQueue) == 0
+	}), "the closed connection should leave the queue")
+}
+
+func TestNormaliseRegion(t *testing.T) {
+	assert.Equal(t, "eu-west", normaliseRegion(" EU-West "))
+	assert.Equal(t, "", normaliseRegion(""))
+	assert.Equal(t, "", normaliseRegion("eu west"))
+	assert.Equal(t, "", normaliseRegion("<script>"))
+	assert.Equal(t, "", normaliseRegion(strings.Repeat("a", MaxRegionLength+1)))
+}
+
+func TestDuplicateConnectionTakesOver(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	server := httptest.NewServer(http.HandlerFunc(NewWebsocketHandler(mm)))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?name=player1&flag=US&client_token=tab"
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), RespConnectionConfirmation)
+		return conn
+	}
+
+	first := dial()
+	require.NoError(t, first.WriteJSON(map[string]any{
+		"messageType": ReqJoinQueue,
+		"payload":     map[string]any{"game_mode": ModeSprint},
+	}))
+	require.True(t, waitFor(time.Second, func() bool {
+		mm.queueMu.Lock()
+		defer mm.queueMu.Unlock()
+		return len(mm.sprintQueue) == 1
+	}))
+	original, ok := mm.connections.Get("tab")
+	require.True(t, ok)
+
+	dial()
+
+	// The original connection is closed by the server
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	var closeErr *websocket.CloseError
+	for {
+		_, _, err := first.ReadMessage()
+		if err != nil {
+			require.ErrorAs(t, err, &closeErr)
+			break
+		}
+	}
+	assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+
+	require.True(t, waitFor(time.Second, func() bool {
+		mm.queueMu.Lock()
+		defer mm.queueMu.Unlock()
+		return len(mm.sprintQueue) == 0
+	}), "the replaced connection should leave the queue")
+	assert.Equal(t, DisconnectReplaced, original.disconnectReason)
+
+	current, ok := mm.connections.Get("tab")
+	require.True(t, ok, "the new connection should remain registered")
+	assert.NotSame(t, original, current)
+
+	// Connections without a token are never treated as duplicates
+	other, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?name=player1&flag=US", nil)
+	require.NoError(t, err)
+	defer other.Close()
+	assert.Equal(t, 1, mm.connections.Len())
+}
+
+func TestOnlinePlayers(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	server := httptest.NewServer(http.HandlerFunc(NewWebsocketHandler(mm)))
+	t.Cleanup(server.Close)
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Contains(t, string(msg), RespConnectionConfirmation)
+		return conn
+	}
+	online := func() []OnlinePlayer {
+		w := httptest.NewRecorder()
+		NewOnlinePlayersHandler(mm)(w, httptest.NewRequest(http.MethodGet, "/api/players", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp OnlinePlayersResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Players
+	}
+
+	assert.Empty(t, online())
+
+	bob := dial("name=bob&flag=GB")
+	dial("name=alice&flag=US&client_token=tab")
+	require.NoError(t, bob.WriteJSON(map[string]any{
+		"messageType": ReqJoinQueue,
+		"payload":     map[string]any{"game_mode": ModeRace},
+	}))
+	require.True(t, waitFor(time.Second, func() bool {
+		return len(online()) == 2 && online()[1].Status == StatusQueued
+	}))
+	assert.Equal(t, []OnlinePlayer{
+		{Username: "alice", Flag: "US", Status: StatusIdle},
+		{Username: "bob", Flag: "GB", Status: StatusQueued},
+	}, online())
+
+	// Once a connection is taken over the player is only listed once
+	dial("name=alice&flag=US&client_token=tab")
+	assert.True(t, waitFor(time.Second, func() bool { return len(online()) == 2 }))
+
+	bob.Close()
+	assert.True(t, waitFor(time.Second, func() bool {
+		players := online()
+		return len(players) == 1 && players[0].Username == "alice"
+	}), "disconnected players should be removed")
+}
+
+func TestServerCloseSendsCloseFrame(t *testing.T) {
+	// dial connects to a server which hands its side of the connection to close
+	dial := func(close func(cl *Client)) *websocket.Conn {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			close(NewClient(ws, NewPlayer("player1", "US"), nil, 1))
+		}))
+		t.Cleanup(server.Close)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	t.Run("send channel closed", func(t *testing.T) {
+		conn := dial(func(cl *Client) {
+			cl.send <- []byte("last message")
+			close(cl.send)
+			cl.StartWriting()
+		})
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "last message", string(msg), "pending messages should be delivered before closing")
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseNormalClosure, closeErr.Code)
+	})
+
+	t.Run("explicit code", func(t *testing.T) {
+		conn := dial(func(cl *Client) {
+			cl.Close(websocket.CloseGoingAway, "server shutting down")
+		})
+
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+		assert.Equal(t, "server shutting down", closeErr.Text)
+	})
+}
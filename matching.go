@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// MatchStrategy selects which two queued players should be paired into a game
+type MatchStrategy interface {
+	// SelectPair returns the indices of the two players in the queue to match,
+	// or false if no suitable pair is waiting. The queue is oldest first.
+	SelectPair(queue []*Client) (int, int, bool)
+}
+
+// FIFOStrategy pairs the two players who have been waiting longest
+type FIFOStrategy struct{}
+
+func (FIFOStrategy) SelectPair(queue []*Client) (int, int, bool) {
+	if len(queue) < 2 {
+		return 0, 0, false
+	}
+	return 0, 1, true
+}
+
+// BalancedStrategy pairs the longest waiting player with the queued player
+// closest to them by some attribute, e.g. rating or region. Ties are broken
+// in favour of whoever has waited longest.
+type BalancedStrategy struct {
+	// Distance is how poorly two players are matched, 0 being a perfect match
+	Distance func(a, b *Player) int
+}
+
+func (s BalancedStrategy) SelectPair(queue []*Client) (int, int, bool) {
+	if len(queue) < 2 {
+		return 0, 0, false
+	}
+
+	best := 1
+	bestDistance := s.Distance(queue[0].player, queue[1].player)
+	for i := 2; i < len(queue) && bestDistance > 0; i++ {
+		if d := s.Distance(queue[0].player, queue[i].player); d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	return 0, best, true
+}
+
+// RegionStrategy buckets queued players by region, pairing the longest
+// waiting players within a region first. A player who has waited longer than
+// FallbackAfter without a same-region opponent is matched across regions.
+type RegionStrategy struct {
+	FallbackAfter time.Duration
+}
+
+func (s RegionStrategy) SelectPair(queue []*Client) (int, int, bool) {
+	// Each bucket holds queue indices, so oldest first
+	buckets := make(map[string][]int)
+	for i, c := range queue {
+		buckets[c.player.Region] = append(buckets[c.player.Region], i)
+	}
+
+	var i, j int
+	found := false
+	for _, bucket := range buckets {
+		if len(bucket) >= 2 && (!found || bucket[0] < i) {
+			i, j, found = bucket[0], bucket[1], true
+		}
+	}
+	if found {
+		return i, j, true
+	}
+
+	// Every region now has at most one player waiting
+	if len(queue) >= 2 && time.Since(queue[0].queuedAt) >= s.FallbackAfter {
+		return 0, 1, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queueOf creates a queue of test clients with the given flags, oldest first
+func queueOf(flags ...string) []*Client {
+	queue := make([]*Client, 0, len(flags))
+	for _, flag := range flags {
+		c := newTestClient(flag)
+		c.player.Flag = flag
+		queue = append(queue, c)
+	}
+	return queue
+}
+
+// sameFlag is a distance matching players who share a flag
+func sameFlag(a, b *Player) int {
+	if a.Flag == b.Flag {
+		return 0
+	}
+	return 1
+}
+
+func TestFIFOStrategy(t *testing.T) {
+	var strategy FIFOStrategy
+
+	_, _, ok := strategy.SelectPair(queueOf("US"))
+	assert.False(t, ok, "a single player can't be paired")
+
+	i, j, ok := strategy.SelectPair(queueOf("US", "UK", "US"))
+	require.True(t, ok)
+	assert.Equal(t, 0, i)
+	assert.Equal(t, 1, j)
+}
+
+func TestBalancedStrategy(t *testing.T) {
+	strategy := BalancedStrategy{Distance: sameFlag}
+
+	_, _, ok := strategy.SelectPair(queueOf("US"))
+	assert.False(t, ok)
+
+	i, j, ok := strategy.SelectPair(queueOf("US", "UK", "FR", "US", "US"))
+	require.True(t, ok)
+	assert.Equal(t, 0, i)
+	assert.Equal(t, 3, j, "the oldest matching player should be chosen")
+
+	// The oldest player is still matched if nobody is a good fit
+	i, j, ok = strategy.SelectPair(queueOf("US", "UK", "FR"))
+	require.True(t, ok)
+	assert.Equal(t, 0, i)
+	assert.Equal(t, 1, j)
+}
+
+func TestAddToQueueUsesStrategy(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.strategy = BalancedStrategy{Distance: sameFlag}
+
+	queue := queueOf("US", "UK", "US")
+	mm.queueMu.Lock()
+	mm.sprintQueue = slices.Clone(queue[:2])
+	mm.queueMu.Unlock()
+	mm.AddToQueue(queue[2], ModeSprint)
+
+	mm.queueMu.Lock()
+	assert.Equal(t, []*Client{queue[1]}, mm.sprintQueue, "the player without a match should be left waiting")
+	mm.queueMu.Unlock()
+
+	games := mm.headToHeadGames.Values()
+	require.Len(t, games, 1)
+	game := games[0].(*SprintGame)
+	defer game.Cleanup()
+	require.True(t, waitFor(time.Second, func() bool { return game.Clients.Len() == 2 }))
+	for _, c := range []*Client{queue[0], queue[2]} {
+		_, ok := game.Clients.Get(c.player.Id)
+		assert.True(t, ok, "players sharing a flag should be matched")
+	}
+}
+
+// regionQueueOf creates a queue of test clients in the given regions, oldest first
+func regionQueueOf(regions ...string) []*Client {
+	queue := queueOf(regions...)
+	for i, c := range queue {
+		c.player.Region = regions[i]
+		c.queuedAt = time.Now()
+	}
+	return queue
+}
+
+func TestRegionStrategy(t *testing.T) {
+	strategy := RegionStrategy{FallbackAfter: time.Minute}
+
+	i, j, ok := strategy.SelectPair(regionQueueOf("eu", "us", "ap", "us", "eu"))
+	require.True(t, ok)
+	assert.Equal(t, 0, i, "the longest waiting player with a regional match goes first")
+	assert.Equal(t, 4, j)
+
+	i, j, ok = strategy.SelectPair(regionQueueOf("eu", "us", "ap", "us"))
+	require.True(t, ok)
+	assert.Equal(t, 1, i)
+	assert.Equal(t, 3, j)
+
+	queue := regionQueueOf("eu", "us")
+	_, _, ok = strategy.SelectPair(queue)
+	assert.False(t, ok, "cross-region players shouldn't be matched before the fallback")
+
+	queue[0].queuedAt = time.Now().Add(-2 * time.Minute)
+	i, j, ok = strategy.SelectPair(queue)
+	require.True(t, ok, "players should be matched across regions after the fallback")
+	assert.Equal(t, 0, i)
+	assert.Equal(t, 1, j)
+}
+
+func TestRegionMatchingPrefersSameRegion(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.strategy = RegionStrategy{FallbackAfter: time.Minute}
+
+	queue := regionQueueOf("eu", "us", "eu")
+	for _, c := range queue {
+		require.NoError(t, mm.AddToQueue(c, ModeRace))
+	}
+
+	games := mm.headToHeadGames.Values()
+	require.Len(t, games, 1, "the two players in the same region should be matched")
+	game := games[0].(*RaceGame)
+	defer game.Cleanup()
+	require.True(t, waitFor(time.Second, func() bool { return game.Clients.Len() == 2 }))
+	for _, c := range []*Client{queue[0], queue[2]} {
+		_, ok := game.Clients.Get(c.player.Id)
+		assert.True(t, ok)
+	}
+
+	// The lone player is only matched across regions once they've waited
+	late := regionQueueOf("ap")[0]
+	require.NoError(t, mm.AddToQueue(late, ModeRace))
+	assert.Equal(t, 1, mm.headToHeadGames.Len())
+
+	mm.queueMu.Lock()
+	queue[1].queuedAt = time.Now().Add(-2 * time.Minute)
+	mm.queueMu.Unlock()
+	stop := make(chan struct{})
+	defer close(stop)
+	go mm.RematchEvery(5*time.Millisecond, stop)
+	require.True(t, waitFor(time.Second, func() bool { return mm.headToHeadGames.Len() == 2 }))
+	for _, g := range mm.headToHeadGames.Values() {
+		defer g.Cleanup()
+	}
+}
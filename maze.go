@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Bounds on the dimensions of a custom maze layout
+const (
+	MinMazeSize int = 5
+	MaxMazeSize int = 64
+)
+
+// MazeAlgo identifies the algorithm clients use to generate a maze from the
+// game's seed. Every player in a game must use the same algorithm, or their
+// mazes won't match.
+type MazeAlgo string
+
+const (
+	AlgoRecursiveBacktracker MazeAlgo = "recursive-backtracker"
+	AlgoPrims                MazeAlgo = "prims"
+)
+
+// DefaultMazeAlgo is used for games which don't request an algorithm
+const DefaultMazeAlgo = AlgoRecursiveBacktracker
+
+// mazeAlgos are the algorithms clients know how to generate mazes with
+var mazeAlgos = []MazeAlgo{AlgoRecursiveBacktracker, AlgoPrims}
+
+// ParseMazeAlgo validates a maze algorithm name against the known algorithms
+func ParseMazeAlgo(name string) (MazeAlgo, error) {
+	algo := MazeAlgo(name)
+	if !slices.Contains(mazeAlgos, algo) {
+		return "", fmt.Errorf("unknown maze algorithm %q, must be one of: %v", name, mazeAlgos)
+	}
+	return algo, nil
+}
+
+// MazeLayout is a custom maze shared between the players of a game, in place
+// of the maze clients would otherwise generate from the game's seed.
+//
+// Layouts are encoded as "<width>x<height>:<cells>", where cells is the
+// unpadded base64url encoding of a row-major bitset with a 1 for each wall.
+type MazeLayout struct {
+	Width  int
+	Height int
+	walls  []byte
+}
+
+// ParseMazeLayout decodes and validates an encoded maze layout
+func ParseMazeLayout(encoded string) (MazeLayout, error) {
+	size, cells, ok := strings.Cut(encoded, ":")
+	if !ok {
+		return MazeLayout{}, fmt.Errorf("layout must be of the form <width>x<height>:<cells>")
+	}
+
+	w, h, ok := strings.Cut(size, "x")
+	if !ok {
+		return MazeLayout{}, fmt.Errorf("layout size must be of the form <width>x<height>")
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return MazeLayout{}, fmt.Errorf("invalid layout width: %w", err)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return MazeLayout{}, fmt.Errorf("invalid layout height: %w", err)
+	}
+	if width < MinMazeSize || width > MaxMazeSize || height < MinMazeSize || height > MaxMazeSize {
+		return MazeLayout{}, fmt.Errorf("layout dimensions must be between %v and %v", MinMazeSize, MaxMazeSize)
+	}
+
+	walls, err := base64.RawURLEncoding.DecodeString(cells)
+	if err != nil {
+		return MazeLayout{}, fmt.Errorf("invalid layout cells: %w", err)
+	}
+	bits := width * height
+	if len(walls) != (bits+7)/8 {
+		return MazeLayout{}, fmt.Errorf("layout has %v bytes of cells, expected %v", len(walls), (bits+7)/8)
+	}
+	// Trailing bits beyond the last cell must be clear so each maze has one encoding
+	if spare := len(walls)*8 - bits; spare > 0 && walls[len(walls)-1]&(1<<spare-1) != 0 {
+		return MazeLayout{}, fmt.Errorf("layout has cells beyond its dimensions")
+	}
+
+	return MazeLayout{
+		Width:  width,
+		Height: height,
+		walls:  walls,
+	}, nil
+}
+
+// Wall reports whether the cell at column x of row y is a wall
+func (l MazeLayout) Wall(x, y int) bool {
+	i := y*l.Width + x
+	return l.walls[i/8]&(1<<(7-i%8)) != 0
+}
+
+// String returns the encoded form of the layout
+func (l MazeLayout) String() string {
+	return fmt.Sprintf("%dx%d:%s", l.Width, l.Height, base64.RawURLEncoding.EncodeToString(l.walls))
+}
+
+// SpawnSpread is how far apart, in cells, the outermost players are spawned
+// within the start cell
+const SpawnSpread float64 = 0.5
+
+// StartCell returns the column and row of the layout's first open cell in
+// row-major order, which players start from
+func (l MazeLayout) StartCell() (int, int, bool) {
+	for y := range l.Height {
+		for x := range l.Width {
+			if !l.Wall(x, y) {
+				return x, y, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// SpawnPositions returns a spawn point for each of n players, in maze cell
+// units. Players share the start cell, the top left cell of a generated maze
+// or the first open cell of a layout, spread evenly and symmetrically across
+// it so none starts closer to the exit.
+func SpawnPositions(layout *MazeLayout, n int) []Position {
+	x, y := 0, 0
+	if layout != nil {
+		if cx, cy, ok := layout.StartCell(); ok {
+			x, y = cx, cy
+		}
+	}
+	positions := make([]Position, n)
+	for i := range positions {
+		offset := 0.0
+		if n > 1 {
+			offset = SpawnSpread * (float64(i)/float64(n-1) - 0.5)
+		}
+		positions[i] = Position{X: float64(x) + 0.5 + offset, Y: float64(y) + 0.5}
+	}
+	return positions
+}
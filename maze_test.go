@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMazeLayout(t *testing.T) {
+	layout, err := ParseMazeLayout("5x5:gAAAAA")
+	require.NoError(t, err)
+	assert.Equal(t, 5, layout.Width)
+	assert.Equal(t, 5, layout.Height)
+	assert.True(t, layout.Wall(0, 0))
+	assert.False(t, layout.Wall(1, 0))
+	assert.False(t, layout.Wall(4, 4))
+	assert.Equal(t, "5x5:gAAAAA", layout.String())
+
+	full, err := ParseMazeLayout("5x5:____gA")
+	require.NoError(t, err)
+	assert.True(t, full.Wall(4, 4))
+
+	malformed := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"missing cells", "5x5"},
+		{"missing height", "5:gAAAAA"},
+		{"non numeric size", "ax5:gAAAAA"},
+		{"too small", "4x4:AAA"},
+		{"too large", "65x5:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"},
+		{"invalid base64", "5x5:g$AAAA"},
+		{"too few cells", "5x5:gAAA"},
+		{"too many cells", "5x5:gAAAAAA"},
+		{"cells beyond dimensions", "5x5:____wA"},
+	}
+	for _, tc := range malformed {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseMazeLayout(tc.encoded)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSpawnPositions(t *testing.T) {
+	assert.Equal(t, []Position{{X: 0.5, Y: 0.5}}, SpawnPositions(nil, 1),
+		"a lone player spawns in the middle of the start cell")
+	assert.Equal(t, []Position{{X: 0.25, Y: 0.5}, {X: 0.75, Y: 0.5}}, SpawnPositions(nil, 2))
+
+	// The top left cell is a wall, so players start in the next one
+	layout, err := ParseMazeLayout("5x5:gAAAAA")
+	require.NoError(t, err)
+	assert.Equal(t, []Position{{X: 1.25, Y: 0.5}, {X: 1.5, Y: 0.5}, {X: 1.75, Y: 0.5}}, SpawnPositions(&layout, 3))
+}
+
+func TestCustomLayoutPropagation(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	challengeID, err := mm.CreateOpenChallenge(ModeRace, GameParams{Layout: "5x5:____gA"})
+	require.NoError(t, err)
+
+	g, ok := mm.headToHeadGames.Get(challengeID)
+	require.True(t, ok)
+	defer g.Cleanup()
+	game := g.(*RaceGame)
+	assert.Equal(t, "5x5:____gA", game.GetParams().Layout)
+
+	initial, err := game.State.AsInitialMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(initial), `"layout":"5x5:____gA"`)
+
+	update, err := game.State.AsUpdateMessage()
+	require.NoError(t, err)
+	assert.NotContains(t, string(update), "layout", "the layout should only be sent with the initial state")
+
+	_, err = mm.CreateOpenChallenge(ModeRace, GameParams{Layout: "5x5:nope"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, mm.headToHeadGames.Len(), "a game with a malformed layout shouldn't be registered")
+}
+
+func TestMazeAlgoPropagation(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	challengeID, err := mm.CreateOpenChallenge(ModeRace, GameParams{MazeAlgo: AlgoPrims})
+	require.NoError(t, err)
+
+	g, ok := mm.headToHeadGames.Get(challengeID)
+	require.True(t, ok)
+	defer g.Cleanup()
+	game := g.(*RaceGame)
+	assert.Equal(t, AlgoPrims, game.GetParams().MazeAlgo)
+
+	initial, err := game.State.AsInitialMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(initial), `"maze_algo":"prims"`)
+
+	update, err := game.State.AsUpdateMessage()
+	require.NoError(t, err)
+	assert.NotContains(t, string(update), "maze_algo", "the algorithm should only be sent with the seed")
+
+	rematch, err := mm.Rematch(game, nil, false)
+	require.NoError(t, err)
+	defer rematch.Cleanup()
+	assert.Equal(t, AlgoPrims, rematch.GetParams().MazeAlgo, "rematches should keep the algorithm")
+
+	defaulted, err := mm.newGame(ModeRace, GameParams{})
+	require.NoError(t, err)
+	defer defaulted.Cleanup()
+	assert.Equal(t, DefaultMazeAlgo, defaulted.GetParams().MazeAlgo)
+
+	registered := mm.headToHeadGames.Len()
+	_, err = mm.CreateOpenChallenge(ModeRace, GameParams{MazeAlgo: "kruskal"})
+	assert.Error(t, err)
+	assert.Equal(t, registered, mm.headToHeadGames.Len(), "a game with an unknown algorithm shouldn't be registered")
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-
-	"github.com/google/uuid"
+	"slices"
+	"strings"
+	"time"
 )
 
 // WebSocket message types
@@ -14,14 +16,26 @@ type MessageType string
 
 const (
 	// Client Requests
-	ReqJoinQueue       MessageType = "join_queue"
-	ReqLeaveQueue      MessageType = "leave_queue"
-	ReqEnterGame       MessageType = "enter_game"
-	ReqExitGame        MessageType = "exit_game"
-	ReqCreateChallenge MessageType = "create_challenge"
-	ReqAcceptChallenge MessageType = "accept_challenge"
-	ReqPlayerUpdate    MessageType = "player_update"
-	ReqPlayerReady     MessageType = "player_ready"
+	ReqJoinQueue        MessageType = "join_queue"
+	ReqLeaveQueue       MessageType = "leave_queue"
+	ReqEnterGame        MessageType = "enter_game"
+	ReqExitGame         MessageType = "exit_game"
+	ReqCreateChallenge  MessageType = "create_challenge"
+	ReqAcceptChallenge  MessageType = "accept_challenge"
+	ReqListMyChallenges MessageType = "list_my_challenges"
+	ReqCancelChallenge  MessageType = "cancel_challenge"
+	ReqGetGameInfo      MessageType = "get_game_info"
+	ReqPlayerUpdate     MessageType = "player_update"
+	ReqPlayerReady      MessageType = "player_ready"
+	ReqSetReady         MessageType = "set_ready"
+	ReqResync           MessageType = "resync"
+	ReqClientLoaded     MessageType = "client_loaded"
+	ReqPong             MessageType = "pong"
+	ReqVoteSurrender    MessageType = "vote_surrender"
+	ReqCreateParty      MessageType = "create_party"
+	ReqJoinParty        MessageType = "join_party"
+	ReqLeaveParty       MessageType = "leave_party"
+	ReqRematch          MessageType = "rematch"
 
 	// Server Responses
 	RespGameState                MessageType = "game_state"
@@ -38,6 +52,29 @@ const (
 	RespSecondsToCurrentRoundEnd MessageType = "secs_next_round"
 	RespRoundResult              MessageType = "round_result"
 	RespJoinRunningGame          MessageType = "error_game_running"
+	RespPersonalBest             MessageType = "personal_best"
+	RespError                    MessageType = "error"
+	RespGamePaused               MessageType = "game_paused"
+	RespGameResumed              MessageType = "game_resumed"
+	RespServerBusy               MessageType = "server_busy"
+	RespRequeued                 MessageType = "requeued"
+	RespGameStarted              MessageType = "game_started"
+	RespMyChallenges             MessageType = "my_challenges"
+	RespChallengeCancelled       MessageType = "challenge_cancelled"
+	RespReadyRoster              MessageType = "ready_roster"
+	RespPing                     MessageType = "ping"
+	RespChallengeLimitReached    MessageType = "challenge_limit_reached"
+	RespKickedAFK                MessageType = "kicked_afk"
+	RespPlayerLeft               MessageType = "player_left"
+	RespBatch                    MessageType = "batch"
+	RespGameEnded                MessageType = "game_ended"
+	RespGameInfo                 MessageType = "game_info"
+	RespChallengeModeMismatch    MessageType = "challenge_mode_mismatch"
+	RespSurrenderVote            MessageType = "surrender_vote"
+	RespNotReady                 MessageType = "not_ready"
+	RespParty                    MessageType = "party"
+	RespPartyLeft                MessageType = "party_left"
+	RespRematchVote              MessageType = "rematch_vote"
 )
 
 // Message is the base interface that all messages must implement
@@ -52,8 +89,14 @@ type BaseMessage struct {
 	Payload json.RawMessage `json:"payload"`
 }
 
-// CreateMessage creates a base message from a Message
+// CreateMessage creates a base message from a Message.
+// The message is validated first, so malformed responses are caught before
+// they can be sent.
 func CreateMessage[T Message](msg T) (*BaseMessage, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+
 	payload, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
@@ -88,6 +131,12 @@ func ParseMessage[T Message](base BaseMessage) (*T, error) {
 		return &msg, nil
 	}
 
+	// Every message payload is an object, anything else would otherwise fail
+	// with a confusing error about the message's fields
+	if trimmed := bytes.TrimSpace(base.Payload); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, PayloadFormatError{MessageType: base.Type, Err: ErrPayloadNotObject}
+	}
+
 	decoder := json.NewDecoder(bytes.NewReader(base.Payload))
 	decoder.DisallowUnknownFields()
 
@@ -118,13 +167,13 @@ func (m JoinQueueRequest) Type() MessageType {
 
 func (m JoinQueueRequest) Validate() error {
 	switch m.GameMode {
-	case ModeSprint, ModeRace:
+	case ModeSprint, ModeRace, ModeHybrid, ModeTimeTrial, ModePractice:
 		return nil
 	default:
 		return ValidationError{
 			MessageType: ReqJoinQueue,
 			Field:       "game_mode",
-			Reason:      fmt.Sprintf("must be one of: %v, %v", ModeSprint, ModeRace),
+			Reason:      fmt.Sprintf("must be one of: %v, %v, %v, %v, %v", ModeSprint, ModeRace, ModeHybrid, ModeTimeTrial, ModePractice),
 		}
 	}
 
@@ -150,6 +199,10 @@ type PlayerUpdateRequest struct {
 	Level    int      `json:"level"`
 	Position Position `json:"position"`
 	Rotation float64  `json:"rotation"`
+	// Seq optionally numbers a connection's updates within a game, starting
+	// from 1. Updates numbered at or below the last one applied are stale and
+	// ignored. Unnumbered updates are always applied.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 func (m PlayerUpdateRequest) Type() MessageType {
@@ -178,8 +231,80 @@ func (m PlayerReadyRequest) Validate() error {
 
 func (m PlayerReadyRequest) RequiresPayload() bool { return false }
 
+// SetReadyRequest represents a client readying or unreadying during the countdown
+type SetReadyRequest struct {
+	Ready bool `json:"ready"`
+}
+
+func (m SetReadyRequest) Type() MessageType {
+	return ReqSetReady
+}
+
+func (m SetReadyRequest) Validate() error {
+	return nil
+}
+
+func (m SetReadyRequest) RequiresPayload() bool { return true }
+
+// ResyncRequest represents a client that has missed frames asking for the
+// latest game state
+type ResyncRequest struct{}
+
+func (m ResyncRequest) Type() MessageType {
+	return ReqResync
+}
+
+func (m ResyncRequest) Validate() error {
+	return nil
+}
+
+func (m ResyncRequest) RequiresPayload() bool { return false }
+
+// ClientLoadedRequest represents a client acknowledging it has loaded the maze
+// and is ready for the round to start
+type ClientLoadedRequest struct{}
+
+func (m ClientLoadedRequest) Type() MessageType {
+	return ReqClientLoaded
+}
+
+func (m ClientLoadedRequest) Validate() error {
+	return nil
+}
+
+func (m ClientLoadedRequest) RequiresPayload() bool { return false }
+
+// PongRequest represents a client answering a ping, echoing its timestamp
+type PongRequest struct {
+	SentAtMs int64 `json:"sent_at_ms"`
+}
+
+func (m PongRequest) Type() MessageType {
+	return ReqPong
+}
+
+func (m PongRequest) Validate() error {
+	if m.SentAtMs <= 0 {
+		return ValidationError{
+			MessageType: ReqPong,
+			Field:       "sent_at_ms",
+			Reason:      "must be a ping timestamp",
+		}
+	}
+	return nil
+}
+
+func (m PongRequest) RequiresPayload() bool { return true }
+
 type CreateChallengeRequest struct {
 	GameMode GameMode `json:"game_mode"`
+	// Optional overrides of the mode defaults
+	LevelTarget     int `json:"level_target,omitempty"`
+	RoundLengthSecs int `json:"round_length_secs,omitempty"`
+	// Optional encoded custom maze layout, see MazeLayout
+	Layout string `json:"layout,omitempty"`
+	// Optional maze generation algorithm, see MazeAlgo
+	MazeAlgo string `json:"maze_algo,omitempty"`
 }
 
 func (m CreateChallengeRequest) Type() MessageType {
@@ -188,22 +313,72 @@ func (m CreateChallengeRequest) Type() MessageType {
 
 func (m CreateChallengeRequest) Validate() error {
 	switch m.GameMode {
-	case ModeSprint, ModeRace:
-		return nil
+	case ModeSprint, ModeRace, ModeHybrid:
 	default:
 		return ValidationError{
-			MessageType: ReqJoinQueue,
+			MessageType: ReqCreateChallenge,
 			Field:       "game_mode",
-			Reason:      fmt.Sprintf("must be one of: %v, %v", ModeSprint, ModeRace),
+			Reason:      fmt.Sprintf("must be one of: %v, %v, %v", ModeSprint, ModeRace, ModeHybrid),
+		}
+	}
+
+	if m.LevelTarget != 0 && (m.LevelTarget < MinRaceLevelTarget || m.LevelTarget > MaxRaceLevelTarget) {
+		return ValidationError{
+			MessageType: ReqCreateChallenge,
+			Field:       "level_target",
+			Reason:      fmt.Sprintf("must be between %v and %v", MinRaceLevelTarget, MaxRaceLevelTarget),
 		}
 	}
 
+	roundLength := time.Duration(m.RoundLengthSecs) * time.Second
+	if m.RoundLengthSecs != 0 && (roundLength < MinSprintRoundLength || roundLength > MaxSprintRoundLength) {
+		return ValidationError{
+			MessageType: ReqCreateChallenge,
+			Field:       "round_length_secs",
+			Reason:      fmt.Sprintf("must be between %v and %v", MinSprintRoundLength.Seconds(), MaxSprintRoundLength.Seconds()),
+		}
+	}
+
+	if m.Layout != "" {
+		if _, err := ParseMazeLayout(m.Layout); err != nil {
+			return ValidationError{
+				MessageType: ReqCreateChallenge,
+				Field:       "layout",
+				Reason:      err.Error(),
+			}
+		}
+	}
+
+	if m.MazeAlgo != "" {
+		if _, err := ParseMazeAlgo(m.MazeAlgo); err != nil {
+			return ValidationError{
+				MessageType: ReqCreateChallenge,
+				Field:       "maze_algo",
+				Reason:      err.Error(),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Params returns the game params requested by the challenge creator
+func (m CreateChallengeRequest) Params() GameParams {
+	return GameParams{
+		LevelTarget: m.LevelTarget,
+		RoundLength: time.Duration(m.RoundLengthSecs) * time.Second,
+		Layout:      m.Layout,
+		MazeAlgo:    MazeAlgo(m.MazeAlgo),
+	}
 }
 
 func (m CreateChallengeRequest) RequiresPayload() bool { return true }
 
 type AcceptChallengeRequest struct {
 	ChallengeID string `json:"challenge_id"`
+	// GameMode is the mode the player expects to be playing, if set the
+	// challenge is only accepted if its game is of this mode
+	GameMode GameMode `json:"game_mode,omitempty"`
 }
 
 func (m AcceptChallengeRequest) Type() MessageType {
@@ -214,15 +389,95 @@ func (m AcceptChallengeRequest) Validate() error {
 	if m.ChallengeID == "" {
 		return fmt.Errorf("received blank challenge id")
 	}
-	return nil
+	switch m.GameMode {
+	case "", ModeSprint, ModeRace, ModeHybrid:
+		return nil
+	default:
+		return ValidationError{
+			MessageType: ReqAcceptChallenge,
+			Field:       "game_mode",
+			Reason:      fmt.Sprintf("must be one of: %v, %v, %v", ModeSprint, ModeRace, ModeHybrid),
+		}
+	}
 }
 
 func (m AcceptChallengeRequest) RequiresPayload() bool { return true }
 
+type CancelChallengeRequest struct {
+	ChallengeID string `json:"challenge_id"`
+}
+
+func (m CancelChallengeRequest) Type() MessageType {
+	return ReqCancelChallenge
+}
+
+func (m CancelChallengeRequest) Validate() error {
+	if m.ChallengeID == "" {
+		return fmt.Errorf("received blank challenge id")
+	}
+	return nil
+}
+
+func (m CancelChallengeRequest) RequiresPayload() bool { return true }
+
+// GetGameInfoRequest asks about a challenge without accepting it
+type GetGameInfoRequest struct {
+	ChallengeID string `json:"challenge_id"`
+}
+
+func (m GetGameInfoRequest) Type() MessageType {
+	return ReqGetGameInfo
+}
+
+func (m GetGameInfoRequest) Validate() error {
+	if m.ChallengeID == "" {
+		return fmt.Errorf("received blank challenge id")
+	}
+	return nil
+}
+
+func (m GetGameInfoRequest) RequiresPayload() bool { return true }
+
+// JoinPartyRequest joins the party with a code shared by its leader
+type JoinPartyRequest struct {
+	Code string `json:"code"`
+}
+
+func (m JoinPartyRequest) Type() MessageType {
+	return ReqJoinParty
+}
+
+func (m JoinPartyRequest) Validate() error {
+	if m.Code == "" {
+		return fmt.Errorf("received blank party code")
+	}
+	return nil
+}
+
+func (m JoinPartyRequest) RequiresPayload() bool { return true }
+
+// RematchRequest votes to play the finished game again with the same players,
+// on the same maze if SameMaze is set and a fresh one otherwise
+type RematchRequest struct {
+	SameMaze bool `json:"same_maze"`
+}
+
+func (m RematchRequest) Type() MessageType {
+	return ReqRematch
+}
+
+func (m RematchRequest) Validate() error {
+	return nil
+}
+
+func (m RematchRequest) RequiresPayload() bool { return false }
+
 // Response Messages
 
 type ConnectedResponse struct {
 	PlayerID string `json:"player_id"`
+	// Secret to present alongside the player id when reconnecting
+	ReconnectToken string `json:"reconnect_token"`
 }
 
 func (m ConnectedResponse) Type() MessageType {
@@ -230,15 +485,36 @@ func (m ConnectedResponse) Type() MessageType {
 }
 
 func (m ConnectedResponse) Validate() error {
-
-	err := uuid.Validate(m.PlayerID)
-	if err != nil {
-		return fmt.Errorf("invalid player id")
+	if !validPlayerID(m.PlayerID) {
+		return ValidationError{
+			MessageType: RespConnectionConfirmation,
+			Field:       "player_id",
+			Reason:      "must be a player id",
+		}
+	}
+	if len(m.ReconnectToken) != ReconnectTokenLength {
+		return ValidationError{
+			MessageType: RespConnectionConfirmation,
+			Field:       "reconnect_token",
+			Reason:      "must be a reconnect token",
+		}
 	}
-
 	return nil
 }
 
+// validPlayerID reports whether id could have been generated by NewPlayer
+func validPlayerID(id string) bool {
+	if len(id) != PlayerIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune(nanoidAlphabet, r) {
+			return false
+		}
+	}
+	return true
+}
+
 func (m ConnectedResponse) RequiresPayload() bool { return true }
 
 // Message-related errors
@@ -254,9 +530,21 @@ type ResponseMessage struct {
 	Payload     interface{} `json:"payload"`
 }
 
+// validator is implemented by response payloads that check their fields
+type validator interface {
+	Validate() error
+}
+
 // CreateResponseBytes marshalls a given payload into a corresponding ResponseMessage
-// Doesn't ensure consistency between messageType and expected payload
+// Doesn't ensure consistency between messageType and expected payload. Every
+// response is created here, so payloads with a Validate method are validated
+// before they can be sent.
 func CreateResponseBytes(messageType MessageType, payload interface{}) ([]byte, error) {
+	if v, ok := payload.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	return json.Marshal(ResponseMessage{
 		MessageType: messageType,
 		Payload:     payload,
@@ -280,18 +568,248 @@ type QueueLeftResponse struct {
 	Queue GameMode `json:"game_mode"`
 }
 
+// GameConfirmedResponse describes the game a player has been placed in, so
+// the lobby can be shown before the countdown ends
 type GameConfirmedResponse struct {
-	GameID string `json:"game_id"`
+	GameID string     `json:"game_id"`
+	Mode   GameMode   `json:"game_mode"`
+	Params GameParams `json:"params"`
+	Seed   int64      `json:"seed"`
+	// Algorithm the maze is generated from the seed with
+	MazeAlgo MazeAlgo `json:"maze_algo,omitempty"`
+	// The other players in the game, ordered by username
+	Opponents []ConfirmedPlayer `json:"opponents"`
+	// Set if players must enter the game before they can ready up
+	RequireEnter bool `json:"require_enter,omitempty"`
+}
+
+// ConfirmedPlayer describes an opponent in a confirmed game
+type ConfirmedPlayer struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Flag     string `json:"flag"`
+	Color    string `json:"color"`
+}
+
+// ReadyRosterResponse reports whether each player in the game is ready, by player id
+type ReadyRosterResponse struct {
+	Players map[string]bool `json:"players"`
+	// Whether each player has entered the game, for games requiring it
+	Entered map[string]bool `json:"entered,omitempty"`
+}
+
+// SurrenderVoteResponse reports how many of the connected players have voted
+// to end the game early, and how many votes end it
+type SurrenderVoteResponse struct {
+	Votes   int `json:"votes"`
+	Needed  int `json:"needed"`
+	Players int `json:"players"`
+}
+
+// RematchVoteResponse reports how many of the connected players have voted
+// for a rematch, and how many votes start it
+type RematchVoteResponse struct {
+	Votes  int `json:"votes"`
+	Needed int `json:"needed"`
+}
+
+type GameStartedResponse struct {
+	GameID    string     `json:"game_id"`
+	StartTime int64      `json:"start_time_ms"`
+	Mode      GameMode   `json:"game_mode"`
+	Params    GameParams `json:"params"`
 }
 
 type ChallengeCreatedResponse struct {
 	ChallengeID string `json:"challenge_id"`
+	JoinURL     string `json:"join_url,omitempty"`
+}
+
+// ServerBusyResponse tells a client refused at capacity how long to back off
+type ServerBusyResponse struct {
+	RetryAfterMs int64 `json:"retryAfterMs"`
+}
+
+// QueueStatsResponse reports the players waiting and games running for each mode
+type QueueStatsResponse struct {
+	Queues      map[GameMode]int `json:"queues"`
+	ActiveGames map[GameMode]int `json:"active_games"`
+	// Games aborted without a result by reason, for churn analysis
+	Aborts map[AbortReason]int `json:"aborts"`
+	// Clients dropped from games for falling behind on broadcasts
+	BackpressureDrops int64 `json:"backpressure_drops"`
+}
+
+// OnlinePlayersResponse lists the players currently connected
+type OnlinePlayersResponse struct {
+	Players []OnlinePlayer `json:"players"`
+}
+
+// OnlinePlayer is a connected player as shown to other players
+type OnlinePlayer struct {
+	Username string       `json:"username"`
+	Flag     string       `json:"flag"`
+	Status   ClientStatus `json:"status"`
+}
+
+// ChallengeStatesResponse reports the lifecycle state of each challenge by
+// id, for debugging
+type ChallengeStatesResponse struct {
+	Challenges map[string]ChallengeState `json:"challenges"`
+}
+
+// ConfigRequest changes the defaults of games created from now on. Fields
+// left unset keep their current value.
+type ConfigRequest struct {
+	LevelTarget     int `json:"level_target,omitempty"`
+	RoundLengthSecs int `json:"round_length_secs,omitempty"`
+	// Broadcast tickrates in ticks per second by mode
+	TickratesHz map[GameMode]int `json:"tickrates_hz,omitempty"`
+}
+
+func (m ConfigRequest) Validate() error {
+	if m.LevelTarget != 0 && (m.LevelTarget < MinRaceLevelTarget || m.LevelTarget > MaxRaceLevelTarget) {
+		return fmt.Errorf("level_target must be between %v and %v", MinRaceLevelTarget, MaxRaceLevelTarget)
+	}
+	roundLength := time.Duration(m.RoundLengthSecs) * time.Second
+	if m.RoundLengthSecs != 0 && (roundLength < MinSprintRoundLength || roundLength > MaxSprintRoundLength) {
+		return fmt.Errorf("round_length_secs must be between %v and %v", MinSprintRoundLength.Seconds(), MaxSprintRoundLength.Seconds())
+	}
+	for mode, hz := range m.TickratesHz {
+		if !slices.Contains(gameModes, mode) {
+			return fmt.Errorf("tickrates_hz has unknown game mode %q", mode)
+		}
+		if hz < 1 || hz > MaxTickrateHz {
+			return fmt.Errorf("tickrates_hz must be between 1 and %v", MaxTickrateHz)
+		}
+	}
+	return nil
+}
+
+// ConfigResponse reports the defaults new games are created with
+type ConfigResponse struct {
+	LevelTarget     int              `json:"level_target"`
+	RoundLengthSecs int              `json:"round_length_secs"`
+	TickratesHz     map[GameMode]int `json:"tickrates_hz"`
+}
+
+// ChallengeLimitResponse tells a player refused a new challenge how many
+// active challenge games each player may have
+type ChallengeLimitResponse struct {
+	Limit int `json:"limit"`
+}
+
+// ChallengeModeMismatchResponse tells a player the challenge they tried to
+// accept is for a different mode than they expected
+type ChallengeModeMismatchResponse struct {
+	ChallengeID string   `json:"challenge_id"`
+	GameMode    GameMode `json:"game_mode"`
+}
+
+type ChallengeSummary struct {
+	ChallengeID string   `json:"challenge_id"`
+	GameMode    GameMode `json:"game_mode"`
+	OpenSlots   int      `json:"open_slots"`
+}
+
+type MyChallengesResponse struct {
+	Challenges []ChallengeSummary `json:"challenges"`
+}
+
+type ChallengeCancelledResponse struct {
+	ChallengeID string `json:"challenge_id"`
+}
+
+// GameInfoResponse describes a challenge for a player deciding whether to accept it
+type GameInfoResponse struct {
+	ChallengeID string   `json:"challenge_id"`
+	Mode        GameMode `json:"game_mode"`
+	// Empty for open challenges
+	CreatorName string `json:"creator_name,omitempty"`
+	PlayerCount int    `json:"player_count"`
+	// Whether the challenge can still be accepted
+	Accepting bool `json:"accepting"`
+}
+
+type GamePausedResponse struct {
+	GracePeriodMs int64 `json:"grace_period_ms"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type PersonalBestResponse struct {
+	Level   int  `json:"level"`
+	Best    int  `json:"best"`
+	NewBest bool `json:"new_best"`
+}
+
+// PingResponse asks the client to reply with a pong carrying the same
+// timestamp, so the server can measure the round trip
+type PingResponse struct {
+	SentAtMs int64 `json:"sent_at_ms"`
+}
+
+// PartyResponse tells the members of a party who is in it, after anyone
+// joins or leaves
+type PartyResponse struct {
+	Code     string        `json:"code"`
+	LeaderID string        `json:"leader_id"`
+	Members  []PartyMember `json:"members"`
+}
+
+// PartyMember is a player in a party, in the order they joined
+type PartyMember struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Flag     string `json:"flag"`
+}
+
+// PartyLeftResponse tells a player they've left their party
+type PartyLeftResponse struct {
+	Code string `json:"code"`
+}
+
+// NotReadyResponse tells a player they were removed from a game for not
+// readying up before it started
+type NotReadyResponse struct {
+	GameID string `json:"game_id"`
+}
+
+// KickedAFKResponse tells a player they were removed from a game for inactivity
+type KickedAFKResponse struct {
+	GameID string `json:"game_id"`
 }
 
 type PlayerExitedResponse struct {
 	GameID string `json:"game_id"`
 }
 
+// GameEndedResponse tells a player their game has been torn down and the
+// status they've been returned to, however the game ended
+type GameEndedResponse struct {
+	GameID string       `json:"game_id"`
+	Status ClientStatus `json:"status"`
+}
+
+// PlayerEnteredResponse tells the other players someone joined the running game
+type PlayerEnteredResponse struct {
+	PlayerID string `json:"player_id"`
+	Username string `json:"username"`
+}
+
+// PlayerLeftResponse tells the other players someone left the running game
+type PlayerLeftResponse struct {
+	PlayerID string `json:"player_id"`
+}
+
+// BatchResponse carries the events since the previous tick followed by the
+// tick's state update, in the order they should be applied
+type BatchResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
 // Message related errors
 
 func (e ValidationError) Error() string {
@@ -306,6 +824,10 @@ func (e PayloadRequiredError) Error() string {
 	return fmt.Sprintf("payload required for message type %s", e.MessageType)
 }
 
+// ErrPayloadNotObject is wrapped by the PayloadFormatError returned for a
+// payload that isn't a JSON object, e.g. an array or a number
+var ErrPayloadNotObject = errors.New("expected a JSON object")
+
 type PayloadFormatError struct {
 	MessageType MessageType
 	Err         error
@@ -314,3 +836,7 @@ type PayloadFormatError struct {
 func (e PayloadFormatError) Error() string {
 	return fmt.Sprintf("invalid format for %s message payload: %v", e.MessageType, e.Err)
 }
+
+func (e PayloadFormatError) Unwrap() error {
+	return e.Err
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseMessage(t *testing.T) {
@@ -100,6 +104,95 @@ func TestParseMessage(t *testing.T) {
 			expectedParseResult: nil,
 			wantErr:             true,
 		},
+		{
+			name: "valid create challenge with custom params",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {
+					"game_mode": "race",
+					"level_target": 5,
+					"round_length_secs": 120
+				}
+			}`),
+			expectedParseResult: &CreateChallengeRequest{
+				GameMode:        ModeRace,
+				LevelTarget:     5,
+				RoundLengthSecs: 120,
+			},
+			wantErr: false,
+		},
+		{
+			name: "create challenge level target too low",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "level_target": 2}
+			}`),
+			wantErr: true,
+		},
+		{
+			name: "create challenge level target too high",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "level_target": 51}
+			}`),
+			wantErr: true,
+		},
+		{
+			name: "create challenge round length too short",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "sprint", "round_length_secs": 14}
+			}`),
+			wantErr: true,
+		},
+		{
+			name: "create challenge round length too long",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "sprint", "round_length_secs": 301}
+			}`),
+			wantErr: true,
+		},
+		{
+			name: "valid create challenge with custom layout",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "layout": "5x5:gAAAAA"}
+			}`),
+			expectedParseResult: &CreateChallengeRequest{
+				GameMode: ModeRace,
+				Layout:   "5x5:gAAAAA",
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid create challenge with maze algorithm",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "maze_algo": "prims"}
+			}`),
+			expectedParseResult: &CreateChallengeRequest{
+				GameMode: ModeRace,
+				MazeAlgo: "prims",
+			},
+			wantErr: false,
+		},
+		{
+			name: "create challenge unknown maze algorithm",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "maze_algo": "kruskal"}
+			}`),
+			wantErr: true,
+		},
+		{
+			name: "create challenge malformed layout",
+			input: []byte(`{
+				"messageType": "create_challenge",
+				"payload": {"game_mode": "race", "layout": "5x5:gAAA"}
+			}`),
+			wantErr: true,
+		},
 		{
 			name: "empty payload (leave)",
 			input: []byte(`{
@@ -130,6 +223,9 @@ func TestParseMessage(t *testing.T) {
 			case ReqPlayerUpdate:
 				result, parseErr = ParseMessage[PlayerUpdateRequest](base)
 
+			case ReqCreateChallenge:
+				result, parseErr = ParseMessage[CreateChallengeRequest](base)
+
 			default:
 				parseErr = fmt.Errorf("unknown message type: %s", base.Type)
 			}
@@ -143,3 +239,181 @@ func TestParseMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMessageNonObjectPayload(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{"array", `[]`, true},
+		{"array of objects", `[{"game_mode": "sprint"}]`, true},
+		{"number", `5`, true},
+		{"string", `"sprint"`, true},
+		{"boolean", `true`, true},
+		{"object", `{"game_mode": "sprint"}`, false},
+		{"object with whitespace", ` {"game_mode": "sprint"} `, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := BaseMessage{Type: ReqJoinQueue, Payload: json.RawMessage(tc.payload)}
+			msg, err := ParseMessage[JoinQueueRequest](base)
+			if !tc.wantErr {
+				require.NoError(t, err)
+				assert.Equal(t, ModeSprint, msg.GameMode)
+				return
+			}
+			var formatErr PayloadFormatError
+			require.ErrorAs(t, err, &formatErr)
+			assert.Equal(t, ReqJoinQueue, formatErr.MessageType)
+			assert.ErrorIs(t, err, ErrPayloadNotObject)
+		})
+	}
+
+	// Messages without a payload can't be given a non-object one either
+	_, err := ParseMessage[LeaveQueueRequest](BaseMessage{Type: ReqLeaveQueue, Payload: json.RawMessage(`[]`)})
+	assert.ErrorIs(t, err, ErrPayloadNotObject)
+}
+
+func TestCreateResponseValidates(t *testing.T) {
+	player := NewPlayer("testUser", "🏴")
+	bytes, err := CreateResponseBytes(RespConnectionConfirmation, ConnectedResponse{PlayerID: player.Id, ReconnectToken: player.ReconnectToken})
+	require.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"messageType":"connected","payload":{"player_id":%q,"reconnect_token":%q}}`,
+		player.Id, player.ReconnectToken), string(bytes))
+
+	_, err = CreateResponseBytes(RespConnectionConfirmation, ConnectedResponse{PlayerID: player.Id})
+	assert.ErrorAs(t, err, new(ValidationError), "a missing reconnect token should be rejected")
+
+	for _, id := range []string{"", "abc", "abc$%", "123456"} {
+		bytes, err := CreateResponseBytes(RespConnectionConfirmation, ConnectedResponse{PlayerID: id, ReconnectToken: player.ReconnectToken})
+		var validationErr ValidationError
+		assert.ErrorAs(t, err, &validationErr, "player id %q should be rejected", id)
+		assert.Nil(t, bytes)
+	}
+	assert.Panics(t, func() {
+		MustCreateResponseBytes(RespConnectionConfirmation, ConnectedResponse{})
+	}, "an invalid response should never be sent")
+}
+
+// jsonFields returns the sorted top level field names v marshals to
+func jsonFields(t *testing.T, v any) []string {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	require.NoError(t, err)
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(raw, &fields))
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// TestWireContract pins the field names clients rely on. Payload fields are
+// snake_case, with durations and timestamps suffixed _ms. playerScores and
+// retryAfterMs predate the convention and are kept for existing clients.
+func TestWireContract(t *testing.T) {
+	t.Run("envelope", func(t *testing.T) {
+		msg, err := CreateResponseBytes(RespQueueJoined, QueueJoinedResponse{Queue: ModeSprint})
+		require.NoError(t, err)
+		var envelope map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(msg, &envelope))
+		assert.ElementsMatch(t, []string{"messageType", "payload"}, slices.Collect(maps.Keys(envelope)))
+
+		// Requests share the envelope
+		base, err := json.Marshal(BaseMessage{Type: ReqJoinQueue, Payload: json.RawMessage(`{}`)})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"messageType":"join_queue","payload":{}}`, string(base))
+	})
+
+	testCases := []struct {
+		name   string
+		value  any
+		fields []string
+	}{
+		// Requests
+		{"join queue", JoinQueueRequest{GameMode: ModeSprint}, []string{"game_mode"}},
+		{"player update", PlayerUpdateRequest{Seq: 1}, []string{"level", "position", "rotation", "seq"}},
+		{"set ready", SetReadyRequest{}, []string{"ready"}},
+		{"create challenge", CreateChallengeRequest{GameMode: ModeRace, LevelTarget: 5, RoundLengthSecs: 30, Layout: "5x5:AAAA", MazeAlgo: "prims"},
+			[]string{"game_mode", "layout", "level_target", "maze_algo", "round_length_secs"}},
+		{"accept challenge", AcceptChallengeRequest{GameMode: ModeRace}, []string{"challenge_id", "game_mode"}},
+		{"join party", JoinPartyRequest{}, []string{"code"}},
+		{"rematch", RematchRequest{}, []string{"same_maze"}},
+		{"cancel challenge", CancelChallengeRequest{}, []string{"challenge_id"}},
+		{"get game info", GetGameInfoRequest{}, []string{"challenge_id"}},
+		{"pong", PongRequest{}, []string{"sent_at_ms"}},
+		{"config", ConfigRequest{LevelTarget: 5, RoundLengthSecs: 30, TickratesHz: map[GameMode]int{ModeSprint: 30}},
+			[]string{"level_target", "round_length_secs", "tickrates_hz"}},
+
+		// Responses
+		{"connected", ConnectedResponse{}, []string{"player_id", "reconnect_token"}},
+		{"queue joined", QueueJoinedResponse{}, []string{"game_mode"}},
+		{"queue left", QueueLeftResponse{}, []string{"game_mode"}},
+		{"game confirmed", GameConfirmedResponse{MazeAlgo: AlgoPrims, RequireEnter: true}, []string{"game_id", "game_mode", "maze_algo", "opponents", "params", "require_enter", "seed"}},
+		{"confirmed player", ConfirmedPlayer{}, []string{"color", "flag", "id", "username"}},
+		{"ready roster", ReadyRosterResponse{Entered: map[string]bool{"player": true}}, []string{"entered", "players"}},
+		{"game started", GameStartedResponse{}, []string{"game_id", "game_mode", "params", "start_time_ms"}},
+		{"game params", GameParams{LevelTarget: 5, RoundLength: time.Minute}, []string{"level_target", "round_length_ms"}},
+		{"challenge created", ChallengeCreatedResponse{JoinURL: "http://example.com"}, []string{"challenge_id", "join_url"}},
+		{"server busy", ServerBusyResponse{}, []string{"retryAfterMs"}},
+		{"queue stats", QueueStatsResponse{}, []string{"aborts", "active_games", "backpressure_drops", "queues"}},
+		{"challenge states", ChallengeStatesResponse{}, []string{"challenges"}},
+		{"online players", OnlinePlayersResponse{}, []string{"players"}},
+		{"online player", OnlinePlayer{}, []string{"flag", "status", "username"}},
+		{"challenge mode mismatch", ChallengeModeMismatchResponse{}, []string{"challenge_id", "game_mode"}},
+		{"surrender vote", SurrenderVoteResponse{}, []string{"needed", "players", "votes"}},
+		{"rematch vote", RematchVoteResponse{}, []string{"needed", "votes"}},
+		{"party", PartyResponse{}, []string{"code", "leader_id", "members"}},
+		{"party member", PartyMember{}, []string{"flag", "id", "username"}},
+		{"party left", PartyLeftResponse{}, []string{"code"}},
+		{"config response", ConfigResponse{}, []string{"level_target", "round_length_secs", "tickrates_hz"}},
+		{"challenge limit", ChallengeLimitResponse{}, []string{"limit"}},
+		{"challenge summary", ChallengeSummary{}, []string{"challenge_id", "game_mode", "open_slots"}},
+		{"my challenges", MyChallengesResponse{}, []string{"challenges"}},
+		{"challenge cancelled", ChallengeCancelledResponse{}, []string{"challenge_id"}},
+		{"game info", GameInfoResponse{CreatorName: "alice"}, []string{"accepting", "challenge_id", "creator_name", "game_mode", "player_count"}},
+		{"game paused", GamePausedResponse{}, []string{"grace_period_ms"}},
+		{"error", ErrorResponse{}, []string{"message"}},
+		{"personal best", PersonalBestResponse{}, []string{"best", "level", "new_best"}},
+		{"player exited", PlayerExitedResponse{}, []string{"game_id"}},
+		{"kicked afk", KickedAFKResponse{}, []string{"game_id"}},
+		{"not ready", NotReadyResponse{}, []string{"game_id"}},
+		{"game ended", GameEndedResponse{}, []string{"game_id", "status"}},
+		{"player entered", PlayerEnteredResponse{}, []string{"player_id", "username"}},
+		{"player left", PlayerLeftResponse{}, []string{"player_id"}},
+		{"batch", BatchResponse{}, []string{"messages"}},
+		{"ping", PingResponse{}, []string{"sent_at_ms"}},
+		{"round result", RoundResult{}, []string{"placements", "playerScores", "total_players"}},
+		{"player score", PlayerScore{Forfeited: true, Splits: []LevelSplit{{}}}, []string{"color", "flag", "forfeited", "is_winner", "level", "placement", "splits", "username"}},
+		{"level split", LevelSplit{}, []string{"level", "reached_at_ms"}},
+		{"position", Position{}, []string{"x", "y"}},
+		{"player", &Player{DisconnectReason: DisconnectClean, Region: "eu", Connection: ConnectionGood},
+			[]string{"active", "color", "connection", "disconnect_reason", "flag", "id", "level", "position", "region", "rotation", "spawned", "username"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.fields, jsonFields(t, tc.value))
+		})
+	}
+
+	t.Run("game state", func(t *testing.T) {
+		gs := NewGameState(42, realClock{})
+		gs.StartTime = 1
+		gs.Layout = "5x5:AAAA"
+		gs.MazeAlgo = AlgoPrims
+		var initial, update BaseMessage
+		msg, err := gs.AsInitialMessage()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(msg, &initial))
+		msg, err = gs.AsUpdateMessage()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(msg, &update))
+
+		assert.Equal(t, []string{"id", "layout", "max_level", "maze_algo", "phase", "players", "seed", "server_time_ms", "start_time_ms"}, jsonFields(t, initial.Payload))
+		assert.Equal(t, []string{"id", "max_level", "phase", "players", "server_time_ms", "start_time_ms"}, jsonFields(t, update.Payload))
+	})
+}
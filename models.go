@@ -3,62 +3,446 @@ package main
 import (
 	"cmp"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
+// GamePhase is the stage a game has reached, sent with its state so clients
+// needn't infer it from the messages they've seen
+type GamePhase string
+
+const (
+	PhaseCountdown GamePhase = "countdown"
+	PhaseRunning   GamePhase = "running"
+	PhaseEnded     GamePhase = "ended"
+)
+
 // GameState represents the state of a specific game
+// Player progress must be written through the state so that results and
+// updates are marshalled from a consistent view.
 type GameState struct {
+	mu        sync.RWMutex
 	Id        string                `json:"id"`
 	Seed      int64                 `json:"seed"`
 	MaxLevel  int                   `json:"max_level"`
 	Players   CMap[string, *Player] `json:"players"`
 	StartTime int64                 `json:"start_time_ms,omitempty"`
+	Phase     GamePhase             `json:"phase"`
+	// LevelTarget is the level a player must exceed to win outright, 0 if unset
+	LevelTarget int `json:"-"`
+	// FirstToTarget is the id of the first player to exceed the LevelTarget
+	FirstToTarget string `json:"-"`
+	// Layout is the encoded custom maze layout, if any, sent with the initial state
+	Layout string `json:"-"`
+	// MazeAlgo is the maze generation algorithm, sent with the seed
+	MazeAlgo MazeAlgo `json:"-"`
+	// Spawns are each player's starting position by player id, assigned when
+	// they enter the game and sent with the initial state
+	Spawns map[string]Position `json:"-"`
+	// Source of the server time sent with each state message
+	clock Clock
+	// Set when the state changes, cleared by TakeChanged
+	changed bool
 }
 
-// NewGameState initializes a thread-safe game instance with the given random seed.
+// NewGameState initializes a thread-safe game instance with the given random seed,
+// timing its state messages with the game's clock.
 // The returned state includes a unique identifier and a concurrent-safe player registry.
-func NewGameState(seed int64) *GameState {
+func NewGameState(seed int64, clock Clock) *GameState {
 	return &GameState{
 		Id:       gonanoid.Must(5),
 		Seed:     seed,
 		MaxLevel: 0,
 		Players:  NewMutexMap[string, *Player](),
+		Phase:    PhaseCountdown,
+		clock:    clock,
+	}
+}
+
+// MarshalJSON encodes the full state with players ordered by id, so the
+// broadcast player list is stable between ticks. Callers should hold the
+// state lock.
+func (gs *GameState) MarshalJSON() ([]byte, error) {
+	return gs.marshal(true)
+}
+
+// marshal encodes the state, including the maze seed, algorithm, layout and
+// spawn points only if initial is set. None of them change, so there's no need to resend
+// them with every tick. The server's current time is included so clients can correct
+// for their clock's offset when timing the round from the start time.
+func (gs *GameState) marshal(initial bool) ([]byte, error) {
+	type state GameState
+	players := gs.Players.Values()
+	slices.SortFunc(players, func(a, b *Player) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	var seed *int64
+	var layout string
+	var algo MazeAlgo
+	var spawns map[string]Position
+	if initial {
+		seed = &gs.Seed
+		layout = gs.Layout
+		algo = gs.MazeAlgo
+		spawns = gs.Spawns
 	}
+	return json.Marshal(struct {
+		*state
+		Seed       *int64    `json:"seed,omitempty"`
+		MazeAlgo   MazeAlgo  `json:"maze_algo,omitempty"`
+		Layout     string    `json:"layout,omitempty"`
+		Players    []*Player `json:"players"`
+		ServerTime int64     `json:"server_time_ms"`
+
+		Spawns map[string]Position `json:"spawns,omitempty"`
+	}{
+		state:      (*state)(gs),
+		Seed:       seed,
+		MazeAlgo:   algo,
+		Layout:     layout,
+		Spawns:     spawns,
+		Players:    players,
+		ServerTime: gs.clock.Now().UnixMilli(),
+	})
+}
+
+// AsInitialMessage marshals the full game state, including the maze seed,
+// for players who are starting or rejoining the game
+func (gs *GameState) AsInitialMessage() ([]byte, error) {
+	return gs.asStateMessage(true)
 }
 
-// AsUpdateMessage Marshalls the current gamestate as JSON bytes
+// AsUpdateMessage marshals the current game state as a tick update
 func (gs *GameState) AsUpdateMessage() ([]byte, error) {
+	return gs.asStateMessage(false)
+}
+
+func (gs *GameState) asStateMessage(initial bool) ([]byte, error) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	payload, err := gs.marshal(initial)
+	if err != nil {
+		return nil, err
+	}
 	return json.Marshal(struct {
-		Type    MessageType `json:"messageType"`
-		Payload interface{} `json:"payload"`
+		Type    MessageType     `json:"messageType"`
+		Payload json.RawMessage `json:"payload"`
 	}{
 		Type:    RespGameState,
-		Payload: gs,
+		Payload: payload,
 	})
 }
 
+// UpdatePlayer applies a player update under the state lock
+func (gs *GameState) UpdatePlayer(p *Player, update PlayerUpdateRequest) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if update.Seq != 0 {
+		if update.Seq <= p.LastSeq {
+			return
+		}
+		p.LastSeq = update.Seq
+	}
+	p.SetLevel(update.Level, gs.clock.Now())
+	p.Position = update.Position
+	p.Rotation = update.Rotation
+	p.Spawned = true
+	gs.recordLevel(p)
+	gs.changed = true
+}
+
+// AssignSpawns gives every player a spawn point in the start cell of the
+// maze, moving them to it. Players are spread in id order so the assignment
+// is stable.
+func (gs *GameState) AssignSpawns(layout *MazeLayout) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	players := gs.Players.Values()
+	slices.SortFunc(players, func(a, b *Player) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	gs.Spawns = make(map[string]Position, len(players))
+	for i, spawn := range SpawnPositions(layout, len(players)) {
+		gs.Spawns[players[i].Id] = spawn
+		players[i].Position = spawn
+	}
+	gs.changed = true
+}
+
+// AssignSpawn gives a player joining a running game a spawn point in the
+// middle of the start cell, leaving the other players' spawns alone
+func (gs *GameState) AssignSpawn(p *Player, layout *MazeLayout) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.Spawns == nil {
+		gs.Spawns = make(map[string]Position)
+	}
+	spawn := SpawnPositions(layout, 1)[0]
+	gs.Spawns[p.Id] = spawn
+	p.Position = spawn
+	gs.changed = true
+}
+
+// Reset clears the state for another round with the same players, e.g. a
+// rematch. Players go back to the starting level and their spawn point, and
+// the state is given a new id and the seed. Readers holding the state lock
+// see the old round or the new one, never a mix of the two.
+func (gs *GameState) Reset(seed int64) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.Id = gonanoid.Must(5)
+	gs.Seed = seed
+	gs.MaxLevel = 0
+	gs.StartTime = 0
+	gs.FirstToTarget = ""
+	gs.Phase = PhaseCountdown
+	for _, p := range gs.Players.Values() {
+		p.Level = StartingLevel
+		p.LevelReachedAt = 0
+		p.Splits = nil
+		p.LastSeq = 0
+		p.Rotation = 0
+		p.Spawned = false
+		p.Position = unspawnedPosition
+		if spawn, ok := gs.Spawns[p.Id]; ok {
+			p.Position = spawn
+		}
+	}
+	gs.changed = true
+}
+
+// ResetSeq forgets the sequence number of the player's last update, for a
+// connection numbering its updates afresh
+func (gs *GameState) ResetSeq(p *Player) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	p.LastSeq = 0
+}
+
+// AddPlayer adds a player joining the game, who is yet to spawn and numbers
+// their updates afresh
+func (gs *GameState) AddPlayer(p *Player) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	p.Spawned = false
+	p.LastSeq = 0
+	gs.Players.Set(p.Id, p)
+	gs.changed = true
+}
+
+// RemovePlayer removes a player who has left the game
+func (gs *GameState) RemovePlayer(id string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.Players.Del(id)
+	gs.changed = true
+}
+
+// SetActive marks a player as playing or not under the state lock
+func (gs *GameState) SetActive(p *Player, active bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	p.Active = active
+	gs.changed = true
+}
+
+// SetDisconnectReason records how a player's connection ended under the
+// state lock, empty once they're connected again
+func (gs *GameState) SetDisconnectReason(p *Player, reason DisconnectReason) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	p.DisconnectReason = reason
+	gs.changed = true
+}
+
+// SetConnection updates a player's connection quality under the state lock
+func (gs *GameState) SetConnection(p *Player, quality ConnectionQuality) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	p.Connection = quality
+	gs.changed = true
+}
+
+// SetStartTime sets the time, in unix milliseconds, at which the round started
+func (gs *GameState) SetStartTime(ms int64) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.StartTime = ms
+	gs.changed = true
+}
+
+// SetPhase moves the game to the given phase
+func (gs *GameState) SetPhase(phase GamePhase) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.Phase = phase
+	gs.changed = true
+}
+
+// GetSeed returns the seed the maze is generated from
+func (gs *GameState) GetSeed() int64 {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.Seed
+}
+
+// GetPhase returns the phase the game has reached
+func (gs *GameState) GetPhase() GamePhase {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.Phase
+}
+
+// DelayStart shifts the start time forward, e.g. to account for a pause
+func (gs *GameState) DelayStart(d time.Duration) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.StartTime += d.Milliseconds()
+	gs.changed = true
+}
+
+// TakeChanged reports whether the state has changed since it was last
+// called, clearing the flag
+func (gs *GameState) TakeChanged() bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	changed := gs.changed
+	gs.changed = false
+	return changed
+}
+
+// GetMaxLevel returns the highest level reached by any player
+func (gs *GameState) GetMaxLevel() int {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.MaxLevel
+}
+
+// SetMaxLevel overrides the highest level reached by any player
+func (gs *GameState) SetMaxLevel(level int) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.MaxLevel = level
+	gs.changed = true
+}
+
+// RecordLevel updates the game's max level from the given player's level
+// and records the first player to exceed the LevelTarget, if one is set.
+func (gs *GameState) RecordLevel(p *Player) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.recordLevel(p)
+}
+
+func (gs *GameState) recordLevel(p *Player) {
+	if p.Level > gs.MaxLevel {
+		gs.MaxLevel = p.Level
+	}
+	if gs.LevelTarget > 0 && gs.FirstToTarget == "" && p.Level > gs.LevelTarget {
+		gs.FirstToTarget = p.Id
+	}
+}
+
 // GetRoundResult returns the end-of-round results containing player scores.
 // It collects scores from all players in the game state and sorts them
 // by level in descending order (highest level first).
+//
+// Players on the same level are ordered by who reached it first. The first
+// player in that order is marked as the winner, unless the player who first
+// exceeded the LevelTarget is present, in which case they win regardless of
+// current level. If the top two players share both level and time reached
+// the round is a draw and no winner is marked.
 func (gs *GameState) GetRoundResult() RoundResult {
-	playerScores := make([]PlayerScore, 0, len(gs.Players.Values()))
-	for _, p := range gs.Players.Values() {
-		score := PlayerScore{
-			Username: p.Username,
-			Flag:     p.Flag,
-			Level:    p.Level,
-		}
-		playerScores = append(playerScores, score)
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.roundResult()
+}
+
+// TargetReachedResult atomically checks whether a player has exceeded the
+// target level and, if so, returns the round result at that instant.
+func (gs *GameState) TargetReachedResult(target int) (RoundResult, bool) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	if gs.MaxLevel <= target {
+		return RoundResult{}, false
 	}
-	slices.SortFunc(playerScores,
-		func(a, b PlayerScore) int {
-			return cmp.Compare(b.Level, a.Level)
+	return gs.roundResult(), true
+}
+
+func (gs *GameState) roundResult() RoundResult {
+	players := gs.Players.Values()
+	slices.SortFunc(players,
+		func(a, b *Player) int {
+			if a.Id == gs.FirstToTarget {
+				return -1
+			}
+			if b.Id == gs.FirstToTarget {
+				return 1
+			}
+			return cmp.Or(
+				cmp.Compare(b.Level, a.Level),
+				cmp.Compare(a.LevelReachedAt, b.LevelReachedAt),
+				cmp.Compare(a.Username, b.Username),
+			)
 		})
 
+	draw := len(players) > 1 &&
+		players[0].Id != gs.FirstToTarget &&
+		players[0].Level == players[1].Level &&
+		players[0].LevelReachedAt == players[1].LevelReachedAt
+
+	playerScores := make([]PlayerScore, 0, len(players))
+	for i, p := range players {
+		playerScores = append(playerScores, newPlayerScore(p, i == 0 && !draw))
+	}
+	return rankedResult(players, playerScores)
+}
+
+// ForfeitResult returns the result of a game won by default, with the winner
+// ahead of the players who forfeited by leaving, regardless of level
+func (gs *GameState) ForfeitResult(winner *Player, forfeited []*Player) RoundResult {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+
+	playerScores := []PlayerScore{newPlayerScore(winner, true)}
+	for _, p := range forfeited {
+		score := newPlayerScore(p, false)
+		score.Forfeited = true
+		playerScores = append(playerScores, score)
+	}
+	return rankedResult(append([]*Player{winner}, forfeited...), playerScores)
+}
+
+// rankedResult numbers the scores of the given players, which are in
+// finishing order, and indexes each player's placement by id
+func rankedResult(players []*Player, playerScores []PlayerScore) RoundResult {
+	placements := make(map[string]int, len(players))
+	for i, p := range players {
+		playerScores[i].Placement = i + 1
+		placements[p.Id] = i + 1
+	}
 	return RoundResult{
 		PlayerScores: playerScores,
+		TotalPlayers: len(playerScores),
+		Placements:   placements,
+	}
+}
+
+func newPlayerScore(p *Player, isWinner bool) PlayerScore {
+	return PlayerScore{
+		Username: p.Username,
+		Flag:     p.Flag,
+		Color:    p.Color,
+		Level:    p.Level,
+		IsWinner: isWinner,
+		Splits:   slices.Clone(p.Splits),
 	}
 }
 
@@ -75,25 +459,98 @@ func (gs *GameState) AsRoundResultResponse() ([]byte, error) {
 
 // RoundResult represents the end of round results
 type RoundResult struct {
+	// PlayerScores are in finishing order, possibly only the leading players
 	PlayerScores []PlayerScore `json:"playerScores"`
+	// TotalPlayers counts every player in the result, including any whose
+	// scores were left out
+	TotalPlayers int `json:"total_players"`
+	// Placements are every player's 1-based placement by player id, so
+	// players left out of the scores can still find their own
+	Placements map[string]int `json:"placements"`
+}
+
+// Top returns the result with only the first n scores, or all of them if n
+// is 0. Placements and the total are kept for every player.
+func (r RoundResult) Top(n int) RoundResult {
+	if n > 0 && len(r.PlayerScores) > n {
+		r.PlayerScores = slices.Clone(r.PlayerScores[:n])
+	}
+	return r
 }
 
 // PlayerScore represents an individual players end of round score
 type PlayerScore struct {
 	Username string `json:"username"`
 	Flag     string `json:"flag"`
+	Color    string `json:"color"`
 	Level    int    `json:"level"`
+	IsWinner bool   `json:"is_winner"`
+	// Placement is the player's 1-based finishing position
+	Placement int `json:"placement"`
+	// Forfeited is set for players who left, conceding the game
+	Forfeited bool `json:"forfeited,omitempty"`
+	// Splits are the times at which each level was reached
+	Splits []LevelSplit `json:"splits,omitempty"`
+}
+
+// MaxLevelSplits bounds the number of level splits kept per player.
+// No race can be won without exceeding the largest level target.
+const MaxLevelSplits int = MaxRaceLevelTarget + 1
+
+// LevelSplit records when a player reached a level
+type LevelSplit struct {
+	Level     int   `json:"level"`
+	ReachedAt int64 `json:"reached_at_ms"`
 }
 
 // Player represents a specific player entity in a game
 type Player struct {
-	Id       string   `json:"id"`
-	Active   bool     `json:"active"`
-	Username string   `json:"username"`
-	Flag     string   `json:"flag"`
+	Id       string `json:"id"`
+	Active   bool   `json:"active"`
+	Username string `json:"username"`
+	Flag     string `json:"flag"`
+	// Color is a "#rrggbb" hex color distinguishing the player
+	Color    string   `json:"color"`
 	Level    int      `json:"level"`
 	Position Position `json:"position"`
 	Rotation float64  `json:"rotation"`
+	// Spawned is false until the player's first update in the game, while
+	// their position is still their spawn point, or before the game starts
+	// the off-screen sentinel
+	Spawned bool `json:"spawned"`
+	// LevelReachedAt is the unix millisecond time the current level was reached
+	LevelReachedAt int64 `json:"-"`
+	// LastSeq is the sequence number of the last update applied in the game
+	LastSeq uint64 `json:"-"`
+	// DisconnectReason is set when the player's connection ends during a game
+	DisconnectReason DisconnectReason `json:"disconnect_reason,omitempty"`
+	// Splits holds the time each level was reached, oldest first
+	Splits []LevelSplit `json:"-"`
+	// Region is the player's self reported region, used for matchmaking
+	Region string `json:"region,omitempty"`
+	// Connection is the quality of the player's connection, once measured
+	Connection ConnectionQuality `json:"connection,omitempty"`
+	// Identity is the authenticated subject of the player's token, if any
+	Identity string `json:"-"`
+	// ReconnectToken is the secret a new connection must present to take
+	// over the player after a drop. Unlike the id it's never broadcast.
+	ReconnectToken string `json:"-"`
+}
+
+// SetLevel updates the player's level, recording when a new level is reached
+// as now. Moving back down a level, e.g. for a new game, discards the later splits.
+func (p *Player) SetLevel(level int, now time.Time) {
+	if level > p.Level {
+		p.LevelReachedAt = now.UnixMilli()
+		if len(p.Splits) < MaxLevelSplits {
+			p.Splits = append(p.Splits, LevelSplit{Level: level, ReachedAt: p.LevelReachedAt})
+		}
+	} else if level < p.Level {
+		p.Splits = slices.DeleteFunc(p.Splits, func(s LevelSplit) bool {
+			return s.Level > level
+		})
+	}
+	p.Level = level
 }
 
 // Position represents the position of the sprite for a player
@@ -102,18 +559,77 @@ type Position struct {
 	Y float64 `json:"y"`
 }
 
-// Creates a new player
+// PlayerIDLength is the length of the nanoid assigned to each player
+const PlayerIDLength int = 5
+
+// ReconnectTokenLength is the length of the nanoid players reconnect with
+const ReconnectTokenLength int = 21
+
+// nanoidAlphabet is the default nanoid alphabet, used for player ids and by
+// default for challenge ids
+const nanoidAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// DefaultPlayerColor is given to players who don't choose a color
+const DefaultPlayerColor = "#ffffff"
+
+// ParsePlayerColor validates a "#rrggbb" hex color, returning it in lower case.
+// An empty color gives the default.
+func ParsePlayerColor(color string) (string, error) {
+	if color == "" {
+		return DefaultPlayerColor, nil
+	}
+	if len(color) != 7 || color[0] != '#' {
+		return "", fmt.Errorf("color must be of the form #rrggbb")
+	}
+	for _, r := range color[1:] {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') && (r < 'A' || r > 'F') {
+			return "", fmt.Errorf("color must be of the form #rrggbb")
+		}
+	}
+	return strings.ToLower(color), nil
+}
+
+// ErrInvalidPlayerID is returned for an id NewPlayer could never have assigned
+var ErrInvalidPlayerID = errors.New("invalid player id")
+
+// NewPlayerWithID creates a player with a known id instead of a random one,
+// to restore a player's identity. The id must be in the form NewPlayer assigns.
+func NewPlayerWithID(id, username, flag string) (*Player, error) {
+	if !validPlayerID(id) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPlayerID, id)
+	}
+	p := NewPlayer(username, flag)
+	p.Id = id
+	return p, nil
+}
+
+// StartingLevel is the level players begin a game on
+const StartingLevel int = 1
+
+// unspawnedPosition is the off-screen position of players without a spawn point
+var unspawnedPosition = Position{X: -1000, Y: -1000}
+
+// ResultsKey returns the key the player's results are recorded under. With
+// authentication enabled that's their authenticated subject, so nobody can
+// claim another player's results by taking their username.
+func (p *Player) ResultsKey() string {
+	if p.Identity != "" {
+		return p.Identity
+	}
+	return p.Username
+}
+
+// NewPlayer creates a new player with a random id, at the starting level
 func NewPlayer(username, flag string) *Player {
 	return &Player{
-		Id:       gonanoid.Must(5),
-		Active:   false,
-		Username: username,
-		Flag:     flag,
-		Level:    1,
-		Position: Position{
-			X: -1000,
-			Y: -1000,
-		},
-		Rotation: 0,
+		Id:             gonanoid.Must(PlayerIDLength),
+		ReconnectToken: gonanoid.Must(ReconnectTokenLength),
+		Active:         false,
+		Username:       username,
+		Flag:           flag,
+		Color:          DefaultPlayerColor,
+		Level:          StartingLevel,
+		Position:       unspawnedPosition,
+		Rotation:       0,
 	}
 }
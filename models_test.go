@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewPlayer(t *testing.T) {
@@ -23,6 +28,163 @@ func TestNewPlayer(t *testing.T) {
 	assert.NotEmpty(t, player.Id)
 }
 
+func TestNewPlayerWithID(t *testing.T) {
+	player, err := NewPlayerWithID("aB3_-", "testUser", "🏴")
+	require.NoError(t, err)
+	assert.Equal(t, "aB3_-", player.Id, "the supplied id should be kept")
+	assert.Equal(t, "testUser", player.Username)
+	assert.Equal(t, NewPlayer("testUser", "🏴").Level, player.Level, "other fields should match NewPlayer")
+
+	// Generated ids round trip
+	generated := NewPlayer("testUser", "🏴")
+	restored, err := NewPlayerWithID(generated.Id, "testUser", "🏴")
+	require.NoError(t, err)
+	assert.Equal(t, generated.Id, restored.Id)
+
+	for _, id := range []string{"", "abcd", "abcdef", "ab cd", "ab$cd", "123e4567-e89b-12d3-a456-426614174000"} {
+		_, err := NewPlayerWithID(id, "testUser", "🏴")
+		assert.ErrorIs(t, err, ErrInvalidPlayerID, id)
+	}
+}
+
+func TestPlayerSetLevel(t *testing.T) {
+	player := NewPlayer("testUser", "🏴")
+	assert.Zero(t, player.LevelReachedAt)
+
+	now := time.UnixMilli(1_700_000_000_000)
+	player.SetLevel(2, now)
+	assert.Equal(t, now.UnixMilli(), player.LevelReachedAt)
+
+	player.SetLevel(2, now.Add(time.Second))
+	assert.Equal(t, now.UnixMilli(), player.LevelReachedAt, "same level should not update the timestamp")
+
+	// Levels reached in a game are timed by the game's clock
+	clock := newFakeClock()
+	gs := NewGameState(1, clock)
+	clock.Advance(time.Minute)
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 3})
+	assert.Equal(t, clock.Now().UnixMilli(), player.LevelReachedAt)
+}
+
+func TestUpdatePlayerSequence(t *testing.T) {
+	gs := NewGameState(1, realClock{})
+	player := NewPlayer("testUser", "🏴")
+	gs.Players.Set(player.Id, player)
+
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 3, Seq: 3})
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 2, Seq: 2})
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 1, Seq: 3})
+	assert.Equal(t, 3, player.Level, "stale and repeated updates should be ignored")
+
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 4})
+	assert.Equal(t, 4, player.Level, "unnumbered updates are always applied")
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 5, Seq: 4})
+	assert.Equal(t, 5, player.Level)
+
+	gs.ResetSeq(player)
+	gs.UpdatePlayer(player, PlayerUpdateRequest{Level: 6, Seq: 1})
+	assert.Equal(t, 6, player.Level, "a new connection numbers its updates afresh")
+}
+
+func TestGameStateReset(t *testing.T) {
+	t.Run("clears progress", func(t *testing.T) {
+		gs := NewGameState(1, realClock{})
+		gs.LevelTarget = 3
+		p1 := NewPlayer("player1", "🏴")
+		p2 := NewPlayer("player2", "🏴")
+		for _, p := range []*Player{p1, p2} {
+			gs.Players.Set(p.Id, p)
+		}
+		gs.AssignSpawns(nil)
+		spawn := p1.Position
+		gs.SetStartTime(1000)
+		gs.SetPhase(PhaseEnded)
+		gs.UpdatePlayer(p1, PlayerUpdateRequest{Level: 5, Position: Position{X: 3, Y: 4}, Rotation: 90, Seq: 7})
+		id := gs.Id
+
+		gs.Reset(2)
+		assert.NotEqual(t, id, gs.Id)
+		assert.Equal(t, int64(2), gs.Seed)
+		assert.Equal(t, 0, gs.GetMaxLevel())
+		assert.Zero(t, gs.StartTime)
+		assert.Empty(t, gs.FirstToTarget)
+		assert.Equal(t, PhaseCountdown, gs.GetPhase())
+		assert.ElementsMatch(t, []*Player{p1, p2}, gs.Players.Values(), "the roster should be kept")
+
+		assert.Equal(t, StartingLevel, p1.Level)
+		assert.Empty(t, p1.Splits)
+		assert.Equal(t, spawn, p1.Position, "players should be returned to their spawn")
+		assert.Zero(t, p1.Rotation)
+		assert.False(t, p1.Spawned)
+		gs.UpdatePlayer(p1, PlayerUpdateRequest{Level: 2, Seq: 1})
+		assert.Equal(t, 2, p1.Level, "updates should be numbered afresh")
+	})
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		gs := NewGameState(0, realClock{})
+		players := make([]*Player, 4)
+		for i := range players {
+			players[i] = NewPlayer(fmt.Sprintf("player%d", i), "🏴")
+			gs.Players.Set(players[i].Id, players[i])
+		}
+
+		// Each round players start on the starting level and move to one
+		// past the seed, so a level from another round means a torn read
+		const firstSeed, rounds = 10, 200
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for seed := int64(firstSeed); seed < firstSeed+rounds; seed++ {
+				gs.Reset(seed)
+				for _, p := range players {
+					gs.UpdatePlayer(p, PlayerUpdateRequest{Level: int(seed) + 1})
+				}
+			}
+		}()
+
+		for reading := true; reading; {
+			select {
+			case <-done:
+				reading = false
+			default:
+			}
+			msg, err := gs.AsInitialMessage()
+			require.NoError(t, err)
+			var state struct {
+				Payload struct {
+					Seed    int64 `json:"seed"`
+					Players []struct {
+						Level int `json:"level"`
+					} `json:"players"`
+				} `json:"payload"`
+			}
+			require.NoError(t, json.Unmarshal(msg, &state))
+			if state.Payload.Seed < firstSeed {
+				continue
+			}
+			for _, p := range state.Payload.Players {
+				require.Contains(t, []int{StartingLevel, int(state.Payload.Seed) + 1}, p.Level,
+					"seed %v was read with a level from another round", state.Payload.Seed)
+			}
+		}
+	})
+}
+
+func TestParsePlayerColor(t *testing.T) {
+	color, err := ParsePlayerColor("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPlayerColor, color, "no color should fall back to the default")
+
+	color, err = ParsePlayerColor("#1A2b3C")
+	require.NoError(t, err)
+	assert.Equal(t, "#1a2b3c", color)
+
+	for _, invalid := range []string{"ffffff", "#fff", "#gggggg", "#1234567"} {
+		_, err := ParsePlayerColor(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
 func TestGameStateScoring(t *testing.T) {
 	testsCases := []struct {
 		name     string
@@ -33,7 +195,7 @@ func TestGameStateScoring(t *testing.T) {
 		{
 			name:     "empty game state",
 			setup:    func(gs *GameState) {},
-			expected: `{"playerScores":[]}`,
+			expected: `[]`,
 			wantErr:  false,
 		},
 		{
@@ -43,7 +205,7 @@ func TestGameStateScoring(t *testing.T) {
 				player.Level = 5
 				gs.Players.Set(player.Id, player)
 			},
-			expected: `{"playerScores":[{"username":"player1","flag":"US","level":5}]}`,
+			expected: `[{"username":"player1","flag":"US","color":"#ffffff","level":5,"is_winner":true,"placement":1}]`,
 			wantErr:  false,
 		},
 		{
@@ -61,18 +223,64 @@ func TestGameStateScoring(t *testing.T) {
 				p3.Level = 7
 				gs.Players.Set(p3.Id, p3)
 			},
-			expected: `{"playerScores":[{"username":"player3","flag":"FR","level":7},{"username":"player1","flag":"US","level":5},{"username":"player2","flag":"UK","level":3}]}`,
+			expected: `[{"username":"player3","flag":"FR","color":"#ffffff","level":7,"is_winner":true,"placement":1},{"username":"player1","flag":"US","color":"#ffffff","level":5,"is_winner":false,"placement":2},{"username":"player2","flag":"UK","color":"#ffffff","level":3,"is_winner":false,"placement":3}]`,
+			wantErr:  false,
+		},
+		{
+			name: "tied level won by earliest to reach it",
+			setup: func(gs *GameState) {
+				p1 := NewPlayer("player1", "US")
+				p1.Level = 5
+				p1.LevelReachedAt = 2000
+				gs.Players.Set(p1.Id, p1)
+
+				p2 := NewPlayer("player2", "UK")
+				p2.Level = 5
+				p2.LevelReachedAt = 1000
+				gs.Players.Set(p2.Id, p2)
+			},
+			expected: `[{"username":"player2","flag":"UK","color":"#ffffff","level":5,"is_winner":true,"placement":1},{"username":"player1","flag":"US","color":"#ffffff","level":5,"is_winner":false,"placement":2}]`,
+			wantErr:  false,
+		},
+		{
+			name: "exact tie is a draw",
+			setup: func(gs *GameState) {
+				p1 := NewPlayer("player1", "US")
+				gs.Players.Set(p1.Id, p1)
+
+				p2 := NewPlayer("player2", "UK")
+				gs.Players.Set(p2.Id, p2)
+			},
+			expected: `[{"username":"player1","flag":"US","color":"#ffffff","level":1,"is_winner":false,"placement":1},{"username":"player2","flag":"UK","color":"#ffffff","level":1,"is_winner":false,"placement":2}]`,
+			wantErr:  false,
+		},
+		{
+			name: "first to race target wins regardless of current level",
+			setup: func(gs *GameState) {
+				gs.LevelTarget = 3
+
+				p1 := NewPlayer("player1", "US")
+				gs.Players.Set(p1.Id, p1)
+				p1.Level = 4
+				gs.RecordLevel(p1)
+
+				p2 := NewPlayer("player2", "UK")
+				gs.Players.Set(p2.Id, p2)
+				p2.Level = 6
+				gs.RecordLevel(p2)
+			},
+			expected: `[{"username":"player1","flag":"US","color":"#ffffff","level":4,"is_winner":true,"placement":1},{"username":"player2","flag":"UK","color":"#ffffff","level":6,"is_winner":false,"placement":2}]`,
 			wantErr:  false,
 		},
 	}
 
 	for _, tc := range testsCases {
 		t.Run(tc.name, func(t *testing.T) {
-			gs := NewGameState(123) // seed value doesn't matter for these tests
+			gs := NewGameState(123, realClock{}) // seed value doesn't matter for these tests
 			tc.setup(gs)
 
 			round := gs.GetRoundResult()
-			bytes, err := json.Marshal(round)
+			bytes, err := json.Marshal(round.PlayerScores)
 
 			if tc.wantErr {
 				assert.Error(t, err)
@@ -80,6 +288,173 @@ func TestGameStateScoring(t *testing.T) {
 				assert.NoError(t, err)
 				assert.JSONEq(t, tc.expected, string(bytes))
 			}
+			assert.Equal(t, gs.Players.Len(), round.TotalPlayers)
+			assert.Len(t, round.Placements, gs.Players.Len())
 		})
 	}
 }
+
+func TestRoundResultTop(t *testing.T) {
+	gs := NewGameState(1, realClock{})
+	players := make([]*Player, 5)
+	for i := range players {
+		players[i] = NewPlayer(fmt.Sprintf("player%d", i+1), "US")
+		players[i].Level = 10 - i
+		gs.Players.Set(players[i].Id, players[i])
+	}
+	full := gs.GetRoundResult()
+
+	top := full.Top(2)
+	require.Len(t, top.PlayerScores, 2, "only the leading players' scores should be kept")
+	assert.Equal(t, "player1", top.PlayerScores[0].Username)
+	assert.Equal(t, 1, top.PlayerScores[0].Placement)
+	assert.Equal(t, "player2", top.PlayerScores[1].Username)
+	assert.Equal(t, 2, top.PlayerScores[1].Placement)
+	assert.Equal(t, 5, top.TotalPlayers)
+	for i, p := range players {
+		assert.Equal(t, i+1, top.Placements[p.Id], "every player should be able to find their placement")
+	}
+	assert.Len(t, full.PlayerScores, 5, "truncating shouldn't modify the full result")
+
+	assert.Len(t, full.Top(0).PlayerScores, 5, "0 should keep every score")
+	assert.Len(t, full.Top(10).PlayerScores, 5)
+}
+
+func TestGameStatePlayerOrderStable(t *testing.T) {
+	// Hold the server time still so only the player order could differ
+	gs := NewGameState(1, newFakeClock())
+	for i := 0; i < 20; i++ {
+		p := NewPlayer(fmt.Sprintf("player%d", i), "🏴")
+		gs.Players.Set(p.Id, p)
+	}
+
+	first, err := gs.AsInitialMessage()
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		msg, err := gs.AsInitialMessage()
+		require.NoError(t, err)
+		assert.Equal(t, string(first), string(msg), "player order should not change between broadcasts")
+	}
+
+	var decoded struct {
+		Payload struct {
+			Seed    int64    `json:"seed"`
+			Players []Player `json:"players"`
+		} `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(first, &decoded))
+	assert.Equal(t, int64(1), decoded.Payload.Seed)
+	require.Len(t, decoded.Payload.Players, 20)
+	assert.True(t, slices.IsSortedFunc(decoded.Payload.Players, func(a, b Player) int {
+		return strings.Compare(a.Id, b.Id)
+	}))
+}
+
+func TestPlayerLevelSplits(t *testing.T) {
+	player := NewPlayer("testUser", "🏴")
+	assert.Empty(t, player.Splits)
+
+	now := time.Now()
+	for level := 2; level <= 5; level++ {
+		player.SetLevel(level, now.Add(time.Duration(level)*time.Millisecond))
+	}
+
+	require.Len(t, player.Splits, 4)
+	for i, split := range player.Splits {
+		assert.Equal(t, i+2, split.Level)
+		if i > 0 {
+			assert.Greater(t, split.ReachedAt, player.Splits[i-1].ReachedAt, "splits should be monotonically increasing")
+		}
+	}
+
+	// Repeated updates at the same level don't add splits
+	player.SetLevel(5, time.Now())
+	assert.Len(t, player.Splits, 4)
+
+	// Dropping back for a new game discards the old splits
+	player.SetLevel(1, time.Now())
+	assert.Empty(t, player.Splits)
+
+	for level := 2; level < MaxLevelSplits+10; level++ {
+		player.SetLevel(level, time.Now())
+	}
+	assert.Len(t, player.Splits, MaxLevelSplits, "splits should be bounded")
+}
+
+func TestRoundResultIncludesSplits(t *testing.T) {
+	gs := NewGameState(1, realClock{})
+	p := NewPlayer("testUser", "🏴")
+	gs.Players.Set(p.Id, p)
+	gs.UpdatePlayer(p, PlayerUpdateRequest{Level: 2})
+	gs.UpdatePlayer(p, PlayerUpdateRequest{Level: 3})
+
+	result := gs.GetRoundResult()
+	require.Len(t, result.PlayerScores, 1)
+	splits := result.PlayerScores[0].Splits
+	require.Len(t, splits, 2)
+	assert.Equal(t, 2, splits[0].Level)
+	assert.Equal(t, 3, splits[1].Level)
+	assert.LessOrEqual(t, splits[0].ReachedAt, splits[1].ReachedAt)
+}
+
+func TestGameStateInitialAndUpdatePayloads(t *testing.T) {
+	gs := NewGameState(42, newFakeClock())
+	p := NewPlayer("testUser", "🏴")
+	gs.Players.Set(p.Id, p)
+
+	decode := func(msg []byte) map[string]json.RawMessage {
+		var decoded struct {
+			Type    MessageType                `json:"messageType"`
+			Payload map[string]json.RawMessage `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(msg, &decoded))
+		assert.Equal(t, RespGameState, decoded.Type)
+		return decoded.Payload
+	}
+
+	initialMsg, err := gs.AsInitialMessage()
+	require.NoError(t, err)
+	initial := decode(initialMsg)
+	assert.JSONEq(t, "42", string(initial["seed"]))
+
+	updateMsg, err := gs.AsUpdateMessage()
+	require.NoError(t, err)
+	update := decode(updateMsg)
+	assert.NotContains(t, update, "seed", "tick updates shouldn't resend the seed")
+
+	// Everything else is shared between the two
+	delete(initial, "seed")
+	assert.Equal(t, initial, update)
+	assert.Contains(t, update, "players")
+	assert.Less(t, len(updateMsg), len(initialMsg))
+}
+
+func TestGameStateServerTime(t *testing.T) {
+	clock := newFakeClock()
+	gs := NewGameState(42, clock)
+
+	serverTime := func(msg []byte, err error) int64 {
+		require.NoError(t, err)
+		var decoded struct {
+			Payload map[string]json.RawMessage `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(msg, &decoded))
+		require.Contains(t, decoded.Payload, "server_time_ms")
+		var ms int64
+		require.NoError(t, json.Unmarshal(decoded.Payload["server_time_ms"], &ms))
+		return ms
+	}
+
+	initial := serverTime(gs.AsInitialMessage())
+	assert.Equal(t, clock.Now().UnixMilli(), initial)
+
+	// Each update carries the time it was created
+	last := initial
+	for range 3 {
+		clock.Advance(ServerTickrate)
+		update := serverTime(gs.AsUpdateMessage())
+		assert.Equal(t, clock.Now().UnixMilli(), update)
+		assert.Greater(t, update, last, "server time should advance between updates")
+		last = update
+	}
+}
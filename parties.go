@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// DefaultMaxPartySize is how many players a party may hold unless configured
+const DefaultMaxPartySize = 4
+
+var (
+	// ErrAlreadyInParty is returned when a player in a party creates or joins another
+	ErrAlreadyInParty = errors.New("already in a party")
+	// ErrNotInParty is returned when a player who isn't in a party leaves one
+	ErrNotInParty = errors.New("not in a party")
+	// ErrPartyNotFound is returned when joining a party with an unknown code
+	ErrPartyNotFound = errors.New("party not found")
+	// ErrPartyFull is returned when joining a party at its size limit
+	ErrPartyFull = errors.New("party is full")
+	// ErrNotPartyLeader is returned when a party member other than the leader
+	// joins a head-to-head queue
+	ErrNotPartyLeader = errors.New("only the party leader can queue")
+	// ErrPartyBusy is returned when the party queues while a member is in a game
+	ErrPartyBusy = errors.New("party member is in a game")
+)
+
+// Party is a group of players who queue together and are placed into the
+// same game. Its leader and members are guarded by the matchmaker's partyMu.
+type Party struct {
+	// Code other players join the party with
+	Code    string
+	leader  *Client
+	members []*Client
+}
+
+// CreateParty creates a party led by the client, who shares its code with
+// the players they want to queue with
+func (m *Matchmaker) CreateParty(c *Client) (*Party, error) {
+	m.partyMu.Lock()
+
+	if c.party.Load() != nil {
+		m.partyMu.Unlock()
+		return nil, ErrAlreadyInParty
+	}
+
+	var party *Party
+	for {
+		code, err := m.challengeIDs.Generate()
+		if err != nil {
+			m.partyMu.Unlock()
+			return nil, err
+		}
+		party = &Party{Code: code, leader: c, members: []*Client{c}}
+		if m.parties.SetIfAbsent(code, party) {
+			break
+		}
+	}
+	c.party.Store(party)
+	slog.Info("created party", "party", party.Code, "player_id", c.player.Id)
+	msg, members := partyUpdate(party)
+	m.partyMu.Unlock()
+
+	sendParty(members, msg)
+	return party, nil
+}
+
+// JoinParty adds the client to the party with the given code
+func (m *Matchmaker) JoinParty(c *Client, code string) error {
+	m.partyMu.Lock()
+
+	if c.party.Load() != nil {
+		m.partyMu.Unlock()
+		return ErrAlreadyInParty
+	}
+	party, ok := m.parties.Get(code)
+	if !ok {
+		m.partyMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrPartyNotFound, code)
+	}
+	if len(party.members) >= m.partyLimit() {
+		m.partyMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrPartyFull, code)
+	}
+
+	party.members = append(party.members, c)
+	c.party.Store(party)
+	slog.Info("joined party", "party", party.Code, "player_id", c.player.Id)
+	msg, members := partyUpdate(party)
+	m.partyMu.Unlock()
+
+	sendParty(members, msg)
+	return nil
+}
+
+// LeaveParty removes the client from their party. The longest standing
+// member takes over if the leader leaves, and the party is disbanded once
+// it's empty. A queued player stays queued on their own.
+func (m *Matchmaker) LeaveParty(c *Client) error {
+	m.partyMu.Lock()
+
+	party := c.party.Load()
+	if party == nil {
+		m.partyMu.Unlock()
+		return ErrNotInParty
+	}
+	party.members = slices.DeleteFunc(party.members, func(member *Client) bool {
+		return member == c
+	})
+	c.party.Store(nil)
+	slog.Info("left party", "party", party.Code, "player_id", c.player.Id)
+
+	var msg []byte
+	var members []*Client
+	if len(party.members) == 0 {
+		m.parties.Del(party.Code)
+		slog.Info("disbanded party", "party", party.Code)
+	} else {
+		if party.leader == c {
+			party.leader = party.members[0]
+		}
+		msg, members = partyUpdate(party)
+	}
+	m.partyMu.Unlock()
+
+	// Nobody is listening to a disconnecting client
+	if c.ctx.Err() == nil {
+		c.trySend(MustCreateResponseBytes(RespPartyLeft, PartyLeftResponse{
+			Code: party.Code,
+		}))
+	}
+	sendParty(members, msg)
+	return nil
+}
+
+// partyLimit returns how many players a party may hold. A party never
+// outgrows a lobby, so its members can always be placed together.
+func (m *Matchmaker) partyLimit() int {
+	if capacity := m.lobbyCapacity(); capacity > 0 {
+		return min(m.maxPartySize, capacity)
+	}
+	return m.maxPartySize
+}
+
+// lobbyCapacity returns how many players a new head-to-head game admits, or
+// 0 if it isn't limited. Lobbies no larger than a pair are disabled.
+func (m *Matchmaker) lobbyCapacity() int {
+	if m.lobby.FillTimeout <= 0 || m.lobby.MaxPlayers <= 2 {
+		return 0
+	}
+	return m.lobby.MaxPlayers
+}
+
+// partyUpdate returns the message telling a party's members who is in it,
+// and the members to send it to once partyMu is released.
+// The caller must hold partyMu.
+func partyUpdate(party *Party) ([]byte, []*Client) {
+	members := make([]PartyMember, len(party.members))
+	for i, member := range party.members {
+		members[i] = PartyMember{
+			ID:       member.player.Id,
+			Username: member.player.Username,
+			Flag:     member.player.Flag,
+		}
+	}
+	msg := MustCreateResponseBytes(RespParty, PartyResponse{
+		Code:     party.Code,
+		LeaderID: party.leader.player.Id,
+		Members:  members,
+	})
+	return msg, slices.Clone(party.members)
+}
+
+// sendParty delivers a party message to each member without blocking
+func sendParty(members []*Client, msg []byte) {
+	for _, member := range members {
+		member.trySend(msg)
+	}
+}
+
+// addPartyToQueue queues every member of the leader's party together, at
+// the back of the queue, so they're matched into the same game
+func (m *Matchmaker) addPartyToQueue(c *Client, party *Party, mode GameMode) error {
+	m.partyMu.Lock()
+	if party.leader != c {
+		m.partyMu.Unlock()
+		return ErrNotPartyLeader
+	}
+	members := slices.Clone(party.members)
+	m.partyMu.Unlock()
+
+	// Checked under queueMu so no member is matched in the meantime
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+
+	for _, member := range members {
+		switch member.Status() {
+		case StatusIdle, StatusQueued, StatusEndGame:
+		default:
+			return fmt.Errorf("%w: %v", ErrPartyBusy, member.player.Id)
+		}
+	}
+
+	queue := m.queue(mode)
+	if queue == nil {
+		return fmt.Errorf("unrecognized queue: %v", mode)
+	}
+	for _, member := range members {
+		*queue = slices.DeleteFunc(*queue, func(queued *Client) bool {
+			return queued == member
+		})
+		if err := m.enqueue(member, mode); err != nil {
+			return err
+		}
+	}
+	slog.Info("added party to queue",
+		"party", party.Code,
+		"players", len(members),
+		"queue", mode)
+
+	m.matchQueue(mode)
+	return nil
+}
+
+// partyOf returns the players in the queue who must be placed into the same
+// game as the client, the client alone if they aren't in a party
+func partyOf(queue []*Client, c *Client) []*Client {
+	party := c.party.Load()
+	if party == nil {
+		return []*Client{c}
+	}
+	var members []*Client
+	for _, queued := range queue {
+		if queued.party.Load() == party {
+			members = append(members, queued)
+		}
+	}
+	return members
+}
+
+// firstSolo returns the index of the longest waiting player in the queue
+// who isn't waiting with their party, or -1 if there are none
+func firstSolo(queue []*Client) int {
+	return slices.IndexFunc(queue, func(c *Client) bool {
+		return len(partyOf(queue, c)) == 1
+	})
+}
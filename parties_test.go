@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lastParty returns the latest party update sent to a client
+func lastParty(t *testing.T, c *Client) (PartyResponse, bool) {
+	t.Helper()
+	var party PartyResponse
+	found := false
+	for len(c.send) > 0 {
+		var base BaseMessage
+		require.NoError(t, json.Unmarshal(<-c.send, &base))
+		if base.Type == RespParty {
+			require.NoError(t, json.Unmarshal(base.Payload, &party))
+			found = true
+		}
+	}
+	return party, found
+}
+
+// lastConfirmed waits for the game confirmation sent to a client
+func lastConfirmed(t *testing.T, c *Client) (GameConfirmedResponse, bool) {
+	t.Helper()
+	var confirmed GameConfirmedResponse
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case msg := <-c.send:
+			var base BaseMessage
+			require.NoError(t, json.Unmarshal(msg, &base))
+			if base.Type == RespGameConfirmed {
+				require.NoError(t, json.Unmarshal(base.Payload, &confirmed))
+				return confirmed, true
+			}
+		case <-deadline:
+			return confirmed, false
+		}
+	}
+}
+
+func TestPartyMembership(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxPartySize = 2
+	leader := newTestClient("leader")
+	member := newTestClient("member")
+
+	party, err := mm.CreateParty(leader)
+	require.NoError(t, err)
+	_, err = mm.CreateParty(leader)
+	assert.ErrorIs(t, err, ErrAlreadyInParty)
+
+	assert.ErrorIs(t, mm.JoinParty(member, "missing"), ErrPartyNotFound)
+	require.NoError(t, mm.JoinParty(member, party.Code))
+	assert.ErrorIs(t, mm.JoinParty(member, party.Code), ErrAlreadyInParty)
+	assert.ErrorIs(t, mm.JoinParty(newTestClient("third"), party.Code), ErrPartyFull)
+
+	update, ok := lastParty(t, leader)
+	require.True(t, ok, "members should be told who is in the party")
+	assert.Equal(t, party.Code, update.Code)
+	assert.Equal(t, leader.player.Id, update.LeaderID)
+	require.Len(t, update.Members, 2)
+	assert.Equal(t, "member", update.Members[1].Username)
+
+	assert.ErrorIs(t, mm.AddToQueue(member, ModeRace), ErrNotPartyLeader)
+
+	require.NoError(t, mm.LeaveParty(leader))
+	assert.True(t, receiveType(leader, RespPartyLeft, time.Second))
+	update, ok = lastParty(t, member)
+	require.True(t, ok)
+	assert.Equal(t, member.player.Id, update.LeaderID, "the remaining member should take over")
+
+	require.NoError(t, mm.LeaveParty(member))
+	assert.ErrorIs(t, mm.LeaveParty(member), ErrNotInParty)
+	_, ok = mm.parties.Get(party.Code)
+	assert.False(t, ok, "empty parties should be disbanded")
+}
+
+func TestPartyStalledMember(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	leader := newTestClient("leader")
+	stalled := newTestClient("stalled")
+	party, err := mm.CreateParty(leader)
+	require.NoError(t, err)
+	require.NoError(t, mm.JoinParty(stalled, party.Code))
+	stalled.mm = mm
+	for len(stalled.send) < cap(stalled.send) {
+		stalled.send <- []byte("{}")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, mm.JoinParty(newTestClient("member"), party.Code))
+		// Refusals are dropped rather than waiting on the stalled client
+		stalled.HandleJoinParty(&JoinPartyRequest{Code: "missing"})
+		stalled.cancel()
+		assert.NoError(t, mm.LeaveParty(stalled))
+		_, err := mm.CreateParty(newTestClient("other"))
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a member with a full buffer shouldn't stall parties")
+	}
+}
+
+func TestPartyQueuesTogether(t *testing.T) {
+	// gameOf returns the game a client was added to
+	gameOf := func(t *testing.T, mm *Matchmaker, c *Client) Game {
+		t.Helper()
+		var found Game
+		require.True(t, waitFor(time.Second, func() bool {
+			for _, game := range mm.headToHeadGames.Values() {
+				if game.PlayerConnected(c.player.Id) {
+					found = game
+					return true
+				}
+			}
+			return false
+		}), "%v should be placed into a game", c.player.Username)
+		return found
+	}
+
+	t.Run("party of two", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		leader := newTestClient("leader")
+		member := newTestClient("member")
+		party, err := mm.CreateParty(leader)
+		require.NoError(t, err)
+		require.NoError(t, mm.JoinParty(member, party.Code))
+
+		require.NoError(t, mm.AddToQueue(leader, ModeRace))
+		require.Equal(t, 1, mm.headToHeadGames.Len())
+		game := gameOf(t, mm, leader)
+		defer game.Cleanup()
+		assert.Equal(t, game, gameOf(t, mm, member))
+		assert.True(t, receiveType(member, RespGameConfirmed, time.Second))
+	})
+
+	t.Run("party with a solo player", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		solo := newTestClient("solo")
+		require.NoError(t, mm.AddToQueue(solo, ModeRace))
+
+		leader := newTestClient("leader")
+		member := newTestClient("member")
+		party, err := mm.CreateParty(leader)
+		require.NoError(t, err)
+		require.NoError(t, mm.JoinParty(member, party.Code))
+		require.NoError(t, mm.AddToQueue(leader, ModeRace))
+
+		require.Equal(t, 1, mm.headToHeadGames.Len(), "the solo player and the party should share one game")
+		game := gameOf(t, mm, solo)
+		defer game.Cleanup()
+		assert.Equal(t, game, gameOf(t, mm, leader))
+		assert.Equal(t, game, gameOf(t, mm, member))
+		assert.Empty(t, mm.QueueDepths()[ModeRace])
+	})
+
+	t.Run("two full parties", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		var players []*Client
+		for _, name := range []string{"a", "b"} {
+			leader := newTestClient(name + "0")
+			party, err := mm.CreateParty(leader)
+			require.NoError(t, err)
+			players = append(players, leader)
+			for i := 1; i < DefaultMaxPartySize; i++ {
+				member := newTestClient(fmt.Sprintf("%v%d", name, i))
+				require.NoError(t, mm.JoinParty(member, party.Code))
+				players = append(players, member)
+			}
+			require.NoError(t, mm.AddToQueue(leader, ModeRace))
+		}
+
+		// Each party fills a game of its own
+		require.Equal(t, 2, mm.headToHeadGames.Len())
+		for _, c := range players {
+			game := gameOf(t, mm, c)
+			defer game.Cleanup()
+			confirmed, ok := lastConfirmed(t, c)
+			require.True(t, ok, "%v should be confirmed", c.player.Username)
+			assert.Equal(t, game.GetID(), confirmed.GameID)
+			assert.Len(t, confirmed.Opponents, DefaultMaxPartySize-1,
+				"%v should be confirmed with every other member", c.player.Username)
+		}
+	})
+
+	t.Run("parties larger than the lobby together", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		mm.lobby = LobbyConfig{MaxPlayers: 3, FillTimeout: time.Minute}
+		solo := newTestClient("solo")
+		require.NoError(t, mm.AddToQueue(solo, ModeRace))
+
+		leader := newTestClient("leader")
+		party, err := mm.CreateParty(leader)
+		require.NoError(t, err)
+		members := []*Client{leader}
+		for _, name := range []string{"a", "b"} {
+			member := newTestClient(name)
+			require.NoError(t, mm.JoinParty(member, party.Code))
+			members = append(members, member)
+		}
+		assert.ErrorIs(t, mm.JoinParty(newTestClient("c"), party.Code), ErrPartyFull,
+			"a party shouldn't outgrow the lobby")
+		require.NoError(t, mm.AddToQueue(leader, ModeRace))
+
+		game := gameOf(t, mm, leader)
+		defer game.Cleanup()
+		for _, c := range members {
+			assert.True(t, game.PlayerConnected(c.player.Id), "the party shouldn't be split")
+		}
+		assert.False(t, game.PlayerConnected(solo.player.Id))
+		assert.Equal(t, 1, mm.QueueDepths()[ModeRace], "the solo player should wait for the next game")
+	})
+
+	t.Run("member in a game", func(t *testing.T) {
+		mm := NewMatchmaker(ServerTickrate)
+		leader := newTestClient("leader")
+		member := newTestClient("member")
+		party, err := mm.CreateParty(leader)
+		require.NoError(t, err)
+		require.NoError(t, mm.JoinParty(member, party.Code))
+		member.SetStatus(StatusInGame)
+
+		assert.ErrorIs(t, mm.AddToQueue(leader, ModeRace), ErrPartyBusy)
+		assert.Equal(t, StatusIdle, leader.Status(), "the party shouldn't be queued")
+	})
+}
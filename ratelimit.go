@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnRateLimiter limits how many connections each client IP may open within
+// a sliding window
+type ConnRateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	// Times of recent connections by client IP, oldest first
+	hits  map[string][]time.Time
+	clock Clock
+	// Take the client IP from X-Forwarded-For, for servers behind a proxy
+	trustProxy bool
+}
+
+// NewConnRateLimiter creates a limiter allowing limit connections per IP
+// within each window
+func NewConnRateLimiter(limit int, window time.Duration, trustProxy bool) *ConnRateLimiter {
+	return &ConnRateLimiter{
+		limit:      limit,
+		window:     window,
+		hits:       make(map[string][]time.Time),
+		clock:      realClock{},
+		trustProxy: trustProxy,
+	}
+}
+
+// Allow records a connection from the given IP, reporting whether it is
+// within the limit. Refused connections don't count towards the limit.
+func (l *ConnRateLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	hits := l.recent(l.hits[ip], now)
+	if len(hits) >= l.limit {
+		l.hits[ip] = hits
+		return false
+	}
+	l.hits[ip] = append(hits, now)
+	return true
+}
+
+// recent drops the hits which have fallen out of the window.
+// The caller must hold the lock.
+func (l *ConnRateLimiter) recent(hits []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-l.window)
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// sweep forgets IPs with no connections in the window
+func (l *ConnRateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	for ip, hits := range l.hits {
+		if hits = l.recent(hits, now); len(hits) == 0 {
+			delete(l.hits, ip)
+		} else {
+			l.hits[ip] = hits
+		}
+	}
+}
+
+// SweepEvery periodically forgets stale IPs until stop is closed
+func (l *ConnRateLimiter) SweepEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.sweep()
+		}
+	}
+}
+
+// clientIP returns the IP a request originated from
+func (l *ConnRateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The first address is the original client
+			client, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(client)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limit wraps a handler, refusing requests from IPs over the limit with 429
+func (l *ConnRateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := l.clientIP(r)
+		if !l.Allow(ip) {
+			slog.Warn("connection rate limit exceeded", "ip", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int((l.window+time.Second-1)/time.Second)))
+			http.Error(w, "too many connections", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
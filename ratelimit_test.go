@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewConnRateLimiter(2, time.Minute, false)
+	limiter.clock = clock
+
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"), "third connection in the window should be refused")
+	assert.True(t, limiter.Allow("10.0.0.2"), "other IPs have their own limit")
+
+	clock.Advance(30 * time.Second)
+	assert.False(t, limiter.Allow("10.0.0.1"))
+	clock.Advance(31 * time.Second)
+	assert.True(t, limiter.Allow("10.0.0.1"), "connections should be allowed once old ones leave the window")
+
+	clock.Advance(2 * time.Minute)
+	limiter.sweep()
+	assert.Empty(t, limiter.hits, "stale IPs should be forgotten")
+}
+
+func TestConnRateLimitHandler(t *testing.T) {
+	request := func(handler http.HandlerFunc, remoteAddr string, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/ws", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		handler := NewConnRateLimiter(1, time.Minute, false).Limit(ok)
+
+		assert.Equal(t, http.StatusOK, request(handler, "10.0.0.1:1234", ""))
+		assert.Equal(t, http.StatusTooManyRequests, request(handler, "10.0.0.1:5678", "10.0.0.9"),
+			"the forwarded address shouldn't be trusted without a proxy")
+		assert.Equal(t, http.StatusOK, request(handler, "10.0.0.2:1234", ""))
+	})
+
+	t.Run("behind proxy", func(t *testing.T) {
+		handler := NewConnRateLimiter(1, time.Minute, true).Limit(ok)
+
+		assert.Equal(t, http.StatusOK, request(handler, "10.0.0.100:1234", "203.0.113.1, 10.0.0.50"))
+		assert.Equal(t, http.StatusTooManyRequests, request(handler, "10.0.0.100:1234", "203.0.113.1"))
+		assert.Equal(t, http.StatusOK, request(handler, "10.0.0.100:1234", "203.0.113.2"))
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ReplayMaxFrames bounds the number of frames kept per recorded game.
+// At the default tickrate this is roughly five minutes of state.
+const ReplayMaxFrames int = 30 * 60 * 5
+
+// DefaultMaxReplays is how many replays of finished games are kept unless
+// configured. The oldest are discarded first.
+const DefaultMaxReplays int = 100
+
+// ReplayFrame represents a single timestamped broadcast captured by a Recorder
+type ReplayFrame struct {
+	Timestamp int64           `json:"timestamp_ms"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// Recorder captures the broadcast state frames of a game into a ring buffer.
+// Once the buffer is full the oldest frames are overwritten.
+type Recorder struct {
+	sync.Mutex
+	frames []ReplayFrame
+	start  int
+	count  int
+	// Gzipped JSON array of the frames, set once the recording is compressed
+	compressed []byte
+}
+
+// NewRecorder creates a recorder that holds at most maxFrames frames
+func NewRecorder(maxFrames int) *Recorder {
+	return &Recorder{
+		frames: make([]ReplayFrame, max(maxFrames, 1)),
+	}
+}
+
+// Record stores a copy of the given message as the most recent frame, taken
+// at now. Recording stops once the replay has been compressed.
+func (r *Recorder) Record(message []byte, now time.Time) {
+	frame := ReplayFrame{
+		Timestamp: now.UnixMilli(),
+		Message:   append(json.RawMessage(nil), message...),
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.compressed != nil {
+		return
+	}
+
+	idx := (r.start + r.count) % len(r.frames)
+	r.frames[idx] = frame
+	if r.count < len(r.frames) {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % len(r.frames)
+	}
+}
+
+// Frames returns the recorded frames, oldest first
+func (r *Recorder) Frames() []ReplayFrame {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.compressed != nil {
+		frames, err := decompressFrames(r.compressed)
+		if err != nil {
+			slog.Error("error decompressing replay", "error", err)
+		}
+		return frames
+	}
+	return r.ordered()
+}
+
+// ordered returns the frames held in the ring buffer, oldest first.
+// The caller must hold the lock.
+func (r *Recorder) ordered() []ReplayFrame {
+	frames := make([]ReplayFrame, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		frames = append(frames, r.frames[(r.start+i)%len(r.frames)])
+	}
+	return frames
+}
+
+// Compress gzips the recorded frames and releases the ring buffer.
+// It is called once a game has ended, after which the replay is read only.
+func (r *Recorder) Compress() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.compressed != nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(r.ordered())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	r.compressed = buf.Bytes()
+	r.frames = nil
+	r.start = 0
+	return nil
+}
+
+// Compressed returns the gzipped JSON encoding of the replay, if it has been
+// compressed
+func (r *Recorder) Compressed() ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+	return r.compressed, r.compressed != nil
+}
+
+// decompressFrames decodes frames from a gzipped JSON array
+func decompressFrames(compressed []byte) ([]ReplayFrame, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var frames []ReplayFrame
+	if err := json.Unmarshal(raw, &frames); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// Len returns the number of frames currently held
+func (r *Recorder) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+// MarshalJSON encodes the replay as a JSON array of frames
+func (r *Recorder) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Frames())
+}
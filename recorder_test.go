@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderCapsFrames(t *testing.T) {
+	rec := NewRecorder(3)
+	for i := 0; i < 5; i++ {
+		rec.Record([]byte(fmt.Sprintf(`{"n":%d}`, i)), time.Now())
+	}
+
+	frames := rec.Frames()
+	require.Len(t, frames, 3)
+	assert.JSONEq(t, `{"n":2}`, string(frames[0].Message))
+	assert.JSONEq(t, `{"n":4}`, string(frames[2].Message))
+}
+
+func TestShortGameReplay(t *testing.T) {
+	game := NewSprintGame(5*time.Millisecond, 50*time.Millisecond).(*SprintGame)
+	game.SetRecorder(NewRecorder(ReplayMaxFrames))
+	for _, c := range []*Client{newTestClient("player1"), newTestClient("player2")} {
+		game.Clients.Set(c.player.Id, NewClientSink(c))
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go drainBroadcasts(game.BaseGame, stop)
+
+	game.BroadcastState()
+
+	frames := game.Recorder().Frames()
+	require.NotEmpty(t, frames)
+
+	for i := 1; i < len(frames); i++ {
+		assert.LessOrEqual(t, frames[i-1].Timestamp, frames[i].Timestamp, "frames should be time ordered")
+	}
+
+	var last BaseMessage
+	require.NoError(t, json.Unmarshal(frames[len(frames)-1].Message, &last))
+	assert.Equal(t, RespRoundResult, last.Type)
+}
+
+func TestReplayHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	rec := NewRecorder(10)
+	rec.Record([]byte(`{"messageType":"game_state"}`), time.Now())
+	mm.replays.Set("abcde", rec)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/games/{id}/replay", NewReplayHandler(mm))
+
+	t.Run("known game", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/games/abcde/replay", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var frames []ReplayFrame
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &frames))
+		assert.Len(t, frames, 1)
+	})
+
+	t.Run("unknown game", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/games/zzzzz/replay", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestReplaysEvicted(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	mm.maxReplays = 2
+	for _, id := range []string{"first", "second", "third"} {
+		mm.storeReplay(id, NewRecorder(10))
+	}
+
+	_, ok := mm.Replay("first")
+	assert.False(t, ok, "the oldest replay should be discarded")
+	for _, id := range []string{"second", "third"} {
+		_, ok := mm.Replay(id)
+		assert.True(t, ok, "replay %v should be kept", id)
+	}
+}
+
+func TestCompressedReplayRoundTrip(t *testing.T) {
+	rec := NewRecorder(3)
+	for i := 0; i < 5; i++ {
+		rec.Record([]byte(fmt.Sprintf(`{"n":%d}`, i)), time.Now())
+	}
+	want := rec.Frames()
+
+	require.NoError(t, rec.Compress())
+	gz, ok := rec.Compressed()
+	require.True(t, ok)
+	assert.NotEmpty(t, gz)
+
+	assert.Equal(t, want, rec.Frames(), "compressed replay should decompress to the original frames")
+	assert.Equal(t, 3, rec.Len())
+
+	rec.Record([]byte(`{"n":5}`), time.Now())
+	assert.Equal(t, want, rec.Frames(), "recording should stop once compressed")
+
+	raw, err := json.Marshal(rec)
+	require.NoError(t, err)
+	var frames []ReplayFrame
+	require.NoError(t, json.Unmarshal(raw, &frames))
+	assert.Equal(t, want, frames)
+}
+
+func TestCompressedReplayHandler(t *testing.T) {
+	mm := NewMatchmaker(ServerTickrate)
+	rec := NewRecorder(10)
+	rec.Record([]byte(`{"messageType":"game_state"}`), time.Now())
+	require.NoError(t, rec.Compress())
+	mm.replays.Set("abcde", rec)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/games/{id}/replay", NewReplayHandler(mm))
+
+	t.Run("accepts gzip", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/games/abcde/replay", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		mux.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		zr, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		var frames []ReplayFrame
+		require.NoError(t, json.NewDecoder(zr).Decode(&frames))
+		assert.Len(t, frames, 1)
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/games/abcde/replay", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		var frames []ReplayFrame
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &frames))
+		assert.Len(t, frames, 1)
+	})
+}
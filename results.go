@@ -0,0 +1,201 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// PersonalBest represents a player's best time trial result
+type PersonalBest struct {
+	Username string `json:"username"`
+	Level    int    `json:"level"`
+	// When the result was set, used for eviction
+	RecordedAt time.Time `json:"-"`
+}
+
+// AbortReason describes why a game ended without a result
+type AbortReason string
+
+const (
+	// AbortOrphaned is a game left short of players during its countdown
+	AbortOrphaned AbortReason = "orphaned"
+	// AbortInsufficientPlayers is a running game left with too few players to continue
+	AbortInsufficientPlayers AbortReason = "insufficient_players"
+	// AbortGraceExpired is a paused game whose players didn't reconnect in time
+	AbortGraceExpired AbortReason = "grace_expired"
+)
+
+// MaxAbortedGames bounds the aborted games held, the oldest are dropped first
+const MaxAbortedGames int = 1000
+
+// AbortedGame records a game that was cancelled rather than completed
+type AbortedGame struct {
+	GameID string
+	Reason AbortReason
+	// Ids of the players in the game when it was aborted, including the leaver
+	PlayerIDs  []string
+	RecordedAt time.Time
+}
+
+// ResultPolicy decides which round results are worth persisting, so games
+// that effectively didn't happen don't leave junk leaderboard entries. The
+// zero policy records every result.
+type ResultPolicy struct {
+	// How long the game phase must have run, 0 for no minimum
+	MinDuration time.Duration
+	// Require a player to have got past the starting level
+	RequireProgress bool
+}
+
+// Qualifies reports whether a game which ran for duration, with the highest
+// level reached by any player of maxLevel, should have its result recorded
+func (p ResultPolicy) Qualifies(duration time.Duration, maxLevel int) bool {
+	if duration < p.MinDuration {
+		return false
+	}
+	return !p.RequireProgress || maxLevel > StartingLevel
+}
+
+// ResultStore keeps completed game results in memory.
+// If a TTL is set, results older than it are evicted by a background sweeper.
+type ResultStore struct {
+	// Serialises read-modify-write updates of personal bests
+	mu sync.Mutex
+	// Each player's best by their results key
+	personalBests CMap[string, PersonalBest]
+	// Aborted games, oldest first, guarded by mu
+	aborts   []AbortedGame
+	ttl      time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewResultStore creates an empty result store which keeps results forever
+func NewResultStore() *ResultStore {
+	return &ResultStore{
+		personalBests: NewMutexMap[string, PersonalBest](),
+		stop:          make(chan struct{}),
+	}
+}
+
+// NewTTLResultStore creates an empty result store which evicts results older
+// than ttl, checking every sweepInterval. Close stops the sweeper.
+func NewTTLResultStore(ttl time.Duration, sweepInterval time.Duration) *ResultStore {
+	s := NewResultStore()
+	s.ttl = ttl
+	go s.sweep(sweepInterval)
+	return s
+}
+
+// sweep periodically evicts expired results until the store is closed
+func (s *ResultStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.evictExpired(now)
+		}
+	}
+}
+
+// evictExpired removes results recorded more than the TTL before now
+func (s *ResultStore) evictExpired(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, best := range s.personalBests.Snapshot() {
+		if now.Sub(best.RecordedAt) > s.ttl {
+			s.personalBests.Del(key)
+		}
+	}
+	i := 0
+	for i < len(s.aborts) && now.Sub(s.aborts[i].RecordedAt) > s.ttl {
+		i++
+	}
+	s.aborts = s.aborts[i:]
+}
+
+// Close stops the background sweeper, if any
+func (s *ResultStore) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Len returns the number of results currently held
+func (s *ResultStore) Len() int {
+	return s.personalBests.Len()
+}
+
+// RecordPersonalBest stores a time trial result for the given player, under
+// their results key, if it beats their previous best. It returns the player's
+// best and whether the given level set a new one, recorded at now.
+func (s *ResultStore) RecordPersonalBest(p *Player, level int, now time.Time) (PersonalBest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := p.ResultsKey()
+	if best, ok := s.personalBests.Get(key); ok && best.Level >= level {
+		return best, false
+	}
+	best := PersonalBest{
+		Username:   p.Username,
+		Level:      level,
+		RecordedAt: now,
+	}
+	s.personalBests.Set(key, best)
+	return best, true
+}
+
+// GetPersonalBest returns the best time trial result recorded under a
+// player's results key, if any
+func (s *ResultStore) GetPersonalBest(key string) (PersonalBest, bool) {
+	return s.personalBests.Get(key)
+}
+
+// SaveAbort records a game cancelled at now without a result, for churn analysis
+func (s *ResultStore) SaveAbort(gameID string, reason AbortReason, players []*Player, now time.Time) {
+	ids := make([]string, 0, len(players))
+	for _, p := range players {
+		ids = append(ids, p.Id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.aborts) >= MaxAbortedGames {
+		s.aborts = s.aborts[1:]
+	}
+	s.aborts = append(s.aborts, AbortedGame{
+		GameID:     gameID,
+		Reason:     reason,
+		PlayerIDs:  ids,
+		RecordedAt: now,
+	})
+}
+
+// Aborts returns the recorded aborted games, oldest first
+func (s *ResultStore) Aborts() []AbortedGame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.aborts)
+}
+
+// AbortCounts returns the number of recorded aborted games by reason
+func (s *ResultStore) AbortCounts() map[AbortReason]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[AbortReason]int{
+		AbortOrphaned:            0,
+		AbortInsufficientPlayers: 0,
+		AbortGraceExpired:        0,
+	}
+	for _, abort := range s.aborts {
+		counts[abort.Reason]++
+	}
+	return counts
+}
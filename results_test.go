@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultStoreTTLEviction(t *testing.T) {
+	results := NewTTLResultStore(50*time.Millisecond, 5*time.Millisecond)
+	defer results.Close()
+
+	results.RecordPersonalBest(NewPlayer("old", "🏴"), 3, time.Now())
+	time.Sleep(30 * time.Millisecond)
+	results.RecordPersonalBest(NewPlayer("recent", "🏴"), 4, time.Now())
+	assert.Equal(t, 2, results.Len())
+
+	require.True(t, waitFor(time.Second, func() bool { return results.Len() == 1 }), "old results should be evicted")
+	_, ok := results.GetPersonalBest("old")
+	assert.False(t, ok)
+	best, ok := results.GetPersonalBest("recent")
+	require.True(t, ok, "recent results should remain")
+	assert.Equal(t, 4, best.Level)
+
+	// A new best resets the clock
+	results.RecordPersonalBest(NewPlayer("recent", "🏴"), 5, time.Now())
+	time.Sleep(30 * time.Millisecond)
+	_, ok = results.GetPersonalBest("recent")
+	assert.True(t, ok)
+}
+
+func TestResultStoreWithoutTTLKeepsResults(t *testing.T) {
+	results := NewResultStore()
+	defer results.Close()
+
+	results.RecordPersonalBest(NewPlayer("player1", "🏴"), 3, time.Now())
+	results.evictExpired(time.Now().Add(time.Hour))
+	assert.Equal(t, 1, results.Len())
+}
+
+func TestOrphanedCountdownRecordsAbort(t *testing.T) {
+	results := NewResultStore()
+	g := NewGame(ModeSprint, ServerTickrate)
+	g.SetResultStore(results)
+	go g.RunListeners()
+	defer g.Cleanup()
+
+	c1 := newTestClient("player1")
+	c2 := newTestClient("player2")
+	g.Add() <- c1
+	g.Add() <- c2
+	// The countdown has started, so losing a player orphans the game
+	g.Remove() <- c2
+	require.True(t, receiveType(c1, RespGameCancelled, time.Second))
+
+	aborts := results.Aborts()
+	require.Len(t, aborts, 1)
+	assert.Equal(t, g.GetID(), aborts[0].GameID)
+	assert.Equal(t, AbortOrphaned, aborts[0].Reason)
+	assert.ElementsMatch(t, []string{c1.player.Id, c2.player.Id}, aborts[0].PlayerIDs,
+		"the leaver and the remaining player should be recorded")
+	assert.Equal(t, 1, results.AbortCounts()[AbortOrphaned])
+}
+
+func TestAbortsBounded(t *testing.T) {
+	results := NewResultStore()
+	for i := range MaxAbortedGames + 1 {
+		results.SaveAbort(strconv.Itoa(i), AbortGraceExpired, nil, time.Now())
+	}
+	aborts := results.Aborts()
+	require.Len(t, aborts, MaxAbortedGames)
+	assert.Equal(t, "1", aborts[0].GameID, "the oldest abort should be dropped")
+}
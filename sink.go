@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ClientSink is a stable, player keyed destination for game messages.
+// The underlying client connection can be swapped (e.g. on reconnection)
+// without the game having to update any of its broadcast paths.
+type ClientSink struct {
+	sync.RWMutex
+	client *Client
+}
+
+// NewClientSink creates a sink delivering to the given client
+func NewClientSink(c *Client) *ClientSink {
+	return &ClientSink{
+		client: c,
+	}
+}
+
+// Client returns the client currently backing the sink
+func (s *ClientSink) Client() *Client {
+	s.RLock()
+	defer s.RUnlock()
+	return s.client
+}
+
+// Swap replaces the client backing the sink and returns the previous one
+func (s *ClientSink) Swap(c *Client) *Client {
+	s.Lock()
+	defer s.Unlock()
+	old := s.client
+	s.client = c
+	return old
+}
+
+// Send attempts a non-blocking send to the current client.
+// It returns false if the client has disconnected or its buffer is full.
+func (s *ClientSink) Send(message []byte) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.client.trySend(message)
+}
+
+// trySend attempts a non-blocking send to the client, for messages sent
+// while holding a lock or from a goroutine other clients depend on.
+// It returns false if the client has disconnected or its buffer is full.
+func (cl *Client) trySend(message []byte) bool {
+	select {
+	case <-cl.ctx.Done():
+		return false
+	default:
+	}
+
+	select {
+	case cl.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendWait sends to the current client, waiting for room in its buffer
+// until ctx is done. It returns false if the client disconnects first.
+func (s *ClientSink) SendWait(ctx context.Context, message []byte) bool {
+	client := s.Client()
+	select {
+	case <-client.ctx.Done():
+		return false
+	default:
+	}
+
+	select {
+	case client.send <- message:
+		return true
+	case <-client.ctx.Done():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memConn is an in-memory Conn, standing in for a websocket in tests.
+// The test writes to inbound and reads what the server sent from outbound.
+type memConn struct {
+	inbound   chan []byte
+	outbound  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemConn() *memConn {
+	return &memConn{
+		inbound:  make(chan []byte, 16),
+		outbound: make(chan []byte, 1024),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *memConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-c.inbound:
+		return websocket.TextMessage, msg, nil
+	case <-c.closed:
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+}
+
+func (c *memConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return errors.New("connection closed")
+	case c.outbound <- data:
+		return nil
+	}
+}
+
+func (c *memConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// connectMemClient connects a new player to the matchmaker over an in-memory conn
+func connectMemClient(t *testing.T, mm *Matchmaker, username string) *memConn {
+	t.Helper()
+	conn := newMemConn()
+	client := NewClient(conn, NewPlayer(username, "🏴"), mm, mm.sendBufferSize)
+	go client.StartWriting()
+	go client.StartReading()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendRequest sends a request from the client side of the conn
+func (c *memConn) sendRequest(t *testing.T, msgType MessageType, payload any) {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	require.NoError(t, err)
+	msg, err := json.Marshal(BaseMessage{Type: msgType, Payload: raw})
+	require.NoError(t, err)
+	c.inbound <- msg
+}
+
+// expect reads from the conn until a message of the given type arrives,
+// returning its payload
+func (c *memConn) expect(t *testing.T, msgType MessageType, timeout time.Duration) json.RawMessage {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg := <-c.outbound:
+			var base BaseMessage
+			require.NoError(t, json.Unmarshal(msg, &base))
+			if base.Type == msgType {
+				return base.Payload
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for %s", msgType)
+			return nil
+		}
+	}
+}
+
+func TestSprintGameEndToEnd(t *testing.T) {
+	mm := NewMatchmaker(5 * time.Millisecond)
+	mm.SetDefaultParams(GameParams{LevelTarget: RaceLevelTarget, RoundLength: 300 * time.Millisecond})
+	mm.SetCountdown(10*time.Second, 50*time.Millisecond)
+
+	alice := connectMemClient(t, mm, "alice")
+	bob := connectMemClient(t, mm, "bob")
+
+	alice.sendRequest(t, ReqJoinQueue, JoinQueueRequest{GameMode: ModeSprint})
+	alice.expect(t, RespQueueJoined, time.Second)
+	bob.sendRequest(t, ReqJoinQueue, JoinQueueRequest{GameMode: ModeSprint})
+	bob.expect(t, RespQueueJoined, time.Second)
+
+	for _, conn := range []*memConn{alice, bob} {
+		conn.expect(t, RespGameConfirmed, time.Second)
+		conn.sendRequest(t, ReqPlayerReady, PlayerReadyRequest{})
+	}
+	for _, conn := range []*memConn{alice, bob} {
+		conn.expect(t, RespGameStarted, 2*time.Second)
+		conn.expect(t, RespGameState, time.Second)
+	}
+
+	alice.sendRequest(t, ReqPlayerUpdate, PlayerUpdateRequest{Level: 3})
+	bob.sendRequest(t, ReqPlayerUpdate, PlayerUpdateRequest{Level: 2})
+
+	for _, conn := range []*memConn{alice, bob} {
+		var result RoundResult
+		require.NoError(t, json.Unmarshal(conn.expect(t, RespRoundResult, 2*time.Second), &result))
+		require.Len(t, result.PlayerScores, 2)
+		for _, score := range result.PlayerScores {
+			assert.Equal(t, score.Username == "alice", score.IsWinner, score.Username)
+		}
+	}
+}